@@ -0,0 +1,226 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(AbuseIPDBIPRange{})
+}
+
+// AbuseIPDBIPRange provides the addresses on the AbuseIPDB blacklist.
+// The blacklist endpoint is heavily rate limited (5 requests a day on the
+// free plan), so the default interval is 6h and, once the limit is
+// reached, refreshes are skipped until it resets.
+type AbuseIPDBIPRange struct {
+	// API key. Supports placeholders such as {env.ABUSEIPDB_KEY}.
+	APIKey string `json:"api_key"`
+	// Minimum abuse confidence score (25-100). Default is 100.
+	ConfidenceMinimum int `json:"confidence_minimum,omitempty"`
+	// Maximum number of addresses. Default is 10000, the free plan limit.
+	Limit int `json:"limit,omitempty"`
+	// Optional override of the API base URL.
+	Endpoint string `json:"endpoint,omitempty"`
+	// refresh Interval. Default is 6h.
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// request Timeout
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	limitedUntil time.Time
+	pollingSource
+}
+
+// CaddyModule returns the Caddy module information.
+func (AbuseIPDBIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.abuseipdb",
+		New: func() caddy.Module { return new(AbuseIPDBIPRange) },
+	}
+}
+
+func (s *AbuseIPDBIPRange) Provision(ctx caddy.Context) error {
+	s.APIKey = caddy.NewReplacer().ReplaceAll(s.APIKey, "")
+	if s.APIKey == "" {
+		return fmt.Errorf("api_key is required")
+	}
+	if s.ConfidenceMinimum == 0 {
+		s.ConfidenceMinimum = 100
+	}
+	if s.ConfidenceMinimum < 25 || s.ConfidenceMinimum > 100 {
+		return fmt.Errorf("confidence_minimum must be between 25 and 100")
+	}
+	if s.Limit == 0 {
+		s.Limit = 10000
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = "https://api.abuseipdb.com"
+	}
+	s.Endpoint = strings.TrimSuffix(s.Endpoint, "/")
+	if s.Interval == 0 {
+		s.Interval = caddy.Duration(6 * time.Hour)
+	}
+	return s.start(ctx, time.Duration(s.Interval), s.fetch)
+}
+
+func (s *AbuseIPDBIPRange) fetch(ctx context.Context) ([]netip.Prefix, error) {
+	if time.Now().Before(s.limitedUntil) {
+		return nil, fmt.Errorf("rate limited until %s", s.limitedUntil.Format(time.RFC3339))
+	}
+
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.Timeout))
+		defer cancel()
+	}
+
+	q := url.Values{
+		"confidenceMinimum": {strconv.Itoa(s.ConfidenceMinimum)},
+		"limit":             {strconv.Itoa(s.Limit)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.Endpoint+"/api/v2/blacklist?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Key", s.APIKey)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			s.limitedUntil = time.Unix(reset, 0)
+		}
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			s.limitedUntil = time.Now().Add(time.Duration(secs) * time.Second)
+		}
+	}
+
+	var out struct {
+		Data []struct {
+			IPAddress string `json:"ipAddress"`
+		} `json:"data"`
+		Errors []struct {
+			Detail string `json:"detail"`
+			Status int    `json:"status"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("blacklist returned HTTP %d: %w", resp.StatusCode, err)
+	}
+	if len(out.Errors) > 0 {
+		return nil, fmt.Errorf("blacklist returned HTTP %d: %s", resp.StatusCode, out.Errors[0].Detail)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("blacklist returned HTTP %d", resp.StatusCode)
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(out.Data))
+	for _, entry := range out.Data {
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(entry.IPAddress)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	abuseipdb {
+//	   api_key key
+//	   confidence_minimum score
+//	   limit count
+//	   endpoint url
+//	   interval val
+//	   timeout val
+//	}
+func (m *AbuseIPDBIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	// No same-line options are supported
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "api_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.APIKey = d.Val()
+		case "confidence_minimum":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid confidence_minimum: %s", d.Val())
+			}
+			m.ConfidenceMinimum = val
+		case "limit":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := strconv.Atoi(d.Val())
+			if err != nil || val < 1 {
+				return d.Errf("invalid limit: %s", d.Val())
+			}
+			m.Limit = val
+		case "endpoint":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Endpoint = d.Val()
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Interval = caddy.Duration(val)
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Timeout = caddy.Duration(val)
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*AbuseIPDBIPRange)(nil)
+	_ caddy.Provisioner       = (*AbuseIPDBIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*AbuseIPDBIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*AbuseIPDBIPRange)(nil)
+)
@@ -0,0 +1,69 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestAbuseIPDB(t *testing.T) {
+	t.Setenv("ABUSEIPDB_KEY", "abuse-key")
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path != "/api/v2/blacklist" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get("Key") != "abuse-key" {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"errors":[{"detail":"Daily rate limit of 5 requests exceeded for this endpoint.","status":429}]}`))
+			return
+		}
+		if r.URL.Query().Get("confidenceMinimum") != "90" || r.URL.Query().Get("limit") != "500" {
+			t.Errorf("unexpected query %q", r.URL.RawQuery)
+		}
+		w.Write([]byte(`{"meta":{"generatedAt":"2026-01-01T00:00:00+00:00"},"data":[
+			{"ipAddress":"192.0.2.15","abuseConfidenceScore":100},
+			{"ipAddress":"2001:db8::15","abuseConfidenceScore":94}
+		]}`))
+	}))
+	defer server.Close()
+
+	d := caddyfile.NewTestDispenser(`abuseipdb {
+		api_key {env.ABUSEIPDB_KEY}
+		confidence_minimum 90
+		limit 500
+		endpoint ` + server.URL + `
+	}`)
+	r := AbuseIPDBIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+
+	expected := []string{"192.0.2.15/32", "2001:db8::15/128"}
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	limited := AbuseIPDBIPRange{APIKey: "other", Endpoint: server.URL}
+	if err := limited.Provision(ctx); err == nil || !strings.Contains(err.Error(), "Daily rate limit") {
+		t.Errorf("expected rate limit error, got %v", err)
+	}
+	requests.Store(0)
+	if _, err := limited.fetch(ctx); err == nil || requests.Load() != 0 {
+		t.Errorf("expected fetch to be skipped while rate limited, got %v after %d requests", err, requests.Load())
+	}
+}
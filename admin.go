@@ -0,0 +1,558 @@
+package caddy_ip_list
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(adminIPList{})
+}
+
+// adminIPList is a module that provides the /ip-list/ endpoints for the
+// Caddy admin API.
+type adminIPList struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminIPList) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.ip_list",
+		New: func() caddy.Module { return new(adminIPList) },
+	}
+}
+
+// Routes returns the routes for the /ip-list/ endpoints.
+func (a adminIPList) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/ip-list/sources/",
+			Handler: caddy.AdminHandlerFunc(a.handleSources),
+		},
+		{
+			Pattern: "/ip-list/lists",
+			Handler: caddy.AdminHandlerFunc(a.handleLists),
+		},
+		{
+			Pattern: "/ip-list/cache",
+			Handler: caddy.AdminHandlerFunc(a.handleCache),
+		},
+		{
+			Pattern: "/ip-list/history/",
+			Handler: caddy.AdminHandlerFunc(a.handleHistory),
+		},
+		{
+			Pattern: "/ip-list/ranges",
+			Handler: caddy.AdminHandlerFunc(a.handleRanges),
+		},
+		{
+			Pattern: "/ip-list/ranges/",
+			Handler: caddy.AdminHandlerFunc(a.handleRanges),
+		},
+		{
+			Pattern: "/ip-list/lookup/",
+			Handler: caddy.AdminHandlerFunc(a.handleLookup),
+		},
+		{
+			Pattern: "/ip-list/check",
+			Handler: caddy.AdminHandlerFunc(a.handleCheck),
+		},
+		{
+			Pattern: "/ip-list/accept/",
+			Handler: caddy.AdminHandlerFunc(a.handleAccept),
+		},
+		{
+			Pattern: "/ip-list/refresh",
+			Handler: caddy.AdminHandlerFunc(a.handleRefresh),
+		},
+		{
+			Pattern: "/ip-list/refresh/",
+			Handler: caddy.AdminHandlerFunc(a.handleRefresh),
+		},
+		{
+			Pattern: "/ip-list/pause",
+			Handler: caddy.AdminHandlerFunc(a.handlePause),
+		},
+		{
+			Pattern: "/ip-list/pause/",
+			Handler: caddy.AdminHandlerFunc(a.handlePause),
+		},
+		{
+			Pattern: "/ip-list/resume",
+			Handler: caddy.AdminHandlerFunc(a.handlePause),
+		},
+		{
+			Pattern: "/ip-list/resume/",
+			Handler: caddy.AdminHandlerFunc(a.handlePause),
+		},
+	}
+}
+
+type listStatus struct {
+	ID     string               `json:"id"`
+	URLs   map[string]urlStatus `json:"urls"`
+	Paused bool                 `json:"paused,omitempty"`
+
+	key string
+}
+
+// handleLists reports the fetch status of the URLs of each list source.
+// Identical lists are reported once.
+func (adminIPList) handleLists(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	lists := []listStatus{}
+	listPool.Range(func(_, value any) bool {
+		list := value.(*pooledList).list
+		lists = append(lists, listStatus{
+			ID:     list.listID(),
+			URLs:   list.fetchStatus(),
+			Paused: list.paused.Load(),
+			key:    strings.Join(list.URLs, "|"),
+		})
+		return true
+	})
+	slices.SortFunc(lists, func(a, b listStatus) int {
+		return strings.Compare(a.key, b.key)
+	})
+	return writeJSON(w, lists)
+}
+
+// handleSources reads (GET) or replaces (POST, PUT) the list of a push
+// source.
+func (adminIPList) handleSources(w http.ResponseWriter, r *http.Request) error {
+	name := strings.TrimPrefix(r.URL.Path, "/ip-list/sources/")
+	if name == "" || strings.Contains(name, "/") {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("invalid source name"),
+		}
+	}
+
+	pushSourcesMu.RLock()
+	src, ok := pushSources[name]
+	active := ok && src.refs > 0
+	pushSourcesMu.RUnlock()
+	if !active {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no push source named %q", name),
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		pushSourcesMu.RLock()
+		ranges := src.ranges
+		pushSourcesMu.RUnlock()
+		return writeJSON(w, prefixStrings(ranges))
+
+	case http.MethodPost, http.MethodPut:
+		prefixes, err := parseList(r.Body)
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        err,
+			}
+		}
+		pushSourcesMu.Lock()
+		src.ranges = prefixes
+		pushSourcesMu.Unlock()
+		caddy.Log().Named("admin.api.ip_list").Info("received pushed IP ranges")
+		return writeJSON(w, map[string]int{"count": len(prefixes)})
+
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+}
+
+// handleCache deletes (DELETE) the caches of all list sources, e.g. after
+// a provider published bad data. Their next refresh downloads every list
+// in full.
+func (adminIPList) handleCache(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodDelete {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	var errs []error
+	count := 0
+	listPool.Range(func(_, value any) bool {
+		if err := value.(*pooledList).list.invalidateCache(); err != nil {
+			errs = append(errs, err)
+		}
+		count++
+		return true
+	})
+	if err := errors.Join(errs...); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+	caddy.Log().Named("admin.api.ip_list").Info("invalidated IP list caches", zap.Int("count", count))
+	return writeJSON(w, map[string]int{"count": count})
+}
+
+// handleHistory serves the snapshots kept with cache_history of the list
+// with the given ID:
+//
+//	GET  /ip-list/history/<id>                    lists the snapshots, newest first
+//	GET  /ip-list/history/<id>/<n>                compares snapshot n with the ranges in use
+//	POST /ip-list/history/<id>/<n>/rollback       replaces the ranges with snapshot n
+func (adminIPList) handleHistory(w http.ResponseWriter, r *http.Request) error {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/ip-list/history/"), "/")
+	list := findList(parts[0])
+	if list == nil || len(parts) > 3 || (len(parts) == 3 && parts[2] != "rollback") {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("not found"),
+		}
+	}
+	method := http.MethodGet
+	if len(parts) == 3 {
+		method = http.MethodPost
+	}
+	if r.Method != method {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	if len(parts) == 1 {
+		return writeJSON(w, list.historyEntries())
+	}
+
+	n, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("invalid snapshot %q", parts[1]),
+		}
+	}
+	if len(parts) == 3 {
+		if err := list.rollback(n); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        err,
+			}
+		}
+		return writeJSON(w, map[string]int{"count": len(list.GetIPRanges(nil))})
+	}
+	added, removed, err := list.snapshotDiff(n)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        err,
+		}
+	}
+	return writeJSON(w, map[string][]string{
+		"added":   prefixStrings(added),
+		"removed": prefixStrings(removed),
+	})
+}
+
+type listRanges struct {
+	ID     string   `json:"id"`
+	Ranges []string `json:"ranges"`
+}
+
+// handleRanges reports the ranges each list provides right now:
+//
+//	GET /ip-list/ranges                    the ranges of every list
+//	GET /ip-list/ranges/<id>               the ranges of the list with the given ID
+//	GET /ip-list/ranges?source=<url|cidr>  the prefixes from a source, in every list that has it
+func (adminIPList) handleRanges(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/ip-list/ranges"), "/")
+	source := r.URL.Query().Get("source")
+	lists := []listRanges{}
+	listPool.Range(func(_, value any) bool {
+		list := value.(*pooledList).list
+		if id != "" && list.listID() != id {
+			return true
+		}
+		if ranges, ok := list.rangesFrom(source); ok {
+			lists = append(lists, listRanges{ID: list.listID(), Ranges: prefixStrings(ranges)})
+		}
+		return true
+	})
+	if len(lists) == 0 && (id != "" || source != "") {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("not found"),
+		}
+	}
+	slices.SortFunc(lists, func(a, b listRanges) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return writeJSON(w, lists)
+}
+
+type listLookup struct {
+	ID      string         `json:"id"`
+	Sources []prefixSource `json:"sources"`
+}
+
+// handleLookup reports which URLs of each list source provide an IP
+// (GET /ip-list/lookup/<ip>). Lists that don't provide it are omitted.
+func (adminIPList) handleLookup(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	addr, err := netip.ParseAddr(strings.TrimPrefix(r.URL.Path, "/ip-list/lookup/"))
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+	lookups := []listLookup{}
+	listPool.Range(func(_, value any) bool {
+		list := value.(*pooledList).list
+		if sources := list.sourcesOf(addr); len(sources) > 0 {
+			lookups = append(lookups, listLookup{ID: list.listID(), Sources: sources})
+		}
+		return true
+	})
+	slices.SortFunc(lookups, func(a, b listLookup) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return writeJSON(w, lookups)
+}
+
+type ipCheck struct {
+	IP        string      `json:"ip"`
+	Contained bool        `json:"contained"`
+	Lists     []listCheck `json:"lists"`
+}
+
+type listCheck struct {
+	ID        string `json:"id"`
+	Contained bool   `json:"contained"`
+	// The range in use that contains the IP, and the prefixes of the
+	// sources it was resolved from.
+	Range   string         `json:"range,omitempty"`
+	Sources []prefixSource `json:"sources,omitempty"`
+}
+
+// handleCheck reports whether an IP is in the ranges of each list, and
+// which range and sources matched (GET /ip-list/check?ip=<ip>).
+func (adminIPList) handleCheck(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	addr, err := netip.ParseAddr(r.URL.Query().Get("ip"))
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+	check := ipCheck{IP: addr.String(), Lists: []listCheck{}}
+	listPool.Range(func(_, value any) bool {
+		list := value.(*pooledList).list
+		result := listCheck{ID: list.listID()}
+		if prefix, ok := list.rangeOf(addr); ok {
+			result.Contained, result.Range = true, prefix.String()
+			result.Sources = list.sourcesOf(addr)
+			check.Contained = true
+		}
+		check.Lists = append(check.Lists, result)
+		return true
+	})
+	slices.SortFunc(check.Lists, func(a, b listCheck) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return writeJSON(w, check)
+}
+
+// handleAccept lets the next refresh of the list with the given ID accept
+// lists that shrink beyond min_change_guard (POST /ip-list/accept/<id>).
+func (adminIPList) handleAccept(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	list := findList(strings.TrimPrefix(r.URL.Path, "/ip-list/accept/"))
+	if list == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("not found"),
+		}
+	}
+	list.acceptChange()
+	caddy.Log().Named("admin.api.ip_list").Info("accepting next IP list change", zap.String("id", list.listID()))
+	return writeJSON(w, map[string]string{"id": list.listID()})
+}
+
+type listRefresh struct {
+	ID      string `json:"id"`
+	Changed int    `json:"changed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// handleRefresh fetches the URLs of every list right away, outside their
+// interval, e.g. after a provider announced a change:
+//
+//	POST /ip-list/refresh               refreshes every list
+//	POST /ip-list/refresh/<id>          refreshes the list with the given ID
+//	POST /ip-list/refresh?url=<url>     only fetches the given URL, in every list that has it
+func (adminIPList) handleRefresh(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/ip-list/refresh"), "/")
+	refreshes, ok := refreshLists(id, r.URL.Query().Get("url"))
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("not found"),
+		}
+	}
+	caddy.Log().Named("admin.api.ip_list").Info("refreshed IP lists", zap.Int("count", len(refreshes)))
+	return writeJSON(w, refreshes)
+}
+
+// refreshLists fetches url, or every URL if it is empty, of the list with
+// the given ID, or of every list, right away. It reports false if the
+// lists were scoped but none matched.
+func refreshLists(id, url string) ([]listRefresh, bool) {
+	var lists []*URLIPRange
+	listPool.Range(func(_, value any) bool {
+		list := value.(*pooledList).list
+		if (id == "" || list.listID() == id) && (url == "" || slices.Contains(list.URLs, url) || slices.Contains(list.excludeURLs, url)) {
+			lists = append(lists, list)
+		}
+		return true
+	})
+	if len(lists) == 0 && (id != "" || url != "") {
+		return nil, false
+	}
+	refreshes := []listRefresh{}
+	for _, list := range lists {
+		changed, err := list.forceRefresh(url)
+		refresh := listRefresh{ID: list.listID(), Changed: changed}
+		if err != nil {
+			refresh.Error = err.Error()
+		}
+		refreshes = append(refreshes, refresh)
+	}
+	slices.SortFunc(refreshes, func(a, b listRefresh) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return refreshes, true
+}
+
+type listPause struct {
+	ID     string `json:"id"`
+	Paused bool   `json:"paused"`
+}
+
+// handlePause suspends or restarts the refreshes of every list, or of the
+// list with the given ID, e.g. to freeze the ranges during maintenance of
+// a provider:
+//
+//	POST /ip-list/pause[/<id>]
+//	POST /ip-list/resume[/<id>]
+func (adminIPList) handlePause(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	action, id, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/ip-list/"), "/")
+	pause := action == "pause"
+	pauses := []listPause{}
+	listPool.Range(func(_, value any) bool {
+		if list := value.(*pooledList).list; id == "" || list.listID() == id {
+			list.setPaused(pause)
+			pauses = append(pauses, listPause{ID: list.listID(), Paused: pause})
+		}
+		return true
+	})
+	if len(pauses) == 0 && id != "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("not found"),
+		}
+	}
+	slices.SortFunc(pauses, func(a, b listPause) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	caddy.Log().Named("admin.api.ip_list").Info(action+"d IP list refreshes", zap.Int("count", len(pauses)))
+	return writeJSON(w, pauses)
+}
+
+// findList returns the running list with the given ID, or nil.
+func findList(id string) *URLIPRange {
+	var list *URLIPRange
+	listPool.Range(func(_, value any) bool {
+		if l := value.(*pooledList).list; l.listID() == id {
+			list = l
+			return false
+		}
+		return true
+	})
+	return list
+}
+
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+	return nil
+}
+
+// prefixStrings formats prefixes for API responses. It never returns nil,
+// so empty lists encode as [].
+func prefixStrings(prefixes []netip.Prefix) []string {
+	out := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		out = append(out, p.String())
+	}
+	return out
+}
+
+// Interface guards
+var (
+	_ caddy.Module      = (*adminIPList)(nil)
+	_ caddy.AdminRouter = (*adminIPList)(nil)
+)
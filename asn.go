@@ -0,0 +1,227 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(ASNIPRange{})
+}
+
+// ASNIPRange provides the prefixes currently announced by a set of
+// autonomous systems, looked up through a public routing data API.
+type ASNIPRange struct {
+	// Autonomous system numbers to collect the prefixes of.
+	ASNs []uint32 `json:"asns"`
+	// Routing data provider, "ripestat" (default) or "bgpview".
+	Provider string `json:"provider,omitempty"`
+	// Optional override of the provider's API base URL.
+	Endpoint string `json:"endpoint,omitempty"`
+	// refresh Interval
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// request Timeout
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	pollingSource
+}
+
+// CaddyModule returns the Caddy module information.
+func (ASNIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.asn",
+		New: func() caddy.Module { return new(ASNIPRange) },
+	}
+}
+
+func (s *ASNIPRange) Provision(ctx caddy.Context) error {
+	if len(s.ASNs) == 0 {
+		return fmt.Errorf("at least one ASN is required")
+	}
+	switch s.Provider {
+	case "":
+		s.Provider = "ripestat"
+	case "ripestat", "bgpview":
+	default:
+		return fmt.Errorf("unknown ASN provider %q", s.Provider)
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = map[string]string{
+			"ripestat": "https://stat.ripe.net",
+			"bgpview":  "https://api.bgpview.io",
+		}[s.Provider]
+	}
+	s.Endpoint = strings.TrimSuffix(s.Endpoint, "/")
+	return s.start(ctx, time.Duration(s.Interval), s.fetch)
+}
+
+func (s *ASNIPRange) fetch(ctx context.Context) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, asn := range s.ASNs {
+		announced, err := s.fetchASN(ctx, asn)
+		if err != nil {
+			return nil, fmt.Errorf("AS%d: %w", asn, err)
+		}
+		prefixes = append(prefixes, announced...)
+	}
+	return prefixes, nil
+}
+
+func (s *ASNIPRange) fetchASN(ctx context.Context, asn uint32) ([]netip.Prefix, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.Timeout))
+		defer cancel()
+	}
+
+	var cidrs []string
+	switch s.Provider {
+	case "ripestat":
+		var out struct {
+			Data struct {
+				Prefixes []struct {
+					Prefix string `json:"prefix"`
+				} `json:"prefixes"`
+			} `json:"data"`
+		}
+		endpoint := fmt.Sprintf("%s/data/announced-prefixes/data.json?resource=AS%d&sourceapp=caddy-ip-list", s.Endpoint, asn)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := getJSON(req, &out); err != nil {
+			return nil, err
+		}
+		for _, p := range out.Data.Prefixes {
+			cidrs = append(cidrs, p.Prefix)
+		}
+	case "bgpview":
+		type prefix struct {
+			Prefix string `json:"prefix"`
+		}
+		var out struct {
+			Data struct {
+				IPv4 []prefix `json:"ipv4_prefixes"`
+				IPv6 []prefix `json:"ipv6_prefixes"`
+			} `json:"data"`
+		}
+		endpoint := fmt.Sprintf("%s/asn/%d/prefixes", s.Endpoint, asn)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := getJSON(req, &out); err != nil {
+			return nil, err
+		}
+		for _, p := range append(out.Data.IPv4, out.Data.IPv6...) {
+			cidrs = append(cidrs, p.Prefix)
+		}
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// parseASN accepts an AS number with or without the "AS" prefix.
+func parseASN(s string) (uint32, error) {
+	trimmed := strings.TrimPrefix(strings.ToUpper(s), "AS")
+	n, err := strconv.ParseUint(trimmed, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ASN %q", s)
+	}
+	return uint32(n), nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	asn [<asn...>] {
+//	   asn <asn...>
+//	   provider ripestat|bgpview
+//	   endpoint url
+//	   interval val
+//	   timeout val
+//	}
+func (m *ASNIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	for _, arg := range d.RemainingArgs() {
+		asn, err := parseASN(arg)
+		if err != nil {
+			return d.WrapErr(err)
+		}
+		m.ASNs = append(m.ASNs, asn)
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "asn":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			for _, arg := range args {
+				asn, err := parseASN(arg)
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				m.ASNs = append(m.ASNs, asn)
+			}
+		case "provider":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Provider = d.Val()
+		case "endpoint":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Endpoint = d.Val()
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Interval = caddy.Duration(val)
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Timeout = caddy.Duration(val)
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*ASNIPRange)(nil)
+	_ caddy.Provisioner       = (*ASNIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*ASNIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*ASNIPRange)(nil)
+)
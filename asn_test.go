@@ -0,0 +1,73 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestASNUnmarshal(t *testing.T) {
+	input := `
+	asn 13335 AS16509 {
+		asn as15169
+		provider bgpview
+		interval 24h
+	}`
+
+	d := caddyfile.NewTestDispenser(input)
+	r := ASNIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	expected := []uint32{13335, 16509, 15169}
+	if len(r.ASNs) != len(expected) {
+		t.Fatalf("expected ASNs %v, got %v", expected, r.ASNs)
+	}
+	for i := range expected {
+		if r.ASNs[i] != expected[i] {
+			t.Errorf("expected ASNs %v, got %v", expected, r.ASNs)
+		}
+	}
+	if r.Provider != "bgpview" {
+		t.Errorf("unexpected provider %q", r.Provider)
+	}
+
+	if err := (&ASNIPRange{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`asn ASX`)); err == nil {
+		t.Errorf("expected error for invalid ASN")
+	}
+}
+
+func TestASNProviders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/data/announced-prefixes/data.json":
+			if r.URL.Query().Get("resource") != "AS13335" {
+				t.Errorf("unexpected resource %q", r.URL.Query().Get("resource"))
+			}
+			w.Write([]byte(`{"data":{"prefixes":[{"prefix":"1.1.1.0/24"},{"prefix":"2606:4700::/32"}]}}`))
+		case "/asn/13335/prefixes":
+			w.Write([]byte(`{"data":{"ipv4_prefixes":[{"prefix":"1.1.1.0/24"}],"ipv6_prefixes":[{"prefix":"2606:4700::/32"}]}}`))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	for _, provider := range []string{"ripestat", "bgpview"} {
+		r := ASNIPRange{ASNs: []uint32{13335}, Provider: provider, Endpoint: server.URL}
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		if err := r.Provision(ctx); err != nil {
+			t.Fatalf("%s: error provisioning: %v", provider, err)
+		}
+		ranges := r.GetIPRanges(nil)
+		if len(ranges) != 2 || ranges[0].String() != "1.1.1.0/24" || ranges[1].String() != "2606:4700::/32" {
+			t.Errorf("%s: unexpected ranges: %v", provider, ranges)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,141 @@
+package caddy_ip_list
+
+import (
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// sourcePlaceholder names the URLs (or "cidr") that provide the client IP
+// of a request, or its remote address.
+const sourcePlaceholder = "ip_list.source"
+
+// prefixSource is a prefix of a list with the URL it was fetched from, or
+// "cidr" for the static CIDRs.
+type prefixSource struct {
+	Prefix string `json:"prefix"`
+	Source string `json:"source"`
+}
+
+// publish makes ranges the ranges in use, and keeps the lists of the URLs
+// they were resolved from to attribute them.
+func (s *URLIPRange) publish(ranges []netip.Prefix) {
+	origins := make(map[string][]netip.Prefix, len(s.URLs))
+	for _, url := range s.URLs {
+		if list, ok := s.lists[url]; ok {
+			origins[url] = list.prefixes
+		}
+	}
+	s.lock.Lock()
+	s.ranges = ranges
+	s.origins = origins
+	s.lock.Unlock()
+	if s.log != nil {
+		fields := make([]zap.Field, 0, len(s.URLs)+1)
+		fields = append(fields, zap.Int("count", len(ranges)))
+		for _, url := range s.URLs {
+			fields = append(fields, zap.Int(url, len(origins[url])))
+		}
+		s.log.Debug("updated IP ranges", fields...)
+	}
+}
+
+// sourcesOf returns the prefixes of the lists that contain addr, with
+// their source. It is empty if addr is not in the ranges in use, e.g.
+// because it is excluded.
+func (s *URLIPRange) sourcesOf(addr netip.Addr) []prefixSource {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if !slices.ContainsFunc(s.ranges, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+		return nil
+	}
+	// the lists hold the IPv4 prefixes that NAT64 and IPv4-mapped ranges
+	// are translated from
+	if ipv4Mapped.Contains(addr) || (s.nat64.IsValid() && s.nat64.Contains(addr)) {
+		b := addr.As16()
+		addr = netip.AddrFrom4([4]byte(b[12:]))
+	}
+	var sources []prefixSource
+	for _, url := range s.URLs {
+		for _, p := range s.origins[url] {
+			if p.Contains(addr) {
+				sources = append(sources, prefixSource{Prefix: p.String(), Source: url})
+			}
+		}
+	}
+	for _, p := range s.static {
+		if p.Contains(addr) {
+			sources = append(sources, prefixSource{Prefix: p.String(), Source: "cidr"})
+		}
+	}
+	return sources
+}
+
+// rangeOf returns the range in use that contains addr.
+func (s *URLIPRange) rangeOf(addr netip.Addr) (netip.Prefix, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, p := range s.ranges {
+		if p.Contains(addr) {
+			return p, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// rangesFrom returns the ranges in use or, given a source, the prefixes of
+// that URL, or of "cidr" for the static CIDRs, that they were resolved
+// from. It reports false if the list has no such source.
+func (s *URLIPRange) rangesFrom(source string) ([]netip.Prefix, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	switch {
+	case source == "":
+		return s.ranges, true
+	case source == "cidr":
+		return s.static, len(s.static) > 0
+	case slices.Contains(s.URLs, source):
+		return s.origins[source], true
+	}
+	return nil, false
+}
+
+// addPlaceholder provides the {ip_list.source} placeholder for r. It is
+// only evaluated when used.
+func (s *URLIPRange) addPlaceholder(r *http.Request) {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return
+	}
+	repl.Map(func(key string) (any, bool) {
+		if key != sourcePlaceholder {
+			return nil, false
+		}
+		var addrs []netip.Addr
+		if clientIP, ok := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string); ok {
+			if addr, err := netip.ParseAddr(clientIP); err == nil {
+				addrs = append(addrs, addr)
+			}
+		}
+		if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+			addrs = append(addrs, addrPort.Addr())
+		}
+		for _, addr := range addrs {
+			var names []string
+			for _, source := range s.sourcesOf(addr) {
+				if !slices.Contains(names, source.Source) {
+					names = append(names, source.Source)
+				}
+			}
+			if len(names) > 0 {
+				return strings.Join(names, " "), true
+			}
+		}
+		return nil, false
+	})
+}
@@ -0,0 +1,169 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestAttribution(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			w.Write([]byte("192.0.2.0/24\n"))
+		default:
+			w.Write([]byte("192.0.2.0/25\n198.51.100.0/24\n"))
+		}
+	}))
+	defer server.Close()
+
+	r := URLIPRange{
+		URLs:          []string{server.URL + "/a", server.URL + "/b"},
+		CIDRs:         []string{"203.0.113.0/24"},
+		Exclude:       []string{"198.51.100.0/25"},
+		MapIPv4:       true,
+		CacheDisabled: true,
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Cleanup()
+
+	for ip, expected := range map[string][]string{
+		"192.0.2.7":          {server.URL + "/a", server.URL + "/b"},
+		"192.0.2.200":        {server.URL + "/a"},
+		"::ffff:192.0.2.200": {server.URL + "/a"},
+		"198.51.100.7":       nil,
+		"198.51.100.200":     {server.URL + "/b"},
+		"203.0.113.1":        {"cidr"},
+		"2001:db8::1":        nil,
+	} {
+		var lookups []listLookup
+		rec := httptest.NewRecorder()
+		if err := (adminIPList{}).handleLookup(rec, httptest.NewRequest(http.MethodGet, "/ip-list/lookup/"+ip, nil)); err != nil {
+			t.Fatalf("%s: %v", ip, err)
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &lookups); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, lookup := range lookups {
+			for _, source := range lookup.Sources {
+				got = append(got, source.Source)
+			}
+		}
+		if !slices.Equal(got, expected) {
+			t.Errorf("%s: expected %v, got %v", ip, expected, got)
+		}
+	}
+
+	repl := caddy.NewReplacer()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+	req.RemoteAddr = "198.51.100.200:1234"
+	r.GetIPRanges(req)
+	if got := repl.ReplaceAll("{ip_list.source}", "-"); got != server.URL+"/b" {
+		t.Errorf("expected the source in the placeholder, got %q", got)
+	}
+}
+
+func TestRanges(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("192.0.2.0/24\n198.51.100.0/24\n"))
+	}))
+	defer server.Close()
+
+	r := URLIPRange{
+		URLs:          []string{server.URL},
+		CIDRs:         []string{"203.0.113.0/24"},
+		Exclude:       []string{"198.51.100.0/25"},
+		CacheDisabled: true,
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Cleanup()
+
+	for target, expected := range map[string][]string{
+		"/ip-list/ranges/" + r.listID():                           {"192.0.2.0/24", "198.51.100.128/25", "203.0.113.0/24"},
+		"/ip-list/ranges/" + r.listID() + "?source=" + server.URL: {"192.0.2.0/24", "198.51.100.0/24"},
+		"/ip-list/ranges/" + r.listID() + "?source=cidr":          {"203.0.113.0/24"},
+	} {
+		rec := httptest.NewRecorder()
+		if err := (adminIPList{}).handleRanges(rec, httptest.NewRequest(http.MethodGet, target, nil)); err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		var lists []listRanges
+		if err := json.Unmarshal(rec.Body.Bytes(), &lists); err != nil {
+			t.Fatal(err)
+		}
+		if len(lists) != 1 || !slices.Equal(lists[0].Ranges, expected) {
+			t.Errorf("%s: expected %v, got %s", target, expected, rec.Body)
+		}
+	}
+
+	for _, target := range []string{"/ip-list/ranges/unknown", "/ip-list/ranges?source=https://example.com/unknown"} {
+		if err := (adminIPList{}).handleRanges(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil)); err == nil {
+			t.Errorf("%s: expected not found", target)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("192.0.2.0/25\n192.0.2.128/25\n"))
+	}))
+	defer server.Close()
+
+	r := URLIPRange{
+		URLs:          []string{server.URL},
+		Aggregate:     true,
+		CacheDisabled: true,
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Cleanup()
+
+	check := func(ip string) listCheck {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		if err := (adminIPList{}).handleCheck(rec, httptest.NewRequest(http.MethodGet, "/ip-list/check?ip="+ip, nil)); err != nil {
+			t.Fatalf("%s: %v", ip, err)
+		}
+		var result ipCheck
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		for _, list := range result.Lists {
+			if list.ID == r.listID() {
+				return list
+			}
+		}
+		t.Fatalf("%s: expected the list in %s", ip, rec.Body)
+		return listCheck{}
+	}
+	got := check("192.0.2.200")
+	expected := []prefixSource{{Prefix: "192.0.2.128/25", Source: server.URL}}
+	if !got.Contained || got.Range != "192.0.2.0/24" || !slices.Equal(got.Sources, expected) {
+		t.Errorf("unexpected check result %+v", got)
+	}
+	if got := check("198.51.100.7"); got.Contained || got.Range != "" {
+		t.Errorf("expected the IP not to be contained, got %+v", got)
+	}
+
+	if err := (adminIPList{}).handleCheck(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ip-list/check?ip=invalid", nil)); err == nil {
+		t.Error("expected an invalid IP to be rejected")
+	}
+}
@@ -0,0 +1,335 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/miekg/dns"
+)
+
+func init() {
+	caddy.RegisterModule(AXFRIPRange{})
+}
+
+// AXFRIPRange provides the entries of a DNSBL zone obtained by zone
+// transfer. Entries are encoded DNSBL-style as the reversed address below
+// the zone, e.g. 2.0.0.127.bl.example.org for 127.0.0.2, with a leading
+// wildcard label for ranges (*.2.0.192.bl.example.org is 192.0.2.0/24)
+// and nibbles for IPv6. With ixfr enabled, refreshes after the first full
+// transfer only request the changes since the last serial.
+type AXFRIPRange struct {
+	// Zone to transfer, e.g. bl.example.org.
+	Zone string `json:"zone"`
+	// Address of the primary server, host[:port].
+	Server string `json:"server"`
+	// Only include entries whose A record is one of these return codes,
+	// e.g. 127.0.0.2. Default is any A record.
+	ReturnCodes []string `json:"return_codes,omitempty"`
+	// Use incremental zone transfers (IXFR) after the first transfer.
+	IXFR bool `json:"ixfr,omitempty"`
+	// Optional TSIG key name, algorithm (default hmac-sha256.) and
+	// base64 secret. The secret supports placeholders.
+	TSIGName      string `json:"tsig_name,omitempty"`
+	TSIGAlgorithm string `json:"tsig_algorithm,omitempty"`
+	TSIGSecret    string `json:"tsig_secret,omitempty"`
+	// refresh Interval
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// Read Timeout of each message. Default is 30s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	codes   map[netip.Addr]bool
+	entries map[string]map[netip.Addr]bool
+	serial  uint32
+	soa     *dns.SOA
+	pollingSource
+}
+
+// CaddyModule returns the Caddy module information.
+func (AXFRIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.axfr",
+		New: func() caddy.Module { return new(AXFRIPRange) },
+	}
+}
+
+func (s *AXFRIPRange) Provision(ctx caddy.Context) error {
+	if s.Zone == "" || s.Server == "" {
+		return fmt.Errorf("zone and server are required")
+	}
+	s.Zone = dns.CanonicalName(s.Zone)
+	if _, _, err := net.SplitHostPort(s.Server); err != nil {
+		s.Server = net.JoinHostPort(s.Server, "53")
+	}
+	if len(s.ReturnCodes) > 0 {
+		s.codes = make(map[netip.Addr]bool)
+		for _, code := range s.ReturnCodes {
+			addr, err := netip.ParseAddr(code)
+			if err != nil {
+				return fmt.Errorf("invalid return code %q: %v", code, err)
+			}
+			s.codes[addr] = true
+		}
+	}
+	if s.TSIGName != "" {
+		s.TSIGName = dns.CanonicalName(s.TSIGName)
+		s.TSIGSecret = caddy.NewReplacer().ReplaceAll(s.TSIGSecret, "")
+		if s.TSIGAlgorithm == "" {
+			s.TSIGAlgorithm = dns.HmacSHA256
+		}
+		s.TSIGAlgorithm = dns.CanonicalName(s.TSIGAlgorithm)
+	}
+	if s.Timeout == 0 {
+		s.Timeout = caddy.Duration(30 * time.Second)
+	}
+	s.entries = make(map[string]map[netip.Addr]bool)
+	return s.start(ctx, time.Duration(s.Interval), s.fetch)
+}
+
+func (s *AXFRIPRange) fetch(_ context.Context) ([]netip.Prefix, error) {
+	m := new(dns.Msg)
+	incremental := s.IXFR && s.soa != nil
+	if incremental {
+		m.SetIxfr(s.Zone, s.serial, s.soa.Ns, s.soa.Mbox)
+	} else {
+		m.SetAxfr(s.Zone)
+	}
+	t := &dns.Transfer{
+		DialTimeout: time.Duration(s.Timeout),
+		ReadTimeout: time.Duration(s.Timeout),
+	}
+	if s.TSIGName != "" {
+		t.TsigSecret = map[string]string{s.TSIGName: s.TSIGSecret}
+		m.SetTsig(s.TSIGName, s.TSIGAlgorithm, 300, time.Now().Unix())
+	}
+	envelopes, err := t.In(m, s.Server)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for env := range envelopes {
+		if env.Error != nil {
+			return nil, fmt.Errorf("transfer of %s: %w", s.Zone, env.Error)
+		}
+		rrs = append(rrs, env.RR...)
+	}
+	if len(rrs) == 0 {
+		return nil, fmt.Errorf("transfer of %s: empty response", s.Zone)
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return nil, fmt.Errorf("transfer of %s: response does not start with SOA", s.Zone)
+	}
+
+	switch {
+	case incremental && len(rrs) == 1:
+		// up to date
+	case incremental && len(rrs) > 2 && rrs[1].Header().Rrtype == dns.TypeSOA:
+		// sequences of deletions, each starting with the old SOA, and
+		// additions, each starting with the new SOA
+		adding := true
+		for _, rr := range rrs[1 : len(rrs)-1] {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				adding = !adding
+				continue
+			}
+			if adding {
+				s.add(rr)
+			} else {
+				s.remove(rr)
+			}
+		}
+	default:
+		// full transfer
+		s.entries = make(map[string]map[netip.Addr]bool)
+		for _, rr := range rrs {
+			s.add(rr)
+		}
+	}
+	s.serial, s.soa = soa.Serial, soa
+
+	var prefixes []netip.Prefix
+	for _, name := range slices.Sorted(maps.Keys(s.entries)) {
+		if !s.matches(s.entries[name]) {
+			continue
+		}
+		prefix, err := dnsblNameToPrefix(strings.TrimSuffix(name, "."+s.Zone))
+		if err != nil {
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+func (s *AXFRIPRange) add(rr dns.RR) {
+	a, ok := rr.(*dns.A)
+	if !ok {
+		return
+	}
+	name := dns.CanonicalName(a.Hdr.Name)
+	addr, _ := netip.AddrFromSlice(a.A.To4())
+	if s.entries[name] == nil {
+		s.entries[name] = make(map[netip.Addr]bool)
+	}
+	s.entries[name][addr] = true
+}
+
+func (s *AXFRIPRange) remove(rr dns.RR) {
+	a, ok := rr.(*dns.A)
+	if !ok {
+		return
+	}
+	name := dns.CanonicalName(a.Hdr.Name)
+	addr, _ := netip.AddrFromSlice(a.A.To4())
+	delete(s.entries[name], addr)
+	if len(s.entries[name]) == 0 {
+		delete(s.entries, name)
+	}
+}
+
+// matches reports whether one of the return codes of an entry is included.
+func (s *AXFRIPRange) matches(codes map[netip.Addr]bool) bool {
+	if s.codes == nil {
+		return true
+	}
+	for code := range codes {
+		if s.codes[code] {
+			return true
+		}
+	}
+	return false
+}
+
+// dnsblNameToPrefix decodes the labels of a DNSBL entry below its zone:
+// reversed IPv4 octets or IPv6 nibbles, optionally preceded by a wildcard
+// label for a range covering the remaining labels.
+func dnsblNameToPrefix(name string) (netip.Prefix, error) {
+	labels := strings.Split(name, ".")
+	wildcard := labels[0] == "*"
+	if wildcard {
+		labels = labels[1:]
+	}
+	if len(labels) == 0 {
+		// never turn a bare wildcard into ::/0 or 0.0.0.0/0
+		return netip.Prefix{}, fmt.Errorf("invalid DNSBL entry %q", name)
+	}
+	slices.Reverse(labels)
+
+	// IPv6 entries have single hex digit labels, so anything longer than
+	// four labels or with hex letters is IPv6
+	if len(labels) > 4 || strings.ContainsAny(name, "abcdef") {
+		var b [16]byte
+		if len(labels) > 32 {
+			return netip.Prefix{}, fmt.Errorf("invalid DNSBL entry %q", name)
+		}
+		for i, label := range labels {
+			n, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return netip.Prefix{}, fmt.Errorf("invalid DNSBL entry %q", name)
+			}
+			b[i/2] |= byte(n) << (4 * (1 - i%2))
+		}
+		if !wildcard && len(labels) != 32 {
+			return netip.Prefix{}, fmt.Errorf("invalid DNSBL entry %q", name)
+		}
+		return netip.PrefixFrom(netip.AddrFrom16(b), 4*len(labels)), nil
+	}
+
+	var b [4]byte
+	for i, label := range labels {
+		n, err := strconv.ParseUint(label, 10, 8)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid DNSBL entry %q", name)
+		}
+		b[i] = byte(n)
+	}
+	if !wildcard && len(labels) != 4 {
+		return netip.Prefix{}, fmt.Errorf("invalid DNSBL entry %q", name)
+	}
+	return netip.PrefixFrom(netip.AddrFrom4(b), 8*len(labels)), nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	axfr <zone> <server> {
+//	   return_codes <addr...>
+//	   ixfr
+//	   tsig <name> <secret> [algorithm]
+//	   interval val
+//	   timeout val
+//	}
+func (m *AXFRIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	if !d.Args(&m.Zone, &m.Server) {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "return_codes":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			m.ReturnCodes = append(m.ReturnCodes, args...)
+		case "ixfr":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.IXFR = true
+		case "tsig":
+			args := d.RemainingArgs()
+			if len(args) < 2 || len(args) > 3 {
+				return d.ArgErr()
+			}
+			m.TSIGName, m.TSIGSecret = args[0], args[1]
+			if len(args) == 3 {
+				m.TSIGAlgorithm = args[2]
+			}
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Interval = caddy.Duration(val)
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Timeout = caddy.Duration(val)
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*AXFRIPRange)(nil)
+	_ caddy.Provisioner       = (*AXFRIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*AXFRIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*AXFRIPRange)(nil)
+)
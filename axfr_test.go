@@ -0,0 +1,122 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/miekg/dns"
+)
+
+func TestDNSBLNameToPrefix(t *testing.T) {
+	for name, expected := range map[string]string{
+		"2.0.0.127":         "127.0.0.2/32",
+		"*.2.0.192":         "192.0.2.0/24",
+		"*.10":              "10.0.0.0/8",
+		"*.8.b.d.0.1.0.0.2": "2001:db8::/32",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2": "2001:db8::1/128",
+	} {
+		prefix, err := dnsblNameToPrefix(name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if prefix.String() != expected {
+			t.Errorf("%s: expected %s, got %s", name, expected, prefix)
+		}
+	}
+	for _, name := range []string{"*", "2.0.127", "300.0.0.127", "bl"} {
+		if _, err := dnsblNameToPrefix(name); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestAXFR(t *testing.T) {
+	rr := func(s string) dns.RR {
+		r, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	soa1 := rr("bl.example.org. 300 IN SOA ns.example.org. hostmaster.example.org. 1 3600 600 86400 300")
+	soa2 := rr("bl.example.org. 300 IN SOA ns.example.org. hostmaster.example.org. 2 3600 600 86400 300")
+	zone := []dns.RR{
+		soa1,
+		rr("bl.example.org. 300 IN NS ns.example.org."),
+		rr("2.0.0.127.bl.example.org. 300 IN A 127.0.0.2"),
+		rr("10.2.0.192.bl.example.org. 300 IN A 127.0.0.2"),
+		rr("10.2.0.192.bl.example.org. 300 IN TXT \"listed\""),
+		rr("*.100.51.198.bl.example.org. 300 IN A 127.0.0.3"),
+		rr("7.113.0.203.bl.example.org. 300 IN A 127.0.0.4"),
+		soa1,
+	}
+	// serial 1 -> 2: delist 192.0.2.10, list 192.0.2.11
+	diff := []dns.RR{
+		soa2,
+		soa1,
+		rr("10.2.0.192.bl.example.org. 300 IN A 127.0.0.2"),
+		soa2,
+		rr("11.2.0.192.bl.example.org. 300 IN A 127.0.0.2"),
+		soa2,
+	}
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc("bl.example.org.", func(w dns.ResponseWriter, r *dns.Msg) {
+		records := zone
+		if r.Question[0].Qtype == dns.TypeIXFR {
+			records = diff
+		}
+		ch := make(chan *dns.Envelope)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			(&dns.Transfer{}).Out(w, r, ch)
+			wg.Done()
+		}()
+		ch <- &dns.Envelope{RR: records}
+		close(ch)
+		wg.Wait()
+		w.Hijack()
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{Listener: ln, Handler: mux}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	d := caddyfile.NewTestDispenser(`axfr bl.example.org ` + ln.Addr().String() + ` {
+		return_codes 127.0.0.2 127.0.0.3
+		ixfr
+	}`)
+	r := AXFRIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+
+	expected := []string{"198.51.100.0/24", "192.0.2.10/32", "127.0.0.2/32"}
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	prefixes, err := r.fetch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"198.51.100.0/24", "192.0.2.11/32", "127.0.0.2/32"}
+	if got := prefixStrings(prefixes); !slices.Equal(got, expected) {
+		t.Errorf("expected %v after IXFR, got %v", expected, got)
+	}
+}
@@ -0,0 +1,245 @@
+package caddy_ip_list
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// The bolt cache holds the format version and the fetch status in the meta
+// bucket, and a bucket per URL in the urls bucket. Each URL bucket holds
+// the cacheEntry without prefixes under meta, and the prefixes in binary
+// form as the keys of its prefixes bucket, so saving only touches the
+// prefixes that changed.
+var (
+	boltMeta     = []byte("meta")
+	boltVersion  = []byte("version")
+	boltStatus   = []byte("status")
+	boltURLs     = []byte("urls")
+	boltPrefixes = []byte("prefixes")
+)
+
+// boltPath returns the path of the bolt cache, which defaults to a .db file
+// instead of the .json file.
+func (s *URLIPRange) boltPath() (string, error) {
+	if s.CacheFile != "" {
+		return s.CacheFile, nil
+	}
+	path, err := s.cachePath()
+	return strings.TrimSuffix(path, ".json") + ".db", err
+}
+
+func (s *URLIPRange) openBolt(path string) (*bbolt.DB, error) {
+	fileMode, dirMode := s.fileMode, s.dirMode
+	if fileMode == 0 {
+		fileMode = 0o644
+	}
+	if dirMode == 0 {
+		dirMode = 0o755
+	}
+	if err := os.MkdirAll(filepath.Dir(path), dirMode); err != nil {
+		return nil, err
+	}
+	return bbolt.Open(path, fileMode, &bbolt.Options{Timeout: 10 * time.Second})
+}
+
+// loadFromBolt reads the lists of the configured URLs from the bolt cache.
+func (s *URLIPRange) loadFromBolt() (map[string]urlList, error) {
+	path, err := s.boltPath()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := s.openBolt(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	lists := make(map[string]urlList, len(s.URLs))
+	filter := s.filterKey()
+	err = db.View(func(tx *bbolt.Tx) error {
+		if meta := tx.Bucket(boltMeta); meta != nil {
+			if version, _ := strconv.Atoi(string(meta.Get(boltVersion))); version > cacheVersion && s.log != nil {
+				s.log.Info("reading cache written by a newer version",
+					zap.Int("version", version),
+					zap.Int("supported_version", cacheVersion))
+			}
+			if data := meta.Get(boltStatus); data != nil && s.status == nil {
+				if err := json.Unmarshal(data, &s.status); err != nil {
+					return fmt.Errorf("invalid status in cache: %w", err)
+				}
+			}
+		}
+		urls := tx.Bucket(boltURLs)
+		if urls == nil {
+			return nil
+		}
+		for _, url := range s.URLs {
+			bucket := urls.Bucket([]byte(url))
+			if bucket == nil {
+				continue
+			}
+			var entry cacheEntry
+			if err := json.Unmarshal(bucket.Get(boltMeta), &entry); err != nil {
+				return fmt.Errorf("invalid cache entry for %s: %w", url, err)
+			}
+			if !s.sameFilter(url, entry, filter) {
+				continue
+			}
+			expires, err := parseExpires(entry.Expires)
+			if err != nil {
+				return err
+			}
+			list := urlList{
+				expires:       expires,
+				updated:       entry.UpdatedAt,
+				etag:          entry.ETag,
+				lastModified:  entry.LastModified,
+				contentLength: entry.ContentLength,
+			}
+			if prefixes := bucket.Bucket(boltPrefixes); prefixes != nil {
+				err := prefixes.ForEach(func(k, _ []byte) error {
+					var prefix netip.Prefix
+					if err := prefix.UnmarshalBinary(k); err != nil {
+						return fmt.Errorf("invalid prefix in cache for %s: %w", url, err)
+					}
+					list.prefixes = append(list.prefixes, prefix)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			lists[url] = list
+		}
+		return nil
+	})
+	return lists, err
+}
+
+// saveToBolt writes the lists to the bolt cache.
+func (s *URLIPRange) saveToBolt() error {
+	path, err := s.boltPath()
+	if err != nil {
+		return err
+	}
+	db, err := s.openBolt(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(boltMeta)
+		if err != nil {
+			return err
+		}
+		if err := meta.Put(boltVersion, []byte(strconv.Itoa(cacheVersion))); err != nil {
+			return err
+		}
+		status, err := json.Marshal(s.status)
+		if err != nil {
+			return err
+		}
+		if err := meta.Put(boltStatus, status); err != nil {
+			return err
+		}
+
+		urls, err := tx.CreateBucketIfNotExists(boltURLs)
+		if err != nil {
+			return err
+		}
+		var dropped [][]byte
+		err = urls.ForEach(func(k, _ []byte) error {
+			if _, ok := s.lists[string(k)]; !ok {
+				dropped = append(dropped, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range dropped {
+			if err := urls.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+
+		filter := s.filterKey()
+		for url, list := range s.lists {
+			bucket, err := urls.CreateBucketIfNotExists([]byte(url))
+			if err != nil {
+				return err
+			}
+			entry, err := json.Marshal(cacheEntry{
+				UpdatedAt:     list.updated,
+				ETag:          list.etag,
+				LastModified:  list.lastModified,
+				ContentLength: list.contentLength,
+				Expires:       formatExpires(list.expires),
+				Filter:        filter,
+			})
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(boltMeta, entry); err != nil {
+				return err
+			}
+			prefixes, err := bucket.CreateBucketIfNotExists(boltPrefixes)
+			if err != nil {
+				return err
+			}
+			if err := updatePrefixes(prefixes, list.prefixes); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// updatePrefixes makes the keys of bucket the given prefixes, deleting and
+// adding only those that changed.
+func updatePrefixes(bucket *bbolt.Bucket, prefixes []netip.Prefix) error {
+	added := make(map[string]bool, len(prefixes))
+	for _, prefix := range prefixes {
+		k, err := prefix.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		added[string(k)] = true
+	}
+	var removed [][]byte
+	err := bucket.ForEach(func(k, _ []byte) error {
+		if added[string(k)] {
+			delete(added, string(k))
+		} else {
+			removed = append(removed, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range removed {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	for k := range added {
+		if err := bucket.Put([]byte(k), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
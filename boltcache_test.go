@@ -0,0 +1,112 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.etcd.io/bbolt"
+)
+
+func TestBoltCache(t *testing.T) {
+	var down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "fail", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("198.51.100.0/24\n192.0.2.0/24\n2001:db8::/32\n"))
+	}))
+	defer server.Close()
+
+	cacheFile := filepath.Join(t.TempDir(), "cache.db")
+	provision := func() (*URLIPRange, error) {
+		d := caddyfile.NewTestDispenser(`list {
+			url ` + server.URL + `
+			retries 0
+			cache_backend bolt
+			cache_file ` + cacheFile + `
+		}`)
+		r := &URLIPRange{}
+		if err := r.UnmarshalCaddyfile(d); err != nil {
+			t.Fatalf("unmarshal error: %v", err)
+		}
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		t.Cleanup(cancel)
+		return r, r.Provision(ctx)
+	}
+
+	r, err := provision()
+	if err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	r.Cleanup()
+
+	down.Store(true)
+	r, err = provision()
+	if err != nil {
+		t.Fatalf("expected cached ranges, got %v", err)
+	}
+	defer r.Cleanup()
+	// the cache returns the prefixes in binary order
+	expected := []string{"192.0.2.0/24", "198.51.100.0/24", "2001:db8::/32"}
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	cached, err := r.loadFromBolt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := cached[server.URL]; list.etag != `"v1"` || list.updated.IsZero() {
+		t.Errorf("expected validators in cache, got %+v", list)
+	}
+
+	// saving only touches changed prefixes; the running list owns its
+	// lists, so save them from a copy
+	saved := &URLIPRange{URLs: r.URLs, CacheFile: cacheFile, lists: map[string]urlList{server.URL: {
+		prefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("203.0.113.0/24")},
+		updated:  time.Now(),
+	}}}
+	if err := saved.saveToBolt(); err != nil {
+		t.Fatal(err)
+	}
+	if cached, err = r.loadFromBolt(); err != nil {
+		t.Fatal(err)
+	}
+	if got := prefixStrings(cached[server.URL].prefixes); !slices.Equal(got, []string{"192.0.2.0/24", "203.0.113.0/24"}) {
+		t.Errorf("unexpected cached ranges %v", got)
+	}
+	db, err := bbolt.Open(cacheFile, 0o644, &bbolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_ = db.View(func(tx *bbolt.Tx) error {
+		if string(tx.Bucket(boltMeta).Get(boltVersion)) != "2" {
+			t.Error("expected cache version")
+		}
+		return nil
+	})
+}
+
+func TestBoltCacheOptions(t *testing.T) {
+	r := URLIPRange{CacheBackend: "bolt", CacheCompression: "gzip"}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.setup(ctx); err == nil {
+		t.Error("expected bolt with compression to be rejected")
+	}
+	r = URLIPRange{CacheBackend: "sqlite"}
+	if err := r.setup(ctx); err == nil {
+		t.Error("expected unknown backend to be rejected")
+	}
+}
@@ -2,23 +2,40 @@ package caddy_ip_list
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
-    "crypto/sha256"
-    "encoding/hex"
-    "encoding/json"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"maps"
 	"net/http"
 	"net/netip"
-    "os"
-    "path/filepath"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
-    "go.uber.org/zap"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
 )
 
 func init() {
@@ -31,22 +48,336 @@ type URLIPRange struct {
 	URLs []string `json:"url"`
 	// refresh Interval
 	Interval caddy.Duration `json:"interval,omitempty"`
-    // request Timeout
+	// Random deviation of each refresh from Interval, either a duration
+	// like "5m" or a percentage of Interval like "10%", so instances
+	// started together don't refresh in lockstep.
+	IntervalJitter string `json:"interval_jitter,omitempty"`
+	// How provisioning gets the initial ranges: "blocking" (default)
+	// fetches every URL first and falls back to the cache, "async"
+	// starts right away with the cached ranges, or none if there are no
+	// usable ones, and fetches in the background.
+	Startup string `json:"startup,omitempty"`
+	// What a blocking startup does when fetching a URL fails: "use_cache"
+	// (default) uses its cached ranges and fails without them, "fail"
+	// always fails to fail closed, and "start_empty" starts without its
+	// ranges if there are no cached ones, to stay available.
+	OnStartupFailure string `json:"on_startup_failure,omitempty"`
+	// Refresh intervals of individual URLs that override Interval, e.g.
+	// to refresh a ban list every minute and a cloud provider's ranges
+	// daily. Each URL is refreshed on its own schedule.
+	URLIntervals map[string]caddy.Duration `json:"url_intervals,omitempty"`
+	// A cron expression, evaluated in UTC, on which to refresh the URLs
+	// instead of an interval, such as "0 3 * * *" for daily at 03:00.
+	// URLs with their own interval keep it.
+	Schedule string `json:"schedule,omitempty"`
+	// Time of day, in UTC, outside of which URLs are not refreshed, such
+	// as "01:00-05:00". Refreshes that fall outside are postponed to the
+	// start of the window, keeping the previous ranges until then.
+	RefreshWindow string `json:"refresh_window,omitempty"`
+	// A Redis or NATS channel on which messages make the list fetch its
+	// URLs right away, in addition to the interval.
+	RefreshOn *RefreshTrigger `json:"refresh_on,omitempty"`
+	// Bounds a whole refresh, including retries. URLs that are not fetched
+	// by then keep their previous ranges, and are fetched on the next
+	// refresh. Default is no deadline.
+	RefreshDeadline caddy.Duration `json:"refresh_deadline,omitempty"`
+	// Whether to spread the refreshes of the URLs evenly across the
+	// interval, instead of fetching them all at once.
+	Stagger bool `json:"stagger,omitempty"`
+	// How the list is refreshed: "interval" (default) refreshes it in the
+	// background on its interval or schedule, "on_demand" only when its
+	// ranges are used and older than on_demand_max_age.
+	Refresh string `json:"refresh,omitempty"`
+	// Age of the ranges after which using them refreshes them in the
+	// background, with refresh on_demand. Default is the interval.
+	OnDemandMaxAge caddy.Duration `json:"on_demand_max_age,omitempty"`
+	// Whether to send a HEAD request before downloading a list again, and
+	// skip the download if its ETag or Last-Modified and Content-Length
+	// are unchanged. Useful for large lists on servers that ignore
+	// conditional requests.
+	HeadCheck bool `json:"head_check,omitempty"`
+	// Upper bound of the backoff of a URL that keeps failing: its refresh
+	// interval doubles with every consecutive failure up to this limit,
+	// and is reset once a fetch succeeds. Default is no backoff.
+	MaxBackoff caddy.Duration `json:"max_backoff,omitempty"`
+	// request Timeout
 	Timeout caddy.Duration `json:"timeout,omitempty"`
-    // Number of retries for fetching the IP list.
-    // Default is 2 when unspecified. Set explicitly to 0 to disable retries.
-    Retries *int `json:"retries,omitempty"`
+	// Number of retries for fetching the IP list.
+	// Default is 2 when unspecified. Set explicitly to 0 to disable retries.
+	Retries *int `json:"retries,omitempty"`
+	// Request timeout and number of retries of the initial fetch when
+	// startup blocks, so startup can try harder than background refreshes.
+	// Default to timeout and retries.
+	StartupTimeout caddy.Duration `json:"startup_timeout,omitempty"`
+	StartupRetries *int           `json:"startup_retries,omitempty"`
+	// How long the last good ranges of a URL remain in use while fetching
+	// it fails. Once exceeded, its ranges are dropped until a fetch
+	// succeeds, and older caches are not used on startup. Default is no
+	// limit.
+	StaleIfError caddy.Duration `json:"stale_if_error,omitempty"`
+	// What happens to the last good ranges of a URL that keeps failing:
+	// "keep" (default) keeps using them, e.g. for trusted proxies, and
+	// "clear" drops them once the URL has been failing for ClearAfter or
+	// for ClearAfterFailures consecutive fetches, e.g. for blocklists.
+	// The ranges are back once a fetch succeeds.
+	OnSustainedFailure string         `json:"on_sustained_failure,omitempty"`
+	ClearAfter         caddy.Duration `json:"clear_after,omitempty"`
+	ClearAfterFailures int            `json:"clear_after_failures,omitempty"`
 
-    // Optional path to a cache file. If not set, a file under Caddy's data
-    // directory will be used, derived from the URLs.
-    CacheFile string `json:"cache_file,omitempty"`
+	// Optional path to a cache file. If not set, a file under Caddy's data
+	// directory will be used, derived from the URLs.
+	CacheFile string `json:"cache_file,omitempty"`
+	// Optional directory for the cache file derived from the URLs,
+	// instead of Caddy's data directory. With CacheStorage it is the
+	// prefix of the storage key.
+	CacheDir string `json:"cache_dir,omitempty"`
+	// Disable the cache. Nothing is read or written, and startup fails if
+	// a list cannot be fetched.
+	CacheDisabled bool `json:"cache_disabled,omitempty"`
+	// Maximum age of cached ranges loaded on startup. Older caches are
+	// rejected, unless CacheMaxAgeWarnOnly is set, in which case they are
+	// used and an error is logged. Default is no limit.
+	CacheMaxAge         caddy.Duration `json:"cache_max_age,omitempty"`
+	CacheMaxAgeWarnOnly bool           `json:"cache_max_age_warn_only,omitempty"`
+	// Keep the cache in Caddy's configured storage instead of a local file,
+	// so instances sharing storage also share the cache. CacheFile, if set,
+	// is used as the storage key.
+	CacheStorage bool `json:"cache_storage,omitempty"`
+	// Format of the cache: "json" (default) or "bolt", a bbolt database
+	// that stores the ranges in binary form and only writes what changed,
+	// for lists with millions of entries. The bolt cache is always a local
+	// file and can't be combined with cache_storage, cache_compression,
+	// cache_encryption_key or cache_sign.
+	CacheBackend string `json:"cache_backend,omitempty"`
+	// Compress the cache. The only supported value is "gzip". Compressed
+	// caches are detected on load regardless of this setting.
+	CacheCompression string `json:"cache_compression,omitempty"`
+	// Encrypt the cache with AES-GCM using this base64 encoded 128, 192 or
+	// 256 bit key. Supports placeholders such as {env.IP_LIST_CACHE_KEY}
+	// or {file./etc/caddy/cache.key}.
+	CacheEncryptionKey string `json:"cache_encryption_key,omitempty"`
+	// Octal permissions of the cache file and of directories created for
+	// it. Defaults are 0644 and 0755.
+	CacheFileMode string `json:"cache_file_mode,omitempty"`
+	CacheDirMode  string `json:"cache_dir_mode,omitempty"`
+	// Number of earlier versions of the lists to keep in the cache, for
+	// rolling back through the admin API. Not supported by the bolt
+	// cache.
+	CacheHistory int `json:"cache_history,omitempty"`
+	// Flush cache files and their directory to disk before and after
+	// replacing the file, so the cache survives a power loss intact.
+	CacheSync bool `json:"cache_sync,omitempty"`
+	// Sign the cache with HMAC-SHA256 and refuse to load caches whose
+	// signature does not verify. The key is CacheSigningKey, or a random
+	// key kept in Caddy's storage when that is empty.
+	CacheSign bool `json:"cache_sign,omitempty"`
+	// Base64 encoded signing key. Supports placeholders such as
+	// {env.IP_LIST_SIGNING_KEY}.
+	CacheSigningKey string `json:"cache_signing_key,omitempty"`
+
+	// Optional path of a plain text file to which the ranges in use,
+	// including the static CIDRs, are written one per line whenever they
+	// change, for use by other programs. It is written even if the cache
+	// is disabled and is never read.
+	CacheExport string `json:"cache_export,omitempty"`
+
+	// Static IPs or CIDRs to provide in addition to the fetched ranges.
+	// They are not written to the cache.
+	CIDRs []string `json:"cidrs,omitempty"`
+	// Ranges to remove from the fetched ranges, as CIDRs or URLs of lists
+	// that are fetched along with URLs. Fetched prefixes that contain an
+	// excluded range are split around it. The static CIDRs are kept.
+	Exclude []string `json:"exclude,omitempty"`
+	// What to do with lines of a fetched list that can't be parsed:
+	// "fail" (default) rejects the list, "skip" ignores the line and
+	// keeps the valid entries.
+	OnParseError string `json:"on_parse_error,omitempty"`
+	// Maximum number of lines skipped with OnParseError skip, as a count
+	// or a percentage of the entries such as "5%". A list with more is
+	// considered corrupt and rejected like a failed fetch. Default is no
+	// limit.
+	MaxParseErrors string `json:"max_parse_errors,omitempty"`
+	// Regular expression that lines of the fetched lists must match to be
+	// parsed, e.g. to only use the lines of a mixed feed that are tagged
+	// with a category. It is matched against the whole line, including
+	// comments.
+	LineFilter string `json:"line_filter,omitempty"`
+	// Regular expression that extracts the entry from each line of the
+	// fetched lists, for feeds that embed CIDRs in other text. The entry
+	// is the group named "cidr", or else the first capture group. Lines
+	// that don't match are ignored.
+	Extract string `json:"extract,omitempty"`
+	// Widen bare IPs of the fetched lists to prefixes of these lengths,
+	// e.g. to the /24 around each IP of an abuse feed. Zero leaves the
+	// IPs of that family as they are.
+	ExpandSingleTo PrefixLengths `json:"expand_single_to,omitzero"`
+	// Merge adjacent and overlapping fetched prefixes into as few
+	// prefixes as possible after each refresh. The merged ranges are
+	// sorted.
+	Aggregate bool `json:"aggregate,omitempty"`
+	// Also provide every IPv4 range translated into this NAT64 prefix,
+	// e.g. 64:ff9b::/96, for IPv6-only servers behind NAT64 that see
+	// clients at IPv4-embedded addresses. Only /96 prefixes are
+	// supported.
+	NAT64 string `json:"nat64,omitempty"`
+	// Also provide every IPv4 range as IPv4-mapped IPv6 addresses
+	// (::ffff:0:0/96), for clients that connect as e.g.
+	// ::ffff:203.0.113.7 on dual-stack sockets.
+	MapIPv4 bool `json:"map_ipv4,omitempty"`
+	// Supernets that every fetched prefix must lie within, so a
+	// compromised or malformed list can't add arbitrary ranges.
+	AllowWithin []string `json:"allow_within,omitempty"`
+	// Maximum number of prefixes a URL's list may have after filtering,
+	// so a feed that suddenly explodes in size can't exhaust memory.
+	// MaxEntriesPolicy decides what happens to a larger list: "fail"
+	// (default) rejects it like a failed fetch, "truncate" uses its first
+	// MaxEntries prefixes, and "keep_previous" keeps the last good list
+	// without recording an error.
+	MaxEntries       int    `json:"max_entries,omitempty"`
+	MaxEntriesPolicy string `json:"max_entries_policy,omitempty"`
+	// Upper bound, in bytes, of the estimated memory that the parsed
+	// lists of all URLs and the resolved ranges may use together, so
+	// small nodes are protected from a feed explosion. A refresh that
+	// would exceed it is aborted and the previous lists are kept.
+	MaxMemory int64 `json:"max_memory,omitempty"`
+	// Prefixes that the fetched lists must contain, e.g. a range the
+	// provider is known to use. A refresh whose lists don't contain them
+	// all is rejected as implausible and the previous lists are kept.
+	RequirePrefixes []string `json:"require_prefix,omitempty"`
+	// Drop private and special-purpose ranges (RFC 1918, loopback,
+	// link-local, documentation, multicast, ...) from the fetched lists,
+	// or with RejectPrivate reject a list that overlaps any, since they
+	// usually indicate a poisoned or broken feed. Wider prefixes that
+	// contain such a range are kept by StripPrivate.
+	StripPrivate  bool `json:"strip_private,omitempty"`
+	RejectPrivate bool `json:"reject_private,omitempty"`
+	// Validate the fetched prefixes against the ROAs known to an RPKI
+	// validator, and drop those that are not valid for an expected ASN.
+	RPKI *RPKIValidation `json:"rpki,omitempty"`
+	// Remove the bogons, ranges that must not appear in the global
+	// routing table, from the fetched lists, splitting larger prefixes
+	// around them. This is independent of StripPrivate.
+	StripBogons bool `json:"strip_bogons,omitempty"`
+	// Accept a URL's list that is empty after filtering. By default an
+	// empty list, e.g. an empty response body, is rejected like a failed
+	// fetch and the previous list is kept.
+	AllowEmpty bool `json:"allow_empty,omitempty"`
+	// Reject a URL's list that has shrunk by more than this percentage
+	// compared to its previous list, e.g. due to a truncated response,
+	// and keep the previous list. A shrink can be accepted once through
+	// the admin API. Default is no limit.
+	MinChangeGuard int `json:"min_change_guard,omitempty"`
+	// What to do with fetched prefixes that fail a filter: "drop" them
+	// (default), "fail" to reject the list and keep its last good
+	// version, or "warn" to log them but use them anyway.
+	OnInvalid string `json:"on_invalid,omitempty"`
+	// Address family of the fetched prefixes to use: "ipv4", "ipv6" or
+	// "both" (default). Prefixes of the other family are ignored.
+	Family string `json:"family,omitempty"`
+	// Bounds of the prefix lengths of fetched prefixes, per family, to
+	// reject entries like 0.0.0.0/0 or a flood of host routes. Prefixes
+	// outside them are handled according to OnInvalid. The default
+	// MinPrefixLen is 8 for IPv4 and 19 for IPv6; set it to 0 for no
+	// limit.
+	MinPrefixLen *PrefixLengths `json:"min_prefix_len,omitempty"`
+	MaxPrefixLen PrefixLengths  `json:"max_prefix_len,omitzero"`
 
 	// Holds the parsed CIDR ranges from Ranges.
 	ranges []netip.Prefix
+	// Holds the parsed CIDRs.
+	static []netip.Prefix
+	// Holds the list of each URL that ranges was resolved from, written
+	// with lock held.
+	origins map[string][]netip.Prefix
+	// Holds the parsed CIDRs and the URLs of Exclude, and the last good
+	// list of each of those URLs.
+	excludeStatic []netip.Prefix
+	excludeURLs   []string
+	excluded      map[string]urlList
+	// Holds the recent RPKI validation results of each URL. It is only
+	// used by the refreshing goroutine.
+	rpkiResults map[string]map[netip.Prefix]rpkiResult
+	// Holds the compiled LineFilter and Extract, and the index of the
+	// group of Extract that holds the entry.
+	lineFilter   *regexp.Regexp
+	extract      *regexp.Regexp
+	extractGroup int
+	// Holds the parsed IntervalJitter, as a duration or a percentage of
+	// the interval.
+	jitter        time.Duration
+	jitterPercent float64
+	// Deadline of the refresh in progress, if any. Only used by the
+	// refreshing goroutine.
+	deadline time.Time
+	// Whether the initial fetch of a blocking startup is in progress.
+	starting bool
+	// Unix time in nanoseconds of the last refresh, and whether an on
+	// demand refresh is pending.
+	lastRefresh    *atomic.Int64
+	refreshPending *atomic.Bool
+	// Whether refreshes are paused through the admin API, and a signal to
+	// the refresh loop that they were resumed.
+	paused  *atomic.Bool
+	resumed chan struct{}
+	// The parsed schedule and refresh window, if any.
+	cron   *cronSchedule
+	window *refreshWindow
+	// Holds the time each URL is due to be refreshed, the number of
+	// consecutive failures of each URL that is backing off, and the URLs
+	// retried soon after a failed startup, and when a failure of each
+	// degraded URL was last logged. They are only used by the refreshing
+	// goroutine.
+	due      map[string]time.Time
+	failures map[string]int
+	retrying map[string]bool
+	warned   map[string]time.Time
+	// Holds the parsed NAT64 prefix.
+	nat64 netip.Prefix
+	// Holds the parsed MaxParseErrors.
+	maxParseErrors        int
+	maxParseErrorsPercent bool
+	// Holds the parsed AllowWithin and RequirePrefixes.
+	allowWithin     []netip.Prefix
+	requirePrefixes []netip.Prefix
+	// Holds the last good list of each URL.
+	lists map[string]urlList
+	// Holds the cached lists until the first refresh.
+	cached map[string]urlList
+	// Holds the fetch status of each URL. It is only written by the
+	// refreshing goroutine, with lock held.
+	status map[string]urlStatus
+	// Holds the fetch metrics of each URL, written with lock held.
+	metrics map[string]fetchMetrics
+	// Set, with lock held, to refresh without validators.
+	fullFetch bool
+	// Set, with lock held, to accept lists that shrink beyond
+	// MinChangeGuard on the next refresh.
+	acceptShrink bool
+	// The last saved version and earlier versions of the lists, written
+	// with lock held.
+	saved         *cacheSnapshot
+	history       []cacheSnapshot
+	rollbacks     chan rollbackRequest
+	snapshotDiffs chan snapshotDiffRequest
+	refreshes     chan refreshRequest
+	// Closed to stop the refresh loop once its current refresh is done,
+	// and once the refresh loop has stopped.
+	shutdown chan struct{}
+	stopped  chan struct{}
+	// The list that fetches for this configuration, which is s itself
+	// for the first of identical lists.
+	shared  *URLIPRange
+	poolKey string
 
-	ctx  caddy.Context
-	lock *sync.RWMutex
-    log  *zap.Logger
+	ctx        caddy.Context
+	events     *atomic.Pointer[listEvents]
+	lock       *sync.RWMutex
+	log        *zap.Logger
+	storage    cacheStorage
+	cipher     cipher.AEAD
+	fileMode   os.FileMode
+	dirMode    os.FileMode
+	signingKey []byte
 }
 
 // CaddyModule returns the Caddy module information.
@@ -57,258 +388,1841 @@ func (URLIPRange) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-// getContext returns a cancelable context, with a timeout if configured.
+// getContext returns a cancelable context, with a timeout if configured,
+// that ends at the deadline of the refresh in progress. The initial fetch
+// uses the startup timeout.
 func (s *URLIPRange) getContext() (context.Context, context.CancelFunc) {
-	if s.Timeout > 0 {
-		return context.WithTimeout(s.ctx, time.Duration(s.Timeout))
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if s.deadline.IsZero() {
+		ctx, cancel = context.WithCancel(s.ctx)
+	} else {
+		ctx, cancel = context.WithDeadline(s.ctx, s.deadline)
+	}
+	timeout := s.Timeout
+	if s.starting && s.StartupTimeout > 0 {
+		timeout = s.StartupTimeout
+	}
+	if timeout > 0 {
+		timeoutCtx, timeoutCancel := context.WithTimeout(ctx, time.Duration(timeout))
+		return timeoutCtx, func() { timeoutCancel(); cancel() }
 	}
-	return context.WithCancel(s.ctx)
+	return ctx, cancel
 }
 
-func (s *URLIPRange) fetch(api string) ([]netip.Prefix, error) {
-    retries := 2
-    if s.Retries != nil {
-        retries = *s.Retries
-        if retries < 0 {
-            retries = 0
-        }
-    }
+// fetch downloads the list at api. When prev holds validators of an
+// earlier download, the request is conditional and prev is returned again
+// if the list is unchanged.
+func (s *URLIPRange) fetch(api string, prev urlList) (_ urlList, stats fetchStats, err error) {
+	start := time.Now()
+	defer func() { s.recordMetrics(api, stats, time.Since(start), err) }()
+	retries := 2
+	if s.Retries != nil {
+		retries = *s.Retries
+	}
+	if s.starting && s.StartupRetries != nil {
+		retries = *s.StartupRetries
+	}
+	retries = max(retries, 0)
+	if s.HeadCheck && s.headUnchanged(api, prev) {
+		list := prev
+		list.updated = time.Now()
+		return list, stats, nil
+	}
 	var lastErr error
-    for attempt := 0; attempt <= retries; attempt++ {
-        ctx, cancel := s.getContext()
-
-        req, err := http.NewRequestWithContext(ctx, http.MethodGet, api, nil)
-        if err != nil {
-            lastErr = err
-            cancel()
-            break
-        }
-
-        resp, err := http.DefaultClient.Do(req)
-        if err != nil {
-            lastErr = err
-            cancel()
-        } else {
-            if resp.StatusCode < 200 || resp.StatusCode > 299 {
-                // drain and close body before next attempt
-                _ = resp.Body.Close()
-                lastErr = fmt.Errorf("fetch %s returned HTTP %d", api, resp.StatusCode)
-                cancel()
-            } else {
-                scanner := bufio.NewScanner(resp.Body)
-                var prefixes []netip.Prefix
-                for scanner.Scan() {
-                    line := scanner.Text()
-
-                    // Remove comments from the line
-                    if idx := strings.Index(line, "#"); idx != -1 {
-                        line = line[:idx]
-                    }
-
-                    // Trim spaces
-                    line = strings.TrimSpace(line)
-
-                    // Skip empty lines
-                    if line == "" {
-                        continue
-                    }
-
-                    // Convert to prefix
-                    prefix, err := caddyhttp.CIDRExpressionToPrefix(line)
-                    if err != nil {
-                        _ = resp.Body.Close()
-                        cancel()
-                        return nil, err
-                    }
-                    prefixes = append(prefixes, prefix)
-                }
-                // capture scanner error before closing body
-                scanErr := scanner.Err()
-                _ = resp.Body.Close()
-                cancel()
-                if scanErr != nil {
-                    lastErr = scanErr
-                } else {
-                    return prefixes, nil // Success
-                }
-            }
-        }
-
-        // If not last attempt, delay before retrying
-        if attempt < retries {
-			time.Sleep(1 * time.Second)
+	for attempt := 0; attempt <= retries; attempt++ {
+		stats.retries = attempt
+		ctx, cancel := s.getContext()
+
+		req, err := newRequest(ctx, api)
+		if err != nil {
+			lastErr = err
+			cancel()
+			break
+		}
+		if prev.etag != "" {
+			req.Header.Set("If-None-Match", prev.etag)
+		}
+		if prev.lastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.lastModified)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			stats.finalURL, stats.status = resp.Request.URL.String(), resp.StatusCode
+		}
+		if err != nil {
+			lastErr = err
+			cancel()
+		} else if resp.StatusCode == http.StatusNotModified && (prev.etag != "" || prev.lastModified != "") {
+			_ = resp.Body.Close()
+			cancel()
+			list := prev
+			list.updated = time.Now()
+			list.status = resp.StatusCode
+			if etag := resp.Header.Get("ETag"); etag != "" {
+				list.etag = etag
+			}
+			return list, stats, nil
+		} else {
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				// drain and close body before next attempt
+				_ = resp.Body.Close()
+				lastErr = httpStatusError{url: api, status: resp.StatusCode}
+				cancel()
+			} else {
+				body := &countingReader{r: resp.Body}
+				scanner := bufio.NewScanner(body)
+				var prefixes []netip.Prefix
+				var expires map[netip.Prefix]time.Time
+				var parseErrs []error
+				fetched := time.Now()
+				for scanner.Scan() {
+					prefix, ttl, ok, err := s.parseEntry(scanner.Text())
+					if err != nil && s.OnParseError == "skip" {
+						parseErrs = append(parseErrs, err)
+						continue
+					}
+					if err != nil {
+						_ = resp.Body.Close()
+						cancel()
+						return urlList{}, stats, err
+					}
+					if !ok {
+						continue
+					}
+					prefixes = append(prefixes, prefix)
+					if s.MaxMemory > 0 && int64(len(prefixes))*prefixSize > s.MaxMemory {
+						_ = resp.Body.Close()
+						cancel()
+						return urlList{}, stats, fmt.Errorf("list exceeds max_memory %s", humanize.IBytes(uint64(s.MaxMemory)))
+					}
+					if ttl > 0 {
+						if expires == nil {
+							expires = make(map[netip.Prefix]time.Time)
+						}
+						expires[prefix] = fetched.Add(ttl)
+					}
+				}
+				// capture scanner error before closing body
+				scanErr := scanner.Err()
+				stats.bytes, stats.parseErrors = body.n, len(parseErrs)
+				stats.parsed, stats.parseDuration = len(prefixes), time.Since(fetched)
+				_ = resp.Body.Close()
+				cancel()
+				if scanErr != nil {
+					lastErr = scanErr
+				} else {
+					if err := s.checkParseErrors(len(parseErrs), len(prefixes)+len(parseErrs)); err != nil {
+						return urlList{}, stats, fmt.Errorf("%w, first: %v", err, parseErrs[0])
+					}
+					if len(parseErrs) > 0 && s.log != nil {
+						s.log.Warn("skipped invalid lines of IP list",
+							zap.String("url", api),
+							zap.Int("skipped", len(parseErrs)),
+							zap.Error(parseErrs[0]))
+					}
+					// Success
+					return urlList{
+						prefixes:      prefixes,
+						expires:       expires,
+						updated:       time.Now(),
+						etag:          resp.Header.Get("ETag"),
+						lastModified:  resp.Header.Get("Last-Modified"),
+						contentLength: max(resp.ContentLength, 0),
+						status:        resp.StatusCode,
+					}, stats, nil
+				}
+			}
+		}
+
+		// If not last attempt, delay before retrying
+		if !s.deadline.IsZero() && time.Until(s.deadline) < time.Second {
+			break
+		}
+		if attempt < retries {
+			select {
+			case <-time.After(1 * time.Second):
+			case <-s.ctx.Done():
+				return urlList{}, stats, s.ctx.Err()
+			}
 		}
 	}
 	// After all attempts
-    return nil, fmt.Errorf("after %d retries: %w", retries, lastErr)
+	return urlList{}, stats, fmt.Errorf("after %d retries: %w", retries, lastErr)
+}
+
+// headUnchanged reports whether a HEAD request shows that the list at api
+// is unchanged since prev was downloaded, so the download can be skipped
+// even if the server ignores conditional requests. The list must have the
+// same ETag or Last-Modified, and the same Content-Length if both are
+// known. Object storage URLs are always downloaded, as their requests are
+// signed for GET.
+func (s *URLIPRange) headUnchanged(api string, prev urlList) bool {
+	if prev.etag == "" && prev.lastModified == "" {
+		return false
+	}
+	if !strings.HasPrefix(api, "http://") && !strings.HasPrefix(api, "https://") {
+		return false
+	}
+	ctx, cancel := s.getContext()
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, api, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return false
+	}
+	if prev.contentLength > 0 && resp.ContentLength > 0 && prev.contentLength != resp.ContentLength {
+		return false
+	}
+	if prev.etag != "" {
+		return resp.Header.Get("ETag") == prev.etag
+	}
+	return resp.Header.Get("Last-Modified") == prev.lastModified
+}
+
+// httpStatusError is the error for an unsuccessful HTTP response.
+type httpStatusError struct {
+	url    string
+	status int
+}
+
+func (e httpStatusError) Error() string {
+	return fmt.Sprintf("fetch %s returned HTTP %d", e.url, e.status)
+}
+
+// parseLine parses a single list entry. Comments start with '#'; ok is
+// false for lines that hold no entry.
+func parseLine(line string) (prefix netip.Prefix, ok bool, err error) {
+	// Remove comments from the line
+	if idx := strings.Index(line, "#"); idx != -1 {
+		line = line[:idx]
+	}
+
+	// Trim spaces
+	line = strings.TrimSpace(line)
+
+	// Skip empty lines
+	if line == "" {
+		return netip.Prefix{}, false, nil
+	}
+
+	// Convert to prefix
+	prefix, err = caddyhttp.CIDRExpressionToPrefix(line)
+	if err != nil {
+		return netip.Prefix{}, false, err
+	}
+	return prefix, true, nil
+}
+
+// parseEntry parses a line of a fetched list like parseLine. Lines that
+// don't match LineFilter are skipped. With Extract, the entry is the
+// captured text of lines that match it. The IP or CIDR may be followed by
+// attributes: ttl=<duration> expires the entry that long after it was
+// fetched. Bare IPs are widened to the prefix lengths of ExpandSingleTo.
+func (s *URLIPRange) parseEntry(line string) (prefix netip.Prefix, ttl time.Duration, ok bool, err error) {
+	if s.lineFilter != nil && !s.lineFilter.MatchString(line) {
+		return netip.Prefix{}, 0, false, nil
+	}
+	if s.extract != nil {
+		match := s.extract.FindStringSubmatch(line)
+		if match == nil {
+			return netip.Prefix{}, 0, false, nil
+		}
+		line = match[s.extractGroup]
+	}
+	entry, _, _ := strings.Cut(line, "#")
+	fields := strings.Fields(entry)
+	if len(fields) == 0 {
+		return netip.Prefix{}, 0, false, nil
+	}
+	prefix, err = caddyhttp.CIDRExpressionToPrefix(fields[0])
+	if err != nil {
+		return netip.Prefix{}, 0, false, err
+	}
+	for _, attr := range fields[1:] {
+		key, value, _ := strings.Cut(attr, "=")
+		switch key {
+		case "ttl":
+			ttl, err = caddy.ParseDuration(value)
+			if err != nil || ttl <= 0 {
+				return netip.Prefix{}, 0, false, fmt.Errorf("invalid ttl %q", value)
+			}
+		default:
+			return netip.Prefix{}, 0, false, fmt.Errorf("unknown attribute %q", attr)
+		}
+	}
+	if bits := s.ExpandSingleTo.of(prefix); bits > 0 && prefix.IsSingleIP() && !strings.Contains(fields[0], "/") {
+		prefix = netip.PrefixFrom(prefix.Addr(), bits).Masked()
+	}
+	return prefix, ttl, true, nil
 }
 
+// parseList parses a newline separated list of IPs and CIDRs.
+func parseList(r io.Reader) ([]netip.Prefix, error) {
+	scanner := bufio.NewScanner(r)
+	var prefixes []netip.Prefix
+	for scanner.Scan() {
+		prefix, ok, err := parseLine(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes, scanner.Err()
+}
+
+// cacheVersion is the version of the cache format. Version 1, which had no
+// version field, only held the combined ranges of all URLs; version 2 holds
+// the ranges and validators of each URL. Later versions may only add
+// fields, so that older releases can still read what they know of.
+const cacheVersion = 2
+
 type cacheFileContents struct {
-    Prefixes  []string  `json:"prefixes"`
-    UpdatedAt time.Time `json:"updated_at"`
+	Version int `json:"version,omitempty"`
+	// Combined ranges of all URLs, as written by version 1.
+	Prefixes []string `json:"prefixes,omitempty"`
+	// Ranges of each URL.
+	URLs map[string]cacheEntry `json:"urls,omitempty"`
+	// Fetch status of each URL, including URLs without ranges.
+	Status map[string]urlStatus `json:"status,omitempty"`
+	// Earlier versions of the ranges, newest first.
+	History   []cacheSnapshot `json:"history,omitempty"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+type cacheEntry struct {
+	Prefixes  []string  `json:"prefixes"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// HTTP validators of the response the prefixes were read from.
+	ETag          string `json:"etag,omitempty"`
+	LastModified  string `json:"last_modified,omitempty"`
+	ContentLength int64  `json:"content_length,omitempty"`
+	// When the prefixes fetched with a ttl expire.
+	Expires map[string]time.Time `json:"expires,omitempty"`
+	// Options the prefixes were filtered with, see filterKey.
+	Filter string `json:"filter,omitempty"`
+}
+
+// urlList is the last good list of a URL.
+type urlList struct {
+	prefixes []netip.Prefix
+	// when the prefixes fetched with a ttl expire
+	expires      map[netip.Prefix]time.Time
+	updated      time.Time
+	etag         string
+	lastModified string
+	// Content-Length of the response, if known
+	contentLength int64
+	// HTTP status of the response
+	status int
+}
+
+// urlStatus describes the fetches of a URL, for the cache and the admin
+// API.
+type urlStatus struct {
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitzero"`
+	// HTTP status of the last response, if any.
+	HTTPStatus int `json:"http_status,omitempty"`
+	// Number of ranges in use from the URL.
+	Entries int `json:"entries"`
+	// Number of fetches that failed since the last success, and when the
+	// first of them failed.
+	Failures     int       `json:"consecutive_failures,omitempty"`
+	FailingSince time.Time `json:"failing_since,omitzero"`
+	// Health of the URL, derived from the above when reported: healthy,
+	// degraded (failing, but its last good ranges are in use) or failed
+	// (failing without ranges in use).
+	Health string `json:"health,omitempty"`
+}
+
+// health returns the health state of a URL with the status.
+func (status urlStatus) health() string {
+	switch {
+	case status.Failures == 0:
+		return "healthy"
+	case status.Entries > 0:
+		return "degraded"
+	default:
+		return "failed"
+	}
+}
+
+// cacheStorage is the part of Caddy's storage (certmagic.Storage) used to
+// share the cache between instances of a cluster.
+type cacheStorage interface {
+	Load(ctx context.Context, key string) ([]byte, error)
+	Store(ctx context.Context, key string, value []byte) error
+	Delete(ctx context.Context, key string) error
+}
+
+// cacheName derives the cache file name from the URLs.
+func (s *URLIPRange) cacheName() string {
+	joined := strings.Join(s.URLs, "|")
+	sum := sha256.Sum256([]byte(joined))
+	return "ip-list-cache-" + hex.EncodeToString(sum[:]) + ".json"
 }
 
 func (s *URLIPRange) cachePath() (string, error) {
-    if s.CacheFile != "" {
-        return s.CacheFile, nil
-    }
-    // derive from URLs
-    joined := strings.Join(s.URLs, "|")
-    sum := sha256.Sum256([]byte(joined))
-    name := "ip-list-cache-" + hex.EncodeToString(sum[:]) + ".json"
-    dir := caddy.AppDataDir()
-    if dir == "" {
-        // fallback to current working directory
-        dir = "."
-    }
-    return filepath.Join(dir, name), nil
-}
-
-func (s *URLIPRange) loadFromCache() ([]netip.Prefix, error) {
-    path, err := s.cachePath()
-    if err != nil {
-        return nil, err
-    }
-    f, err := os.Open(path)
-    if err != nil {
-        return nil, err
-    }
-    defer f.Close()
-    var contents cacheFileContents
-    if err := json.NewDecoder(f).Decode(&contents); err != nil {
-        return nil, err
-    }
-    prefixes := make([]netip.Prefix, 0, len(contents.Prefixes))
-    for _, p := range contents.Prefixes {
-        prefix, err := caddyhttp.CIDRExpressionToPrefix(p)
-        if err != nil {
-            return nil, fmt.Errorf("invalid prefix in cache %q: %w", p, err)
-        }
-        prefixes = append(prefixes, prefix)
-    }
-    return prefixes, nil
-}
-
-func (s *URLIPRange) saveToCache(prefixes []netip.Prefix) error {
-    path, err := s.cachePath()
-    if err != nil {
-        return err
-    }
-    // ensure directory exists
-    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
-        return err
-    }
-    // prepare contents
-    contents := cacheFileContents{UpdatedAt: time.Now()}
-    contents.Prefixes = make([]string, 0, len(prefixes))
-    for _, p := range prefixes {
-        contents.Prefixes = append(contents.Prefixes, p.String())
-    }
-    // write atomically
-    tmp := path + ".tmp"
-    f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
-    if err != nil {
-        return err
-    }
-    enc := json.NewEncoder(f)
-    enc.SetIndent("", "  ")
-    if err := enc.Encode(&contents); err != nil {
-        f.Close()
-        _ = os.Remove(tmp)
-        return err
-    }
-    if err := f.Close(); err != nil {
-        _ = os.Remove(tmp)
-        return err
-    }
-    return os.Rename(tmp, path)
-}
-
-func (s *URLIPRange) getPrefixes() ([]netip.Prefix, error) {
-	var fullPrefixes []netip.Prefix
-	for _, url := range s.URLs {
-		// Fetch list
-		prefixes, err := s.fetch(url)
+	if s.CacheFile != "" {
+		return s.CacheFile, nil
+	}
+	dir := s.CacheDir
+	if dir == "" {
+		dir = caddy.AppDataDir()
+	}
+	if dir == "" {
+		// fallback to current working directory
+		dir = "."
+	}
+	return filepath.Join(dir, s.cacheName()), nil
+}
+
+// cacheKey returns the key of the cache in Caddy's storage.
+func (s *URLIPRange) cacheKey() string {
+	if s.CacheFile != "" {
+		return s.CacheFile
+	}
+	if s.CacheDir != "" {
+		return path.Join(s.CacheDir, s.cacheName())
+	}
+	return path.Join("ip_list", s.cacheName())
+}
+
+// readCache reads the raw cache from storage or from the cache file.
+func (s *URLIPRange) readCache() ([]byte, error) {
+	if s.storage != nil {
+		return s.storage.Load(s.ctx, s.cacheKey())
+	}
+	path, err := s.cachePath()
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// writeCache writes the raw cache to storage or atomically to the cache
+// file.
+func (s *URLIPRange) writeCache(data []byte) error {
+	if s.storage != nil {
+		return s.storage.Store(s.ctx, s.cacheKey(), data)
+	}
+	path, err := s.cachePath()
+	if err != nil {
+		return err
+	}
+	return s.writeFile(path, data)
+}
+
+// writeFile atomically writes a file with the configured modes.
+func (s *URLIPRange) writeFile(path string, data []byte) error {
+	fileMode, dirMode := s.fileMode, s.dirMode
+	if fileMode == 0 {
+		fileMode = 0o644
+	}
+	if dirMode == 0 {
+		dirMode = 0o755
+	}
+	// ensure directory exists
+	if err := os.MkdirAll(filepath.Dir(path), dirMode); err != nil {
+		return err
+	}
+	// write atomically through a temporary file of its own, so that
+	// concurrent writers don't clobber each other's
+	tmp, err := writeTemp(path, data, fileMode, s.CacheSync)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if s.CacheSync {
+		// persist the rename
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// writeTemp writes data to a new temporary file next to path and returns
+// its name. The mode is set explicitly as the umask applies on creation.
+func writeTemp(path string, data []byte, mode os.FileMode, sync bool) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	err = f.Chmod(mode)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil && sync {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+var errCacheDisabled = errors.New("cache is disabled")
+
+// invalidateCache deletes the cache and makes the next refresh download
+// every list, even if it is unchanged.
+func (s *URLIPRange) invalidateCache() error {
+	s.lock.Lock()
+	s.fullFetch = true
+	s.lock.Unlock()
+
+	var err error
+	switch {
+	case s.CacheDisabled:
+		return nil
+	case s.storage != nil:
+		err = s.storage.Delete(s.ctx, s.cacheKey())
+	case s.CacheBackend == "bolt":
+		var path string
+		if path, err = s.boltPath(); err == nil {
+			err = os.Remove(path)
+		}
+	default:
+		var path string
+		if path, err = s.cachePath(); err == nil {
+			err = os.Remove(path)
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// exportRanges writes the ranges in use, one per line, to CacheExport.
+func (s *URLIPRange) exportRanges(ranges []netip.Prefix) {
+	if s.CacheExport == "" {
+		return
+	}
+	var b strings.Builder
+	for _, prefix := range ranges {
+		b.WriteString(prefix.String())
+		b.WriteByte('\n')
+	}
+	if err := s.writeFile(s.CacheExport, []byte(b.String())); err != nil && s.log != nil {
+		s.log.Warn("failed to export IP ranges", zap.String("path", s.CacheExport), zap.Error(err))
+	}
+}
+
+// loadFromCache returns the cached lists by URL and restores the recorded
+// fetch status. A version 1 cache only holds the combined ranges, which are
+// returned under the empty URL; it is migrated by the next save.
+func (s *URLIPRange) loadFromCache() (map[string]urlList, error) {
+	if s.CacheDisabled {
+		return nil, errCacheDisabled
+	}
+	if s.CacheBackend == "bolt" {
+		return s.loadFromBolt()
+	}
+	data, err := s.readCache()
+	if err != nil {
+		return nil, err
+	}
+	contents, err := s.decodeCache(data)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case contents.Version > cacheVersion:
+		if contents.URLs == nil {
+			return nil, fmt.Errorf("unsupported cache version %d", contents.Version)
+		}
+		if s.log != nil {
+			s.log.Info("reading cache written by a newer version",
+				zap.Int("version", contents.Version),
+				zap.Int("supported_version", cacheVersion))
+		}
+	case contents.Version < cacheVersion:
+		// version 1 only holds the combined ranges; a current cache
+		// without URLs holds no ranges at all
+		contents.URLs = map[string]cacheEntry{"": {Prefixes: contents.Prefixes, UpdatedAt: contents.UpdatedAt}}
+	}
+	if s.status == nil && contents.Status != nil {
+		s.status = contents.Status
+	}
+	s.restoreHistory(&contents)
+
+	lists := make(map[string]urlList, len(contents.URLs))
+	filter := s.filterKey()
+	for url, entry := range contents.URLs {
+		if !s.sameFilter(url, entry, filter) {
+			continue
+		}
+		prefixes := make([]netip.Prefix, 0, len(entry.Prefixes))
+		for _, p := range entry.Prefixes {
+			prefix, err := caddyhttp.CIDRExpressionToPrefix(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid prefix in cache %q: %w", p, err)
+			}
+			prefixes = append(prefixes, prefix)
+		}
+		expires, err := parseExpires(entry.Expires)
 		if err != nil {
 			return nil, err
 		}
-		fullPrefixes = append(fullPrefixes, prefixes...)
+		lists[url] = urlList{
+			prefixes:      prefixes,
+			expires:       expires,
+			updated:       entry.UpdatedAt,
+			etag:          entry.ETag,
+			lastModified:  entry.LastModified,
+			contentLength: entry.ContentLength,
+		}
 	}
+	return lists, nil
+}
 
-	return fullPrefixes, nil
+// sameFilter reports whether the cached entry of url was filtered with
+// the options of filter, and may be used.
+func (s *URLIPRange) sameFilter(url string, entry cacheEntry, filter string) bool {
+	if entry.Filter == filter {
+		return true
+	}
+	if s.log != nil {
+		s.log.Info("ignoring cached IP ranges filtered with other options", zap.String("url", url))
+	}
+	return false
 }
 
-func (s *URLIPRange) Provision(ctx caddy.Context) error {
+// usableCache reports whether a cached list may be used in place of a
+// fetch, according to stale_if_error and cache_max_age.
+func (s *URLIPRange) usableCache(url string, list urlList) bool {
+	age := time.Since(list.updated)
+	if s.StaleIfError > 0 && age > time.Duration(s.StaleIfError) {
+		if s.log != nil {
+			s.log.Warn("ignoring cached IP ranges older than stale_if_error",
+				zap.String("url", url),
+				zap.Time("updated_at", list.updated))
+		}
+		return false
+	}
+	if s.CacheMaxAge <= 0 || age <= time.Duration(s.CacheMaxAge) {
+		return true
+	}
+	if !s.CacheMaxAgeWarnOnly {
+		if s.log != nil {
+			s.log.Warn("ignoring cached IP ranges older than cache_max_age",
+				zap.String("url", url),
+				zap.Time("updated_at", list.updated))
+		}
+		return false
+	}
+	if s.log != nil {
+		s.log.Error("using cached IP ranges older than cache_max_age",
+			zap.String("url", url),
+			zap.Time("updated_at", list.updated),
+			zap.Duration("age", age),
+			zap.Duration("cache_max_age", time.Duration(s.CacheMaxAge)))
+	}
+	return true
+}
+
+func (s *URLIPRange) saveToCache() error {
+	if s.CacheDisabled {
+		return nil
+	}
+	if s.CacheBackend == "bolt" {
+		return s.saveToBolt()
+	}
+	// prepare contents
+	contents := cacheFileContents{
+		Version:   cacheVersion,
+		URLs:      make(map[string]cacheEntry, len(s.lists)),
+		Status:    s.status,
+		UpdatedAt: time.Now(),
+	}
+	filter := s.filterKey()
+	for url, list := range s.lists {
+		entry := cacheEntry{
+			Prefixes:      make([]string, 0, len(list.prefixes)),
+			UpdatedAt:     list.updated,
+			ETag:          list.etag,
+			LastModified:  list.lastModified,
+			ContentLength: list.contentLength,
+			Expires:       formatExpires(list.expires),
+			Filter:        filter,
+		}
+		for _, p := range list.prefixes {
+			entry.Prefixes = append(entry.Prefixes, p.String())
+		}
+		contents.URLs[url] = entry
+	}
+	s.recordHistory(&contents)
+	data, err := s.encodeCache(&contents)
+	if err != nil {
+		return err
+	}
+	return s.writeCache(data)
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	// encrypted caches start with this header, followed by the nonce and
+	// the sealed cache
+	aesGCMCacheMagic = []byte("IPLAESGCM1")
+	// signed caches start with this header, followed by the MAC
+	hmacCacheMagic = []byte("IPLHMAC1")
+)
+
+// encodeCache serializes contents, compressing and encrypting them as
+// configured.
+func (s *URLIPRange) encodeCache(contents *cacheFileContents) ([]byte, error) {
+	var data []byte
+	if s.CacheCompression == "gzip" {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if err := json.NewEncoder(zw).Encode(contents); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	} else {
+		b, err := json.MarshalIndent(contents, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		data = append(b, '\n')
+	}
+
+	if s.cipher != nil {
+		nonce := make([]byte, s.cipher.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		sealed := append(bytes.Clone(aesGCMCacheMagic), nonce...)
+		data = s.cipher.Seal(sealed, nonce, data, []byte(s.cacheName()))
+	}
+
+	if s.signingKey != nil {
+		signed := append(bytes.Clone(hmacCacheMagic), s.cacheMAC(data)...)
+		data = append(signed, data...)
+	}
+	return data, nil
+}
+
+// cacheMAC returns the HMAC-SHA256 of the encoded cache, bound to the URLs
+// so that the caches of different lists cannot be swapped.
+func (s *URLIPRange) cacheMAC(data []byte) []byte {
+	mac := hmac.New(sha256.New, s.signingKey)
+	mac.Write([]byte(s.cacheName()))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// decodeCache reverses encodeCache. Encryption and compression are
+// detected from the data, so changing the options does not invalidate
+// an existing cache; an encrypted cache requires the key though.
+func (s *URLIPRange) decodeCache(data []byte) (cacheFileContents, error) {
+	var contents cacheFileContents
+	signed, isSigned := bytes.CutPrefix(data, hmacCacheMagic)
+	if s.signingKey != nil {
+		if !isSigned || len(signed) < sha256.Size {
+			return contents, fmt.Errorf("cache is not signed")
+		}
+		if !hmac.Equal(signed[:sha256.Size], s.cacheMAC(signed[sha256.Size:])) {
+			return contents, fmt.Errorf("cache signature does not verify")
+		}
+	}
+	if isSigned && len(signed) >= sha256.Size {
+		data = signed[sha256.Size:]
+	}
+	if sealed, ok := bytes.CutPrefix(data, aesGCMCacheMagic); ok {
+		if s.cipher == nil {
+			return contents, fmt.Errorf("cache is encrypted but no cache_encryption_key is configured")
+		}
+		if len(sealed) < s.cipher.NonceSize() {
+			return contents, fmt.Errorf("encrypted cache is truncated")
+		}
+		nonce, sealed := sealed[:s.cipher.NonceSize()], sealed[s.cipher.NonceSize():]
+		var err error
+		if data, err = s.cipher.Open(nil, nonce, sealed, []byte(s.cacheName())); err != nil {
+			return contents, fmt.Errorf("decrypting cache: %w", err)
+		}
+	}
+	if bytes.HasPrefix(data, gzipMagic) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return contents, err
+		}
+		if data, err = io.ReadAll(zr); err != nil {
+			return contents, fmt.Errorf("decompressing cache: %w", err)
+		}
+	}
+	err := json.Unmarshal(data, &contents)
+	return contents, err
+}
+
+// cacheSigningKeyName is the storage key of the generated signing key.
+const cacheSigningKeyName = "ip_list/cache_signing.key"
+
+// loadSigningKey returns the signing key kept in storage, generating it on
+// first use.
+func loadSigningKey(ctx context.Context, storage cacheStorage) ([]byte, error) {
+	key, err := storage.Load(ctx, cacheSigningKeyName)
+	if err == nil {
+		if len(key) < 16 {
+			return nil, fmt.Errorf("stored key %s is too short", cacheSigningKeyName)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := storage.Store(ctx, cacheSigningKeyName, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// newCacheCipher returns an AES-GCM cipher for a base64 encoded 128, 192 or
+// 256 bit key.
+func newCacheCipher(key string) (cipher.AEAD, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache_encryption_key: %v", err)
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache_encryption_key: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// refresh fetches every URL. A URL that fails keeps its last good list
+// until it is older than stale_if_error; the returned error joins the
+// failures of URLs that have none. changed counts the lists that were
+// fetched or dropped.
+func (s *URLIPRange) refresh() (changed int, err error) {
+	return s.refreshURLs(true)
+}
+
+// checkDeadline returns an error if the refresh in progress ran past its
+// deadline, in which case url is not fetched: it keeps its previous ranges
+// and stays due.
+func (s *URLIPRange) checkDeadline(url string) error {
+	if s.deadline.IsZero() || time.Now().Before(s.deadline) {
+		return nil
+	}
+	if s.log != nil {
+		s.log.Warn("refresh_deadline exceeded; not fetching IP list", zap.String("url", url))
+	}
+	return fmt.Errorf("%s: refresh_deadline exceeded", url)
+}
+
+// refreshDue fetches the URLs that are due according to their interval,
+// like refresh.
+func (s *URLIPRange) refreshDue() (changed int, err error) {
+	return s.refreshURLs(false)
+}
+
+func (s *URLIPRange) refreshURLs(all bool) (changed int, err error) {
+	s.lock.Lock()
+	full, accept := s.fullFetch, s.acceptShrink
+	s.fullFetch, s.acceptShrink = false, false
+	s.lock.Unlock()
+
+	previous, previousExcluded := maps.Clone(s.lists), maps.Clone(s.excluded)
+	// the updates are only recorded once the lists pass the checks of the
+	// whole refresh below
+	var staged []stagedURL
+	var errs []error
+	now := time.Now()
+	all = all || full
+	s.lastRefresh.Store(now.UnixNano())
+	if s.RefreshDeadline > 0 {
+		s.deadline = now.Add(time.Duration(s.RefreshDeadline))
+		defer func() { s.deadline = time.Time{} }()
+	}
+	for _, url := range s.URLs {
+		if !all && !s.isDue(url, now) {
+			continue
+		}
+		if err := s.checkDeadline(url); err != nil {
+			if _, ok := s.lists[url]; !ok {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		s.scheduleNext(url, now)
+		prev, ok := s.lists[url]
+		if !ok {
+			// revalidate the cached list after a restart
+			prev = s.cached[url]
+		}
+		if full {
+			prev.etag, prev.lastModified = "", ""
+		}
+		list, stats, err := s.fetch(url, prev)
+		if s.ctx.Err() != nil {
+			// cancelled on shutdown, and the lists are released
+			return 0, s.ctx.Err()
+		}
+		parsed := len(list.prefixes)
+		if err == nil {
+			list.prefixes, err = s.filter(url, list.prefixes)
+		}
+		s.logFetch(url, stats, parsed-len(list.prefixes), err)
+		if err == nil && len(list.prefixes) == 0 && !s.AllowEmpty {
+			err = fmt.Errorf("list is empty")
+		}
+		if err == nil {
+			err = s.checkShrink(url, prev, list, accept)
+		}
+		var keep keepPreviousError
+		if errors.As(err, &keep) {
+			if last, ok := s.lists[url]; ok {
+				if s.log != nil {
+					s.log.Error("rejected IP list; keeping last good ranges",
+						zap.String("url", url),
+						zap.Time("updated_at", last.updated),
+						zap.Error(err))
+				}
+				continue
+			}
+			err = keep.err
+		}
+		if err == nil {
+			s.lists[url] = list
+			staged = append(staged, stagedURL{url: url, list: list})
+			changed++
+			continue
+		}
+		failures := s.recordFetch(url, list, err)
+		s.emit("ip_list.failed", map[string]any{"url": url, "error": err.Error()})
+		s.backOff(url, now, err)
+		last, ok := s.lists[url]
+		switch {
+		case !ok:
+			errs = append(errs, err)
+		case s.StaleIfError > 0 && time.Since(last.updated) > time.Duration(s.StaleIfError):
+			delete(s.lists, url)
+			staged = append(staged, stagedURL{url: url, err: err})
+			changed++
+			if s.log != nil {
+				s.log.Error("failed to refresh IP list; dropping ranges older than stale_if_error",
+					zap.String("url", url),
+					zap.Time("updated_at", last.updated),
+					zap.Error(err))
+			}
+		case s.clearsOnFailure(url, failures):
+			delete(s.lists, url)
+			staged = append(staged, stagedURL{url: url, err: err})
+			changed++
+			if s.log != nil {
+				s.log.Error("failed to refresh IP list; clearing ranges after sustained failure",
+					zap.String("url", url),
+					zap.Time("updated_at", last.updated),
+					zap.Int("consecutive_failures", failures),
+					zap.Error(err))
+			}
+		case s.log != nil:
+			// a degraded URL is only logged now and then, instead of
+			// on every failure
+			level := zap.WarnLevel
+			if !s.warnDegraded(url, now) {
+				level = zap.DebugLevel
+			}
+			s.log.Log(level, "failed to refresh IP list; keeping last good ranges",
+				zap.String("url", url),
+				zap.Time("updated_at", last.updated),
+				zap.Int("consecutive_failures", failures),
+				zap.Error(err))
+		}
+	}
+	for _, url := range s.excludeURLs {
+		if !all && !s.isDue(url, now) {
+			continue
+		}
+		if err := s.checkDeadline(url); err != nil {
+			if _, ok := s.excluded[url]; !ok {
+				errs = append(errs, fmt.Errorf("exclude %w", err))
+			}
+			continue
+		}
+		s.scheduleNext(url, now)
+		last, ok := s.excluded[url]
+		list, stats, err := s.fetch(url, last)
+		if s.ctx.Err() != nil {
+			return 0, s.ctx.Err()
+		}
+		s.logFetch(url, stats, 0, err)
+		if err != nil {
+			s.backOff(url, now, err)
+			s.emit("ip_list.failed", map[string]any{"url": url, "error": err.Error()})
+			if !ok {
+				errs = append(errs, fmt.Errorf("exclude %s: %w", url, err))
+			} else if s.log != nil {
+				s.log.Warn("failed to refresh excluded IP list; keeping last good ranges",
+					zap.String("url", url),
+					zap.Time("updated_at", last.updated),
+					zap.Error(err))
+			}
+			continue
+		}
+		s.excluded[url] = list
+		staged = append(staged, stagedURL{url: url, list: list, exclude: true})
+		changed++
+	}
+	if changed > 0 {
+		err := s.checkMemory()
+		if err == nil {
+			err = s.checkCanaries(s.combined())
+		}
+		if err != nil {
+			// keeping only some of the updates could still exceed the
+			// budget, or the lists are implausible as a whole, e.g. a URL
+			// serves another list, so none of the updates are applied
+			s.lists, s.excluded = previous, previousExcluded
+			s.rejectStaged(staged, now, err)
+			return 0, errors.Join(append(errs, err)...)
+		}
+	}
+	s.applyStaged(staged, now)
+	return changed, errors.Join(errs...)
+}
+
+// stagedURL is the update of a URL by a refresh that is only recorded once
+// the lists pass the checks of the whole refresh.
+type stagedURL struct {
+	url string
+	// the list fetched from the URL
+	list    urlList
+	exclude bool
+	// the error the URL failed with, if its last good ranges are dropped
+	err error
+}
+
+// applyStaged records the status and schedule of the URLs updated by a
+// refresh at now, and emits their events.
+func (s *URLIPRange) applyStaged(staged []stagedURL, now time.Time) {
+	for _, update := range staged {
+		if update.err != nil {
+			s.storeBackoff(update.url, now, update.err)
+			s.updateStatus(update.url, func(status *urlStatus) { status.Entries = 0 })
+			continue
+		}
+		if !update.exclude {
+			s.recordFetch(update.url, update.list, nil)
+			delete(s.warned, update.url)
+		}
+		s.backOff(update.url, now, nil)
+		s.emit("ip_list.refreshed", map[string]any{"url": update.url, "count": len(update.list.prefixes)})
+	}
+}
+
+// rejectStaged records the URLs fetched by a refresh at now as failed with
+// err, as the lists they make up were rejected. Dropped ranges are kept.
+func (s *URLIPRange) rejectStaged(staged []stagedURL, now time.Time, err error) {
+	for _, update := range staged {
+		if update.err != nil {
+			continue
+		}
+		if !update.exclude {
+			s.recordFetch(update.url, update.list, err)
+		}
+		s.backOff(update.url, now, err)
+		s.emit("ip_list.failed", map[string]any{"url": update.url, "error": err.Error()})
+	}
+}
+
+// logFetch logs the details of a fetch of url at debug level. filtered is
+// the number of its entries that were filtered out.
+func (s *URLIPRange) logFetch(url string, stats fetchStats, filtered int, err error) {
+	if s.log == nil {
+		return
+	}
+	s.log.Debug("fetched IP list",
+		zap.String("url", url),
+		zap.String("final_url", stats.finalURL),
+		zap.Int("status", stats.status),
+		zap.Int("retries", stats.retries),
+		zap.Int64("bytes", stats.bytes),
+		zap.Duration("parse_duration", stats.parseDuration),
+		zap.Int("entries", stats.parsed),
+		zap.Int("filtered", filtered),
+		zap.Error(err))
+}
+
+// clearsOnFailure reports whether the last good ranges of url, which failed
+// failures consecutive times, are to be dropped per on_sustained_failure.
+func (s *URLIPRange) clearsOnFailure(url string, failures int) bool {
+	if s.OnSustainedFailure != "clear" {
+		return false
+	}
+	if s.ClearAfterFailures > 0 {
+		return failures >= s.ClearAfterFailures
+	}
+	s.lock.RLock()
+	since := s.status[url].FailingSince
+	s.lock.RUnlock()
+	return !since.IsZero() && time.Since(since) >= time.Duration(s.ClearAfter)
+}
+
+// recordFetch updates the fetch status of a URL with the result of a fetch,
+// and returns the number of consecutive failures of the URL.
+func (s *URLIPRange) recordFetch(url string, list urlList, err error) (failures int) {
+	var previous int
+	s.updateStatus(url, func(status *urlStatus) {
+		previous = status.Failures
+		if err == nil {
+			status.LastSuccess = list.updated
+			status.HTTPStatus = list.status
+			status.Entries = len(list.prefixes)
+			status.Failures, status.FailingSince = 0, time.Time{}
+			return
+		}
+		if status.Failures == 0 {
+			status.FailingSince = time.Now()
+		}
+		status.Failures++
+		failures = status.Failures
+		status.LastError = err.Error()
+		status.LastErrorAt = time.Now()
+		status.HTTPStatus = 0
+		var statusErr httpStatusError
+		if errors.As(err, &statusErr) {
+			status.HTTPStatus = statusErr.status
+		}
+	})
+	if err == nil && previous > 0 && s.log != nil {
+		s.log.Info("IP list recovered", zap.String("url", url), zap.Int("failed_fetches", previous))
+	}
+	return failures
+}
+
+func (s *URLIPRange) updateStatus(url string, update func(*urlStatus)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.status == nil {
+		s.status = make(map[string]urlStatus)
+	}
+	status := s.status[url]
+	update(&status)
+	s.status[url] = status
+}
+
+// fetchStatus returns the fetch status of each configured URL.
+func (s *URLIPRange) fetchStatus() map[string]urlStatus {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	out := make(map[string]urlStatus, len(s.URLs))
+	for _, url := range s.URLs {
+		status := s.status[url]
+		status.Health = status.health()
+		out[url] = status
+	}
+	return out
+}
+
+// combined returns the lists of the URLs in order.
+func (s *URLIPRange) combined() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, url := range s.URLs {
+		prefixes = append(prefixes, s.lists[url].prefixes...)
+	}
+	return prefixes
+}
+
+// resolve returns the ranges to provide: the fetched prefixes without the
+// excluded ranges, duplicates and prefixes contained in others, aggregated
+// if enabled, together with the static CIDRs and the NAT64 and IPv4-mapped
+// translations of the IPv4 prefixes, in canonical order.
+func (s *URLIPRange) resolve(fetched []netip.Prefix) []netip.Prefix {
+	exclude := s.excludeStatic
+	for _, url := range s.excludeURLs {
+		exclude = append(exclude[:len(exclude):len(exclude)], s.excluded[url].prefixes...)
+	}
+	if len(exclude) > 0 {
+		fetched = subtractPrefixes(fetched, exclude)
+	}
+	if s.Aggregate {
+		fetched = aggregatePrefixes(fetched)
+	} else {
+		fetched = dedupePrefixes(fetched)
+	}
+	return canonicalPrefixes(s.withEmbedded(s.withStatic(fetched)))
+}
+
+// ipv4Mapped is the prefix of IPv4-mapped IPv6 addresses.
+var ipv4Mapped = netip.MustParsePrefix("::ffff:0:0/96")
+
+// withEmbedded returns prefixes followed by the translations of its IPv4
+// prefixes into the NAT64 prefix and into IPv4-mapped addresses, if
+// configured.
+func (s *URLIPRange) withEmbedded(prefixes []netip.Prefix) []netip.Prefix {
+	var into []netip.Prefix
+	if s.nat64.IsValid() {
+		into = append(into, s.nat64)
+	}
+	if s.MapIPv4 {
+		into = append(into, ipv4Mapped)
+	}
+	if len(into) == 0 {
+		return prefixes
+	}
+	result := slices.Clip(prefixes)
+	for _, p := range prefixes {
+		if !p.Addr().Is4() {
+			continue
+		}
+		for _, embedding := range into {
+			result = append(result, embedIPv4(p, embedding))
+		}
+	}
+	return result
+}
+
+// setup prepares the list for fetching: it validates the cache options,
+// loads the cache keys and parses the inline CIDRs.
+func (s *URLIPRange) setup(ctx caddy.Context) error {
 	s.ctx = ctx
+	s.events = new(atomic.Pointer[listEvents])
+	s.useEvents(ctx)
 	s.lock = new(sync.RWMutex)
-    s.log = ctx.Logger()
-
-	// Perform initial fetch
-    initialRanges, err := s.getPrefixes()
-    if err != nil {
-        // Attempt to load from cache so we can start even when sources are down
-        cached, cacheErr := s.loadFromCache()
-        if cacheErr != nil {
-            return fmt.Errorf("failed to fetch initial IP ranges and no cache available: fetch error: %v, cache error: %v", err, cacheErr)
-        }
-        s.ranges = cached
-        if s.log != nil {
-            s.log.Warn("using cached IP ranges due to fetch failure on startup", zap.Error(err))
-        }
-    } else {
-        s.ranges = initialRanges
-        if err := s.saveToCache(initialRanges); err != nil && s.log != nil {
-            s.log.Warn("failed to save IP ranges cache", zap.Error(err))
-        }
-    }
+	s.lastRefresh, s.refreshPending = new(atomic.Int64), new(atomic.Bool)
+	s.paused, s.resumed = new(atomic.Bool), make(chan struct{}, 1)
+	s.log = ctx.Logger()
+	s.lists = make(map[string]urlList)
+	s.excluded = make(map[string]urlList)
+	s.rollbacks = make(chan rollbackRequest)
+	s.snapshotDiffs = make(chan snapshotDiffRequest)
+	s.refreshes = make(chan refreshRequest)
+	s.shutdown = make(chan struct{})
+	s.stopped = make(chan struct{})
+	switch s.Startup {
+	case "", "blocking", "async":
+	default:
+		return fmt.Errorf("unsupported startup %q", s.Startup)
+	}
+	switch s.OnStartupFailure {
+	case "", "use_cache", "start_empty":
+	case "fail":
+		if s.Startup == "async" {
+			return fmt.Errorf("on_startup_failure fail requires startup blocking")
+		}
+	default:
+		return fmt.Errorf("unsupported on_startup_failure %q", s.OnStartupFailure)
+	}
+	if s.ClearAfter < 0 || s.ClearAfterFailures < 0 {
+		return fmt.Errorf("on_sustained_failure after must not be negative")
+	}
+	switch s.OnSustainedFailure {
+	case "", "keep":
+		if s.ClearAfter != 0 || s.ClearAfterFailures != 0 {
+			return fmt.Errorf("on_sustained_failure after requires clear")
+		}
+	case "clear":
+		if (s.ClearAfter == 0) == (s.ClearAfterFailures == 0) {
+			return fmt.Errorf("on_sustained_failure clear requires either a duration or a number of failures")
+		}
+	default:
+		return fmt.Errorf("unsupported on_sustained_failure %q", s.OnSustainedFailure)
+	}
+	if s.CacheCompression != "" && s.CacheCompression != "gzip" {
+		return fmt.Errorf("unsupported cache_compression %q", s.CacheCompression)
+	}
+	if s.CacheHistory < 0 {
+		return fmt.Errorf("cache_history must not be negative")
+	}
+	if s.CacheFile != "" && s.CacheDir != "" {
+		return fmt.Errorf("cache_file and cache_dir can't be combined")
+	}
+	switch s.CacheBackend {
+	case "", "json":
+	case "bolt":
+		if s.CacheStorage || s.CacheCompression != "" || s.CacheEncryptionKey != "" || s.CacheSign || s.CacheSigningKey != "" || s.CacheHistory != 0 {
+			return fmt.Errorf("cache_backend bolt can't be combined with cache_storage, cache_compression, cache_encryption_key, cache_sign or cache_history")
+		}
+	default:
+		return fmt.Errorf("unsupported cache_backend %q", s.CacheBackend)
+	}
+	for _, mode := range []struct {
+		name  string
+		value string
+		mode  *os.FileMode
+	}{
+		{"cache_file_mode", s.CacheFileMode, &s.fileMode},
+		{"cache_dir_mode", s.CacheDirMode, &s.dirMode},
+	} {
+		if mode.value == "" {
+			continue
+		}
+		m, err := strconv.ParseUint(mode.value, 8, 32)
+		if err != nil || m > 0o777 {
+			return fmt.Errorf("invalid %s %q", mode.name, mode.value)
+		}
+		*mode.mode = os.FileMode(m)
+	}
+	if s.CacheEncryptionKey != "" {
+		aead, err := newCacheCipher(caddy.NewReplacer().ReplaceAll(s.CacheEncryptionKey, ""))
+		if err != nil {
+			return err
+		}
+		s.cipher = aead
+	}
+	if s.CacheStorage {
+		s.storage = ctx.Storage()
+	}
+	if (s.CacheSign || s.CacheSigningKey != "") && !s.CacheDisabled {
+		var err error
+		if s.CacheSigningKey != "" {
+			s.signingKey, err = base64.StdEncoding.DecodeString(strings.TrimSpace(caddy.NewReplacer().ReplaceAll(s.CacheSigningKey, "")))
+			if err == nil && len(s.signingKey) < 16 {
+				err = fmt.Errorf("key must be at least 16 bytes")
+			}
+		} else {
+			s.signingKey, err = loadSigningKey(ctx, ctx.Storage())
+		}
+		if err != nil {
+			return fmt.Errorf("invalid cache_signing_key: %v", err)
+		}
+	}
+
+	for _, cidr := range s.CIDRs {
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(cidr)
+		if err != nil {
+			return err
+		}
+		s.static = append(s.static, prefix)
+	}
+	if err := s.setupFilters(); err != nil {
+		return err
+	}
+	if err := s.setupSchedule(); err != nil {
+		return err
+	}
+	if s.RefreshOn != nil {
+		if err := s.RefreshOn.setup(); err != nil {
+			return err
+		}
+	}
+	for _, exclude := range s.Exclude {
+		if strings.Contains(exclude, "://") {
+			s.excludeURLs = append(s.excludeURLs, exclude)
+			continue
+		}
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(exclude)
+		if err != nil {
+			return fmt.Errorf("invalid exclude %q: %v", exclude, err)
+		}
+		s.excludeStatic = append(s.excludeStatic, prefix)
+	}
+	return nil
+}
+
+// listPool holds the provisioned lists by the hash of their configuration,
+// so identical lists, e.g. the same list in many server blocks, share one
+// fetcher and cache, and a reload reuses the ranges of unchanged lists
+// instead of fetching them again.
+var listPool = caddy.NewUsagePool()
+
+type pooledList struct {
+	list   *URLIPRange
+	cancel context.CancelFunc
+}
+
+// shutdownTimeout is how long a stopping list waits for a refresh in
+// progress to finish before it is cancelled.
+var shutdownTimeout = 10 * time.Second
+
+// Destruct stops the refresh loop of the list and releases the fetched
+// lists. A refresh in progress may finish for up to the shutdown timeout,
+// and is cancelled after that.
+func (l *pooledList) Destruct() error {
+	close(l.list.shutdown)
+	timer := time.NewTimer(shutdownTimeout)
+	defer timer.Stop()
+	select {
+	case <-l.list.stopped:
+	case <-timer.C:
+		if l.list.log != nil {
+			l.list.log.Warn("cancelling IP list refresh in progress on shutdown")
+		}
+	}
+	l.cancel()
+	<-l.list.stopped
+	l.list.release()
+	return nil
+}
+
+func (s *URLIPRange) Provision(ctx caddy.Context) error {
+	config, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(config)
+	key := hex.EncodeToString(sum[:])
+	val, _, err := listPool.LoadOrNew(key, func() (caddy.Destructor, error) {
+		// the list may outlive this config, as a reload keeps lists that
+		// are in the new config too
+		listCtx := ctx
+		var cancel context.CancelFunc
+		listCtx.Context, cancel = context.WithCancel(context.WithoutCancel(ctx))
+		// the ID of the list is known to the first refresh
+		s.poolKey = key
+		if err := s.provision(listCtx); err != nil {
+			cancel()
+			return nil, err
+		}
+		watchSignals()
+		return &pooledList{list: s, cancel: cancel}, nil
+	})
+	if err != nil {
+		return err
+	}
+	s.shared = val.(*pooledList).list
+	s.poolKey = key
+	// a reload reuses the list, which emits through the events app of
+	// the newest config from now on
+	s.shared.useEvents(ctx)
+	return registerMetrics(ctx, s.shared)
+}
+
+// Cleanup releases the shared list, which stops once no list uses it.
+func (s *URLIPRange) Cleanup() error {
+	if s.shared == nil {
+		return nil
+	}
+	_, err := listPool.Delete(s.poolKey)
+	return err
+}
+
+// release drops the lists of a stopped list, which may stay referenced
+// after a reload, and closes the idle connections to the URLs.
+func (s *URLIPRange) release() {
+	s.lists, s.excluded, s.rpkiResults = nil, nil, nil
+	s.lock.Lock()
+	s.origins, s.history = nil, nil
+	s.lock.Unlock()
+	http.DefaultClient.CloseIdleConnections()
+}
+
+func (s *URLIPRange) provision(ctx caddy.Context) error {
+	if err := s.setup(ctx); err != nil {
+		return err
+	}
+
+	// The cache provides validators for conditional requests, and the
+	// ranges of URLs that are down so we can start anyway
+	cached, cacheErr := s.loadFromCache()
+	s.cached = cached
+	s.restoreBackoff()
+
+	if s.Startup == "async" {
+		s.provisionAsync(cached)
+		return nil
+	}
+
+	// Perform initial fetch of the URLs, except those still backing off
+	s.starting = true
+	fetched, err := s.refreshDue()
+	s.starting = false
+	s.cached = nil
+	if err != nil {
+		if s.OnStartupFailure == "fail" {
+			return fmt.Errorf("failed to fetch initial IP ranges: %v", err)
+		}
+		startEmpty := s.OnStartupFailure == "start_empty"
+		for _, url := range s.excludeURLs {
+			if _, ok := s.excluded[url]; ok {
+				continue
+			}
+			// the cache does not hold the excluded ranges, and
+			// providing the ranges without them would trust them
+			if !startEmpty {
+				return fmt.Errorf("failed to fetch initial IP ranges: %v", err)
+			}
+			clear(s.lists)
+			for _, url := range slices.Concat(s.URLs, s.excludeURLs) {
+				s.retrySoon(url)
+			}
+			if s.log != nil {
+				s.log.Error("starting without IP ranges due to fetch failure of excluded ranges on startup", zap.Error(err))
+			}
+			s.publish(s.resolve(nil))
+			s.exportRanges(s.ranges)
+			go s.refreshLoop()
+			return nil
+		}
+		if cacheErr != nil && !startEmpty {
+			return fmt.Errorf("failed to fetch initial IP ranges and no cache available: fetch error: %v, cache error: %v", err, cacheErr)
+		}
+		if legacy, ok := cached[""]; ok && s.usableCache("", legacy) {
+			// the cache only holds the combined ranges
+			s.publish(s.resolve(legacy.prefixes))
+			if s.log != nil {
+				s.log.Warn("using cached IP ranges due to fetch failure on startup", zap.Error(err))
+			}
+			for _, url := range s.URLs {
+				if _, ok := s.lists[url]; !ok {
+					s.retrySoon(url)
+				}
+			}
+			s.exportRanges(s.ranges)
+			go s.refreshLoop()
+			return nil
+		}
+		for _, url := range s.URLs {
+			if _, ok := s.lists[url]; ok {
+				continue
+			}
+			list, ok := cached[url]
+			if !ok || !s.usableCache(url, list) {
+				if !startEmpty {
+					return fmt.Errorf("failed to fetch initial IP ranges and no cache available for %s: fetch error: %v", url, err)
+				}
+				if s.log != nil {
+					s.log.Error("starting without IP ranges due to fetch failure on startup",
+						zap.String("url", url),
+						zap.Error(err))
+				}
+				s.retrySoon(url)
+				continue
+			}
+			s.useCached(url, list)
+			if s.log != nil {
+				s.log.Warn("using cached IP ranges due to fetch failure on startup",
+					zap.String("url", url),
+					zap.Time("updated_at", list.updated))
+			}
+		}
+	}
+	// cached entries may have expired while stopped
+	s.expire(time.Now())
+	s.publish(s.resolve(s.combined()))
+	s.exportRanges(s.ranges)
+	if fetched > 0 {
+		if err := s.saveToCache(); err != nil && s.log != nil {
+			s.log.Warn("failed to save IP ranges cache", zap.Error(err))
+		}
+	}
 
 	// update in background
 	go s.refreshLoop()
 	return nil
 }
 
+// provisionAsync starts with the usable cached ranges, or none, and
+// leaves the initial fetch to the refresh loop.
+func (s *URLIPRange) provisionAsync(cached map[string]urlList) {
+	legacy, hasLegacy := cached[""]
+	switch {
+	case len(s.excludeURLs) > 0:
+		// the cache does not hold the excluded ranges, and providing
+		// the ranges without them would trust them
+	case hasLegacy && s.usableCache("", legacy):
+		// the cache only holds the combined ranges
+		s.publish(s.resolve(legacy.prefixes))
+		for _, url := range s.URLs {
+			s.retrySoon(url)
+		}
+		s.exportRanges(s.ranges)
+		go s.refreshLoop()
+		return
+	default:
+		for _, url := range s.URLs {
+			if _, ok := s.lists[url]; ok {
+				// still backing off from before a reload
+				continue
+			}
+			if list, ok := cached[url]; ok && s.usableCache(url, list) {
+				s.useCached(url, list)
+			}
+		}
+	}
+	// cached entries may have expired while stopped
+	s.expire(time.Now())
+	s.publish(s.resolve(s.combined()))
+	s.exportRanges(s.ranges)
+	go s.refreshLoop()
+}
+
+// useCached uses the cached list of url until it is fetched, retrying
+// the fetch soon.
+func (s *URLIPRange) useCached(url string, list urlList) {
+	s.lists[url] = list
+	s.retrySoon(url)
+	s.updateStatus(url, func(status *urlStatus) {
+		status.LastSuccess = list.updated
+		status.Entries = len(list.prefixes)
+	})
+}
+
+// warm fetches every URL once and writes the cache without starting the
+// refresh loop. Unlike Provision it fails if any URL can't be fetched.
+func (s *URLIPRange) warm(ctx caddy.Context) error {
+	if err := s.setup(ctx); err != nil {
+		return err
+	}
+	if s.CacheDisabled {
+		return errCacheDisabled
+	}
+	// cached validators make this a cheap conditional request when the
+	// cache is already warm
+	s.cached, _ = s.loadFromCache()
+	_, err := s.refresh()
+	s.cached = nil
+	if err != nil {
+		return err
+	}
+	return s.saveToCache()
+}
+
 func (s *URLIPRange) refreshLoop() {
-	if s.Interval == 0 {
-		s.Interval = caddy.Duration(time.Hour)
+	defer close(s.stopped)
+	if s.RefreshOn != nil {
+		go s.watchTrigger()
 	}
-
-	ticker := time.NewTicker(time.Duration(s.Interval))
+	ticker := time.NewTimer(s.untilDue())
+	defer ticker.Stop()
+	expiry := time.NewTimer(time.Duration(s.Interval))
+	defer expiry.Stop()
 	for {
+		// stop rather than start another refresh that is due
+		select {
+		case <-s.shutdown:
+			return
+		default:
+		}
+		s.resetExpiry(expiry)
 		select {
 		case <-ticker.C:
-			fullPrefixes, err := s.getPrefixes()
-			if err != nil {
-                if s.log != nil {
-                    s.log.Warn("failed to refresh IP ranges; keeping existing cache", zap.Error(err))
-                }
-                break
-			}
-
-			s.lock.Lock()
-			s.ranges = fullPrefixes
-			s.lock.Unlock()
-            if err := s.saveToCache(fullPrefixes); err != nil && s.log != nil {
-                s.log.Warn("failed to save IP ranges cache after refresh", zap.Error(err))
-            }
+			if s.paused.Load() {
+				// resuming restarts the ticker
+				break
+			}
+			changed, err := s.refreshDue()
+			// the cache of an async startup was only needed for the
+			// validators of the first fetch
+			s.cached = nil
+			ticker.Reset(s.untilDue())
+			if s.ctx.Err() != nil {
+				return
+			}
+			if err != nil && s.log != nil {
+				s.log.Warn("failed to refresh IP ranges", zap.Error(err))
+			}
+			if changed == 0 {
+				break
+			}
+			s.update()
+		case <-s.resumed:
+			ticker.Reset(s.untilDue())
+		case req := <-s.refreshes:
+			if s.paused.Load() {
+				req.done <- refreshResult{err: fmt.Errorf("refreshes are paused")}
+				break
+			}
+			changed, err := s.refreshNow(req.url)
+			ticker.Reset(s.untilDue())
+			if changed > 0 {
+				s.update()
+			}
+			req.done <- refreshResult{changed: changed, err: err}
+		case <-expiry.C:
+			if s.expire(time.Now()) == 0 {
+				break
+			}
+			ranges := s.resolve(s.combined())
+			s.publish(ranges)
+			s.exportRanges(ranges)
+			if err := s.saveToCache(); err != nil && s.log != nil {
+				s.log.Warn("failed to save IP ranges cache after expiring entries", zap.Error(err))
+			}
+		case req := <-s.rollbacks:
+			req.done <- s.applySnapshot(req.snapshot)
+		case req := <-s.snapshotDiffs:
+			added, removed, err := s.diffSnapshot(req.snapshot)
+			req.done <- snapshotDiffResult{added: added, removed: removed, err: err}
+		case <-s.shutdown:
+			return
 		case <-s.ctx.Done():
-			ticker.Stop()
 			return
 		}
 	}
 }
 
-func (s *URLIPRange) GetIPRanges(_ *http.Request) []netip.Prefix {
+// update publishes the ranges resolved from the refreshed lists and
+// saves them.
+func (s *URLIPRange) update() {
+	ranges := s.resolve(s.combined())
+	s.lock.RLock()
+	previous, origins := s.ranges, s.origins
+	s.lock.RUnlock()
+	s.publish(ranges)
+	if !slices.Equal(previous, ranges) {
+		var changed []string
+		for _, url := range s.URLs {
+			if !slices.Equal(origins[url], s.lists[url].prefixes) {
+				changed = append(changed, url)
+			}
+		}
+		added, removed := diffPrefixes(previous, ranges)
+		if s.log != nil {
+			s.log.Info("IP ranges changed",
+				zap.Strings("urls", changed),
+				zap.Int("count", len(ranges)),
+				zap.Int("added", len(added)),
+				zap.Int("removed", len(removed)),
+				zap.Strings("added_sample", prefixStrings(added[:min(len(added), diffSampleSize)])),
+				zap.Strings("removed_sample", prefixStrings(removed[:min(len(removed), diffSampleSize)])))
+		}
+		s.emit("ip_list.changed", map[string]any{
+			"urls":           changed,
+			"count":          len(ranges),
+			"previous_count": len(previous),
+			"added":          len(added),
+			"removed":        len(removed),
+		})
+	}
+	s.exportRanges(ranges)
+	if err := s.saveToCache(); err != nil && s.log != nil {
+		s.log.Warn("failed to save IP ranges cache after refresh", zap.Error(err))
+	}
+}
+
+// diffSampleSize is the number of added and removed ranges that are logged
+// when the ranges change.
+const diffSampleSize = 10
+
+// withStatic returns the fetched prefixes followed by the static CIDRs.
+func (s *URLIPRange) withStatic(fetched []netip.Prefix) []netip.Prefix {
+	if len(s.static) == 0 {
+		return fetched
+	}
+	return append(append(make([]netip.Prefix, 0, len(fetched)+len(s.static)), fetched...), s.static...)
+}
+
+func (s *URLIPRange) GetIPRanges(r *http.Request) []netip.Prefix {
+	if s.shared != nil && s.shared != s {
+		return s.shared.GetIPRanges(r)
+	}
+	if r != nil {
+		s.addPlaceholder(r)
+	}
+	if s.Refresh == "on_demand" {
+		s.refreshIfStale()
+	}
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 	return s.ranges
 }
 
+// refreshIfStale refreshes the list in the background if its ranges are
+// older than on_demand_max_age, unless a refresh is already pending.
+func (s *URLIPRange) refreshIfStale() {
+	if time.Since(time.Unix(0, s.lastRefresh.Load())) < time.Duration(s.OnDemandMaxAge) {
+		return
+	}
+	if !s.refreshPending.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer s.refreshPending.Store(false)
+		if _, err := s.forceRefresh(""); err != nil && s.log != nil && s.ctx.Err() == nil {
+			s.log.Warn("failed to refresh IP ranges on demand", zap.Error(err))
+		}
+	}()
+}
+
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler.
 //
 //	list {
 //	   interval val
+//	   schedule <cron>
+//	   refresh_window <start>-<end>
+//	   refresh_on <server> <channel>
+//	   head_check
+//	   refresh_deadline val
+//	   refresh interval|on_demand [max_age val]
+//	   interval_jitter <duration|percent%>
+//	   stagger
+//	   max_backoff val
+//	   startup blocking|async
+//	   on_startup_failure fail|use_cache|start_empty
 //	   timeout val
-//	   url string
+//	   startup_timeout val
+//	   startup_retries n
+//	   url string [{
+//	      interval val
+//	   }]
+//	   cidr <cidr...>
+//	   exclude <cidr|url...>
+//	   on_parse_error skip|fail
+//	   max_parse_errors <n|percent%>
+//	   line_filter <regex>
+//	   extract <regex>
+//	   expand_single_to <ipv4> [<ipv6>]
+//	   aggregate
+//	   nat64 [<prefix>]
+//	   map_ipv4
+//	   allow_within <cidr...>
+//	   on_invalid drop|fail|warn
+//	   min_change_guard <percent>
+//	   allow_empty [true|false]
+//	   require_prefix <cidr...>
+//	   strip_private
+//	   reject_private
+//	   strip_bogons
+//	   rpki <validator> <asn...>
+//	   max_entries n [fail|truncate|keep_previous]
+//	   max_memory <size>
+//	   family ipv4|ipv6|both
+//	   min_prefix_len <ipv4> <ipv6>
+//	   max_prefix_len <ipv4> <ipv6>
+//	   stale_if_error val
+//	   on_sustained_failure keep|clear [after <duration>|<n> failures]
+//	   cache off
+//	   cache_file path
+//	   cache_dir path
+//	   cache_export path
+//	   cache_max_age val [warn]
+//	   cache_storage
+//	   cache_backend json|bolt
+//	   cache_compression gzip
+//	   cache_encryption_key key
+//	   cache_file_mode mode
+//	   cache_dir_mode mode
+//	   cache_sync
+//	   cache_history n
+//	   cache_sign [key]
 //	}
 func (m *URLIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	d.Next() // Skip module name.
@@ -329,6 +2243,95 @@ func (m *URLIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return err
 			}
 			m.Interval = caddy.Duration(val)
+		case "schedule":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Schedule = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "refresh":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Refresh = d.Val()
+			for d.NextArg() {
+				if d.Val() != "max_age" || !d.NextArg() {
+					return d.ArgErr()
+				}
+				val, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return err
+				}
+				m.OnDemandMaxAge = caddy.Duration(val)
+			}
+		case "refresh_deadline":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.RefreshDeadline = caddy.Duration(val)
+		case "stagger":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Stagger = true
+		case "head_check":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.HeadCheck = true
+		case "refresh_on":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			m.RefreshOn = &RefreshTrigger{Server: args[0], Channel: args[1]}
+		case "refresh_window":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.RefreshWindow = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "startup":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Startup = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "on_startup_failure":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.OnStartupFailure = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "max_backoff":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.MaxBackoff = caddy.Duration(val)
+		case "interval_jitter":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.IntervalJitter = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
 		case "timeout":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -338,26 +2341,398 @@ func (m *URLIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return err
 			}
 			m.Timeout = caddy.Duration(val)
-		case "retries":
+		case "retries", "startup_retries":
+			option := d.Val()
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
 			var n int
 			_, err := fmt.Sscanf(d.Val(), "%d", &n)
 			if err != nil || n < 0 {
-				return fmt.Errorf("invalid retries value: %s", d.Val())
-			}
-            m.Retries = &n
-        case "cache_file":
-            if !d.NextArg() {
-                return d.ArgErr()
-            }
-            m.CacheFile = d.Val()
+				return fmt.Errorf("invalid %s value: %s", option, d.Val())
+			}
+			if option == "retries" {
+				m.Retries = &n
+			} else {
+				m.StartupRetries = &n
+			}
+		case "startup_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.StartupTimeout = caddy.Duration(val)
+		case "cache":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case "off":
+				m.CacheDisabled = true
+			case "on":
+				m.CacheDisabled = false
+			default:
+				return d.Errf("unknown cache option %q", d.Val())
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "cache_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.CacheFile = d.Val()
+		case "stale_if_error":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.StaleIfError = caddy.Duration(val)
+		case "on_sustained_failure":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.OnSustainedFailure = d.Val()
+			if !d.NextArg() {
+				break
+			}
+			if d.Val() != "after" || !d.NextArg() {
+				return d.ArgErr()
+			}
+			after := d.Val()
+			if d.NextArg() {
+				if d.Val() != "failures" {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(after)
+				if err != nil {
+					return d.Errf("invalid number of failures %q", after)
+				}
+				m.ClearAfterFailures = n
+			} else {
+				val, err := caddy.ParseDuration(after)
+				if err != nil {
+					return err
+				}
+				m.ClearAfter = caddy.Duration(val)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "cache_dir":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.CacheDir = d.Val()
+		case "cache_export":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.CacheExport = d.Val()
+		case "cache_max_age":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.CacheMaxAge = caddy.Duration(val)
+			if d.NextArg() {
+				if d.Val() != "warn" {
+					return d.Errf("unknown cache_max_age option %q", d.Val())
+				}
+				m.CacheMaxAgeWarnOnly = true
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "cache_storage":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.CacheStorage = true
+		case "cache_backend":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.CacheBackend = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "cache_compression":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.CacheCompression = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "cache_encryption_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.CacheEncryptionKey = d.Val()
+		case "cache_file_mode":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.CacheFileMode = d.Val()
+		case "cache_dir_mode":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.CacheDirMode = d.Val()
+		case "cache_history":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid cache_history %q: %v", d.Val(), err)
+			}
+			m.CacheHistory = n
+		case "cache_sync":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.CacheSync = true
+		case "cache_sign":
+			m.CacheSign = true
+			if d.NextArg() {
+				m.CacheSigningKey = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
 		case "url":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			m.URLs = append(m.URLs, d.Val())
+			url := d.Val()
+			m.URLs = append(m.URLs, url)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				if d.Val() != "interval" {
+					return d.Errf("unknown url option %q", d.Val())
+				}
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				val, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return err
+				}
+				if m.URLIntervals == nil {
+					m.URLIntervals = make(map[string]caddy.Duration)
+				}
+				m.URLIntervals[url] = caddy.Duration(val)
+			}
+		case "cidr":
+			cidrs := d.RemainingArgs()
+			if len(cidrs) == 0 {
+				return d.ArgErr()
+			}
+			m.CIDRs = append(m.CIDRs, cidrs...)
+		case "exclude":
+			excludes := d.RemainingArgs()
+			if len(excludes) == 0 {
+				return d.ArgErr()
+			}
+			m.Exclude = append(m.Exclude, excludes...)
+		case "on_parse_error":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.OnParseError = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "max_parse_errors":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.MaxParseErrors = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "line_filter":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.LineFilter = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "extract":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Extract = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "expand_single_to":
+			args := d.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			for i, length := range []*int{&m.ExpandSingleTo.IPv4, &m.ExpandSingleTo.IPv6}[:len(args)] {
+				n, err := strconv.Atoi(args[i])
+				if err != nil {
+					return d.Errf("invalid expand_single_to %q: %v", args[i], err)
+				}
+				*length = n
+			}
+		case "aggregate":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Aggregate = true
+		case "nat64":
+			m.NAT64 = "64:ff9b::/96"
+			if d.NextArg() {
+				m.NAT64 = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "map_ipv4":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.MapIPv4 = true
+		case "allow_within":
+			cidrs := d.RemainingArgs()
+			if len(cidrs) == 0 {
+				return d.ArgErr()
+			}
+			m.AllowWithin = append(m.AllowWithin, cidrs...)
+		case "family":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Family = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "min_prefix_len", "max_prefix_len":
+			name := d.Val()
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			var lengths PrefixLengths
+			for i, length := range []*int{&lengths.IPv4, &lengths.IPv6} {
+				n, err := strconv.Atoi(args[i])
+				if err != nil {
+					return d.Errf("invalid %s %q: %v", name, args[i], err)
+				}
+				*length = n
+			}
+			if name == "min_prefix_len" {
+				m.MinPrefixLen = &lengths
+			} else {
+				m.MaxPrefixLen = lengths
+			}
+		case "max_entries":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_entries %q: %v", d.Val(), err)
+			}
+			m.MaxEntries = n
+			if d.NextArg() {
+				m.MaxEntriesPolicy = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "max_memory":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_memory %q: %v", d.Val(), err)
+			}
+			m.MaxMemory = int64(size)
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "require_prefix":
+			cidrs := d.RemainingArgs()
+			if len(cidrs) == 0 {
+				return d.ArgErr()
+			}
+			m.RequirePrefixes = append(m.RequirePrefixes, cidrs...)
+		case "strip_private":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.StripPrivate = true
+		case "reject_private":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.RejectPrivate = true
+		case "rpki":
+			args := d.RemainingArgs()
+			if len(args) < 2 {
+				return d.ArgErr()
+			}
+			m.RPKI = &RPKIValidation{Validator: args[0]}
+			for _, arg := range args[1:] {
+				asn, err := parseASN(arg)
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				m.RPKI.ASNs = append(m.RPKI.ASNs, asn)
+			}
+		case "strip_bogons":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.StripBogons = true
+		case "allow_empty":
+			m.AllowEmpty = true
+			if d.NextArg() {
+				val, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("invalid allow_empty %q", d.Val())
+				}
+				m.AllowEmpty = val
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "min_change_guard":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(strings.TrimSuffix(d.Val(), "%"))
+			if err != nil {
+				return d.Errf("invalid min_change_guard %q: %v", d.Val(), err)
+			}
+			m.MinChangeGuard = n
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "on_invalid":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.OnInvalid = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
 		default:
 			return d.ArgErr()
 		}
@@ -370,6 +2745,7 @@ func (m *URLIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 var (
 	_ caddy.Module            = (*URLIPRange)(nil)
 	_ caddy.Provisioner       = (*URLIPRange)(nil)
+	_ caddy.CleanerUpper      = (*URLIPRange)(nil)
 	_ caddyfile.Unmarshaler   = (*URLIPRange)(nil)
 	_ caddyhttp.IPRangeSource = (*URLIPRange)(nil)
 )
@@ -1,9 +1,22 @@
 package caddy_ip_list
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"maps"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -169,3 +182,1322 @@ func TestRetriesProvisionAllFail(t *testing.T) {
 		t.Errorf("expected 3 attempts, got %d", hits)
 	}
 }
+
+// TestStartupRetries tests that the initial fetch uses startup_retries
+// and background refreshes use retries.
+func TestStartupRetries(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// every other request fails
+		if hits.Add(1)%2 == 1 {
+			http.Error(w, "fail", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("192.0.2.1/32\n"))
+	}))
+	defer server.Close()
+
+	d := caddyfile.NewTestDispenser(`list {
+		url ` + server.URL + `
+		retries 0
+		startup_retries 1
+		startup_timeout 1m
+		cache off
+	}`)
+	r := URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if *r.StartupRetries != 1 || r.StartupTimeout != caddy.Duration(time.Minute) {
+		t.Errorf("unexpected startup options %d %s", *r.StartupRetries, time.Duration(r.StartupTimeout))
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.setup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	r.starting = true
+	if _, _, err := r.fetch(server.URL, urlList{}); err != nil || hits.Load() != 2 {
+		t.Fatalf("expected the initial fetch to be retried, got %d requests: %v", hits.Load(), err)
+	}
+	r.starting = false
+	if _, _, err := r.fetch(server.URL, urlList{}); err == nil || hits.Load() != 3 {
+		t.Errorf("expected a background refresh without retries, got %d requests: %v", hits.Load(), err)
+	}
+}
+
+// TestInlineCIDRs tests that cidr entries are merged with the fetched
+// ranges but kept out of the cache.
+func TestInlineCIDRs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("192.0.2.1/32\n"))
+	}))
+	defer server.Close()
+
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	input := `
+	list {
+	    url ` + server.URL + `
+	    cidr 10.0.0.0/8 2001:db8::/32
+	    cidr 172.16.0.1
+	    cache_file ` + cacheFile + `
+	}`
+
+	d := caddyfile.NewTestDispenser(input)
+	r := URLIPRange{}
+	err := r.UnmarshalCaddyfile(d)
+	if err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	err = r.Provision(ctx)
+	if err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+
+	var got []string
+	for _, p := range r.GetIPRanges(nil) {
+		got = append(got, p.String())
+	}
+	expected := []string{"10.0.0.0/8", "172.16.0.1/32", "192.0.2.1/32", "2001:db8::/32"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	cached, err := r.loadFromCache()
+	if err != nil {
+		t.Fatalf("loading cache: %v", err)
+	}
+	if list := cached[server.URL].prefixes; len(cached) != 1 || len(list) != 1 || list[0].String() != "192.0.2.1/32" {
+		t.Errorf("cache should only hold fetched ranges, got %v", cached)
+	}
+}
+
+// TestCacheMaxAge tests that caches older than cache_max_age are rejected
+// on startup unless warn is given.
+func TestCacheMaxAge(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "fail", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	data, _ := json.Marshal(cacheFileContents{
+		Prefixes:  []string{"192.0.2.0/24"},
+		UpdatedAt: time.Now().Add(-48 * time.Hour),
+	})
+	if err := os.WriteFile(cacheFile, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		option string
+		ok     bool
+	}{
+		{"cache_max_age 1d", false},
+		{"cache_max_age 1d warn", true},
+		{"cache_max_age 3d", true},
+	} {
+		d := caddyfile.NewTestDispenser(`list {
+			url ` + server.URL + `
+			retries 0
+			cache_file ` + cacheFile + `
+			` + tc.option + `
+		}`)
+		r := URLIPRange{}
+		if err := r.UnmarshalCaddyfile(d); err != nil {
+			t.Fatalf("unmarshal error: %v", err)
+		}
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		err := r.Provision(ctx)
+		cancel()
+		if tc.ok && err != nil {
+			t.Errorf("%s: expected cache to be used, got %v", tc.option, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%s: expected stale cache to be rejected", tc.option)
+		}
+	}
+}
+
+type memoryStorage map[string][]byte
+
+func (m memoryStorage) Load(_ context.Context, key string) ([]byte, error) {
+	data, ok := m[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return data, nil
+}
+
+func (m memoryStorage) Store(_ context.Context, key string, value []byte) error {
+	m[key] = value
+	return nil
+}
+
+func (m memoryStorage) Delete(_ context.Context, key string) error {
+	if _, ok := m[key]; !ok {
+		return fs.ErrNotExist
+	}
+	delete(m, key)
+	return nil
+}
+
+// TestCacheStorage tests that the cache is kept in Caddy's storage when
+// cache_storage is enabled.
+func TestCacheStorage(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`list {
+		url https://example.com/ips
+		cache_storage
+	}`)
+	r := URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if !r.CacheStorage {
+		t.Fatal("expected cache_storage to be set")
+	}
+
+	storage := memoryStorage{}
+	r.storage = storage
+	if _, err := r.loadFromCache(); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected missing cache, got %v", err)
+	}
+	r.lists = map[string]urlList{
+		"https://example.com/ips": {prefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, updated: time.Now()},
+	}
+	if err := r.saveToCache(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := storage[r.cacheKey()]; !ok || !strings.HasPrefix(r.cacheKey(), "ip_list/ip-list-cache-") {
+		t.Errorf("expected cache under key %s, got %v", r.cacheKey(), slices.Collect(maps.Keys(storage)))
+	}
+
+	// another instance with the same URLs shares the cache
+	other := URLIPRange{URLs: r.URLs, storage: storage}
+	cached, err := other.loadFromCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := cached["https://example.com/ips"].prefixes; len(list) != 1 || list[0].String() != "192.0.2.0/24" {
+		t.Errorf("unexpected cached ranges %v", cached)
+	}
+}
+
+// TestCachePerURL tests that a URL failing on startup falls back to its
+// own cached ranges while the other URLs are fetched.
+func TestCachePerURL(t *testing.T) {
+	var down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/a" && !down.Load():
+			w.Write([]byte("192.0.2.0/24\n"))
+		case r.URL.Path == "/a":
+			http.Error(w, "fail", http.StatusInternalServerError)
+		case down.Load():
+			w.Write([]byte("198.51.100.0/24\n"))
+		default:
+			w.Write([]byte("203.0.113.0/24\n"))
+		}
+	}))
+	defer server.Close()
+
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	provision := func() *URLIPRange {
+		t.Helper()
+		d := caddyfile.NewTestDispenser(`list {
+			url ` + server.URL + `/a
+			url ` + server.URL + `/b
+			retries 0
+			cache_file ` + cacheFile + `
+		}`)
+		r := &URLIPRange{}
+		if err := r.UnmarshalCaddyfile(d); err != nil {
+			t.Fatalf("unmarshal error: %v", err)
+		}
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		t.Cleanup(cancel)
+		if err := r.Provision(ctx); err != nil {
+			t.Fatalf("error provisioning: %v", err)
+		}
+		return r
+	}
+
+	provision().Cleanup()
+	down.Store(true)
+	r := provision()
+
+	expected := []string{"192.0.2.0/24", "198.51.100.0/24"}
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, expected) {
+		t.Errorf("expected cached /a and fresh /b, got %v", got)
+	}
+	cached, err := r.loadFromCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := cached[server.URL+"/b"].prefixes; len(list) != 1 || list[0].String() != "198.51.100.0/24" {
+		t.Errorf("expected fresh /b in cache, got %v", cached)
+	}
+}
+
+// TestCacheCompression tests that compressed caches are written with
+// cache_compression and read back transparently.
+func TestCacheCompression(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	d := caddyfile.NewTestDispenser(`list {
+		url https://example.com/ips
+		cache_file ` + cacheFile + `
+		cache_compression gzip
+	}`)
+	r := URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	r.lists = map[string]urlList{
+		"https://example.com/ips": {prefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, updated: time.Now()},
+	}
+	if err := r.saveToCache(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		t.Fatalf("expected gzip data, got %q", data)
+	}
+
+	// loading does not depend on the option
+	plain := URLIPRange{URLs: r.URLs, CacheFile: cacheFile}
+	cached, err := plain.loadFromCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := cached["https://example.com/ips"].prefixes; len(list) != 1 || list[0].String() != "192.0.2.0/24" {
+		t.Errorf("unexpected cached ranges %v", cached)
+	}
+}
+
+// TestCacheEncryption tests that the cache is unreadable without the key.
+func TestCacheEncryption(t *testing.T) {
+	t.Setenv("IP_LIST_CACHE_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	defer server.Close()
+
+	d := caddyfile.NewTestDispenser(`list {
+		url ` + server.URL + `
+		cache_file ` + cacheFile + `
+		cache_compression gzip
+		cache_encryption_key {env.IP_LIST_CACHE_KEY}
+	}`)
+	r := URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+
+	data, err := os.ReadFile(cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, aesGCMCacheMagic) || bytes.Contains(data, []byte("192.0.2.0")) {
+		t.Fatalf("expected encrypted cache, got %q", data)
+	}
+	cached, err := r.loadFromCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := cached[server.URL].prefixes; len(list) != 1 || list[0].String() != "192.0.2.0/24" {
+		t.Errorf("unexpected cached ranges %v", cached)
+	}
+
+	noKey := URLIPRange{URLs: r.URLs, CacheFile: cacheFile}
+	if _, err := noKey.loadFromCache(); err == nil {
+		t.Error("expected encrypted cache to be rejected without key")
+	}
+	wrongKey := URLIPRange{URLs: r.URLs, CacheFile: cacheFile}
+	if wrongKey.cipher, err = newCacheCipher(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrongKey.loadFromCache(); err == nil {
+		t.Error("expected encrypted cache to be rejected with the wrong key")
+	}
+}
+
+// TestCacheModes tests that cache_file_mode and cache_dir_mode are applied.
+func TestCacheModes(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "private", "cache.json")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	defer server.Close()
+
+	d := caddyfile.NewTestDispenser(`list {
+		url ` + server.URL + `
+		cache_file ` + cacheFile + `
+		cache_file_mode 0600
+		cache_dir_mode 0700
+	}`)
+	r := URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	defer r.Cleanup()
+
+	for path, expected := range map[string]os.FileMode{cacheFile: 0o600, filepath.Dir(cacheFile): 0o700} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != expected {
+			t.Errorf("%s: expected mode %o, got %o", path, expected, info.Mode().Perm())
+		}
+	}
+
+	invalid := URLIPRange{CacheFileMode: "rw-------"}
+	if err := invalid.Provision(ctx); err == nil {
+		invalid.Cleanup()
+		t.Error("expected invalid mode to be rejected")
+	}
+}
+
+// TestCacheValidators tests that the first fetch after a restart is a
+// conditional request using the validators stored in the cache.
+func TestCacheValidators(t *testing.T) {
+	var downloads, notModified atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` && r.Header.Get("If-Modified-Since") == "Mon, 02 Jan 2006 15:04:05 GMT" {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	defer server.Close()
+
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	for range 2 {
+		d := caddyfile.NewTestDispenser(`list {
+			url ` + server.URL + `
+			cache_file ` + cacheFile + `
+		}`)
+		r := URLIPRange{}
+		if err := r.UnmarshalCaddyfile(d); err != nil {
+			t.Fatalf("unmarshal error: %v", err)
+		}
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		if err := r.Provision(ctx); err != nil {
+			t.Fatalf("error provisioning: %v", err)
+		}
+		cancel()
+		if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, []string{"192.0.2.0/24"}) {
+			t.Errorf("unexpected ranges %v", got)
+		}
+		r.Cleanup()
+	}
+	if downloads.Load() != 1 || notModified.Load() != 1 {
+		t.Errorf("expected 1 download and 1 revalidation, got %d and %d", downloads.Load(), notModified.Load())
+	}
+}
+
+// TestHeadCheck tests that lists whose server ignores conditional requests
+// are only downloaded again when a HEAD request shows they changed.
+func TestHeadCheck(t *testing.T) {
+	var gets, heads atomic.Int32
+	var modified atomic.Value
+	modified.Store("Mon, 02 Jan 2006 15:04:05 GMT")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+		} else {
+			gets.Add(1)
+		}
+		w.Header().Set("Last-Modified", modified.Load().(string))
+		w.Header().Set("Content-Length", "13")
+		w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	defer server.Close()
+
+	r := URLIPRange{URLs: []string{server.URL}, HeadCheck: true, CacheDisabled: true}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.setup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	list, _, err := r.fetch(server.URL, urlList{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, _, err = r.fetch(server.URL, list); err != nil || len(list.prefixes) != 1 {
+		t.Fatalf("expected the unchanged list, got %v, %v", list.prefixes, err)
+	}
+	if gets.Load() != 1 || heads.Load() != 1 {
+		t.Errorf("expected 1 download and 1 HEAD request, got %d and %d", gets.Load(), heads.Load())
+	}
+
+	modified.Store("Tue, 03 Jan 2006 15:04:05 GMT")
+	if _, _, err := r.fetch(server.URL, list); err != nil {
+		t.Fatal(err)
+	}
+	if gets.Load() != 2 || heads.Load() != 2 {
+		t.Errorf("expected the changed list to be downloaded, got %d downloads and %d HEAD requests", gets.Load(), heads.Load())
+	}
+}
+
+// TestCacheSigning tests that tampered or unsigned caches are refused when
+// signing is enabled.
+func TestCacheSigning(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	r := URLIPRange{URLs: []string{"https://example.com/ips"}, CacheFile: cacheFile, signingKey: bytes.Repeat([]byte{1}, 32)}
+	r.lists = map[string]urlList{
+		"https://example.com/ips": {prefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, updated: time.Now()},
+	}
+	if err := r.saveToCache(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.loadFromCache(); err != nil {
+		t.Fatalf("expected signed cache to load: %v", err)
+	}
+
+	data, err := os.ReadFile(cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Replace(data, []byte("192.0.2.0/24"), []byte("0.0.0.0/0\x20\x20\x20"), 1)
+	if err := os.WriteFile(cacheFile, tampered, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.loadFromCache(); err == nil {
+		t.Error("expected tampered cache to be refused")
+	}
+
+	unsigned := URLIPRange{URLs: r.URLs, CacheFile: cacheFile, lists: r.lists}
+	if err := unsigned.saveToCache(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.loadFromCache(); err == nil {
+		t.Error("expected unsigned cache to be refused")
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	storage := memoryStorage{}
+	key, err := loadSigningKey(context.Background(), storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := loadSigningKey(context.Background(), storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 32 || !bytes.Equal(key, again) {
+		t.Errorf("expected the generated key to be reused, got %x and %x", key, again)
+	}
+}
+
+// TestCacheOff tests that `cache off` skips all cache I/O.
+func TestCacheOff(t *testing.T) {
+	var down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "fail", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	defer server.Close()
+
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	provision := func() error {
+		d := caddyfile.NewTestDispenser(`list {
+			url ` + server.URL + `
+			retries 0
+			cache off
+			cache_file ` + cacheFile + `
+		}`)
+		r := URLIPRange{}
+		if err := r.UnmarshalCaddyfile(d); err != nil {
+			t.Fatalf("unmarshal error: %v", err)
+		}
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		defer cancel()
+		defer r.Cleanup()
+		return r.Provision(ctx)
+	}
+
+	if err := provision(); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	if _, err := os.Stat(cacheFile); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected no cache file, got %v", err)
+	}
+	down.Store(true)
+	if err := provision(); err == nil {
+		t.Error("expected provisioning to fail without cache")
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	var down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "fail", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	defer server.Close()
+
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	newSource := func() *URLIPRange {
+		d := caddyfile.NewTestDispenser(`list {
+			url ` + server.URL + `
+			retries 0
+			interval 10ms
+			stale_if_error 200ms
+			cidr 10.0.0.0/8
+			cache_file ` + cacheFile + `
+		}`)
+		r := &URLIPRange{}
+		if err := r.UnmarshalCaddyfile(d); err != nil {
+			t.Fatalf("unmarshal error: %v", err)
+		}
+		return r
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	r := newSource()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	down.Store(true)
+	time.Sleep(50 * time.Millisecond)
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, []string{"10.0.0.0/8", "192.0.2.0/24"}) {
+		t.Errorf("expected last good ranges, got %v", got)
+	}
+
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got = prefixStrings(r.GetIPRanges(nil)); slices.Equal(got, []string{"10.0.0.0/8"}) {
+			break
+		}
+	}
+	if !slices.Equal(got, []string{"10.0.0.0/8"}) {
+		t.Errorf("expected stale ranges to be dropped, got %v", got)
+	}
+
+	// the expired cache is not used on startup either
+	r.Cleanup()
+	if err := newSource().Provision(ctx); err == nil {
+		t.Error("expected provisioning to fail with a stale cache")
+	}
+}
+
+func TestCacheVersion(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	r := URLIPRange{URLs: []string{"https://example.com/a"}, CacheFile: cacheFile}
+
+	// a newer version is read as far as it is understood
+	newer := `{"version":99,"format_hint":"x","urls":{"https://example.com/a":{"prefixes":["192.0.2.0/24"],"updated_at":"2025-01-01T00:00:00Z","source":"mirror"}}}`
+	if err := os.WriteFile(cacheFile, []byte(newer), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := r.loadFromCache()
+	if err != nil {
+		t.Fatalf("error loading newer cache: %v", err)
+	}
+	if got := prefixStrings(cached["https://example.com/a"].prefixes); !slices.Equal(got, []string{"192.0.2.0/24"}) {
+		t.Errorf("expected cached ranges, got %v", got)
+	}
+
+	// saving migrates a version 1 cache
+	legacy, _ := json.Marshal(cacheFileContents{Prefixes: []string{"198.51.100.0/24"}, UpdatedAt: time.Now()})
+	if err := os.WriteFile(cacheFile, legacy, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if cached, err = r.loadFromCache(); err != nil || len(cached[""].prefixes) != 1 {
+		t.Fatalf("expected legacy ranges, got %v, %v", cached, err)
+	}
+	r.lists = map[string]urlList{"https://example.com/a": cached[""]}
+	if err := r.saveToCache(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(cacheFile)
+	var contents cacheFileContents
+	if err := json.Unmarshal(data, &contents); err != nil {
+		t.Fatal(err)
+	}
+	if contents.Version != cacheVersion || contents.Prefixes != nil || len(contents.URLs) != 1 {
+		t.Errorf("expected migrated cache, got %s", data)
+	}
+
+	// a newer version without per-URL entries is not understood
+	if err := os.WriteFile(cacheFile, []byte(`{"version":99,"lists":[]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.loadFromCache(); err == nil {
+		t.Error("expected unsupported cache version error")
+	}
+}
+
+func TestCacheExport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("192.0.2.0/24\n198.51.100.1\n"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	export := filepath.Join(dir, "lists", "trusted.txt")
+	d := caddyfile.NewTestDispenser(`list {
+		url ` + server.URL + `
+		cidr 10.0.0.0/8
+		cache off
+		cache_export ` + export + `
+		cache_file_mode 0640
+	}`)
+	r := URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+
+	data, err := os.ReadFile(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "10.0.0.0/8\n192.0.2.0/24\n198.51.100.1/32\n"; string(data) != expected {
+		t.Errorf("expected %q, got %q", expected, data)
+	}
+	if info, err := os.Stat(export); err != nil || info.Mode().Perm() != 0o640 {
+		t.Errorf("expected mode 0640, got %v, %v", info, err)
+	}
+}
+
+func TestSharedList(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	defer server.Close()
+
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	provision := func(ctx caddy.Context) *URLIPRange {
+		t.Helper()
+		d := caddyfile.NewTestDispenser(`list {
+			url ` + server.URL + `
+			cache_file ` + cacheFile + `
+		}`)
+		r := &URLIPRange{}
+		if err := r.UnmarshalCaddyfile(d); err != nil {
+			t.Fatalf("unmarshal error: %v", err)
+		}
+		if err := r.Provision(ctx); err != nil {
+			t.Fatalf("error provisioning: %v", err)
+		}
+		return r
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	a, b := provision(ctx), provision(ctx)
+	if requests.Load() != 1 {
+		t.Errorf("expected one fetch for identical lists, got %d", requests.Load())
+	}
+
+	// the list survives a reload that keeps it
+	a.Cleanup()
+	cancel()
+	if got := prefixStrings(b.GetIPRanges(nil)); !slices.Equal(got, []string{"192.0.2.0/24"}) {
+		t.Errorf("expected shared ranges, got %v", got)
+	}
+
+	b.Cleanup()
+	select {
+	case <-a.shared.stopped:
+	default:
+		t.Error("expected the refresh loop to be stopped once the list was released")
+	}
+	ctx, cancel = caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	provision(ctx).Cleanup()
+	if requests.Load() != 2 {
+		t.Errorf("expected a new fetch once the list was released, got %d", requests.Load())
+	}
+}
+
+// TestGracefulShutdown tests that stopping a list waits for a refresh in
+// progress to finish, and cancels it after the shutdown timeout.
+func TestGracefulShutdown(t *testing.T) {
+	defer func(timeout time.Duration) { shutdownTimeout = timeout }(shutdownTimeout)
+
+	var requests atomic.Int32
+	inFlight := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) > 1 {
+			inFlight <- struct{}{}
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	provision := func() *URLIPRange {
+		t.Helper()
+		requests.Store(0)
+		d := caddyfile.NewTestDispenser(`list {
+			url ` + server.URL + `
+			interval 10ms
+			retries 0
+			cache off
+		}`)
+		r := &URLIPRange{}
+		if err := r.UnmarshalCaddyfile(d); err != nil {
+			t.Fatalf("unmarshal error: %v", err)
+		}
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		t.Cleanup(cancel)
+		if err := r.Provision(ctx); err != nil {
+			t.Fatalf("error provisioning: %v", err)
+		}
+		<-inFlight
+		return r
+	}
+	cleanup := func(r *URLIPRange) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			r.Cleanup()
+			close(done)
+		}()
+		return done
+	}
+
+	r := provision()
+	done := cleanup(r)
+	select {
+	case <-done:
+		t.Fatal("expected Cleanup to wait for the refresh in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- struct{}{}
+	<-done
+	if requests.Load() != 2 {
+		t.Errorf("expected the refresh to finish without another one, got %d requests", requests.Load())
+	}
+
+	shutdownTimeout = 10 * time.Millisecond
+	r = provision()
+	select {
+	case <-cleanup(r):
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the refresh in progress to be cancelled after the shutdown timeout")
+	}
+}
+
+func TestFetchStatus(t *testing.T) {
+	var down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("192.0.2.0/24\n198.51.100.0/24\n"))
+	}))
+	defer server.Close()
+
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	d := caddyfile.NewTestDispenser(`list {
+		url ` + server.URL + `
+		retries 0
+		cache_file ` + cacheFile + `
+	}`)
+	r := URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	defer r.Cleanup()
+
+	down.Store(true)
+	if _, err := r.forceRefresh(""); err != nil {
+		t.Fatal(err)
+	}
+	status := r.fetchStatus()[server.URL]
+	if status.LastSuccess.IsZero() || status.Entries != 2 || status.HTTPStatus != http.StatusServiceUnavailable || !strings.Contains(status.LastError, "HTTP 503") {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// the status is kept in the cache
+	if err := r.saveToCache(); err != nil {
+		t.Fatal(err)
+	}
+	restored := URLIPRange{URLs: r.URLs, CacheFile: cacheFile}
+	if _, err := restored.loadFromCache(); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.status[server.URL]; got.LastError != status.LastError || got.Entries != 2 {
+		t.Errorf("expected status from cache, got %+v", got)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := (adminIPList{}).handleLists(rec, httptest.NewRequest(http.MethodGet, "/ip-list/lists", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var lists []struct {
+		URLs map[string]urlStatus `json:"urls"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &lists); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, list := range lists {
+		if got, ok := list.URLs[server.URL]; ok {
+			found = got.HTTPStatus == http.StatusServiceUnavailable
+		}
+	}
+	if !found {
+		t.Errorf("expected list status in %s", rec.Body)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	var down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	defer server.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	r := URLIPRange{URLs: []string{server.URL}, Retries: new(int), CacheDisabled: true}
+	if err := r.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Cleanup()
+	if status := r.fetchStatus()[server.URL]; status.Health != "healthy" {
+		t.Errorf("expected a healthy URL, got %+v", status)
+	}
+
+	down.Store(true)
+	for range 3 {
+		if _, err := r.forceRefresh(""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if status := r.fetchStatus()[server.URL]; status.Health != "degraded" || status.Failures != 3 {
+		t.Errorf("expected a degraded URL after 3 failures, got %+v", status)
+	}
+	// only the first failure is logged as a warning until an hour passed
+	now := time.Now()
+	degraded := URLIPRange{warned: make(map[string]time.Time)}
+	if !degraded.warnDegraded(server.URL, now) {
+		t.Error("expected the first failure of a degraded URL to be logged")
+	}
+	if degraded.warnDegraded(server.URL, now.Add(time.Minute)) {
+		t.Error("expected the failures of a degraded URL not to be logged again")
+	}
+	if !degraded.warnDegraded(server.URL, now.Add(2*time.Hour)) {
+		t.Error("expected the failures of a degraded URL to be logged after an hour")
+	}
+
+	down.Store(false)
+	if _, err := r.forceRefresh(""); err != nil {
+		t.Fatal(err)
+	}
+	if status := r.fetchStatus()[server.URL]; status.Health != "healthy" || status.Failures != 0 {
+		t.Errorf("expected a healthy URL after recovering, got %+v", status)
+	}
+
+	if health := (urlStatus{Failures: 1}).health(); health != "failed" {
+		t.Errorf("expected a failing URL without ranges to be failed, got %s", health)
+	}
+}
+
+func TestOnSustainedFailure(t *testing.T) {
+	var down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	defer server.Close()
+
+	d := caddyfile.NewTestDispenser(`list {
+		url ` + server.URL + `
+		retries 0
+		cache off
+		on_sustained_failure clear after 2 failures
+	}`)
+	r := URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Cleanup()
+
+	down.Store(true)
+	if _, err := r.forceRefresh(""); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.GetIPRanges(nil)) == 0 {
+		t.Error("expected the ranges to be kept after the first failure")
+	}
+	if changed, err := r.forceRefresh(""); err != nil || changed != 1 {
+		t.Fatalf("expected the ranges to be cleared, got %d changes: %v", changed, err)
+	}
+	if status := r.fetchStatus()[server.URL]; status.Health != "failed" || status.FailingSince.IsZero() {
+		t.Errorf("expected a failed URL, got %+v", status)
+	}
+
+	down.Store(false)
+	if _, err := r.forceRefresh(""); err != nil {
+		t.Fatal(err)
+	}
+	if status := r.fetchStatus()[server.URL]; status.Health != "healthy" || !status.FailingSince.IsZero() {
+		t.Errorf("expected a healthy URL, got %+v", status)
+	}
+
+	d = caddyfile.NewTestDispenser(`list {
+		on_sustained_failure clear after 6h
+	}`)
+	parsed := URLIPRange{}
+	if err := parsed.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if parsed.OnSustainedFailure != "clear" || parsed.ClearAfter != caddy.Duration(6*time.Hour) {
+		t.Errorf("unexpected on_sustained_failure %q after %s", parsed.OnSustainedFailure, time.Duration(parsed.ClearAfter))
+	}
+	for _, config := range []string{"on_sustained_failure", "on_sustained_failure clear after", "on_sustained_failure clear after 5 fails", "on_sustained_failure clear before 6h"} {
+		d := caddyfile.NewTestDispenser("list {\n" + config + "\n}")
+		if err := (&URLIPRange{}).UnmarshalCaddyfile(d); err == nil {
+			t.Errorf("expected %q to be rejected", config)
+		}
+	}
+}
+
+func TestCacheSync(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	d := caddyfile.NewTestDispenser(`list {
+		url https://example.com/list
+		cache_file ` + cacheFile + `
+		cache_sync
+	}`)
+	r := URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if !r.CacheSync {
+		t.Fatal("expected cache_sync to be set")
+	}
+	r.lists = map[string]urlList{"https://example.com/list": {prefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, updated: time.Now()}}
+	if err := r.saveToCache(); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := r.loadFromCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached["https://example.com/list"].prefixes) != 1 {
+		t.Errorf("unexpected cache %v", cached)
+	}
+	if tmp, _ := filepath.Glob(cacheFile + ".*.tmp"); len(tmp) > 0 {
+		t.Errorf("expected no temporary file, got %v", tmp)
+	}
+}
+
+// TestConcurrentWrites tests that concurrent writes of a file each write
+// a whole version of it.
+func TestConcurrentWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	r := URLIPRange{}
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := r.writeFile(path, []byte(strings.Repeat(strconv.Itoa(i), 1<<16))); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1<<16 || strings.Trim(string(data), string(data[:1])) != "" {
+		t.Error("expected the file to hold one whole write")
+	}
+	if tmp, _ := filepath.Glob(path + ".*.tmp"); len(tmp) > 0 {
+		t.Errorf("expected no temporary file, got %v", tmp)
+	}
+}
+
+func TestInvalidateCache(t *testing.T) {
+	var downloads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	defer server.Close()
+
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	d := caddyfile.NewTestDispenser(`list {
+		url ` + server.URL + `
+		cache_file ` + cacheFile + `
+	}`)
+	r := URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	defer r.Cleanup()
+
+	rec := httptest.NewRecorder()
+	if err := (adminIPList{}).handleCache(rec, httptest.NewRequest(http.MethodDelete, "/ip-list/cache", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cacheFile); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected cache to be deleted, got %v", err)
+	}
+
+	if _, err := r.forceRefresh(""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.forceRefresh(""); err != nil {
+		t.Fatal(err)
+	}
+	if downloads.Load() != 2 {
+		t.Errorf("expected one full download after invalidation, got %d downloads", downloads.Load())
+	}
+
+	if err := (adminIPList{}).handleCache(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ip-list/cache", nil)); err == nil {
+		t.Error("expected GET to be rejected")
+	}
+}
+
+func TestCacheDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "lists")
+	d := caddyfile.NewTestDispenser(`list {
+		url https://example.com/a
+		cache_dir ` + dir + `
+	}`)
+	r := URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	r.lists = map[string]urlList{"https://example.com/a": {prefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, updated: time.Now()}}
+	if err := r.saveToCache(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, r.cacheName())); err != nil {
+		t.Errorf("expected cache in cache_dir: %v", err)
+	}
+	if key := r.cacheKey(); key != dir+"/"+r.cacheName() {
+		t.Errorf("unexpected storage key %s", key)
+	}
+
+	r = URLIPRange{CacheDir: dir, CacheFile: filepath.Join(dir, "cache.json")}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.setup(ctx); err == nil {
+		t.Error("expected cache_file and cache_dir to be rejected together")
+	}
+}
+
+func TestExclude(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/exclude":
+			w.Write([]byte("192.0.2.128/25\n"))
+		default:
+			w.Write([]byte("10.0.0.0/22\n192.0.2.0/24\n198.51.100.0/24\n"))
+		}
+	}))
+	defer server.Close()
+
+	d := caddyfile.NewTestDispenser(`list {
+		url ` + server.URL + `
+		cidr 10.0.0.0/24
+		exclude 10.0.0.0/24 198.51.100.0/24
+		exclude ` + server.URL + `/exclude
+		cache off
+	}`)
+	r := URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	defer r.Cleanup()
+
+	expected := []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/23", "192.0.2.0/25"}
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	invalid := URLIPRange{URLs: []string{server.URL}, Exclude: []string{"not-a-cidr"}, CacheDisabled: true}
+	if err := invalid.Provision(ctx); err == nil {
+		invalid.Cleanup()
+		t.Error("expected invalid exclude to be rejected")
+	}
+}
+
+func TestStartupAsync(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	d := caddyfile.NewTestDispenser(`list {
+		url ` + server.URL + `
+		startup async
+		cidr 10.0.0.0/8
+		cache off
+	}`)
+	r := &URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	defer r.Cleanup()
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, []string{"10.0.0.0/8"}) {
+		t.Errorf("expected only the static ranges before the first fetch, got %v", got)
+	}
+
+	release <- struct{}{}
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got = prefixStrings(r.GetIPRanges(nil)); len(got) == 2 {
+			break
+		}
+	}
+	if !slices.Equal(got, []string{"10.0.0.0/8", "192.0.2.0/24"}) {
+		t.Errorf("expected the fetched ranges after the first fetch, got %v", got)
+	}
+
+	if err := (&URLIPRange{URLs: []string{server.URL}, Startup: "lazy"}).Provision(ctx); err == nil {
+		t.Error("expected unknown startup to be rejected")
+	}
+}
+
+func TestOnStartupFailure(t *testing.T) {
+	var down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	defer server.Close()
+
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	provision := func(options string) (*URLIPRange, error) {
+		d := caddyfile.NewTestDispenser(`list {
+			url ` + server.URL + `
+			retries 0
+			cidr 10.0.0.0/8
+			` + options + `
+		}`)
+		r := &URLIPRange{}
+		if err := r.UnmarshalCaddyfile(d); err != nil {
+			t.Fatalf("unmarshal error: %v", err)
+		}
+		err := r.Provision(ctx)
+		if err == nil {
+			t.Cleanup(func() { r.Cleanup() })
+		}
+		return r, err
+	}
+
+	if _, err := provision("cache_file " + cacheFile); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	down.Store(true)
+
+	r, err := provision("cache_file " + cacheFile + "\non_startup_failure use_cache")
+	if err != nil {
+		t.Fatalf("expected the cache to be used, got %v", err)
+	}
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, []string{"10.0.0.0/8", "192.0.2.0/24"}) {
+		t.Errorf("expected cached ranges, got %v", got)
+	}
+	if _, err := provision("cache_file " + cacheFile + "\non_startup_failure fail"); err == nil {
+		t.Error("expected on_startup_failure fail to fail despite the cache")
+	}
+	if _, err := provision("cache off"); err == nil {
+		t.Error("expected provisioning to fail without a cache")
+	}
+	r, err = provision("cache off\non_startup_failure start_empty")
+	if err != nil {
+		t.Fatalf("expected to start without ranges, got %v", err)
+	}
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, []string{"10.0.0.0/8"}) {
+		t.Errorf("expected only the static ranges, got %v", got)
+	}
+	if _, err := provision("startup async\non_startup_failure fail"); err == nil {
+		t.Error("expected on_startup_failure fail to be rejected with startup async")
+	}
+}
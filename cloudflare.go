@@ -0,0 +1,264 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(CloudflareIPRange{})
+}
+
+// CloudflareIPRange provides Cloudflare IP ranges through the authenticated
+// API: the edge networks (optionally including the China network) and,
+// for a zone, the IPs of its IP Access Rules.
+type CloudflareIPRange struct {
+	// API token. Supports placeholders such as {env.CF_API_TOKEN}.
+	APIToken string `json:"api_token"`
+	// Zone ID, needed for access rules.
+	ZoneID string `json:"zone_id,omitempty"`
+	// Edge networks to include: "ipv4", "ipv6" and "china". Defaults to
+	// ipv4 and ipv6 unless access rules are included.
+	Networks []string `json:"networks,omitempty"`
+	// Include the IPs of the zone's IP Access Rules with this mode, e.g.
+	// "whitelist" or "block".
+	AccessRules string `json:"access_rules,omitempty"`
+	// Optional override of the API base URL.
+	Endpoint string `json:"endpoint,omitempty"`
+	// refresh Interval
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// request Timeout
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	pollingSource
+}
+
+// CaddyModule returns the Caddy module information.
+func (CloudflareIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.cloudflare",
+		New: func() caddy.Module { return new(CloudflareIPRange) },
+	}
+}
+
+func (s *CloudflareIPRange) Provision(ctx caddy.Context) error {
+	s.APIToken = caddy.NewReplacer().ReplaceAll(s.APIToken, "")
+	if s.APIToken == "" {
+		return fmt.Errorf("api_token is required")
+	}
+	if s.AccessRules != "" && s.ZoneID == "" {
+		return fmt.Errorf("zone_id is required for access rules")
+	}
+	if len(s.Networks) == 0 && s.AccessRules == "" {
+		s.Networks = []string{"ipv4", "ipv6"}
+	}
+	for _, n := range s.Networks {
+		if n != "ipv4" && n != "ipv6" && n != "china" {
+			return fmt.Errorf("unknown network %q", n)
+		}
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = "https://api.cloudflare.com/client/v4"
+	}
+	s.Endpoint = strings.TrimSuffix(s.Endpoint, "/")
+	return s.start(ctx, time.Duration(s.Interval), s.fetch)
+}
+
+func (s *CloudflareIPRange) fetch(ctx context.Context) ([]netip.Prefix, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.Timeout))
+		defer cancel()
+	}
+
+	var cidrs []string
+	if len(s.Networks) > 0 {
+		var out struct {
+			IPv4  []string `json:"ipv4_cidrs"`
+			IPv6  []string `json:"ipv6_cidrs"`
+			China []string `json:"jdcloud_cidrs"`
+		}
+		if _, err := s.call(ctx, "/ips?networks=jdcloud", &out); err != nil {
+			return nil, err
+		}
+		for _, n := range s.Networks {
+			switch n {
+			case "ipv4":
+				cidrs = append(cidrs, out.IPv4...)
+			case "ipv6":
+				cidrs = append(cidrs, out.IPv6...)
+			case "china":
+				cidrs = append(cidrs, out.China...)
+			}
+		}
+	}
+
+	if s.AccessRules != "" {
+		q := url.Values{"mode": {s.AccessRules}, "per_page": {"1000"}}
+		for page := 1; ; page++ {
+			q.Set("page", strconv.Itoa(page))
+			var rules []struct {
+				Configuration struct {
+					Target string `json:"target"`
+					Value  string `json:"value"`
+				} `json:"configuration"`
+			}
+			info, err := s.call(ctx, "/zones/"+url.PathEscape(s.ZoneID)+"/firewall/access_rules/rules?"+q.Encode(), &rules)
+			if err != nil {
+				return nil, err
+			}
+			for _, rule := range rules {
+				switch rule.Configuration.Target {
+				case "ip", "ip6", "ip_range":
+					cidrs = append(cidrs, rule.Configuration.Value)
+				}
+			}
+			if info.TotalPages <= page {
+				break
+			}
+		}
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+type cloudflareResultInfo struct {
+	TotalPages int `json:"total_pages"`
+}
+
+// call performs an API request and decodes the result of the response
+// envelope into v.
+func (s *CloudflareIPRange) call(ctx context.Context, path string, v any) (cloudflareResultInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.Endpoint+path, nil)
+	if err != nil {
+		return cloudflareResultInfo{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.APIToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return cloudflareResultInfo{}, err
+	}
+	defer resp.Body.Close()
+	var envelope struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result     json.RawMessage      `json:"result"`
+		ResultInfo cloudflareResultInfo `json:"result_info"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return cloudflareResultInfo{}, fmt.Errorf("%s returned HTTP %d: %w", path, resp.StatusCode, err)
+	}
+	if !envelope.Success {
+		var errs []error
+		for _, e := range envelope.Errors {
+			errs = append(errs, fmt.Errorf("%d: %s", e.Code, e.Message))
+		}
+		return cloudflareResultInfo{}, fmt.Errorf("cloudflare API error (HTTP %d): %w", resp.StatusCode, errors.Join(errs...))
+	}
+	return envelope.ResultInfo, json.Unmarshal(envelope.Result, v)
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	cloudflare {
+//	   api_token token
+//	   zone_id id
+//	   networks <ipv4|ipv6|china...>
+//	   access_rules mode
+//	   endpoint url
+//	   interval val
+//	   timeout val
+//	}
+func (m *CloudflareIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	// No same-line options are supported
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "api_token":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.APIToken = d.Val()
+		case "zone_id":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ZoneID = d.Val()
+		case "networks":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			m.Networks = append(m.Networks, args...)
+		case "access_rules":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.AccessRules = d.Val()
+		case "endpoint":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Endpoint = d.Val()
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Interval = caddy.Duration(val)
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Timeout = caddy.Duration(val)
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*CloudflareIPRange)(nil)
+	_ caddy.Provisioner       = (*CloudflareIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*CloudflareIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*CloudflareIPRange)(nil)
+)
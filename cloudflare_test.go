@@ -0,0 +1,68 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestCloudflare(t *testing.T) {
+	t.Setenv("CF_API_TOKEN", "cf-token")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer cf-token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"success":false,"errors":[{"code":9109,"message":"Invalid access token"}]}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/ips":
+			w.Write([]byte(`{"success":true,"result":{"ipv4_cidrs":["173.245.48.0/20"],"ipv6_cidrs":["2400:cb00::/32"],"jdcloud_cidrs":["116.196.89.0/24"]}}`))
+		case "/zones/zone123/firewall/access_rules/rules":
+			if r.URL.Query().Get("mode") != "whitelist" {
+				t.Errorf("unexpected mode %q", r.URL.Query().Get("mode"))
+			}
+			if r.URL.Query().Get("page") == "1" {
+				w.Write([]byte(`{"success":true,"result":[{"configuration":{"target":"ip","value":"198.51.100.4"}},{"configuration":{"target":"country","value":"NL"}}],"result_info":{"page":1,"total_pages":2}}`))
+			} else {
+				w.Write([]byte(`{"success":true,"result":[{"configuration":{"target":"ip_range","value":"203.0.113.0/24"}}],"result_info":{"page":2,"total_pages":2}}`))
+			}
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	d := caddyfile.NewTestDispenser(`cloudflare {
+		api_token {env.CF_API_TOKEN}
+		zone_id zone123
+		networks ipv4 china
+		access_rules whitelist
+		endpoint ` + server.URL + `
+	}`)
+	r := CloudflareIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+
+	expected := []string{"173.245.48.0/20", "116.196.89.0/24", "198.51.100.4/32", "203.0.113.0/24"}
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	bad := CloudflareIPRange{APIToken: "wrong", Endpoint: server.URL}
+	if err := bad.Provision(ctx); err == nil || !strings.Contains(err.Error(), "Invalid access token") {
+		t.Errorf("expected API error, got %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package caddy_ip_list
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "ip-list",
+		Short: "Commands for working with IP lists",
+		CobraFunc: func(cmd *cobra.Command) {
+			warmCmd := &cobra.Command{
+				Use:   "warm [--config <path>] [--adapter <name>]",
+				Short: "Fetches all configured IP lists and writes their caches",
+				Long: `
+Loads the config, fetches the URLs of every list source in it and writes
+the list caches, e.g. to bake a warm cache into an image so that startup
+never depends on the network.
+
+Fails if any URL can't be fetched.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdWarm),
+			}
+			warmCmd.Flags().StringP("config", "c", "", "Configuration file")
+			warmCmd.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+			cmd.AddCommand(warmCmd)
+		},
+	})
+}
+
+func cmdWarm(fl caddycmd.Flags) (int, error) {
+	config, _, err := caddycmd.LoadConfig(fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	lists, err := listSources(config)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if len(lists) == 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("no list sources in config")
+	}
+
+	// only the storage is needed from the config, the apps are not started
+	var cfg caddy.Config
+	if err := json.Unmarshal(config, &cfg); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	ctx, err := caddy.ProvisionContext(&caddy.Config{StorageRaw: cfg.StorageRaw})
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	var errs []error
+	for _, list := range lists {
+		if err := list.warm(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", list.URLs, err))
+			continue
+		}
+		caddy.Log().Info("warmed IP list cache", zap.Strings("urls", list.URLs), zap.String("cache", list.cacheKey()))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// listSources returns the list sources anywhere in a JSON config. Identical
+// sources, e.g. the same list used by several servers, are returned once.
+func listSources(config []byte) ([]*URLIPRange, error) {
+	var tree any
+	if err := json.Unmarshal(config, &tree); err != nil {
+		return nil, err
+	}
+	var lists []*URLIPRange
+	seen := make(map[string]bool)
+	var walk func(v any) error
+	walk = func(v any) error {
+		switch v := v.(type) {
+		case map[string]any:
+			if v["source"] == "list" {
+				raw, err := json.Marshal(v)
+				if err != nil {
+					return err
+				}
+				if seen[string(raw)] {
+					return nil
+				}
+				seen[string(raw)] = true
+				list := new(URLIPRange)
+				if err := json.Unmarshal(raw, list); err != nil {
+					return err
+				}
+				lists = append(lists, list)
+				return nil
+			}
+			for _, key := range slices.Sorted(maps.Keys(v)) {
+				if err := walk(v[key]); err != nil {
+					return err
+				}
+			}
+		case []any:
+			for _, child := range v {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return lists, walk(tree)
+}
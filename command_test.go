@@ -0,0 +1,60 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestWarm(t *testing.T) {
+	var down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "fail", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	defer server.Close()
+
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	list := `{"source":"list","url":["` + server.URL + `"],"retries":0,"cache_file":"` + cacheFile + `"}`
+	config := `{"apps":{"http":{"servers":{
+		"a":{"trusted_proxies":` + list + `},
+		"b":{"trusted_proxies":{"source":"union","sources":[` + list + `]}}
+	}}}}`
+	lists, err := listSources([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lists) != 1 || !slices.Equal(lists[0].URLs, []string{server.URL}) {
+		t.Fatalf("expected the list once, got %v", lists)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := lists[0].warm(ctx); err != nil {
+		t.Fatalf("error warming: %v", err)
+	}
+
+	// a cold start with the URL down uses the warmed cache
+	down.Store(true)
+	lists, _ = listSources([]byte(config))
+	if err := lists[0].Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	if got := prefixStrings(lists[0].GetIPRanges(nil)); !slices.Equal(got, []string{"192.0.2.0/24"}) {
+		t.Errorf("expected cached ranges, got %v", got)
+	}
+
+	lists, _ = listSources([]byte(config))
+	if err := lists[0].warm(ctx); err == nil {
+		t.Error("expected warming to fail while the URL is down")
+	}
+}
@@ -0,0 +1,317 @@
+package caddy_ip_list
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(UnionIPRange{})
+	caddy.RegisterModule(DifferenceIPRange{})
+	caddy.RegisterModule(IntersectionIPRange{})
+}
+
+// UnionIPRange provides the combined ranges of several other IP range
+// sources, so static, file and URL sources can be mixed wherever a single
+// source is expected.
+type UnionIPRange struct {
+	// The sources to combine.
+	SourcesRaw []json.RawMessage `json:"sources,omitempty" caddy:"namespace=http.ip_sources inline_key=source"`
+
+	sources []caddyhttp.IPRangeSource
+	memo    *rangeMemo
+}
+
+// CaddyModule returns the Caddy module information.
+func (UnionIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.union",
+		New: func() caddy.Module { return new(UnionIPRange) },
+	}
+}
+
+func (s *UnionIPRange) Provision(ctx caddy.Context) error {
+	sources, err := loadSources(ctx, s, "SourcesRaw")
+	if err != nil {
+		return err
+	}
+	s.sources = sources
+	s.memo = new(rangeMemo)
+	return nil
+}
+
+// GetIPRanges returns the same slice for as long as the ranges of the
+// sources don't change, so a difference or intersection over a union can
+// reuse its result.
+func (s *UnionIPRange) GetIPRanges(r *http.Request) []netip.Prefix {
+	inputs := collectRanges(r, s.sources)
+	return s.memo.get(inputs, func() []netip.Prefix {
+		var prefixes []netip.Prefix
+		for _, ranges := range inputs {
+			prefixes = append(prefixes, ranges...)
+		}
+		return prefixes
+	})
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	union {
+//	   <source> [<args...>] {
+//	      ...
+//	   }
+//	}
+func (m *UnionIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	// No same-line options are supported
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		source, err := unmarshalSource(d)
+		if err != nil {
+			return err
+		}
+		m.SourcesRaw = append(m.SourcesRaw, source)
+	}
+
+	return nil
+}
+
+// DifferenceIPRange provides the ranges of its base sources minus the
+// ranges of its exclude sources. Base prefixes that contain an excluded
+// prefix are split around it, e.g. all Cloudflare ranges except one /24.
+type DifferenceIPRange struct {
+	// The sources to take the ranges from.
+	BaseRaw []json.RawMessage `json:"base,omitempty" caddy:"namespace=http.ip_sources inline_key=source"`
+	// The sources whose ranges are removed.
+	ExcludeRaw []json.RawMessage `json:"exclude,omitempty" caddy:"namespace=http.ip_sources inline_key=source"`
+
+	base    []caddyhttp.IPRangeSource
+	exclude []caddyhttp.IPRangeSource
+	memo    *rangeMemo
+}
+
+// CaddyModule returns the Caddy module information.
+func (DifferenceIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.difference",
+		New: func() caddy.Module { return new(DifferenceIPRange) },
+	}
+}
+
+func (s *DifferenceIPRange) Provision(ctx caddy.Context) error {
+	if len(s.BaseRaw) == 0 {
+		return fmt.Errorf("at least one base source is required")
+	}
+	var err error
+	if s.base, err = loadSources(ctx, s, "BaseRaw"); err != nil {
+		return err
+	}
+	if s.exclude, err = loadSources(ctx, s, "ExcludeRaw"); err != nil {
+		return err
+	}
+	s.memo = new(rangeMemo)
+	return nil
+}
+
+func (s *DifferenceIPRange) GetIPRanges(r *http.Request) []netip.Prefix {
+	inputs := collectRanges(r, s.base, s.exclude)
+	return s.memo.get(inputs, func() []netip.Prefix {
+		var base, exclude []netip.Prefix
+		for i, ranges := range inputs {
+			if i < len(s.base) {
+				base = append(base, ranges...)
+			} else {
+				exclude = append(exclude, ranges...)
+			}
+		}
+		return subtractPrefixes(base, exclude)
+	})
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	difference {
+//	   base <source> [<args...>] {
+//	      ...
+//	   }
+//	   exclude <source> [<args...>] {
+//	      ...
+//	   }
+//	}
+func (m *DifferenceIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	// No same-line options are supported
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "base":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			source, err := unmarshalSource(d)
+			if err != nil {
+				return err
+			}
+			m.BaseRaw = append(m.BaseRaw, source)
+		case "exclude":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			source, err := unmarshalSource(d)
+			if err != nil {
+				return err
+			}
+			m.ExcludeRaw = append(m.ExcludeRaw, source)
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// IntersectionIPRange provides only the address space that is covered by
+// every one of its sources, e.g. "in the vendor list and within our own
+// approved supernets".
+type IntersectionIPRange struct {
+	// The sources to intersect.
+	SourcesRaw []json.RawMessage `json:"sources,omitempty" caddy:"namespace=http.ip_sources inline_key=source"`
+
+	sources []caddyhttp.IPRangeSource
+	memo    *rangeMemo
+}
+
+// CaddyModule returns the Caddy module information.
+func (IntersectionIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.intersection",
+		New: func() caddy.Module { return new(IntersectionIPRange) },
+	}
+}
+
+func (s *IntersectionIPRange) Provision(ctx caddy.Context) error {
+	if len(s.SourcesRaw) < 2 {
+		return fmt.Errorf("at least two sources are required")
+	}
+	sources, err := loadSources(ctx, s, "SourcesRaw")
+	if err != nil {
+		return err
+	}
+	s.sources = sources
+	s.memo = new(rangeMemo)
+	return nil
+}
+
+func (s *IntersectionIPRange) GetIPRanges(r *http.Request) []netip.Prefix {
+	inputs := collectRanges(r, s.sources)
+	return s.memo.get(inputs, func() []netip.Prefix {
+		result := inputs[0]
+		for _, ranges := range inputs[1:] {
+			result = intersectPrefixes(result, ranges)
+		}
+		return result
+	})
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	intersection {
+//	   <source> [<args...>] {
+//	      ...
+//	   }
+//	}
+func (m *IntersectionIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	// No same-line options are supported
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		source, err := unmarshalSource(d)
+		if err != nil {
+			return err
+		}
+		m.SourcesRaw = append(m.SourcesRaw, source)
+	}
+
+	return nil
+}
+
+// collectRanges returns the current ranges of each source, in order.
+func collectRanges(r *http.Request, groups ...[]caddyhttp.IPRangeSource) [][]netip.Prefix {
+	var inputs [][]netip.Prefix
+	for _, sources := range groups {
+		for _, source := range sources {
+			inputs = append(inputs, source.GetIPRanges(r))
+		}
+	}
+	return inputs
+}
+
+// unmarshalSource parses the IP range source module whose name is at the
+// cursor and returns its JSON, the same way trusted_proxies does.
+func unmarshalSource(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	modID := "http.ip_sources." + d.Val()
+	unm, err := caddyfile.UnmarshalModule(d, modID)
+	if err != nil {
+		return nil, err
+	}
+	source, ok := unm.(caddyhttp.IPRangeSource)
+	if !ok {
+		return nil, d.Errf("module %s (%T) is not an IP range source", modID, unm)
+	}
+	return caddyconfig.JSONModuleObject(
+		source,
+		"source",
+		source.(caddy.Module).CaddyModule().ID.Name(),
+		nil,
+	), nil
+}
+
+// loadSources loads the IP range source modules of the given field.
+func loadSources(ctx caddy.Context, structPointer any, fieldName string) ([]caddyhttp.IPRangeSource, error) {
+	mods, err := ctx.LoadModule(structPointer, fieldName)
+	if err != nil {
+		return nil, fmt.Errorf("loading IP range sources: %v", err)
+	}
+	var sources []caddyhttp.IPRangeSource
+	for _, mod := range mods.([]any) {
+		sources = append(sources, mod.(caddyhttp.IPRangeSource))
+	}
+	return sources, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*UnionIPRange)(nil)
+	_ caddy.Provisioner       = (*UnionIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*UnionIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*UnionIPRange)(nil)
+
+	_ caddy.Module            = (*DifferenceIPRange)(nil)
+	_ caddy.Provisioner       = (*DifferenceIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*DifferenceIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*DifferenceIPRange)(nil)
+
+	_ caddy.Module            = (*IntersectionIPRange)(nil)
+	_ caddy.Provisioner       = (*IntersectionIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*IntersectionIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*IntersectionIPRange)(nil)
+)
@@ -0,0 +1,119 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// provisionSource unmarshals and provisions a composition source and
+// returns its ranges as strings.
+func provisionSource(t *testing.T, source interface {
+	caddyfile.Unmarshaler
+	caddy.Provisioner
+	caddyhttp.IPRangeSource
+}, input string) []string {
+	t.Helper()
+	if err := source.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := source.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	var got []string
+	for _, p := range source.GetIPRanges(nil) {
+		got = append(got, p.String())
+	}
+	slices.Sort(got)
+	return got
+}
+
+func TestUnion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("203.0.113.0/24\n"))
+	}))
+	defer server.Close()
+
+	got := provisionSource(t, &UnionIPRange{}, `
+	union {
+		static 10.0.0.0/8 192.168.0.0/16
+		list {
+			url `+server.URL+`
+			cache_file `+filepath.Join(t.TempDir(), "cache.json")+`
+		}
+	}`)
+
+	expected := []string{"10.0.0.0/8", "192.168.0.0/16", "203.0.113.0/24"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestUnionRejectsUnknownSource(t *testing.T) {
+	err := (&UnionIPRange{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`
+	union {
+		nonexistent 10.0.0.0/8
+	}`))
+	if err == nil {
+		t.Errorf("expected error for unknown source module")
+	}
+}
+
+func TestDifference(t *testing.T) {
+	got := provisionSource(t, &DifferenceIPRange{}, `
+	difference {
+		base static 10.0.0.0/22 192.0.2.0/24
+		exclude static 10.0.0.0/24
+		exclude static 192.0.2.0/24
+	}`)
+
+	expected := []string{"10.0.1.0/24", "10.0.2.0/23"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestIntersection(t *testing.T) {
+	got := provisionSource(t, &IntersectionIPRange{}, `
+	intersection {
+		static 104.16.0.0/13 172.64.0.0/13 198.51.100.0/24
+		static 104.16.0.0/12 198.51.100.0/25
+	}`)
+
+	expected := []string{"104.16.0.0/13", "198.51.100.0/25"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestMemoOverUnion(t *testing.T) {
+	source := &DifferenceIPRange{}
+	got := provisionSource(t, source, `
+	difference {
+		base union {
+			static 10.0.0.0/22
+			static 192.0.2.0/24
+		}
+		exclude static 10.0.0.0/24
+	}`)
+	expected := []string{"10.0.1.0/24", "10.0.2.0/23", "192.0.2.0/24"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// the union returns the same slice while its sources don't change, so
+	// the difference is not computed again
+	first, second := source.GetIPRanges(nil), source.GetIPRanges(nil)
+	if len(first) == 0 || &first[0] != &second[0] {
+		t.Error("expected the difference over a union to be reused")
+	}
+}
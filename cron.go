@@ -0,0 +1,135 @@
+package caddy_ip_list
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed cron expression with the standard five fields:
+// minute, hour, day of month, month and day of week. Each field holds a
+// bit per value it matches. Schedules are evaluated in UTC.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// whether the day fields are restricted; if both are, a day matches
+	// either of them, as in cron
+	domRestricted, dowRestricted bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a cron expression such as "0 3 * * *", or one of the
+// macros like @daily.
+func parseCron(expr string) (*cronSchedule, error) {
+	if macro, ok := cronMacros[expr]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: expected 5 fields, got %d", expr, len(fields))
+	}
+	var c cronSchedule
+	var err error
+	for i, field := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	} {
+		if *field.bits, err = parseCronField(fields[i], field.min, field.max); err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %v", expr, err)
+		}
+	}
+	// 7 is Sunday too
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domRestricted = fields[2] != "*"
+	c.dowRestricted = fields[4] != "*"
+	if c.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("invalid schedule %q: never runs", expr)
+	}
+	return &c, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and
+// steps, such as "*/15" or "1-5,10", into a bit per matched value.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		span, stepText, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", item)
+			}
+		}
+		low, high := min, max
+		if span != "*" {
+			lowText, highText, isRange := strings.Cut(span, "-")
+			var err error
+			if low, err = strconv.Atoi(lowText); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", item)
+			}
+			high = low
+			if isRange {
+				if high, err = strconv.Atoi(highText); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", item)
+				}
+			} else if hasStep {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("%q out of range %d-%d", item, min, max)
+		}
+		for value := low; value <= high; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first time after t that matches the schedule, or the
+// zero time if there is none within five years.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case c.month&(1<<t.Month()) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<t.Hour()) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<t.Weekday()) != 0
+	if c.domRestricted && c.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
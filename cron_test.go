@@ -0,0 +1,69 @@
+package caddy_ip_list
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestCronNext(t *testing.T) {
+	// a Wednesday
+	from := time.Date(2024, time.January, 10, 12, 30, 15, 0, time.UTC)
+	for _, test := range []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"0 3 * * *", time.Date(2024, time.January, 11, 3, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, time.January, 10, 12, 45, 0, 0, time.UTC)},
+		{"30 12 * * *", time.Date(2024, time.January, 11, 12, 30, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 6 * * 1-5", time.Date(2024, time.January, 11, 6, 0, 0, 0, time.UTC)},
+		{"0 6 * * 7", time.Date(2024, time.January, 14, 6, 0, 0, 0, time.UTC)},
+		// either day field matches when both are restricted
+		{"0 0 20 * 5", time.Date(2024, time.January, 12, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, time.January, 10, 13, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2024, time.January, 14, 0, 0, 0, 0, time.UTC)},
+	} {
+		c, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("%q: %v", test.expr, err)
+			continue
+		}
+		if next := c.next(from); !next.Equal(test.expected) {
+			t.Errorf("%q: expected %s, got %s", test.expr, test.expected, next)
+		}
+	}
+
+	for _, expr := range []string{"", "0 3 * *", "60 * * * *", "0 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *", "0 0 30 2 *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("expected %q to be rejected", expr)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`list {
+		url https://example.com/list.txt
+		schedule "0 3 * * *"
+	}`)
+	r := &URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if err := r.setupSchedule(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, time.January, 10, 2, 0, 0, 0, time.UTC)
+	r.scheduleNext(r.URLs[0], now)
+	if due := r.due[r.URLs[0]]; !due.Equal(now.Add(time.Hour)) {
+		t.Errorf("expected the URL to be due at 03:00, got %s", due)
+	}
+
+	r = &URLIPRange{Schedule: "0 3 * * *", Interval: caddy.Duration(time.Hour)}
+	if err := r.setupSchedule(); err == nil {
+		t.Error("expected interval and schedule together to be rejected")
+	}
+}
@@ -0,0 +1,227 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(CrowdSecIPRange{})
+}
+
+// CrowdSecIPRange provides the IPs and ranges of active CrowdSec decisions,
+// consumed from the Local API decision stream like a bouncer: the first
+// request fetches all decisions (startup=true) and later requests only
+// fetch the decisions added or deleted since.
+type CrowdSecIPRange struct {
+	// URL of the Local API, e.g. http://127.0.0.1:8080.
+	URL string `json:"url"`
+	// Bouncer API key (cscli bouncers add). Supports placeholders such as
+	// {env.CROWDSEC_API_KEY}.
+	APIKey string `json:"api_key"`
+	// Decision type to include. Default is "ban".
+	Type string `json:"type,omitempty"`
+	// Only include decisions from these origins, e.g. "crowdsec",
+	// "cscli" or "CAPI". Default is all origins.
+	Origins []string `json:"origins,omitempty"`
+	// refresh Interval. Default is 10s.
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// request Timeout
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Holds the prefix of each active decision. Overlapping decisions of
+	// the same value are kept apart by their ID, so the value stays listed
+	// until the last of them is deleted.
+	decisions map[crowdSecKey]netip.Prefix
+	started   bool
+	pollingSource
+}
+
+// CaddyModule returns the Caddy module information.
+func (CrowdSecIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.crowdsec",
+		New: func() caddy.Module { return new(CrowdSecIPRange) },
+	}
+}
+
+func (s *CrowdSecIPRange) Provision(ctx caddy.Context) error {
+	s.APIKey = caddy.NewReplacer().ReplaceAll(s.APIKey, "")
+	if s.URL == "" || s.APIKey == "" {
+		return fmt.Errorf("url and api_key are required")
+	}
+	s.URL = strings.TrimSuffix(s.URL, "/")
+	if s.Type == "" {
+		s.Type = "ban"
+	}
+	if s.Interval == 0 {
+		s.Interval = caddy.Duration(10 * time.Second)
+	}
+	s.decisions = make(map[crowdSecKey]netip.Prefix)
+	return s.start(ctx, time.Duration(s.Interval), s.fetch)
+}
+
+type crowdSecDecision struct {
+	ID    int64  `json:"id"`
+	Scope string `json:"scope"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type crowdSecKey struct {
+	value string
+	id    int64
+}
+
+// accepts reports whether d is a decision of the configured type for an
+// IP or a range.
+func (s *CrowdSecIPRange) accepts(d crowdSecDecision) bool {
+	if !strings.EqualFold(d.Type, s.Type) {
+		return false
+	}
+	scope := strings.ToLower(d.Scope)
+	return scope == "ip" || scope == "range"
+}
+
+func (s *CrowdSecIPRange) fetch(ctx context.Context) ([]netip.Prefix, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.Timeout))
+		defer cancel()
+	}
+
+	q := url.Values{
+		"startup": {strconv.FormatBool(!s.started)},
+		"scopes":  {"ip,range"},
+	}
+	if len(s.Origins) > 0 {
+		q.Set("origins", strings.Join(s.Origins, ","))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+"/v1/decisions/stream?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Api-Key", s.APIKey)
+	var out struct {
+		New     []crowdSecDecision `json:"new"`
+		Deleted []crowdSecDecision `json:"deleted"`
+	}
+	if err := getJSON(req, &out); err != nil {
+		return nil, err
+	}
+	s.started = true
+
+	for _, d := range out.Deleted {
+		if s.accepts(d) {
+			delete(s.decisions, crowdSecKey{d.Value, d.ID})
+		}
+	}
+	for _, d := range out.New {
+		if !s.accepts(d) {
+			continue
+		}
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(d.Value)
+		if err != nil {
+			continue
+		}
+		s.decisions[crowdSecKey{d.Value, d.ID}] = prefix
+	}
+
+	byValue := make(map[string]netip.Prefix, len(s.decisions))
+	for key, prefix := range s.decisions {
+		byValue[key.value] = prefix
+	}
+	prefixes := make([]netip.Prefix, 0, len(byValue))
+	for _, value := range slices.Sorted(maps.Keys(byValue)) {
+		prefixes = append(prefixes, byValue[value])
+	}
+	return prefixes, nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	crowdsec <url> {
+//	   api_key key
+//	   type ban|captcha|...
+//	   origins <origin...>
+//	   interval val
+//	   timeout val
+//	}
+func (m *CrowdSecIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	if d.NextArg() {
+		m.URL = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "url":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.URL = d.Val()
+		case "api_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.APIKey = d.Val()
+		case "type":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Type = d.Val()
+		case "origins":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			m.Origins = append(m.Origins, args...)
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Interval = caddy.Duration(val)
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Timeout = caddy.Duration(val)
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*CrowdSecIPRange)(nil)
+	_ caddy.Provisioner       = (*CrowdSecIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*CrowdSecIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*CrowdSecIPRange)(nil)
+)
@@ -0,0 +1,74 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestCrowdSec(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/decisions/stream" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get("X-Api-Key") != "bouncer-key" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Query().Get("startup") == "true" {
+			w.Write([]byte(`{"new":[
+				{"id":1,"scope":"Ip","type":"ban","value":"192.0.2.10","origin":"crowdsec"},
+				{"id":2,"scope":"Range","type":"ban","value":"198.51.100.0/24","origin":"CAPI"},
+				{"id":3,"scope":"Ip","type":"captcha","value":"192.0.2.11","origin":"crowdsec"},
+				{"id":4,"scope":"Country","type":"ban","value":"XX","origin":"cscli"},
+				{"id":5,"scope":"Ip","type":"ban","value":"192.0.2.12","origin":"crowdsec"},
+				{"id":6,"scope":"Ip","type":"ban","value":"192.0.2.12","origin":"cscli"},
+				{"id":7,"scope":"Ip","type":"ban","value":"192.0.2.13","origin":"crowdsec"},
+				{"id":8,"scope":"Ip","type":"captcha","value":"192.0.2.13","origin":"crowdsec"}
+			],"deleted":null}`))
+			return
+		}
+		w.Write([]byte(`{"new":[{"id":9,"scope":"Ip","type":"ban","value":"2001:db8::10","origin":"crowdsec"}],
+			"deleted":[
+				{"id":1,"scope":"Ip","type":"ban","value":"192.0.2.10","origin":"crowdsec"},
+				{"id":5,"scope":"Ip","type":"ban","value":"192.0.2.12","origin":"crowdsec"},
+				{"id":8,"scope":"Ip","type":"captcha","value":"192.0.2.13","origin":"crowdsec"}
+			]}`))
+	}))
+	defer server.Close()
+
+	d := caddyfile.NewTestDispenser(`crowdsec ` + server.URL + ` {
+		api_key bouncer-key
+		interval 1h
+	}`)
+	r := CrowdSecIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+
+	expected := []string{"192.0.2.10/32", "192.0.2.12/32", "192.0.2.13/32", "198.51.100.0/24"}
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	prefixes, err := r.fetch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the other decision of 192.0.2.12 and the ban of 192.0.2.13 are
+	// still active
+	expected = []string{"192.0.2.12/32", "192.0.2.13/32", "198.51.100.0/24", "2001:db8::10/128"}
+	if got := prefixStrings(prefixes); !slices.Equal(got, expected) {
+		t.Errorf("expected %v after delta, got %v", expected, got)
+	}
+}
@@ -0,0 +1,328 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(EC2IPRange{})
+}
+
+// EC2IPRange provides the CIDRs of AWS managed prefix lists and of the
+// inbound rules of security groups, so Caddy and the VPC firewall share a
+// single source of truth. Requests are signed with the default AWS
+// credential chain of the SDK (environment, shared config, web identity,
+// ECS or instance role), which needs ec2:GetManagedPrefixListEntries and/or
+// ec2:DescribeSecurityGroupRules.
+type EC2IPRange struct {
+	// Managed prefix list IDs (pl-...) to include the entries of.
+	PrefixLists []string `json:"prefix_lists,omitempty"`
+	// Security group IDs (sg-...) to include the inbound rule CIDRs of.
+	// Rules that reference a managed prefix list include its entries.
+	SecurityGroups []string `json:"security_groups,omitempty"`
+	// Only include security group rules that allow this TCP port, e.g.
+	// 443, so unrelated rules (such as SSH) are left out.
+	Port int `json:"port,omitempty"`
+	// AWS region. Defaults to AWS_REGION or AWS_DEFAULT_REGION.
+	Region string `json:"region,omitempty"`
+	// Optional override of the EC2 API endpoint.
+	Endpoint string `json:"endpoint,omitempty"`
+	// refresh Interval
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// request Timeout
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	credentials aws.CredentialsProvider
+
+	pollingSource
+}
+
+// CaddyModule returns the Caddy module information.
+func (EC2IPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.ec2",
+		New: func() caddy.Module { return new(EC2IPRange) },
+	}
+}
+
+func (s *EC2IPRange) Provision(ctx caddy.Context) error {
+	if len(s.PrefixLists) == 0 && len(s.SecurityGroups) == 0 {
+		return fmt.Errorf("at least one prefix list or security group is required")
+	}
+	cfg, err := awsConfig()
+	if err != nil {
+		return fmt.Errorf("loading AWS config: %w", err)
+	}
+	s.credentials = cfg.Credentials
+	if s.Region == "" {
+		s.Region = awsRegion(cfg)
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = "https://ec2." + s.Region + ".amazonaws.com"
+	}
+	s.Endpoint = strings.TrimSuffix(s.Endpoint, "/")
+	return s.start(ctx, time.Duration(s.Interval), s.fetch)
+}
+
+func (s *EC2IPRange) fetch(ctx context.Context) ([]netip.Prefix, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.Timeout))
+		defer cancel()
+	}
+
+	var cidrs []string
+	lists := append([]string(nil), s.PrefixLists...)
+	if len(s.SecurityGroups) > 0 {
+		rules, err := s.securityGroupRules(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			if rule.IsEgress || !rule.allowsPort(s.Port) {
+				continue
+			}
+			switch {
+			case rule.CIDRv4 != "":
+				cidrs = append(cidrs, rule.CIDRv4)
+			case rule.CIDRv6 != "":
+				cidrs = append(cidrs, rule.CIDRv6)
+			case rule.PrefixListID != "":
+				lists = append(lists, rule.PrefixListID)
+			}
+		}
+	}
+	for _, id := range lists {
+		entries, err := s.prefixListEntries(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", id, err)
+		}
+		cidrs = append(cidrs, entries...)
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// emptySHA256 is the hex encoded SHA-256 of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type ec2SecurityGroupRule struct {
+	IsEgress     bool   `xml:"isEgress"`
+	Protocol     string `xml:"ipProtocol"`
+	FromPort     int    `xml:"fromPort"`
+	ToPort       int    `xml:"toPort"`
+	CIDRv4       string `xml:"cidrIpv4"`
+	CIDRv6       string `xml:"cidrIpv6"`
+	PrefixListID string `xml:"prefixListId"`
+}
+
+// allowsPort reports whether the rule allows TCP traffic to port. A port
+// of 0 matches every rule.
+func (r ec2SecurityGroupRule) allowsPort(port int) bool {
+	switch {
+	case port == 0 || r.Protocol == "-1":
+		return true
+	case r.Protocol != "tcp" && r.Protocol != "6":
+		return false
+	default:
+		return r.FromPort <= port && port <= r.ToPort
+	}
+}
+
+func (s *EC2IPRange) securityGroupRules(ctx context.Context) ([]ec2SecurityGroupRule, error) {
+	params := url.Values{
+		"Action":        {"DescribeSecurityGroupRules"},
+		"Filter.1.Name": {"group-id"},
+		"MaxResults":    {"1000"},
+	}
+	for i, id := range s.SecurityGroups {
+		params.Set("Filter.1.Value."+strconv.Itoa(i+1), id)
+	}
+
+	var rules []ec2SecurityGroupRule
+	for {
+		var out struct {
+			Rules     []ec2SecurityGroupRule `xml:"securityGroupRuleSet>item"`
+			NextToken string                 `xml:"nextToken"`
+		}
+		if err := s.call(ctx, params, &out); err != nil {
+			return nil, err
+		}
+		rules = append(rules, out.Rules...)
+		if out.NextToken == "" {
+			return rules, nil
+		}
+		params.Set("NextToken", out.NextToken)
+	}
+}
+
+func (s *EC2IPRange) prefixListEntries(ctx context.Context, id string) ([]string, error) {
+	params := url.Values{
+		"Action":       {"GetManagedPrefixListEntries"},
+		"PrefixListId": {id},
+		"MaxResults":   {"100"},
+	}
+
+	var cidrs []string
+	for {
+		var out struct {
+			CIDRs     []string `xml:"entrySet>item>cidr"`
+			NextToken string   `xml:"nextToken"`
+		}
+		if err := s.call(ctx, params, &out); err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, out.CIDRs...)
+		if out.NextToken == "" {
+			return cidrs, nil
+		}
+		params.Set("NextToken", out.NextToken)
+	}
+}
+
+// call performs a signed EC2 Query API request and decodes the XML
+// response into v.
+func (s *EC2IPRange) call(ctx context.Context, params url.Values, v any) error {
+	params.Set("Version", "2016-11-15")
+	if s.credentials == nil {
+		return fmt.Errorf("no AWS credentials configured")
+	}
+	creds, err := s.credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("resolving AWS credentials: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.Endpoint+"/?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, emptySHA256, "ec2", s.Region, time.Now()); err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiErr struct {
+			Code    string `xml:"Errors>Error>Code"`
+			Message string `xml:"Errors>Error>Message"`
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if xml.Unmarshal(body, &apiErr) == nil && apiErr.Code != "" {
+			return fmt.Errorf("%s: %s: %s", params.Get("Action"), apiErr.Code, apiErr.Message)
+		}
+		return fmt.Errorf("%s returned HTTP %d", params.Get("Action"), resp.StatusCode)
+	}
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	ec2 {
+//	   prefix_list <id...>
+//	   security_group <id...>
+//	   port number
+//	   region name
+//	   endpoint url
+//	   interval val
+//	   timeout val
+//	}
+func (m *EC2IPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	// No same-line options are supported
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "prefix_list":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			m.PrefixLists = append(m.PrefixLists, args...)
+		case "security_group":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			m.SecurityGroups = append(m.SecurityGroups, args...)
+		case "port":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			port, err := strconv.Atoi(d.Val())
+			if err != nil || port < 1 || port > 65535 {
+				return d.Errf("invalid port: %s", d.Val())
+			}
+			m.Port = port
+		case "region":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Region = d.Val()
+		case "endpoint":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Endpoint = d.Val()
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Interval = caddy.Duration(val)
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Timeout = caddy.Duration(val)
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*EC2IPRange)(nil)
+	_ caddy.Provisioner       = (*EC2IPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*EC2IPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*EC2IPRange)(nil)
+)
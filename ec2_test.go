@@ -0,0 +1,82 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestEC2(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") {
+			t.Errorf("request not signed: %q", r.Header.Get("Authorization"))
+		}
+		q := r.URL.Query()
+		switch q.Get("Action") {
+		case "DescribeSecurityGroupRules":
+			if q.Get("Filter.1.Value.1") != "sg-0123" {
+				t.Errorf("unexpected group filter %q", q.Get("Filter.1.Value.1"))
+			}
+			w.Write([]byte(`<DescribeSecurityGroupRulesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+				<securityGroupRuleSet>
+					<item><isEgress>false</isEgress><ipProtocol>tcp</ipProtocol><fromPort>443</fromPort><toPort>443</toPort><cidrIpv4>10.0.0.0/16</cidrIpv4></item>
+					<item><isEgress>false</isEgress><ipProtocol>tcp</ipProtocol><fromPort>22</fromPort><toPort>22</toPort><cidrIpv4>192.0.2.7/32</cidrIpv4></item>
+					<item><isEgress>false</isEgress><ipProtocol>-1</ipProtocol><fromPort>-1</fromPort><toPort>-1</toPort><prefixListId>pl-office</prefixListId></item>
+					<item><isEgress>true</isEgress><ipProtocol>-1</ipProtocol><cidrIpv4>0.0.0.0/0</cidrIpv4></item>
+				</securityGroupRuleSet>
+			</DescribeSecurityGroupRulesResponse>`))
+		case "GetManagedPrefixListEntries":
+			switch q.Get("PrefixListId") {
+			case "pl-office":
+				w.Write([]byte(`<GetManagedPrefixListEntriesResponse><entrySet><item><cidr>198.51.100.0/24</cidr></item></entrySet></GetManagedPrefixListEntriesResponse>`))
+			case "pl-cdn":
+				if q.Get("NextToken") == "" {
+					w.Write([]byte(`<GetManagedPrefixListEntriesResponse><entrySet><item><cidr>203.0.113.0/24</cidr></item></entrySet><nextToken>page2</nextToken></GetManagedPrefixListEntriesResponse>`))
+				} else {
+					w.Write([]byte(`<GetManagedPrefixListEntriesResponse><entrySet><item><cidr>2001:db8::/32</cidr></item></entrySet></GetManagedPrefixListEntriesResponse>`))
+				}
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`<Response><Errors><Error><Code>InvalidPrefixListID.NotFound</Code><Message>not found</Message></Error></Errors></Response>`))
+			}
+		default:
+			t.Errorf("unexpected action %q", q.Get("Action"))
+		}
+	}))
+	defer server.Close()
+
+	d := caddyfile.NewTestDispenser(`ec2 {
+		prefix_list pl-cdn
+		security_group sg-0123
+		port 443
+		region eu-west-1
+		endpoint ` + server.URL + `
+	}`)
+	r := EC2IPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+
+	expected := []string{"10.0.0.0/16", "203.0.113.0/24", "2001:db8::/32", "198.51.100.0/24"}
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	missing := EC2IPRange{PrefixLists: []string{"pl-missing"}, Region: "eu-west-1", Endpoint: server.URL}
+	if err := missing.Provision(ctx); err == nil || !strings.Contains(err.Error(), "InvalidPrefixListID.NotFound") {
+		t.Errorf("expected API error, got %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package caddy_ip_list
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(EnvIPRange{})
+}
+
+// EnvIPRange provides IP ranges listed in an environment variable,
+// separated by commas and/or whitespace. The variable is read when the
+// config is loaded, so changes take effect on the next reload.
+type EnvIPRange struct {
+	// Name of the environment variable.
+	Name string `json:"name"`
+
+	ranges []netip.Prefix
+}
+
+// CaddyModule returns the Caddy module information.
+func (EnvIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.env",
+		New: func() caddy.Module { return new(EnvIPRange) },
+	}
+}
+
+func (s *EnvIPRange) Provision(ctx caddy.Context) error {
+	if s.Name == "" {
+		return fmt.Errorf("environment variable name is required")
+	}
+	val, ok := os.LookupEnv(s.Name)
+	if !ok {
+		return fmt.Errorf("environment variable %s is not set", s.Name)
+	}
+	fields := strings.FieldsFunc(val, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	for _, field := range fields {
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(field)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.Name, err)
+		}
+		s.ranges = append(s.ranges, prefix)
+	}
+	return nil
+}
+
+func (s *EnvIPRange) GetIPRanges(_ *http.Request) []netip.Prefix {
+	return s.ranges
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	env <name>
+func (m *EnvIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	m.Name = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*EnvIPRange)(nil)
+	_ caddy.Provisioner       = (*EnvIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*EnvIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*EnvIPRange)(nil)
+)
@@ -0,0 +1,43 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestEnv(t *testing.T) {
+	t.Setenv("CADDY_ALLOWED_CIDRS", "10.0.0.0/8, 192.0.2.1\t2001:db8::/32,,")
+
+	d := caddyfile.NewTestDispenser(`env CADDY_ALLOWED_CIDRS`)
+	r := EnvIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+
+	expected := []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::/32"}
+	var got []string
+	for _, p := range r.GetIPRanges(nil) {
+		got = append(got, p.String())
+	}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestEnvUnset(t *testing.T) {
+	r := EnvIPRange{Name: "CADDY_IP_LIST_DOES_NOT_EXIST"}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err == nil {
+		t.Errorf("expected error for unset variable")
+	}
+}
@@ -0,0 +1,128 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(RefreshHandler{})
+}
+
+// RefreshHandler is an event handler that makes every list fetch its URLs
+// right away, so external automation can drive updates without waiting
+// for the interval. Subscribe it to an event in the events app, e.g. a
+// custom refresh_ip_lists event:
+//
+//	{
+//	    events {
+//	        on refresh_ip_lists ip_list_refresh
+//	    }
+//	}
+type RefreshHandler struct {
+	log *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (RefreshHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "events.handlers.ip_list_refresh",
+		New: func() caddy.Module { return new(RefreshHandler) },
+	}
+}
+
+func (h *RefreshHandler) Provision(ctx caddy.Context) error {
+	h.log = ctx.Logger()
+	return nil
+}
+
+// Handle refreshes the lists in the background, as fetching them may take
+// longer than an event handler should block the event.
+func (h *RefreshHandler) Handle(_ context.Context, e caddy.Event) error {
+	h.log.Info("refreshing IP lists", zap.String("event", e.Name()))
+	go refreshAll(h.log)
+	return nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	ip_list_refresh
+func (h *RefreshHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// listEvents is the events app a list emits through, with the context of
+// its config.
+type listEvents struct {
+	app *caddyevents.App
+	ctx caddy.Context
+}
+
+// eventsApp returns the events app of the config of ctx, or nil if none
+// is configured.
+var eventsApp = func(ctx caddy.Context) *caddyevents.App {
+	app, err := ctx.AppIfConfigured("events")
+	if err != nil {
+		return nil
+	}
+	return app.(*caddyevents.App)
+}
+
+// useEvents makes the list emit through the events app of the config of
+// ctx, as the events app of an earlier config stops on reload.
+func (s *URLIPRange) useEvents(ctx caddy.Context) {
+	app := eventsApp(ctx)
+	if app == nil {
+		s.events.Store(nil)
+		return
+	}
+	s.events.Store(&listEvents{app: app, ctx: ctx})
+}
+
+// emit emits an event of the list through the events app, if one is
+// configured. The data includes the ID of the list.
+func (s *URLIPRange) emit(name string, data map[string]any) {
+	events := s.events.Load()
+	if events == nil {
+		return
+	}
+	data["id"] = s.listID()
+	events.app.Emit(events.ctx, name, data)
+}
+
+// refreshAll makes every running list fetch its URLs right away.
+func refreshAll(log *zap.Logger) {
+	var lists []*URLIPRange
+	listPool.Range(func(_, value any) bool {
+		lists = append(lists, value.(*pooledList).list)
+		return true
+	})
+	var wg sync.WaitGroup
+	for _, list := range lists {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := list.forceRefresh(""); err != nil {
+				log.Warn("failed to refresh IP list", zap.String("id", list.listID()), zap.Error(err))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Interface guards
+var (
+	_ caddy.Module          = (*RefreshHandler)(nil)
+	_ caddy.Provisioner     = (*RefreshHandler)(nil)
+	_ caddyevents.Handler   = (*RefreshHandler)(nil)
+	_ caddyfile.Unmarshaler = (*RefreshHandler)(nil)
+)
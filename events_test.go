@@ -0,0 +1,225 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+)
+
+// provisionUpdatable provisions an uncached list of one URL whose ranges
+// change from 192.0.2.0/24 to 198.51.100.0/24 once update is called. The
+// options are added to the list's Caddyfile block.
+func provisionUpdatable(t *testing.T, ctx caddy.Context, options ...string) (r *URLIPRange, update func()) {
+	t.Helper()
+	var updated atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if updated.Load() {
+			w.Write([]byte("198.51.100.0/24\n"))
+		} else {
+			w.Write([]byte("192.0.2.0/24\n"))
+		}
+	}))
+	t.Cleanup(server.Close)
+	d := caddyfile.NewTestDispenser(`list {
+		url ` + server.URL + `
+		cache off
+		` + strings.Join(options, "\n") + `
+	}`)
+	r = &URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if err := r.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Cleanup() })
+	return r, func() { updated.Store(true) }
+}
+
+// waitForRanges waits until r provides expected.
+func waitForRanges(t *testing.T, r *URLIPRange, expected []string) {
+	t.Helper()
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got = prefixStrings(r.GetIPRanges(nil)); slices.Equal(got, expected) {
+			return
+		}
+	}
+	t.Errorf("expected %v, got %v", expected, got)
+}
+
+func TestRefreshHandler(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	r, update := provisionUpdatable(t, ctx)
+
+	h := &RefreshHandler{}
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser("ip_list_refresh")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	update()
+	event, err := caddy.NewEvent(ctx, "refresh_ip_lists", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Handle(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	waitForRanges(t, r, []string{"198.51.100.0/24"})
+}
+
+type recordedEvents struct {
+	mu     sync.Mutex
+	events []caddy.Event
+}
+
+func (h *recordedEvents) Handle(_ context.Context, e caddy.Event) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, e)
+	return nil
+}
+
+func TestRefreshEvents(t *testing.T) {
+	var down, updated atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case down.Load():
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case updated.Load():
+			w.Write([]byte("198.51.100.0/24\n"))
+		default:
+			w.Write([]byte("192.0.2.0/24\n"))
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	app := &caddyevents.App{}
+	if err := app.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	recorded := &recordedEvents{}
+	for _, name := range []string{"ip_list.refreshed", "ip_list.failed", "ip_list.changed"} {
+		if err := app.On(name, recorded); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := &URLIPRange{URLs: []string{server.URL}, CacheDisabled: true, Retries: new(int)}
+	if err := r.setup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	r.events.Store(&listEvents{app: app, ctx: ctx})
+
+	refresh := func() {
+		t.Helper()
+		if changed, _ := r.refresh(); changed > 0 {
+			r.update()
+		}
+	}
+	refresh()
+	refresh()
+	updated.Store(true)
+	refresh()
+	down.Store(true)
+	refresh()
+
+	var got []string
+	for _, e := range recorded.events {
+		got = append(got, fmt.Sprintf("%s %v", e.Name(), e.Data["url"] != nil))
+	}
+	expected := []string{
+		"ip_list.refreshed true", "ip_list.changed false",
+		"ip_list.refreshed true",
+		"ip_list.refreshed true", "ip_list.changed false",
+		"ip_list.failed true",
+	}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected events %q, got %q", expected, got)
+	}
+	changed := recorded.events[4].Data
+	if urls := changed["urls"].([]string); !slices.Equal(urls, []string{server.URL}) || changed["count"] != 1 || changed["previous_count"] != 1 {
+		t.Errorf("unexpected change event data %v", changed)
+	}
+}
+
+func TestEventsAcrossReload(t *testing.T) {
+	apps := make(map[context.Context]*caddyevents.App)
+	defer func(orig func(caddy.Context) *caddyevents.App) { eventsApp = orig }(eventsApp)
+	eventsApp = func(ctx caddy.Context) *caddyevents.App { return apps[ctx.Context] }
+	newConfig := func() (caddy.Context, context.CancelFunc, *recordedEvents) {
+		t.Helper()
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		app := &caddyevents.App{}
+		if err := app.Provision(ctx); err != nil {
+			t.Fatal(err)
+		}
+		recorded := &recordedEvents{}
+		if err := app.On("ip_list.changed", recorded); err != nil {
+			t.Fatal(err)
+		}
+		apps[ctx.Context] = app
+		return ctx, cancel, recorded
+	}
+
+	oldCtx, oldCancel, oldRecorded := newConfig()
+	defer oldCancel()
+	old, update := provisionUpdatable(t, oldCtx)
+	oldRecorded.mu.Lock()
+	oldCount := len(oldRecorded.events)
+	oldRecorded.mu.Unlock()
+
+	// the reload provisions the same list in the new config, then stops
+	// the old config
+	ctx, cancel, recorded := newConfig()
+	defer cancel()
+	r := &URLIPRange{}
+	d := caddyfile.NewTestDispenser(`list {
+		url ` + old.URLs[0] + `
+		cache off
+	}`)
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if err := r.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Cleanup()
+	if r.shared != old.shared {
+		t.Fatal("expected the reload to reuse the list")
+	}
+	if err := old.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	oldCancel()
+
+	update()
+	if _, err := r.shared.forceRefresh(""); err != nil {
+		t.Fatal(err)
+	}
+	recorded.mu.Lock()
+	defer recorded.mu.Unlock()
+	if len(recorded.events) != 1 {
+		t.Errorf("expected the new config to receive 1 event, got %d", len(recorded.events))
+	}
+	oldRecorded.mu.Lock()
+	defer oldRecorded.mu.Unlock()
+	if len(oldRecorded.events) != oldCount {
+		t.Errorf("expected the old config to receive no more events, got %d", len(oldRecorded.events)-oldCount)
+	}
+}
@@ -0,0 +1,89 @@
+package caddy_ip_list
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// expire drops the prefixes whose ttl has passed from the lists. It
+// returns the number of lists that changed.
+func (s *URLIPRange) expire(now time.Time) int {
+	changed := 0
+	for url, list := range s.lists {
+		if len(list.expires) == 0 {
+			continue
+		}
+		kept := make([]netip.Prefix, 0, len(list.prefixes))
+		expires := make(map[netip.Prefix]time.Time, len(list.expires))
+		for _, prefix := range list.prefixes {
+			at, ok := list.expires[prefix]
+			if ok && !at.After(now) {
+				continue
+			}
+			kept = append(kept, prefix)
+			if ok {
+				expires[prefix] = at
+			}
+		}
+		if len(kept) == len(list.prefixes) {
+			continue
+		}
+		if s.log != nil {
+			s.log.Debug("expired IP list entries",
+				zap.String("url", url),
+				zap.Int("expired", len(list.prefixes)-len(kept)))
+		}
+		list.prefixes, list.expires = kept, expires
+		s.lists[url] = list
+		s.updateStatus(url, func(status *urlStatus) { status.Entries = len(kept) })
+		changed++
+	}
+	return changed
+}
+
+// resetExpiry sets timer to fire when the next prefix expires, or stops it
+// if none has a ttl.
+func (s *URLIPRange) resetExpiry(timer *time.Timer) {
+	var next time.Time
+	for _, list := range s.lists {
+		for _, at := range list.expires {
+			if next.IsZero() || at.Before(next) {
+				next = at
+			}
+		}
+	}
+	if next.IsZero() {
+		timer.Stop()
+		return
+	}
+	timer.Reset(time.Until(next))
+}
+
+func formatExpires(expires map[netip.Prefix]time.Time) map[string]time.Time {
+	if len(expires) == 0 {
+		return nil
+	}
+	out := make(map[string]time.Time, len(expires))
+	for prefix, at := range expires {
+		out[prefix.String()] = at
+	}
+	return out
+}
+
+func parseExpires(expires map[string]time.Time) (map[netip.Prefix]time.Time, error) {
+	if len(expires) == 0 {
+		return nil, nil
+	}
+	out := make(map[netip.Prefix]time.Time, len(expires))
+	for p, at := range expires {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix in cache %q: %w", p, err)
+		}
+		out[prefix] = at
+	}
+	return out, nil
+}
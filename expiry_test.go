@@ -0,0 +1,59 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestEntryTTL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("192.0.2.0/24\n198.51.100.7 ttl=100ms # temporary ban\n"))
+	}))
+	defer server.Close()
+
+	r := URLIPRange{URLs: []string{server.URL}, CacheDisabled: true}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Cleanup()
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, []string{"192.0.2.0/24", "198.51.100.7/32"}) {
+		t.Fatalf("expected both entries, got %v", got)
+	}
+
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got = prefixStrings(r.GetIPRanges(nil)); slices.Equal(got, []string{"192.0.2.0/24"}) {
+			break
+		}
+	}
+	if !slices.Equal(got, []string{"192.0.2.0/24"}) {
+		t.Errorf("expected the entry to expire before the next refresh, got %v", got)
+	}
+}
+
+func TestParseEntry(t *testing.T) {
+	r := URLIPRange{}
+	for line, ttl := range map[string]time.Duration{
+		"192.0.2.7":             0,
+		"192.0.2.7 ttl=6h":      6 * time.Hour,
+		"192.0.2.0/24\tttl=1d ": 24 * time.Hour,
+	} {
+		_, got, ok, err := r.parseEntry(line)
+		if err != nil || !ok || got != ttl {
+			t.Errorf("%q: expected ttl %v, got %v, %v, %v", line, ttl, got, ok, err)
+		}
+	}
+	for _, line := range []string{"192.0.2.7 ttl=", "192.0.2.7 ttl=-1h", "192.0.2.7 category=scanner"} {
+		if _, _, _, err := r.parseEntry(line); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
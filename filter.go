@@ -0,0 +1,478 @@
+package caddy_ip_list
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
+)
+
+// specialPurpose holds the private and special-purpose ranges (RFC 6890)
+// that don't belong in an externally published list.
+var specialPurpose = func() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, cidr := range []string{
+		"0.0.0.0/8",       // this network
+		"10.0.0.0/8",      // private
+		"100.64.0.0/10",   // shared address space
+		"127.0.0.0/8",     // loopback
+		"169.254.0.0/16",  // link-local
+		"172.16.0.0/12",   // private
+		"192.0.0.0/24",    // IETF protocol assignments
+		"192.0.2.0/24",    // documentation
+		"192.168.0.0/16",  // private
+		"198.18.0.0/15",   // benchmarking
+		"198.51.100.0/24", // documentation
+		"203.0.113.0/24",  // documentation
+		"224.0.0.0/4",     // multicast
+		"240.0.0.0/4",     // reserved, broadcast
+		"::/128",          // unspecified
+		"::1/128",         // loopback
+		"::ffff:0:0/96",   // IPv4-mapped
+		"100::/64",        // discard-only
+		"2001:db8::/32",   // documentation
+		"fc00::/7",        // unique local
+		"fe80::/10",       // link-local
+		"ff00::/8",        // multicast
+	} {
+		prefixes = append(prefixes, netip.MustParsePrefix(cidr))
+	}
+	return prefixes
+}()
+
+// bogons holds the ranges that must not appear in the global routing
+// table: the IPv4 martians, and the IPv6 space outside the global unicast
+// range 2000::/3 together with the special ranges within it.
+var bogons = func() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.0.0.0/24",
+		"192.0.2.0/24",
+		"192.168.0.0/16",
+		"198.18.0.0/15",
+		"198.51.100.0/24",
+		"203.0.113.0/24",
+		"224.0.0.0/3", // multicast and reserved, up to broadcast
+		"::/3",
+		"4000::/2",
+		"8000::/1",
+		"2001:2::/48",   // benchmarking
+		"2001:10::/28",  // ORCHID
+		"2001:db8::/32", // documentation
+		"2002::/16",     // 6to4
+		"3ffe::/16",     // former 6bone
+	} {
+		prefixes = append(prefixes, netip.MustParsePrefix(cidr))
+	}
+	return prefixes
+}()
+
+// PrefixLengths holds a prefix length per address family. Zero means no
+// limit.
+type PrefixLengths struct {
+	IPv4 int `json:"ipv4,omitempty"`
+	IPv6 int `json:"ipv6,omitempty"`
+}
+
+func (l PrefixLengths) of(prefix netip.Prefix) int {
+	if prefix.Addr().Is4() {
+		return l.IPv4
+	}
+	return l.IPv6
+}
+
+// defaultMinPrefixLen bounds how broad fetched prefixes may be unless
+// min_prefix_len is set, so a stray 0.0.0.0/0 or ::/0 in a feed doesn't
+// trust every client.
+var defaultMinPrefixLen = PrefixLengths{IPv4: 8, IPv6: 19}
+
+// minPrefixLen returns min_prefix_len, or the default bound if it is not
+// set.
+func (s *URLIPRange) minPrefixLen() PrefixLengths {
+	if s.MinPrefixLen == nil {
+		return defaultMinPrefixLen
+	}
+	return *s.MinPrefixLen
+}
+
+// setupFilters parses the filter options.
+func (s *URLIPRange) setupFilters() error {
+	switch s.Family {
+	case "", "both", "ipv4", "ipv6":
+	default:
+		return fmt.Errorf("unsupported family %q", s.Family)
+	}
+	switch s.MaxEntriesPolicy {
+	case "", "fail", "truncate", "keep_previous":
+	default:
+		return fmt.Errorf("unsupported max_entries policy %q", s.MaxEntriesPolicy)
+	}
+	if s.MaxEntries < 0 {
+		return fmt.Errorf("max_entries must not be negative")
+	}
+	if s.MaxMemory < 0 {
+		return fmt.Errorf("max_memory must not be negative")
+	}
+	if s.MinChangeGuard < 0 || s.MinChangeGuard > 100 {
+		return fmt.Errorf("min_change_guard must be a percentage between 0 and 100")
+	}
+	if s.StripPrivate && s.RejectPrivate {
+		return fmt.Errorf("strip_private and reject_private can't be combined")
+	}
+	switch s.OnParseError {
+	case "", "fail", "skip":
+	default:
+		return fmt.Errorf("unsupported on_parse_error %q", s.OnParseError)
+	}
+	s.maxParseErrors, s.maxParseErrorsPercent = 0, false
+	if s.MaxParseErrors != "" {
+		value, percent := strings.CutSuffix(s.MaxParseErrors, "%")
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || (percent && n > 100) {
+			return fmt.Errorf("invalid max_parse_errors %q", s.MaxParseErrors)
+		}
+		if s.OnParseError != "skip" {
+			return fmt.Errorf("max_parse_errors requires on_parse_error skip")
+		}
+		s.maxParseErrors, s.maxParseErrorsPercent = n, percent
+	}
+	s.lineFilter = nil
+	if s.LineFilter != "" {
+		re, err := regexp.Compile(s.LineFilter)
+		if err != nil {
+			return fmt.Errorf("invalid line_filter: %v", err)
+		}
+		s.lineFilter = re
+	}
+	s.extract = nil
+	if s.Extract != "" {
+		re, err := regexp.Compile(s.Extract)
+		if err != nil {
+			return fmt.Errorf("invalid extract: %v", err)
+		}
+		if re.NumSubexp() == 0 {
+			return fmt.Errorf("extract must have a capture group")
+		}
+		s.extract, s.extractGroup = re, 1
+		if i := re.SubexpIndex("cidr"); i > 0 {
+			s.extractGroup = i
+		}
+	}
+	if s.RPKI != nil && (s.RPKI.Validator == "" || len(s.RPKI.ASNs) == 0) {
+		return fmt.Errorf("rpki requires a validator and at least one ASN")
+	}
+	switch s.OnInvalid {
+	case "", "drop", "fail", "warn":
+	default:
+		return fmt.Errorf("unsupported on_invalid %q", s.OnInvalid)
+	}
+	for _, limit := range []struct {
+		name   string
+		bits   int
+		min    int
+		max    int
+		expand int
+	}{
+		{"ipv4", 32, s.minPrefixLen().IPv4, s.MaxPrefixLen.IPv4, s.ExpandSingleTo.IPv4},
+		{"ipv6", 128, s.minPrefixLen().IPv6, s.MaxPrefixLen.IPv6, s.ExpandSingleTo.IPv6},
+	} {
+		for _, length := range []int{limit.min, limit.max, limit.expand} {
+			if length < 0 || length > limit.bits {
+				return fmt.Errorf("%s prefix lengths must be between 0 and %d", limit.name, limit.bits)
+			}
+		}
+		if limit.max > 0 && limit.min > limit.max {
+			return fmt.Errorf("%s min_prefix_len %d is greater than max_prefix_len %d", limit.name, limit.min, limit.max)
+		}
+	}
+	s.nat64 = netip.Prefix{}
+	if s.NAT64 != "" {
+		prefix, err := netip.ParsePrefix(s.NAT64)
+		if err != nil || !prefix.Addr().Is6() || ipv4Mapped.Contains(prefix.Addr()) || prefix.Bits() != 96 {
+			return fmt.Errorf("invalid nat64 prefix %q: must be an IPv6 /96 prefix", s.NAT64)
+		}
+		s.nat64 = prefix.Masked()
+	}
+	s.allowWithin = nil
+	for _, cidr := range s.AllowWithin {
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid allow_within %q: %v", cidr, err)
+		}
+		s.allowWithin = append(s.allowWithin, prefix.Masked())
+	}
+	s.requirePrefixes = nil
+	for _, cidr := range s.RequirePrefixes {
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid require_prefix %q: %v", cidr, err)
+		}
+		s.requirePrefixes = append(s.requirePrefixes, prefix.Masked())
+	}
+	return nil
+}
+
+// filter checks a freshly fetched list of url. Prefixes that may not be
+// used are dropped, or the whole list is rejected with on_invalid fail.
+func (s *URLIPRange) filter(url string, prefixes []netip.Prefix) ([]netip.Prefix, error) {
+	kept := make([]netip.Prefix, 0, len(prefixes))
+	dropped := 0
+	var warned []string
+	for _, prefix := range prefixes {
+		if !s.inFamily(prefix) {
+			continue
+		}
+		if s.RejectPrivate && overlapsSpecialPurpose(prefix) {
+			return nil, fmt.Errorf("list contains private or special-purpose range %s", prefix)
+		}
+		if s.StripPrivate && isSpecialPurpose(prefix) {
+			dropped++
+			continue
+		}
+		if reason := s.invalid(prefix); reason != "" {
+			switch s.OnInvalid {
+			case "fail":
+				return nil, fmt.Errorf("invalid prefix %s: %s", prefix, reason)
+			case "warn":
+				warned = append(warned, prefix.String()+": "+reason)
+			default:
+				dropped++
+				continue
+			}
+		}
+		kept = append(kept, prefix)
+	}
+	if s.StripBogons {
+		if stripped := subtractPrefixes(kept, bogons); !slices.Equal(stripped, kept) {
+			if s.log != nil {
+				s.log.Info("stripped bogons from IP list", zap.String("url", url))
+			}
+			kept = stripped
+		}
+	}
+	// validated after stripping, so bogons cost no validator queries
+	if s.RPKI != nil {
+		validated, err := s.validateRPKI(url, kept)
+		if err != nil {
+			return nil, err
+		}
+		kept = validated
+	}
+	if dropped > 0 && s.log != nil {
+		s.log.Warn("dropped invalid prefixes from IP list",
+			zap.String("url", url),
+			zap.Int("dropped", dropped))
+	}
+	if len(warned) > 0 && s.log != nil {
+		s.log.Warn("IP list contains invalid prefixes; using them anyway",
+			zap.String("url", url),
+			zap.Strings("prefixes", warned))
+	}
+	if s.MaxEntries > 0 && len(kept) > s.MaxEntries {
+		err := fmt.Errorf("list has %d entries, more than max_entries %d", len(kept), s.MaxEntries)
+		switch s.MaxEntriesPolicy {
+		case "truncate":
+			if s.log != nil {
+				s.log.Error("truncating IP list to max_entries",
+					zap.String("url", url),
+					zap.Int("entries", len(kept)),
+					zap.Int("max_entries", s.MaxEntries))
+			}
+			kept = kept[:s.MaxEntries:s.MaxEntries]
+		case "keep_previous":
+			return nil, keepPreviousError{err}
+		default:
+			return nil, err
+		}
+	}
+	return kept, nil
+}
+
+// filterKey identifies the options that shape the lists of the URLs. A
+// cached list shaped by other options is not used, as it may hold ranges
+// that these options drop. The key is empty without such options, as for
+// lists cached before they existed, and with the default min_prefix_len.
+func (s *URLIPRange) filterKey() string {
+	options, _ := json.Marshal(struct {
+		AllowWithin      []string        `json:",omitempty"`
+		Family           string          `json:",omitempty"`
+		MinPrefixLen     *PrefixLengths  `json:",omitempty"`
+		MaxPrefixLen     PrefixLengths   `json:",omitzero"`
+		ExpandSingleTo   PrefixLengths   `json:",omitzero"`
+		OnInvalid        string          `json:",omitempty"`
+		StripPrivate     bool            `json:",omitempty"`
+		RejectPrivate    bool            `json:",omitempty"`
+		StripBogons      bool            `json:",omitempty"`
+		RPKI             *RPKIValidation `json:",omitempty"`
+		MaxEntries       int             `json:",omitempty"`
+		MaxEntriesPolicy string          `json:",omitempty"`
+		OnParseError     string          `json:",omitempty"`
+		LineFilter       string          `json:",omitempty"`
+		Extract          string          `json:",omitempty"`
+	}{s.AllowWithin, s.Family, s.MinPrefixLen, s.MaxPrefixLen, s.ExpandSingleTo, s.OnInvalid,
+		s.StripPrivate, s.RejectPrivate, s.StripBogons, s.RPKI, s.MaxEntries, s.MaxEntriesPolicy,
+		s.OnParseError, s.LineFilter, s.Extract})
+	if string(options) == "{}" {
+		return ""
+	}
+	sum := sha256.Sum256(options)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkCanaries returns an error if prefixes don't cover every
+// require_prefix.
+func (s *URLIPRange) checkCanaries(prefixes []netip.Prefix) error {
+	for _, canary := range s.requirePrefixes {
+		if !slices.ContainsFunc(prefixes, func(p netip.Prefix) bool {
+			return p.Bits() <= canary.Bits() && p.Contains(canary.Addr())
+		}) {
+			return fmt.Errorf("lists don't contain require_prefix %s", canary)
+		}
+	}
+	return nil
+}
+
+// prefixSize is the memory a prefix takes up in a list.
+const prefixSize = int64(unsafe.Sizeof(netip.Prefix{}))
+
+// memoryUse estimates the memory taken up by the lists, the lists of
+// the exclude URLs and the ranges resolved from them. An entry with a
+// TTL counts twice for its expiry.
+func (s *URLIPRange) memoryUse() int64 {
+	var entries int
+	for _, list := range s.lists {
+		entries += 2*len(list.prefixes) + 2*len(list.expires)
+	}
+	for _, list := range s.excluded {
+		entries += len(list.prefixes) + 2*len(list.expires)
+	}
+	return int64(entries) * prefixSize
+}
+
+// checkMemory returns an error if the lists take up more memory than
+// max_memory allows.
+func (s *URLIPRange) checkMemory() error {
+	if s.MaxMemory == 0 {
+		return nil
+	}
+	if used := s.memoryUse(); used > s.MaxMemory {
+		return fmt.Errorf("lists would use about %s, more than max_memory %s",
+			humanize.IBytes(uint64(used)), humanize.IBytes(uint64(s.MaxMemory)))
+	}
+	return nil
+}
+
+// checkParseErrors returns an error if more of the entries of a list
+// failed to parse than max_parse_errors allows.
+func (s *URLIPRange) checkParseErrors(failed, entries int) error {
+	if s.MaxParseErrors == "" || failed == 0 {
+		return nil
+	}
+	if s.maxParseErrorsPercent {
+		if 100*failed > s.maxParseErrors*entries {
+			return fmt.Errorf("%d of %d lines failed to parse, more than max_parse_errors %s", failed, entries, s.MaxParseErrors)
+		}
+		return nil
+	}
+	if failed > s.maxParseErrors {
+		return fmt.Errorf("%d lines failed to parse, more than max_parse_errors %d", failed, s.maxParseErrors)
+	}
+	return nil
+}
+
+// keepPreviousError rejects a list in favor of its last good version,
+// without counting as a failed fetch.
+type keepPreviousError struct {
+	err error
+}
+
+func (e keepPreviousError) Error() string { return e.err.Error() }
+func (e keepPreviousError) Unwrap() error { return e.err }
+
+// inFamily reports whether prefix belongs to the configured family.
+func (s *URLIPRange) inFamily(prefix netip.Prefix) bool {
+	switch s.Family {
+	case "ipv4":
+		return prefix.Addr().Is4()
+	case "ipv6":
+		return !prefix.Addr().Is4()
+	default:
+		return true
+	}
+}
+
+// isSpecialPurpose reports whether prefix lies within a private or
+// special-purpose range.
+func isSpecialPurpose(prefix netip.Prefix) bool {
+	return slices.ContainsFunc(specialPurpose, func(sp netip.Prefix) bool {
+		return sp.Bits() <= prefix.Bits() && sp.Contains(prefix.Addr())
+	})
+}
+
+// overlapsSpecialPurpose reports whether prefix overlaps a private or
+// special-purpose range, e.g. 0.0.0.0/0.
+func overlapsSpecialPurpose(prefix netip.Prefix) bool {
+	return slices.ContainsFunc(specialPurpose, prefix.Overlaps)
+}
+
+// invalid returns why prefix may not be used, or "" if it may.
+func (s *URLIPRange) invalid(prefix netip.Prefix) string {
+	if len(s.allowWithin) > 0 && !slices.ContainsFunc(s.allowWithin, func(allowed netip.Prefix) bool {
+		return allowed.Bits() <= prefix.Bits() && allowed.Contains(prefix.Addr())
+	}) {
+		return "outside allow_within"
+	}
+	if bits := s.minPrefixLen().of(prefix); prefix.Bits() < bits {
+		return fmt.Sprintf("shorter than min_prefix_len %d", bits)
+	}
+	if bits := s.MaxPrefixLen.of(prefix); bits > 0 && prefix.Bits() > bits {
+		return fmt.Sprintf("longer than max_prefix_len %d", bits)
+	}
+	return ""
+}
+
+// checkShrink rejects a list of url that has shrunk by more than
+// min_change_guard percent compared to prev, unless accept is set.
+func (s *URLIPRange) checkShrink(url string, prev, list urlList, accept bool) error {
+	if s.MinChangeGuard == 0 || len(prev.prefixes) == 0 || len(list.prefixes) >= len(prev.prefixes) {
+		return nil
+	}
+	shrink := 100 * (len(prev.prefixes) - len(list.prefixes)) / len(prev.prefixes)
+	if shrink <= s.MinChangeGuard {
+		return nil
+	}
+	if accept {
+		if s.log != nil {
+			s.log.Warn("accepting IP list that shrank beyond min_change_guard",
+				zap.String("url", url),
+				zap.Int("previous", len(prev.prefixes)),
+				zap.Int("entries", len(list.prefixes)))
+		}
+		return nil
+	}
+	return fmt.Errorf("list shrank from %d to %d entries, more than min_change_guard %d%%", len(prev.prefixes), len(list.prefixes), s.MinChangeGuard)
+}
+
+// acceptChange lets the next refresh accept lists that shrink beyond
+// min_change_guard.
+func (s *URLIPRange) acceptChange() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.acceptShrink = true
+}
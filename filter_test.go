@@ -0,0 +1,604 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+)
+
+// provisionFiltered provisions an uncached list of one URL serving body, with
+// the given options, and returns its ranges sorted.
+func provisionFiltered(t *testing.T, body, options string) ([]string, error) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	d := caddyfile.NewTestDispenser(`list {
+		url ` + server.URL + `
+		cache off
+		retries 0
+		` + options + `
+	}`)
+	r := URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := r.Provision(ctx); err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { r.Cleanup() })
+	got := prefixStrings(r.GetIPRanges(nil))
+	slices.Sort(got)
+	return got, nil
+}
+
+func TestAllowWithin(t *testing.T) {
+	body := "104.16.0.0/13\n104.24.0.0/14\n192.0.2.0/24\n2606:4700::/32\n2001:db8::/32\n"
+	got, err := provisionFiltered(t, body, "allow_within 104.16.0.0/12 2606:4700::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"104.16.0.0/13", "104.24.0.0/14", "2606:4700::/32"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	if _, err := provisionFiltered(t, body, "allow_within 104.16.0.0/12 2606:4700::/32\non_invalid fail"); err == nil {
+		t.Error("expected the list to be rejected")
+	}
+	if _, err := provisionFiltered(t, body, "on_invalid skip"); err == nil {
+		t.Error("expected unknown on_invalid to be rejected")
+	}
+}
+
+// TestFilteredCache tests that cached lists are only used with the
+// options they were filtered with.
+func TestFilteredCache(t *testing.T) {
+	var down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("192.0.2.0/24\n198.51.100.0/24\n"))
+	}))
+	defer server.Close()
+
+	for _, backend := range []string{"json", "bolt"} {
+		cacheFile := filepath.Join(t.TempDir(), "cache")
+		provision := func(options string) ([]string, error) {
+			d := caddyfile.NewTestDispenser(`list {
+				url ` + server.URL + `
+				retries 0
+				cache_backend ` + backend + `
+				cache_file ` + cacheFile + `
+				` + options + `
+			}`)
+			r := URLIPRange{}
+			if err := r.UnmarshalCaddyfile(d); err != nil {
+				t.Fatalf("unmarshal error: %v", err)
+			}
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			if err := r.Provision(ctx); err != nil {
+				return nil, err
+			}
+			defer r.Cleanup()
+			return prefixStrings(r.GetIPRanges(nil)), nil
+		}
+
+		for _, options := range [][2]string{
+			{"allow_within 192.0.2.0/24", "allow_within 198.51.100.0/24"},
+			{"line_filter ^192", "line_filter ^198"},
+		} {
+			down.Store(false)
+			if _, err := provision(options[0]); err != nil {
+				t.Fatalf("%s: %v", backend, err)
+			}
+			down.Store(true)
+			got, err := provision(options[0])
+			if err != nil {
+				t.Fatalf("%s: expected cached ranges with %s, got %v", backend, options[0], err)
+			}
+			if !slices.Equal(got, []string{"192.0.2.0/24"}) {
+				t.Errorf("%s: unexpected cached ranges with %s: %v", backend, options[0], got)
+			}
+			if _, err := provision(options[1]); err == nil {
+				t.Errorf("%s: expected ranges filtered with %s not to be used with %s", backend, options[0], options[1])
+			}
+		}
+	}
+}
+
+func TestFamily(t *testing.T) {
+	body := "192.0.2.0/24\n2001:db8::/32\n"
+	for family, expected := range map[string][]string{
+		"ipv4": {"192.0.2.0/24"},
+		"ipv6": {"2001:db8::/32"},
+		"both": {"192.0.2.0/24", "2001:db8::/32"},
+	} {
+		got, err := provisionFiltered(t, body, "family "+family+"\non_invalid fail")
+		if err != nil {
+			t.Fatalf("%s: %v", family, err)
+		}
+		if !slices.Equal(got, expected) {
+			t.Errorf("%s: expected %v, got %v", family, expected, got)
+		}
+	}
+	if _, err := provisionFiltered(t, body, "family ipv5"); err == nil {
+		t.Error("expected unknown family to be rejected")
+	}
+}
+
+func TestPrefixLen(t *testing.T) {
+	body := "0.0.0.0/0\n10.0.0.0/8\n192.0.2.0/24\n198.51.100.1/32\n::/0\n2001:db8::/32\n3fff::1/128\n"
+	got, err := provisionFiltered(t, body, "min_prefix_len 8 16\nmax_prefix_len 24 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"10.0.0.0/8", "192.0.2.0/24", "2001:db8::/32", "3fff::1/128"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	if _, err := provisionFiltered(t, body, "min_prefix_len 8 16\non_invalid fail"); err == nil {
+		t.Error("expected the list to be rejected")
+	}
+	got, err = provisionFiltered(t, "10.0.0.0/7\n192.0.2.0/24\n", "min_prefix_len 8 19\non_invalid warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"10.0.0.0/7", "192.0.2.0/24"}; !slices.Equal(got, expected) {
+		t.Errorf("expected invalid prefixes to be kept with on_invalid warn, got %v", got)
+	}
+
+	// overly broad prefixes are dropped by default
+	if _, err := provisionFiltered(t, "0.0.0.0/0\n", ""); err == nil {
+		t.Error("expected a list of 0.0.0.0/0 to be rejected")
+	}
+	broad := "0.0.0.0/0\n10.0.0.0/7\n10.0.0.0/8\n::/0\n2000::/18\n2001::/19\n"
+	got, err = provisionFiltered(t, broad, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"10.0.0.0/8", "2001::/19"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	got, err = provisionFiltered(t, broad, "min_prefix_len 0 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"0.0.0.0/0", "::/0"}; !slices.Equal(got, expected) {
+		t.Errorf("expected min_prefix_len 0 0 to lift the bound, got %v", got)
+	}
+
+	for _, options := range []string{"min_prefix_len 33 0", "min_prefix_len 24 0\nmax_prefix_len 16 0"} {
+		if _, err := provisionFiltered(t, body, options); err == nil {
+			t.Errorf("expected %q to be rejected", options)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	got, err := provisionFiltered(t, "192.0.2.128/25\n192.0.2.0/25\n198.51.100.0/24\n198.51.100.1\n", "aggregate\ncidr 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"192.0.2.0/24", "192.0.2.1/32", "198.51.100.0/24"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	body := "192.0.2.0/24\n198.51.100.0/24\n203.0.113.0/24\n"
+	got, err := provisionFiltered(t, body, "max_entries 2 truncate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"192.0.2.0/24", "198.51.100.0/24"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	for _, policy := range []string{"", "fail", "keep_previous"} {
+		if _, err := provisionFiltered(t, body, "max_entries 2 "+policy); err == nil {
+			t.Errorf("%q: expected the list to be rejected without a previous list", policy)
+		}
+	}
+	if _, err := provisionFiltered(t, body, "max_entries 2 shrink"); err == nil {
+		t.Error("expected unknown policy to be rejected")
+	}
+
+	var large atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if large.Load() {
+			w.Write([]byte(body))
+		} else {
+			w.Write([]byte("192.0.2.0/24\n"))
+		}
+	}))
+	defer server.Close()
+	r := URLIPRange{
+		URLs:             []string{server.URL},
+		Interval:         caddy.Duration(10 * time.Millisecond),
+		CacheDisabled:    true,
+		MaxEntries:       2,
+		MaxEntriesPolicy: "keep_previous",
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Cleanup()
+	large.Store(true)
+	time.Sleep(50 * time.Millisecond)
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, []string{"192.0.2.0/24"}) {
+		t.Errorf("expected the previous list, got %v", got)
+	}
+	if status := r.fetchStatus()[server.URL]; status.LastError != "" {
+		t.Errorf("expected no fetch error, got %q", status.LastError)
+	}
+}
+
+func TestMaxMemory(t *testing.T) {
+	var body strings.Builder
+	for i := range 100 {
+		fmt.Fprintf(&body, "192.0.2.%d/32\n", i)
+	}
+	if _, err := provisionFiltered(t, body.String(), "max_memory 1KB"); err == nil {
+		t.Error("expected a list exceeding max_memory to be rejected")
+	}
+	if _, err := provisionFiltered(t, "192.0.2.0/24\n", "max_memory 1KB"); err != nil {
+		t.Errorf("expected a small list to be accepted, got %v", err)
+	}
+	if err := (&URLIPRange{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("list {\n max_memory lots\n}")); err == nil {
+		t.Error("expected an invalid size to be rejected")
+	}
+
+	// a list that fits on its own, but not together with the ranges
+	// resolved from it
+	var large atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if large.Load() {
+			for i := range 20 {
+				fmt.Fprintf(w, "198.51.100.%d/32\n", i)
+			}
+		} else {
+			w.Write([]byte("192.0.2.0/24\n"))
+		}
+	}))
+	defer server.Close()
+	r := URLIPRange{
+		URLs:          []string{server.URL},
+		Interval:      caddy.Duration(10 * time.Millisecond),
+		CacheDisabled: true,
+		MaxMemory:     1000,
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Cleanup()
+	large.Store(true)
+	time.Sleep(50 * time.Millisecond)
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, []string{"192.0.2.0/24"}) {
+		t.Errorf("expected the previous list, got %v", got)
+	}
+}
+
+func TestMinChangeGuard(t *testing.T) {
+	var truncated atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if truncated.Load() {
+			w.Write([]byte("192.0.2.0/24\n"))
+		} else {
+			w.Write([]byte("192.0.2.0/24\n198.51.100.0/24\n203.0.113.0/24\n"))
+		}
+	}))
+	defer server.Close()
+
+	r := URLIPRange{
+		URLs:           []string{server.URL},
+		Interval:       caddy.Duration(10 * time.Millisecond),
+		CacheDisabled:  true,
+		MinChangeGuard: 50,
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Cleanup()
+
+	truncated.Store(true)
+	time.Sleep(50 * time.Millisecond)
+	if got := r.GetIPRanges(nil); len(got) != 3 {
+		t.Errorf("expected the previous list, got %v", got)
+	}
+	if status := r.fetchStatus()[server.URL]; status.LastError == "" {
+		t.Error("expected the rejection in the fetch status")
+	}
+
+	rec := httptest.NewRecorder()
+	if err := (adminIPList{}).handleAccept(rec, httptest.NewRequest(http.MethodPost, "/ip-list/accept/"+r.listID(), nil)); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(r.GetIPRanges(nil)) != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the shrunk list to be accepted, got %v", r.GetIPRanges(nil))
+		}
+	}
+	if err := (adminIPList{}).handleAccept(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/ip-list/accept/unknown", nil)); err == nil {
+		t.Error("expected unknown list to be rejected")
+	}
+}
+
+func TestAllowEmpty(t *testing.T) {
+	if _, err := provisionFiltered(t, "# no entries\n", ""); err == nil {
+		t.Error("expected the empty list to be rejected")
+	}
+	if _, err := provisionFiltered(t, "2001:db8::/32\n", "family ipv4"); err == nil {
+		t.Error("expected the filtered list to be rejected")
+	}
+	got, err := provisionFiltered(t, "", "allow_empty\ncidr 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"192.0.2.1/32"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestPrivate(t *testing.T) {
+	body := "104.16.0.0/13\n10.1.0.0/16\n127.0.0.1\n100.0.0.0/6\n2606:4700::/32\nfd00::/8\nfe80::1\n"
+	got, err := provisionFiltered(t, body, "strip_private\nmin_prefix_len 0 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wider prefixes that contain a special-purpose range are kept
+	if expected := []string{"100.0.0.0/6", "104.16.0.0/13", "2606:4700::/32"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	if _, err := provisionFiltered(t, body, "reject_private"); err == nil {
+		t.Error("expected the list to be rejected")
+	}
+	if _, err := provisionFiltered(t, "104.16.0.0/13\n0.0.0.0/0\n", "reject_private"); err == nil {
+		t.Error("expected a list overlapping a private range to be rejected")
+	}
+	if _, err := provisionFiltered(t, "104.16.0.0/13\n", "reject_private"); err != nil {
+		t.Errorf("expected a public list to be accepted: %v", err)
+	}
+	if _, err := provisionFiltered(t, body, "strip_private\nreject_private"); err == nil {
+		t.Error("expected the options to be mutually exclusive")
+	}
+}
+
+func TestRequirePrefix(t *testing.T) {
+	body := "103.21.244.0/22\n104.16.0.0/13\n"
+	got, err := provisionFiltered(t, body, "require_prefix 103.21.244.0/22 104.16.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"103.21.244.0/22", "104.16.0.0/13"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if _, err := provisionFiltered(t, body, "require_prefix 173.245.48.0/20"); err == nil {
+		t.Error("expected the lists to be rejected without the canary")
+	}
+}
+
+func TestRequirePrefixRejection(t *testing.T) {
+	var updated atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if updated.Load() {
+			w.Write([]byte("198.51.100.0/24\n"))
+		} else {
+			w.Write([]byte("192.0.2.0/24\n198.51.100.0/24\n"))
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	app := &caddyevents.App{}
+	if err := app.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	recorded := &recordedEvents{}
+	for _, name := range []string{"ip_list.refreshed", "ip_list.failed"} {
+		if err := app.On(name, recorded); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := &URLIPRange{URLs: []string{server.URL}, RequirePrefixes: []string{"192.0.2.0/24"}, CacheDisabled: true, Retries: new(int)}
+	if err := r.setup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	r.events.Store(&listEvents{app: app, ctx: ctx})
+
+	// the rejected list is neither recorded as fetched nor announced
+	updated.Store(true)
+	if _, err := r.refresh(); err == nil {
+		t.Fatal("expected the list without the canary to be rejected")
+	}
+	status := r.fetchStatus()[server.URL]
+	if status.Entries != 2 || status.Failures != 1 || !strings.Contains(status.LastError, "require_prefix") {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if got := len(r.lists[server.URL].prefixes); got != 2 {
+		t.Errorf("expected the last good list to be kept, got %d prefixes", got)
+	}
+	var got []string
+	for _, e := range recorded.events {
+		got = append(got, e.Name())
+	}
+	if expected := []string{"ip_list.failed"}; !slices.Equal(got, expected) {
+		t.Errorf("expected events %q, got %q", expected, got)
+	}
+}
+
+func TestExpandSingleTo(t *testing.T) {
+	body := "192.0.2.7\n198.51.100.1/32\n203.0.113.0/25\n2001:db8::1\n"
+	got, err := provisionFiltered(t, body, "expand_single_to 24 64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"192.0.2.0/24", "198.51.100.1/32", "2001:db8::/64", "203.0.113.0/25"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	got, err = provisionFiltered(t, body, "expand_single_to 24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"192.0.2.0/24", "198.51.100.1/32", "2001:db8::1/128", "203.0.113.0/25"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if _, err := provisionFiltered(t, body, "expand_single_to 33"); err == nil {
+		t.Error("expected invalid length to be rejected")
+	}
+}
+
+func TestOnParseError(t *testing.T) {
+	body := "192.0.2.0/24\n<html>\n198.51.100.0/24\n"
+	if _, err := provisionFiltered(t, body, ""); err == nil {
+		t.Error("expected the list to be rejected")
+	}
+	got, err := provisionFiltered(t, body, "on_parse_error skip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"192.0.2.0/24", "198.51.100.0/24"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestMaxParseErrors(t *testing.T) {
+	body := "192.0.2.0/24\n<html>\n198.51.100.0/24\n</html>\n"
+	for options, ok := range map[string]bool{
+		"max_parse_errors 2":   true,
+		"max_parse_errors 1":   false,
+		"max_parse_errors 50%": true,
+		"max_parse_errors 49%": false,
+	} {
+		_, err := provisionFiltered(t, body, "on_parse_error skip\n"+options)
+		if ok && err != nil {
+			t.Errorf("%s: %v", options, err)
+		} else if !ok && err == nil {
+			t.Errorf("%s: expected the list to be rejected", options)
+		}
+	}
+	if _, err := provisionFiltered(t, body, "max_parse_errors 2"); err == nil {
+		t.Error("expected max_parse_errors without on_parse_error skip to be rejected")
+	}
+}
+
+func TestNAT64(t *testing.T) {
+	got, err := provisionFiltered(t, "192.0.2.0/24\n2001:db8::/32\n", "nat64\ncidr 198.51.100.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"192.0.2.0/24", "198.51.100.7/32", "2001:db8::/32", "64:ff9b::c000:200/120", "64:ff9b::c633:6407/128"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	got, err = provisionFiltered(t, "192.0.2.0/24\n", "nat64 2001:db8:64::/96")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"192.0.2.0/24", "2001:db8:64::c000:200/120"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if _, err := provisionFiltered(t, "192.0.2.0/24\n", "nat64 2001:db8:64::/64"); err == nil {
+		t.Error("expected a non-/96 prefix to be rejected")
+	}
+}
+
+func TestMapIPv4(t *testing.T) {
+	got, err := provisionFiltered(t, "192.0.2.0/24\n2001:db8::/32\n", "map_ipv4\nnat64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"192.0.2.0/24", "2001:db8::/32", "64:ff9b::c000:200/120", "::ffff:192.0.2.0/120"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if mapped := netip.MustParsePrefix(expected[3]); !mapped.Contains(netip.MustParseAddr("::ffff:192.0.2.7")) {
+		t.Errorf("expected %s to contain the mapped client address", mapped)
+	}
+}
+
+func TestLineFilter(t *testing.T) {
+	body := "192.0.2.0/24 # category=scanner\n198.51.100.0/24 # category=spam\n203.0.113.0/24 # category=scanner\n"
+	got, err := provisionFiltered(t, body, `line_filter "category=scanner$"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"192.0.2.0/24", "203.0.113.0/24"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if _, err := provisionFiltered(t, body, `line_filter "("`); err == nil {
+		t.Error("expected invalid regex to be rejected")
+	}
+}
+
+func TestExtract(t *testing.T) {
+	body := "2024-05-01 blocked 192.0.2.7 for abuse\nnothing to see\n2024-05-01 blocked 198.51.100.0/24 for abuse\n"
+	got, err := provisionFiltered(t, body, `extract "blocked (\S+) for"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"192.0.2.7/32", "198.51.100.0/24"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	got, err = provisionFiltered(t, body, `extract "^(\d+)-\S+ blocked (?P<cidr>\S+)"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"192.0.2.7/32", "198.51.100.0/24"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if _, err := provisionFiltered(t, body, `extract "blocked \S+"`); err == nil {
+		t.Error("expected a regex without group to be rejected")
+	}
+}
+
+func TestStripBogons(t *testing.T) {
+	body := "104.16.0.0/13\n10.1.0.0/16\n192.0.0.0/22\n2606:4700::/32\n2001:db8::/48\nfd00::/8\n"
+	got, err := provisionFiltered(t, body, "strip_bogons")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"104.16.0.0/13", "192.0.1.0/24", "192.0.3.0/24", "2606:4700::/32"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// 0.0.0.0/0 is split into the routable space
+	got, err = provisionFiltered(t, "0.0.0.0/0\n", "strip_bogons\nmin_prefix_len 0 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(got, "0.0.0.0/0") || !slices.Contains(got, "1.0.0.0/8") || slices.Contains(got, "10.0.0.0/8") {
+		t.Errorf("unexpected ranges %v", got)
+	}
+}
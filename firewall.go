@@ -0,0 +1,297 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(OPNsenseIPRange{})
+	caddy.RegisterModule(PfSenseIPRange{})
+}
+
+// OPNsenseIPRange provides the current contents of an OPNsense firewall
+// alias. The contents are read from the alias's pf table, so host names,
+// URL tables and nested aliases are resolved exactly as the firewall
+// resolves them.
+type OPNsenseIPRange struct {
+	// Base URL of the firewall, e.g. https://fw.example.com.
+	URL string `json:"url"`
+	// Alias name.
+	Alias string `json:"alias"`
+	// API key and secret. Support placeholders such as {env.OPNSENSE_SECRET}.
+	APIKey    string `json:"api_key"`
+	APISecret string `json:"api_secret"`
+	// refresh Interval
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// request Timeout
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	pollingSource
+}
+
+// CaddyModule returns the Caddy module information.
+func (OPNsenseIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.opnsense",
+		New: func() caddy.Module { return new(OPNsenseIPRange) },
+	}
+}
+
+func (s *OPNsenseIPRange) Provision(ctx caddy.Context) error {
+	if s.URL == "" || s.Alias == "" {
+		return fmt.Errorf("url and alias are required")
+	}
+	s.URL = strings.TrimSuffix(s.URL, "/")
+	repl := caddy.NewReplacer()
+	s.APIKey = repl.ReplaceAll(s.APIKey, "")
+	s.APISecret = repl.ReplaceAll(s.APISecret, "")
+	if s.APIKey == "" || s.APISecret == "" {
+		return fmt.Errorf("api_key and api_secret are required")
+	}
+	return s.start(ctx, time.Duration(s.Interval), s.fetch)
+}
+
+func (s *OPNsenseIPRange) fetch(ctx context.Context) ([]netip.Prefix, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.Timeout))
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+"/api/firewall/alias_util/list/"+url.PathEscape(s.Alias), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(s.APIKey, s.APISecret)
+	var out struct {
+		Rows []struct {
+			IP string `json:"ip"`
+		} `json:"rows"`
+	}
+	if err := getJSON(req, &out); err != nil {
+		return nil, err
+	}
+	prefixes := make([]netip.Prefix, 0, len(out.Rows))
+	for _, row := range out.Rows {
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(row.IP)
+		if err != nil {
+			return nil, fmt.Errorf("alias %s: %v", s.Alias, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	opnsense <url> <alias> {
+//	   api_key key
+//	   api_secret secret
+//	   interval val
+//	   timeout val
+//	}
+func (m *OPNsenseIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	if !d.Args(&m.URL, &m.Alias) {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "api_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.APIKey = d.Val()
+		case "api_secret":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.APISecret = d.Val()
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Interval = caddy.Duration(val)
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Timeout = caddy.Duration(val)
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// PfSenseIPRange provides the addresses of a pfSense firewall alias through
+// the pfSense REST API package. Only IP and CIDR entries are included;
+// host names, ranges and nested aliases are skipped.
+type PfSenseIPRange struct {
+	// Base URL of the firewall, e.g. https://fw.example.com.
+	URL string `json:"url"`
+	// Alias name.
+	Alias string `json:"alias"`
+	// API key. Supports placeholders such as {env.PFSENSE_API_KEY}.
+	APIKey string `json:"api_key"`
+	// refresh Interval
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// request Timeout
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	log *zap.Logger
+	pollingSource
+}
+
+// CaddyModule returns the Caddy module information.
+func (PfSenseIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.pfsense",
+		New: func() caddy.Module { return new(PfSenseIPRange) },
+	}
+}
+
+func (s *PfSenseIPRange) Provision(ctx caddy.Context) error {
+	if s.URL == "" || s.Alias == "" {
+		return fmt.Errorf("url and alias are required")
+	}
+	s.URL = strings.TrimSuffix(s.URL, "/")
+	s.APIKey = caddy.NewReplacer().ReplaceAll(s.APIKey, "")
+	if s.APIKey == "" {
+		return fmt.Errorf("api_key is required")
+	}
+	s.log = ctx.Logger()
+	return s.start(ctx, time.Duration(s.Interval), s.fetch)
+}
+
+func (s *PfSenseIPRange) fetch(ctx context.Context) ([]netip.Prefix, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.Timeout))
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+"/api/v2/firewall/aliases?"+url.Values{"name": {s.Alias}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-API-Key", s.APIKey)
+	var out struct {
+		Data []struct {
+			Name    string   `json:"name"`
+			Address []string `json:"address"`
+		} `json:"data"`
+	}
+	if err := getJSON(req, &out); err != nil {
+		return nil, err
+	}
+
+	var prefixes []netip.Prefix
+	found := false
+	for _, alias := range out.Data {
+		if alias.Name != s.Alias {
+			continue
+		}
+		found = true
+		for _, address := range alias.Address {
+			prefix, err := caddyhttp.CIDRExpressionToPrefix(address)
+			if err != nil {
+				s.log.Debug("skipping alias entry", zap.String("alias", s.Alias), zap.String("entry", address))
+				continue
+			}
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("alias %s not found", s.Alias)
+	}
+	return prefixes, nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	pfsense <url> <alias> {
+//	   api_key key
+//	   interval val
+//	   timeout val
+//	}
+func (m *PfSenseIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	if !d.Args(&m.URL, &m.Alias) {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "api_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.APIKey = d.Val()
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Interval = caddy.Duration(val)
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Timeout = caddy.Duration(val)
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*OPNsenseIPRange)(nil)
+	_ caddy.Provisioner       = (*OPNsenseIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*OPNsenseIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*OPNsenseIPRange)(nil)
+
+	_ caddy.Module            = (*PfSenseIPRange)(nil)
+	_ caddy.Provisioner       = (*PfSenseIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*PfSenseIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*PfSenseIPRange)(nil)
+)
@@ -0,0 +1,53 @@
+package caddy_ip_list
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestOPNsense(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key, secret, _ := r.BasicAuth(); key != "opn-key" || secret != "opn-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/firewall/alias_util/list/trusted_proxies" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		w.Write([]byte(`{"total":2,"rowCount":2,"current":1,"rows":[{"ip":"192.0.2.0/24"},{"ip":"198.51.100.7"}]}`))
+	}))
+	defer server.Close()
+
+	got := provisionSource(t, &OPNsenseIPRange{}, `opnsense `+server.URL+` trusted_proxies {
+		api_key opn-key
+		api_secret opn-secret
+	}`)
+	expected := []string{"192.0.2.0/24", "198.51.100.7/32"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestPfSense(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "pf-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/v2/firewall/aliases" || r.URL.Query().Get("name") != "trusted_proxies" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		w.Write([]byte(`{"code":200,"status":"ok","data":[{"id":0,"name":"trusted_proxies","type":"network","address":["10.0.0.0/8","203.0.113.9","lb.example.com","other_alias"]}]}`))
+	}))
+	defer server.Close()
+
+	got := provisionSource(t, &PfSenseIPRange{}, `pfsense `+server.URL+` trusted_proxies {
+		api_key pf-key
+	}`)
+	expected := []string{"10.0.0.0/8", "203.0.113.9/32"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
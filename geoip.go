@@ -0,0 +1,194 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/oschwald/maxminddb-golang"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(GeoIPRange{})
+}
+
+// GeoIPRange provides the networks of one or more countries, read from a
+// local MaxMind GeoLite2/GeoIP2 Country or City database. The database is
+// re-read whenever the file changes, e.g. after geoipupdate runs.
+type GeoIPRange struct {
+	// Path of the .mmdb database file.
+	Database string `json:"database"`
+	// ISO 3166-1 alpha-2 country codes to provide the networks of.
+	Countries []string `json:"countries"`
+	// How often to check the database file for changes. Default is 1m.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	modTime time.Time
+	log     *zap.Logger
+	pollingSource
+}
+
+// CaddyModule returns the Caddy module information.
+func (GeoIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.geoip",
+		New: func() caddy.Module { return new(GeoIPRange) },
+	}
+}
+
+func (s *GeoIPRange) Provision(ctx caddy.Context) error {
+	if s.Database == "" {
+		return fmt.Errorf("database is required")
+	}
+	if len(s.Countries) == 0 {
+		return fmt.Errorf("at least one country is required")
+	}
+	for i, c := range s.Countries {
+		s.Countries[i] = strings.ToUpper(c)
+	}
+	s.log = ctx.Logger()
+
+	interval := time.Duration(s.Interval)
+	if interval == 0 {
+		interval = time.Minute
+	}
+	return s.start(ctx, interval, s.fetch)
+}
+
+// fetch loads the database when it changed since the last load, otherwise
+// it keeps the current ranges.
+func (s *GeoIPRange) fetch(_ context.Context) ([]netip.Prefix, error) {
+	info, err := os.Stat(s.Database)
+	if err != nil {
+		return nil, err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return s.GetIPRanges(nil), nil
+	}
+
+	buf, err := os.ReadFile(s.Database)
+	if err != nil {
+		return nil, err
+	}
+	db, err := maxminddb.FromBytes(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.Database, err)
+	}
+	prefixes, err := countryNetworks(db, s.Countries)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.Database, err)
+	}
+
+	s.modTime = info.ModTime()
+	s.log.Info("loaded GeoIP networks",
+		zap.String("database", s.Database),
+		zap.Strings("countries", s.Countries),
+		zap.Int("networks", len(prefixes)))
+	return prefixes, nil
+}
+
+// geoIPRecord holds the fields of Country and City database records that
+// locate a network.
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// countryCode returns country.iso_code of a record, falling back to the
+// registered country for networks without a located country.
+func (r geoIPRecord) countryCode() string {
+	if r.Country.ISOCode != "" {
+		return r.Country.ISOCode
+	}
+	return r.RegisteredCountry.ISOCode
+}
+
+// countryNetworks returns the networks of db located in one of countries.
+// IPv4 networks are returned once, skipping the aliases that IPv6
+// databases keep under ::ffff:0:0/96 and 2002::/16.
+func countryNetworks(db *maxminddb.Reader, countries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	networks := db.Networks(maxminddb.SkipAliasedNetworks)
+	for networks.Next() {
+		var record geoIPRecord
+		network, err := networks.Network(&record)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(countries, record.countryCode()) {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(network.IP)
+		if !ok {
+			return nil, fmt.Errorf("invalid network %s", network)
+		}
+		bits, _ := network.Mask.Size()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, bits))
+	}
+	return prefixes, networks.Err()
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	geoip {
+//	   database path
+//	   countries <code...>
+//	   interval val
+//	}
+func (m *GeoIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	// No same-line options are supported
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "database":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Database = d.Val()
+		case "countries":
+			codes := d.RemainingArgs()
+			if len(codes) == 0 {
+				return d.ArgErr()
+			}
+			m.Countries = append(m.Countries, codes...)
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Interval = caddy.Duration(val)
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*GeoIPRange)(nil)
+	_ caddy.Provisioner       = (*GeoIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*GeoIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*GeoIPRange)(nil)
+)
@@ -0,0 +1,213 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// buildTestMMDB writes a country database mapping each network to an ISO
+// code. IPv4 networks are stored under ::/96 when ipVersion is 6, with
+// aliases under ::ffff:0:0/96 and 2002::/16 as in MaxMind's databases.
+func buildTestMMDB(t *testing.T, ipVersion, recordSize int, networks map[string]string) []byte {
+	t.Helper()
+
+	// the data section starts with a shared "country" key that records
+	// refer to through a pointer
+	data := append([]byte{0x47}, "country"...)
+	offsets := map[string]int{}
+	for _, code := range networks {
+		if _, ok := offsets[code]; ok {
+			continue
+		}
+		offsets[code] = len(data)
+		data = append(data, 0xE1, 0x20, 0x00) // map{pointer -> "country":
+		data = append(data, 0xE1, 0x48)       //   map{"iso_code":
+		data = append(data, "iso_code"...)
+		data = append(data, 0x40|byte(len(code)))
+		data = append(data, code...)
+	}
+
+	// search tree; records are >= 0 for nodes, -1 for empty and
+	// -2-offset for data
+	nodes := [][2]int{{-1, -1}}
+	for cidr, code := range networks {
+		p := netip.MustParsePrefix(cidr)
+		ip, bits := p.Addr().As16(), p.Bits()
+		if p.Addr().Is4() {
+			v4 := p.Addr().As4()
+			if ipVersion == 4 {
+				ip = [16]byte{}
+				copy(ip[:], v4[:])
+			} else {
+				ip = [16]byte{12: v4[0], 13: v4[1], 14: v4[2], 15: v4[3]}
+				bits += 96
+			}
+		}
+		node := 0
+		for i := 0; i < bits; i++ {
+			bit := (ip[i/8] >> (7 - i%8)) & 1
+			if i == bits-1 {
+				nodes[node][bit] = -2 - offsets[code]
+				break
+			}
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	if ipVersion == 6 {
+		// the aliases point to the node of ::/96
+		ipv4Start := 0
+		for range 96 {
+			if nodes[ipv4Start][0] < 0 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[ipv4Start][0] = len(nodes) - 1
+			}
+			ipv4Start = nodes[ipv4Start][0]
+		}
+		for _, alias := range []string{"::ffff:0:0/96", "2002::/16"} {
+			p := netip.MustParsePrefix(alias)
+			ip, node := p.Addr().As16(), 0
+			for i := 0; i < p.Bits(); i++ {
+				bit := (ip[i/8] >> (7 - i%8)) & 1
+				if i == p.Bits()-1 {
+					nodes[node][bit] = ipv4Start
+					break
+				}
+				if nodes[node][bit] < 0 {
+					nodes = append(nodes, [2]int{-1, -1})
+					nodes[node][bit] = len(nodes) - 1
+				}
+				node = nodes[node][bit]
+			}
+		}
+	}
+
+	var buf []byte
+	record := func(v int) uint32 {
+		switch {
+		case v == -1:
+			return uint32(len(nodes))
+		case v < -1:
+			return uint32(len(nodes) + 16 + (-2 - v))
+		}
+		return uint32(v)
+	}
+	for _, n := range nodes {
+		l, r := record(n[0]), record(n[1])
+		switch recordSize {
+		case 24:
+			buf = append(buf, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			buf = append(buf, byte(l>>16), byte(l>>8), byte(l), byte(l>>24)<<4|byte(r>>24)&0x0F, byte(r>>16), byte(r>>8), byte(r))
+		case 32:
+			buf = binary.BigEndian.AppendUint32(buf, l)
+			buf = binary.BigEndian.AppendUint32(buf, r)
+		}
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, data...)
+
+	buf = append(buf, "\xAB\xCD\xEFMaxMind.com"...)
+	buf = append(buf, 0xE3, 0x4A)
+	buf = append(buf, "node_count"...)
+	buf = binary.BigEndian.AppendUint32(append(buf, 0xC4), uint32(len(nodes)))
+	buf = append(buf, 0x4B)
+	buf = append(buf, "record_size"...)
+	buf = binary.BigEndian.AppendUint16(append(buf, 0xA2), uint16(recordSize))
+	buf = append(buf, 0x4A)
+	buf = append(buf, "ip_version"...)
+	buf = binary.BigEndian.AppendUint16(append(buf, 0xA2), uint16(ipVersion))
+	return buf
+}
+
+func TestMMDBNetworks(t *testing.T) {
+	networks := map[string]string{
+		"192.0.2.0/24":      "NL",
+		"198.51.100.0/25":   "DE",
+		"198.51.100.128/25": "NL",
+		"2001:db8::/32":     "NL",
+	}
+	for _, tc := range []struct{ ipVersion, recordSize int }{{6, 24}, {6, 28}, {6, 32}, {4, 28}} {
+		nets := networks
+		if tc.ipVersion == 4 {
+			nets = map[string]string{"192.0.2.0/24": "NL", "198.51.100.0/25": "DE", "198.51.100.128/25": "NL"}
+		}
+		db, err := maxminddb.FromBytes(buildTestMMDB(t, tc.ipVersion, tc.recordSize, nets))
+		if err != nil {
+			t.Fatalf("%+v: %v", tc, err)
+		}
+		prefixes, err := countryNetworks(db, []string{"NL"})
+		if err != nil {
+			t.Fatalf("%+v: %v", tc, err)
+		}
+		got := prefixStrings(prefixes)
+		expected := []string{"192.0.2.0/24", "198.51.100.128/25"}
+		if tc.ipVersion == 6 {
+			expected = append(expected, "2001:db8::/32")
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, expected) {
+			t.Errorf("%+v: expected %v, got %v", tc, expected, got)
+		}
+	}
+}
+
+func TestGeoIPProvision(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "GeoLite2-Country.mmdb")
+	if err := os.WriteFile(path, buildTestMMDB(t, 6, 28, map[string]string{
+		"192.0.2.0/24":  "NL",
+		"2001:db8::/32": "DE",
+	}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	input := `
+	geoip {
+		database ` + path + `
+		countries nl de
+		interval 10ms
+	}`
+	d := caddyfile.NewTestDispenser(input)
+	r := GeoIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	if ranges := r.GetIPRanges(nil); len(ranges) != 2 {
+		t.Fatalf("expected 2 ranges, got %v", ranges)
+	}
+
+	// replacing the database is picked up on the next check
+	if err := os.WriteFile(path, buildTestMMDB(t, 6, 28, map[string]string{"192.0.2.0/24": "NL"}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(r.GetIPRanges(nil)) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("database change not picked up, ranges: %v", r.GetIPRanges(nil))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
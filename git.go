@@ -0,0 +1,231 @@
+package caddy_ip_list
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(GitIPRange{})
+}
+
+// gitDirLocks serialise the git commands on each bare clone, which the
+// sources of a repository and ref share, including across config reloads:
+// a fetch overwrites FETCH_HEAD, which the files are then read from.
+var (
+	gitDirLocks   = make(map[string]*sync.Mutex)
+	gitDirLocksMu sync.Mutex
+)
+
+func gitDirLock(dir string) *sync.Mutex {
+	gitDirLocksMu.Lock()
+	defer gitDirLocksMu.Unlock()
+	lock, ok := gitDirLocks[dir]
+	if !ok {
+		lock = new(sync.Mutex)
+		gitDirLocks[dir] = lock
+	}
+	return lock
+}
+
+// GitIPRange provides IP ranges read from files in a Git repository. The
+// repository is fetched with the system git binary on every interval, so
+// both HTTPS and SSH remotes work with the usual git configuration.
+type GitIPRange struct {
+	// Repository to fetch, e.g. https://github.com/org/lists.git or
+	// git@github.com:org/lists.git.
+	Repo string `json:"repo"`
+	// Branch or tag to read the files from. Defaults to the remote HEAD.
+	Ref string `json:"ref,omitempty"`
+	// Paths of the list files within the repository.
+	Paths []string `json:"paths"`
+	// Optional SSH private key used for SSH remotes.
+	SSHKey string `json:"ssh_key,omitempty"`
+	// refresh Interval
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// Timeout for a single fetch of the repository.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	dir string
+	pollingSource
+}
+
+// CaddyModule returns the Caddy module information.
+func (GitIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.git",
+		New: func() caddy.Module { return new(GitIPRange) },
+	}
+}
+
+func (s *GitIPRange) Provision(ctx caddy.Context) error {
+	if s.Repo == "" {
+		return fmt.Errorf("repo is required")
+	}
+	if len(s.Paths) == 0 {
+		return fmt.Errorf("at least one path is required")
+	}
+	// git would take them for options
+	if strings.HasPrefix(s.Repo, "-") || strings.HasPrefix(s.Ref, "-") {
+		return fmt.Errorf("repo and ref must not start with '-'")
+	}
+
+	// one bare clone per repository and ref under Caddy's data directory
+	sum := sha256.Sum256([]byte(s.Repo + "\x00" + s.Ref))
+	s.dir = filepath.Join(caddy.AppDataDir(), "ip-list-git", hex.EncodeToString(sum[:8]))
+
+	return s.start(ctx, time.Duration(s.Interval), s.fetch)
+}
+
+func (s *GitIPRange) fetch(ctx context.Context) ([]netip.Prefix, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.Timeout))
+		defer cancel()
+	}
+
+	lock := gitDirLock(s.dir)
+	lock.Lock()
+	defer lock.Unlock()
+	if _, err := os.Stat(filepath.Join(s.dir, "HEAD")); err != nil {
+		if err := os.MkdirAll(s.dir, 0o755); err != nil {
+			return nil, err
+		}
+		if _, err := s.git(ctx, "init", "--bare", "--quiet"); err != nil {
+			return nil, err
+		}
+	}
+
+	ref := s.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if _, err := s.git(ctx, "fetch", "--quiet", "--depth", "1", "--force", "--no-tags", "--", s.Repo, ref); err != nil {
+		return nil, err
+	}
+
+	var prefixes []netip.Prefix
+	for _, path := range s.Paths {
+		out, err := s.git(ctx, "show", "FETCH_HEAD:"+path)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := parseList(bytes.NewReader(out))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		prefixes = append(prefixes, parsed...)
+	}
+	return prefixes, nil
+}
+
+// git runs a git command against the bare repository.
+func (s *GitIPRange) git(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"--git-dir", s.dir}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if s.SSHKey != "" {
+		cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND=ssh -i "+shellQuote(s.SSHKey)+" -o IdentitiesOnly=yes -o BatchMode=yes")
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// shellQuote quotes s as a single word for the shell, which git runs
+// GIT_SSH_COMMAND with.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	git {
+//	   repo url
+//	   ref branch|tag
+//	   path file [file...]
+//	   ssh_key path
+//	   interval val
+//	   timeout val
+//	}
+func (m *GitIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	// No same-line options are supported
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "repo":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Repo = d.Val()
+		case "ref":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Ref = d.Val()
+		case "path":
+			paths := d.RemainingArgs()
+			if len(paths) == 0 {
+				return d.ArgErr()
+			}
+			m.Paths = append(m.Paths, paths...)
+		case "ssh_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.SSHKey = d.Val()
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Interval = caddy.Duration(val)
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Timeout = caddy.Duration(val)
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*GitIPRange)(nil)
+	_ caddy.Provisioner       = (*GitIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*GitIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*GitIPRange)(nil)
+)
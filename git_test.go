@@ -0,0 +1,138 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestGitUnmarshal(t *testing.T) {
+	input := `
+	git {
+		repo git@github.com:org/lists.git
+		ref v1.2.0
+		path office.txt vpn.txt
+		path partners.txt
+		ssh_key /etc/caddy/deploy_key
+		interval 10m
+	}`
+
+	d := caddyfile.NewTestDispenser(input)
+	r := GitIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if r.Repo != "git@github.com:org/lists.git" || r.Ref != "v1.2.0" || r.SSHKey != "/etc/caddy/deploy_key" {
+		t.Errorf("unexpected config: %+v", r)
+	}
+	if len(r.Paths) != 3 || r.Paths[2] != "partners.txt" {
+		t.Errorf("unexpected paths: %v", r.Paths)
+	}
+}
+
+func TestGitOptionInjection(t *testing.T) {
+	for _, r := range []GitIPRange{
+		{Repo: "--upload-pack=touch /tmp/pwned", Paths: []string{"list.txt"}},
+		{Repo: "https://example.com/lists.git", Ref: "--upload-pack=touch /tmp/pwned", Paths: []string{"list.txt"}},
+	} {
+		if err := r.Provision(caddy.Context{}); err == nil {
+			t.Errorf("expected repo %q and ref %q to be rejected", r.Repo, r.Ref)
+		}
+	}
+
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not installed")
+	}
+	for _, key := range []string{"/etc/caddy/deploy key", "/tmp/it's; touch pwned", "$(id)"} {
+		out, err := exec.Command("sh", "-c", "printf %s "+shellQuote(key)).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != key {
+			t.Errorf("expected the shell to see %q, got %q", key, out)
+		}
+	}
+}
+
+func TestGitProvision(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+
+	// build a local repository with a tagged list file
+	repo := t.TempDir()
+	run := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	run("init", "--quiet")
+	if err := os.MkdirAll(filepath.Join(repo, "lists"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, "lists", "office.txt"), []byte("# office\n192.0.2.0/24\n198.51.100.7\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	run("add", ".")
+	run("commit", "--quiet", "-m", "add list")
+	run("tag", "v1")
+
+	r := GitIPRange{Repo: repo, Ref: "v1", Paths: []string{"lists/office.txt"}}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+
+	ranges := r.GetIPRanges(nil)
+	if len(ranges) != 2 || ranges[0].String() != "192.0.2.0/24" || ranges[1].String() != "198.51.100.7/32" {
+		t.Errorf("unexpected ranges: %v", ranges)
+	}
+
+	// sources of other refs of the repository fetch concurrently without
+	// reading each other's files
+	if err := os.WriteFile(filepath.Join(repo, "lists", "office.txt"), []byte("203.0.113.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	run("commit", "--quiet", "-am", "change list")
+	run("tag", "v2")
+	v2 := GitIPRange{Repo: repo, Ref: "v2", Paths: []string{"lists/office.txt"}}
+	if err := v2.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	var wg sync.WaitGroup
+	for _, source := range []*GitIPRange{&r, &v2} {
+		for range 5 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := source.fetch(ctx); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	for source, expected := range map[*GitIPRange]string{&r: "192.0.2.0/24", &v2: "203.0.113.0/24"} {
+		prefixes, err := source.fetch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(prefixes) == 0 || prefixes[0].String() != expected {
+			t.Errorf("%s: expected %s, got %v", source.Ref, expected, prefixes)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package caddy_ip_list
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// cacheSnapshot is an earlier version of the lists, kept in the cache with
+// cache_history.
+type cacheSnapshot struct {
+	// When this version was first saved.
+	UpdatedAt time.Time           `json:"updated_at"`
+	URLs      map[string][]string `json:"urls"`
+}
+
+func (s cacheSnapshot) prefixes(urls []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, url := range urls {
+		for _, p := range s.URLs[url] {
+			prefix, err := caddyhttp.CIDRExpressionToPrefix(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid prefix in snapshot %q: %w", p, err)
+			}
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes, nil
+}
+
+func snapshotOf(contents *cacheFileContents) cacheSnapshot {
+	snapshot := cacheSnapshot{
+		UpdatedAt: contents.UpdatedAt,
+		URLs:      make(map[string][]string, len(contents.URLs)),
+	}
+	for url, entry := range contents.URLs {
+		snapshot.URLs[url] = entry.Prefixes
+	}
+	return snapshot
+}
+
+// restoreHistory takes the history from a loaded cache.
+func (s *URLIPRange) restoreHistory(contents *cacheFileContents) {
+	if s.CacheHistory <= 0 || s.saved != nil {
+		return
+	}
+	saved := snapshotOf(contents)
+	s.saved = &saved
+	s.history = contents.History
+	if len(s.history) > s.CacheHistory {
+		s.history = s.history[:s.CacheHistory]
+	}
+}
+
+// recordHistory adds the history to the cache about to be saved. The
+// previously saved version becomes the newest snapshot if the lists
+// changed since.
+func (s *URLIPRange) recordHistory(contents *cacheFileContents) {
+	if s.CacheHistory <= 0 {
+		return
+	}
+	current := snapshotOf(contents)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.saved == nil || !maps.EqualFunc(s.saved.URLs, current.URLs, slices.Equal) {
+		if s.saved != nil {
+			s.history = slices.Insert(s.history, 0, *s.saved)
+			if len(s.history) > s.CacheHistory {
+				s.history = s.history[:s.CacheHistory]
+			}
+		}
+		s.saved = &current
+	}
+	contents.History = s.history
+}
+
+// listID identifies a list in the admin API.
+func (s *URLIPRange) listID() string {
+	sum := sha256.Sum256([]byte(s.poolKey))
+	return hex.EncodeToString(sum[:8])
+}
+
+type historyEntry struct {
+	UpdatedAt time.Time `json:"updated_at"`
+	Entries   int       `json:"entries"`
+}
+
+// historyEntries describes the snapshots, newest first.
+func (s *URLIPRange) historyEntries() []historyEntry {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	entries := make([]historyEntry, 0, len(s.history))
+	for _, snapshot := range s.history {
+		entry := historyEntry{UpdatedAt: snapshot.UpdatedAt}
+		for _, url := range s.URLs {
+			entry.Entries += len(snapshot.URLs[url])
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (s *URLIPRange) snapshot(n int) (cacheSnapshot, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if n < 0 || n >= len(s.history) {
+		return cacheSnapshot{}, fmt.Errorf("no snapshot %d", n)
+	}
+	return s.history[n], nil
+}
+
+// snapshotDiff compares snapshot n with the ranges in use: added holds the
+// ranges that are in use but were not in the snapshot, removed those that
+// were in the snapshot but are no longer in use. It is computed by the
+// refresh loop, which owns the excluded lists the snapshot is resolved
+// with.
+func (s *URLIPRange) snapshotDiff(n int) (added, removed []netip.Prefix, err error) {
+	done := make(chan snapshotDiffResult, 1)
+	select {
+	case s.snapshotDiffs <- snapshotDiffRequest{snapshot: n, done: done}:
+		result := <-done
+		return result.added, result.removed, result.err
+	case <-s.shutdown:
+		return nil, nil, fmt.Errorf("list is stopped")
+	case <-s.ctx.Done():
+		return nil, nil, fmt.Errorf("list is stopped")
+	}
+}
+
+type snapshotDiffRequest struct {
+	snapshot int
+	done     chan snapshotDiffResult
+}
+
+type snapshotDiffResult struct {
+	added, removed []netip.Prefix
+	err            error
+}
+
+// diffSnapshot compares snapshot n, resolved like the lists in use, with
+// the ranges in use.
+func (s *URLIPRange) diffSnapshot(n int) (added, removed []netip.Prefix, err error) {
+	snapshot, err := s.snapshot(n)
+	if err != nil {
+		return nil, nil, err
+	}
+	old, err := snapshot.prefixes(s.URLs)
+	if err != nil {
+		return nil, nil, err
+	}
+	// resolve returns canonical prefixes already
+	added, removed = diffPrefixes(s.resolve(old), canonicalPrefixes(s.GetIPRanges(nil)))
+	return added, removed, nil
+}
+
+type rollbackRequest struct {
+	snapshot int
+	done     chan error
+}
+
+// rollback replaces the lists with snapshot n. It is applied by the refresh
+// loop, which owns the lists.
+func (s *URLIPRange) rollback(n int) error {
+	done := make(chan error, 1)
+	select {
+	case s.rollbacks <- rollbackRequest{snapshot: n, done: done}:
+		return <-done
+	case <-s.shutdown:
+		return fmt.Errorf("list is stopped")
+	case <-s.ctx.Done():
+		return fmt.Errorf("list is stopped")
+	}
+}
+
+// applySnapshot replaces the lists with snapshot n. The validators of the
+// current lists are kept, so the rollback stays in effect until a URL
+// publishes a new list, if the server supports conditional requests.
+func (s *URLIPRange) applySnapshot(n int) error {
+	snapshot, err := s.snapshot(n)
+	if err != nil {
+		return err
+	}
+	for _, url := range s.URLs {
+		prefixes, err := snapshot.prefixes([]string{url})
+		if err != nil {
+			return err
+		}
+		list := s.lists[url]
+		list.prefixes = prefixes
+		s.lists[url] = list
+	}
+	ranges := s.resolve(s.combined())
+	s.publish(ranges)
+	s.exportRanges(ranges)
+	if s.log != nil {
+		s.log.Warn("rolled back IP ranges to snapshot",
+			zap.Time("snapshot_updated_at", snapshot.UpdatedAt),
+			zap.Int("count", len(ranges)))
+	}
+	return s.saveToCache()
+}
@@ -0,0 +1,140 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestCacheHistory(t *testing.T) {
+	var version atomic.Int32
+	version.Store(1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := fmt.Sprintf(`"v%d"`, version.Load())
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		if version.Load() == 1 {
+			w.Write([]byte("192.0.2.0/24\n"))
+		} else {
+			w.Write([]byte("192.0.2.0/24\n198.51.100.0/24\n"))
+		}
+	}))
+	defer server.Close()
+
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	d := caddyfile.NewTestDispenser(`list {
+		url ` + server.URL + `
+		interval 10ms
+		cache_file ` + cacheFile + `
+		cache_history 2
+		exclude 192.0.2.128/25
+	}`)
+	r := URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	defer r.Cleanup()
+
+	waitFor := func(expected []string) {
+		t.Helper()
+		var got []string
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if got = prefixStrings(r.GetIPRanges(nil)); slices.Equal(got, expected) {
+				return
+			}
+		}
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	version.Store(2)
+	waitFor([]string{"192.0.2.0/25", "198.51.100.0/24"})
+
+	api := adminIPList{}
+	path := "/ip-list/history/" + r.listID()
+	serve := func(method, path string) []byte {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		if err := api.handleHistory(rec, httptest.NewRequest(method, path, nil)); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		return rec.Body.Bytes()
+	}
+
+	var entries []historyEntry
+	for deadline := time.Now().Add(5 * time.Second); len(entries) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if err := json.Unmarshal(serve(http.MethodGet, path), &entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(entries) != 1 || entries[0].Entries != 1 {
+		t.Fatalf("expected one snapshot, got %+v", entries)
+	}
+
+	var diff map[string][]string
+	if err := json.Unmarshal(serve(http.MethodGet, path+"/0"), &diff); err != nil {
+		t.Fatal(err)
+	}
+	// the snapshot is compared with the exclusions applied
+	if !slices.Equal(diff["added"], []string{"198.51.100.0/24"}) || len(diff["removed"]) != 0 {
+		t.Errorf("unexpected diff %v", diff)
+	}
+
+	serve(http.MethodPost, path+"/0/rollback")
+	waitFor([]string{"192.0.2.0/25"})
+	// the rollback stays in effect while the list is unchanged
+	time.Sleep(50 * time.Millisecond)
+	waitFor([]string{"192.0.2.0/25"})
+
+	if err := api.handleHistory(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, path+"/5/rollback", nil)); err == nil {
+		t.Error("expected missing snapshot to be rejected")
+	}
+	if err := api.handleHistory(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ip-list/history/unknown", nil)); err == nil {
+		t.Error("expected unknown list to be rejected")
+	}
+}
+
+// TestHistoryAfterShutdown tests that snapshot requests fail, rather than
+// wait for the refresh loop, once the list is shutting down.
+func TestHistoryAfterShutdown(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	r := &URLIPRange{CacheDisabled: true}
+	if err := r.setup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	close(r.shutdown)
+
+	done := make(chan error, 2)
+	go func() { done <- r.rollback(0) }()
+	go func() {
+		_, _, err := r.snapshotDiff(0)
+		done <- err
+	}()
+	for range 2 {
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Error("expected the stopped list to reject the request")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("request to the stopped list did not return")
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package caddy_ip_list
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fetchStats describes a single fetch of a URL.
+type fetchStats struct {
+	retries int
+	// URL and HTTP status of the last response, after redirects
+	finalURL string
+	status   int
+	// size of the downloaded list, and how long reading and parsing it
+	// took
+	bytes         int64
+	parseDuration time.Duration
+	// number of entries parsed and of invalid lines skipped
+	parsed      int
+	parseErrors int
+}
+
+// fetchMetrics accumulates the fetches of a URL for the metrics.
+type fetchMetrics struct {
+	successes, failures  uint64
+	retries, parseErrors uint64
+	// duration and size of the last fetch
+	duration time.Duration
+	bytes    int64
+}
+
+// recordMetrics adds a fetch of url that took duration and failed with
+// err, if not nil, to its metrics.
+func (s *URLIPRange) recordMetrics(url string, stats fetchStats, duration time.Duration, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.metrics == nil {
+		s.metrics = make(map[string]fetchMetrics)
+	}
+	m := s.metrics[url]
+	if err == nil {
+		m.successes++
+	} else {
+		m.failures++
+	}
+	m.retries += uint64(stats.retries)
+	m.parseErrors += uint64(stats.parseErrors)
+	m.duration, m.bytes = duration, stats.bytes
+	s.metrics[url] = m
+}
+
+// countingReader counts the bytes read from a response body.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+var (
+	fetchesDesc = prometheus.NewDesc("caddy_ip_list_fetches_total",
+		"Number of fetches of a URL by result.", []string{"list", "url", "result"}, nil)
+	fetchRetriesDesc = prometheus.NewDesc("caddy_ip_list_fetch_retries_total",
+		"Number of retried requests while fetching a URL.", []string{"list", "url"}, nil)
+	parseErrorsDesc = prometheus.NewDesc("caddy_ip_list_parse_errors_total",
+		"Number of invalid lines skipped while parsing the list of a URL.", []string{"list", "url"}, nil)
+	fetchDurationDesc = prometheus.NewDesc("caddy_ip_list_fetch_duration_seconds",
+		"Duration of the last fetch of a URL, including retries.", []string{"list", "url"}, nil)
+	fetchBytesDesc = prometheus.NewDesc("caddy_ip_list_fetch_bytes",
+		"Size of the list downloaded by the last fetch of a URL.", []string{"list", "url"}, nil)
+	httpStatusDesc = prometheus.NewDesc("caddy_ip_list_fetch_http_status",
+		"HTTP status of the last response for a URL.", []string{"list", "url"}, nil)
+	lastSuccessDesc = prometheus.NewDesc("caddy_ip_list_last_success_timestamp_seconds",
+		"Time of the last successful fetch of a URL.", []string{"list", "url"}, nil)
+	failuresDesc = prometheus.NewDesc("caddy_ip_list_consecutive_failures",
+		"Number of fetches of a URL that failed since the last success.", []string{"list", "url"}, nil)
+	healthDesc = prometheus.NewDesc("caddy_ip_list_health",
+		"Health of a URL: 1 for its current state, 0 for the others.", []string{"list", "url", "state"}, nil)
+	prefixesDesc = prometheus.NewDesc("caddy_ip_list_prefixes",
+		"Number of ranges in use from a URL.", []string{"list", "url"}, nil)
+	rangesDesc = prometheus.NewDesc("caddy_ip_list_ranges",
+		"Number of ranges a list provides.", []string{"list"}, nil)
+)
+
+// listCollector exports the metrics of the lists of a config to its
+// metrics registry. The lists are shared between configs, so their
+// metrics are collected on scrape rather than registered by each list.
+type listCollector struct {
+	mu    sync.Mutex
+	lists map[*URLIPRange]struct{}
+}
+
+// registerMetrics exports the metrics of list to the metrics registry of
+// ctx, which has one collector for all of its lists.
+func registerMetrics(ctx caddy.Context, list *URLIPRange) error {
+	registry := ctx.GetMetricsRegistry()
+	if registry == nil {
+		return nil
+	}
+	collector := &listCollector{lists: map[*URLIPRange]struct{}{list: {}}}
+	err := registry.Register(collector)
+	var registered prometheus.AlreadyRegisteredError
+	if !errors.As(err, &registered) {
+		return err
+	}
+	collector, ok := registered.ExistingCollector.(*listCollector)
+	if !ok {
+		return err
+	}
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	collector.lists[list] = struct{}{}
+	return nil
+}
+
+// Describe implements prometheus.Collector.
+func (c *listCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		fetchesDesc, fetchRetriesDesc, parseErrorsDesc, fetchDurationDesc, fetchBytesDesc,
+		httpStatusDesc, lastSuccessDesc, failuresDesc, healthDesc, prefixesDesc, rangesDesc,
+	} {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *listCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for list := range c.lists {
+		list.collect(ch)
+	}
+}
+
+func (s *URLIPRange) collect(ch chan<- prometheus.Metric) {
+	id := s.listID()
+	gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, append([]string{id}, labels...)...)
+	}
+	counter := func(desc *prometheus.Desc, value uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), append([]string{id}, labels...)...)
+	}
+
+	for url, status := range s.fetchStatus() {
+		gauge(prefixesDesc, float64(status.Entries), url)
+		gauge(failuresDesc, float64(status.Failures), url)
+		for _, state := range []string{"healthy", "degraded", "failed"} {
+			value := 0.0
+			if state == status.Health {
+				value = 1
+			}
+			gauge(healthDesc, value, url, state)
+		}
+		if status.HTTPStatus != 0 {
+			gauge(httpStatusDesc, float64(status.HTTPStatus), url)
+		}
+		if !status.LastSuccess.IsZero() {
+			gauge(lastSuccessDesc, float64(status.LastSuccess.UnixNano())/1e9, url)
+		}
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for url, m := range s.metrics {
+		counter(fetchesDesc, m.successes, url, "success")
+		counter(fetchesDesc, m.failures, url, "failure")
+		counter(fetchRetriesDesc, m.retries, url)
+		counter(parseErrorsDesc, m.parseErrors, url)
+		gauge(fetchDurationDesc, m.duration.Seconds(), url)
+		gauge(fetchBytesDesc, float64(m.bytes), url)
+	}
+	gauge(rangesDesc, float64(len(s.ranges)))
+}
+
+// Interface guards
+var (
+	_ prometheus.Collector = (*listCollector)(nil)
+	_ io.Reader            = (*countingReader)(nil)
+)
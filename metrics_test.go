@@ -0,0 +1,98 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestMetrics(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	r, _ := provisionUpdatable(t, ctx)
+	// another use of the list in the same config shares the collector
+	shared := &URLIPRange{URLs: r.URLs, CacheDisabled: true}
+	if err := shared.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer shared.Cleanup()
+
+	families, err := ctx.GetMetricsRegistry().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			name := family.GetName()
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "result" || label.GetName() == "state" {
+					name += "/" + label.GetValue()
+				}
+			}
+			switch {
+			case metric.GetGauge() != nil:
+				values[name] = metric.GetGauge().GetValue()
+			case metric.GetCounter() != nil:
+				values[name] = metric.GetCounter().GetValue()
+			}
+		}
+	}
+	for name, expected := range map[string]float64{
+		"caddy_ip_list_fetches_total/success": 1,
+		"caddy_ip_list_fetches_total/failure": 0,
+		"caddy_ip_list_fetch_retries_total":   0,
+		"caddy_ip_list_fetch_bytes":           float64(len("192.0.2.0/24\n")),
+		"caddy_ip_list_fetch_http_status":     200,
+		"caddy_ip_list_prefixes":              1,
+		"caddy_ip_list_health/healthy":        1,
+		"caddy_ip_list_health/degraded":       0,
+		"caddy_ip_list_ranges":                1,
+		"caddy_ip_list_consecutive_failures":  0,
+		"caddy_ip_list_parse_errors_total":    0,
+	} {
+		if got, ok := values[name]; !ok || got != expected {
+			t.Errorf("expected %s to be %v, got %v", name, expected, got)
+		}
+	}
+	if values["caddy_ip_list_last_success_timestamp_seconds"] == 0 {
+		t.Error("expected the time of the last success")
+	}
+}
+
+func TestFetchStats(t *testing.T) {
+	const body = "192.0.2.0/24\ninvalid\n198.51.100.0/24\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/list.txt", http.StatusFound)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	d := caddyfile.NewTestDispenser(`list {
+		url ` + server.URL + `/old
+		on_parse_error skip
+	}`)
+	r := URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.setup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_, stats, err := r.fetch(r.URLs[0], urlList{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.finalURL != server.URL+"/list.txt" || stats.status != http.StatusOK || stats.bytes != int64(len(body)) || stats.parsed != 2 || stats.parseErrors != 1 {
+		t.Errorf("unexpected fetch stats %+v", stats)
+	}
+}
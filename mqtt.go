@@ -0,0 +1,244 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(MQTTIPRange{})
+}
+
+// MQTTIPRange provides IP ranges published to an MQTT topic. Each message
+// holds a complete list (one IP or CIDR per line) and replaces the list
+// previously published to the same topic; with a wildcard topic the
+// ranges of all matching topics are combined. Retained messages provide
+// the current list right after subscribing, and an empty message clears
+// a topic's list.
+type MQTTIPRange struct {
+	// Broker URL, e.g. mqtt://broker:1883 or mqtts://broker:8883.
+	Broker string `json:"broker"`
+	// Topic (filter) to subscribe to.
+	Topic string `json:"topic"`
+	// Client identifier. Defaults to a random caddy-ip-list-* ID.
+	ClientID string `json:"client_id,omitempty"`
+	// Credentials. Support placeholders such as {env.MQTT_PASSWORD}.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Subscription QoS, 0 (default) or 1.
+	QoS int `json:"qos,omitempty"`
+	// Keep alive interval. Default is 60s.
+	KeepAlive caddy.Duration `json:"keep_alive,omitempty"`
+
+	streamSource
+}
+
+// CaddyModule returns the Caddy module information.
+func (MQTTIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.mqtt",
+		New: func() caddy.Module { return new(MQTTIPRange) },
+	}
+}
+
+func (s *MQTTIPRange) Provision(ctx caddy.Context) error {
+	if s.Broker == "" || s.Topic == "" {
+		return fmt.Errorf("broker and topic are required")
+	}
+	if _, err := mqttBroker(s.Broker); err != nil {
+		return err
+	}
+	if s.QoS < 0 || s.QoS > 1 {
+		return fmt.Errorf("unsupported QoS %d", s.QoS)
+	}
+	if s.ClientID == "" {
+		b := make([]byte, 6)
+		_, _ = rand.Read(b)
+		s.ClientID = "caddy-ip-list-" + hex.EncodeToString(b)
+	}
+	if s.KeepAlive == 0 {
+		s.KeepAlive = caddy.Duration(60 * time.Second)
+	}
+	if err := checkMQTTKeepAlive(time.Duration(s.KeepAlive)); err != nil {
+		return err
+	}
+	repl := caddy.NewReplacer()
+	s.Username = repl.ReplaceAll(s.Username, "")
+	s.Password = repl.ReplaceAll(s.Password, "")
+
+	s.run(ctx, s.session)
+	return nil
+}
+
+// checkMQTTKeepAlive returns an error if keepAlive doesn't fit the whole
+// seconds of the keep alive field of CONNECT.
+func checkMQTTKeepAlive(keepAlive time.Duration) error {
+	if keepAlive < time.Second || keepAlive > math.MaxUint16*time.Second {
+		return fmt.Errorf("keep_alive must be between 1s and %ds", math.MaxUint16)
+	}
+	return nil
+}
+
+// mqttBroker returns the URL of broker with its default port filled in.
+func mqttBroker(broker string) (string, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return "", err
+	}
+	port := "1883"
+	switch u.Scheme {
+	case "mqtt", "tcp":
+	case "mqtts", "ssl", "tls":
+		port = "8883"
+	default:
+		return "", fmt.Errorf("unsupported broker scheme %q", u.Scheme)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	return u.Scheme + "://" + net.JoinHostPort(u.Hostname(), port), nil
+}
+
+func (s *MQTTIPRange) session(ctx context.Context) error {
+	broker, _ := mqttBroker(s.Broker)
+	lost := make(chan error, 1)
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(s.ClientID).
+		SetUsername(s.Username).
+		SetPassword(s.Password).
+		SetCleanSession(true).
+		SetKeepAlive(time.Duration(s.KeepAlive)).
+		SetConnectTimeout(30 * time.Second).
+		SetAutoReconnect(false).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) { lost <- err })
+	client := mqtt.NewClient(opts)
+	if err := waitMQTT(ctx, client.Connect()); err != nil {
+		return err
+	}
+	defer client.Disconnect(250)
+
+	subscribe := client.Subscribe(s.Topic, byte(s.QoS), func(_ mqtt.Client, msg mqtt.Message) {
+		s.update(msg.Topic(), msg.Payload())
+	})
+	if err := waitMQTT(ctx, subscribe); err != nil {
+		return err
+	}
+	if code := subscribe.(*mqtt.SubscribeToken).Result()[s.Topic]; code == 0x80 {
+		return fmt.Errorf("subscription to %q rejected", s.Topic)
+	}
+	s.log.Info("subscribed to MQTT topic", zap.String("topic", s.Topic))
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-lost:
+		return err
+	}
+}
+
+// waitMQTT waits for token to complete, or ctx to be done.
+func waitMQTT(ctx context.Context, token mqtt.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	mqtt {
+//	   broker url
+//	   topic filter
+//	   client_id id
+//	   username name
+//	   password secret
+//	   qos 0|1
+//	   keep_alive val
+//	}
+func (m *MQTTIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	// No same-line options are supported
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "broker":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Broker = d.Val()
+		case "topic":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Topic = d.Val()
+		case "client_id":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ClientID = d.Val()
+		case "username":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Username = d.Val()
+		case "password":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Password = d.Val()
+		case "qos":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			qos, err := strconv.Atoi(d.Val())
+			if err != nil || qos < 0 || qos > 1 {
+				return d.Errf("invalid qos value: %s", d.Val())
+			}
+			m.QoS = qos
+		case "keep_alive":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			if err := checkMQTTKeepAlive(val); err != nil {
+				return d.WrapErr(err)
+			}
+			m.KeepAlive = caddy.Duration(val)
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*MQTTIPRange)(nil)
+	_ caddy.Provisioner       = (*MQTTIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*MQTTIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*MQTTIPRange)(nil)
+)
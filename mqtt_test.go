@@ -0,0 +1,134 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// fakeMQTTBroker accepts one client, grants its subscription with code
+// and sends it the retained payloads published on the channel.
+func fakeMQTTBroker(t *testing.T, code byte, publish <-chan string) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if p, err := packets.ReadPacket(conn); err != nil {
+			t.Errorf("expected CONNECT: %v", err)
+			return
+		} else if _, ok := p.(*packets.ConnectPacket); !ok {
+			t.Errorf("expected CONNECT, got %v", p)
+			return
+		}
+		_ = packets.NewControlPacket(packets.Connack).Write(conn)
+
+		p, err := packets.ReadPacket(conn)
+		sub, ok := p.(*packets.SubscribePacket)
+		if err != nil || !ok {
+			t.Errorf("expected SUBSCRIBE, got %v: %v", p, err)
+			return
+		}
+		ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+		ack.MessageID = sub.MessageID
+		ack.ReturnCodes = []byte{code}
+		_ = ack.Write(conn)
+
+		for payload := range publish {
+			msg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			msg.Retain = true
+			msg.TopicName = "edge/egress"
+			msg.Payload = []byte(payload)
+			_ = msg.Write(conn)
+		}
+	}()
+	return ln
+}
+
+func TestMQTT(t *testing.T) {
+	publish := make(chan string)
+	ln := fakeMQTTBroker(t, 0, publish)
+
+	d := caddyfile.NewTestDispenser(`mqtt {
+		broker mqtt://` + ln.Addr().String() + `
+		topic edge/egress
+		keep_alive 10s
+	}`)
+	r := MQTTIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+
+	waitFor := func(expected []string) {
+		t.Helper()
+		var got []string
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			got = got[:0]
+			for _, p := range r.GetIPRanges(nil) {
+				got = append(got, p.String())
+			}
+			if slices.Equal(got, expected) {
+				return
+			}
+		}
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	publish <- "192.0.2.0/24\n198.51.100.1\n"
+	waitFor([]string{"192.0.2.0/24", "198.51.100.1/32"})
+
+	publish <- "203.0.113.0/24\n"
+	waitFor([]string{"203.0.113.0/24"})
+
+	publish <- ""
+	waitFor(nil)
+	close(publish)
+}
+
+func TestMQTTSubscriptionRejected(t *testing.T) {
+	publish := make(chan string)
+	close(publish)
+	ln := fakeMQTTBroker(t, 0x80, publish)
+	r := MQTTIPRange{Broker: "mqtt://" + ln.Addr().String(), Topic: "edge/egress", ClientID: "test", KeepAlive: caddy.Duration(10 * time.Second)}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.session(ctx); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("expected the subscription to be rejected, got %v", err)
+	}
+}
+
+func TestMQTTKeepAlive(t *testing.T) {
+	for _, keepAlive := range []string{"1ns", "500ms", "65536s", "24h"} {
+		d := caddyfile.NewTestDispenser("mqtt {\nkeep_alive " + keepAlive + "\n}")
+		if err := (&MQTTIPRange{}).UnmarshalCaddyfile(d); err == nil {
+			t.Errorf("expected keep_alive %s to be rejected", keepAlive)
+		}
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	r := MQTTIPRange{Broker: "mqtt://127.0.0.1:1883", Topic: "edge/egress", KeepAlive: caddy.Duration(time.Nanosecond)}
+	if err := r.Provision(ctx); err == nil {
+		t.Error("expected keep_alive 1ns to be rejected")
+	}
+}
@@ -0,0 +1,254 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(NATSIPRange{})
+}
+
+// NATSIPRange provides IP ranges published on a NATS subject. Each message
+// holds a complete list (one IP or CIDR per line) and replaces the list
+// previously published on the same subject; with a wildcard subject the
+// ranges of all matching subjects are combined.
+//
+// When a JetStream stream is configured, an ephemeral consumer delivers
+// the last message of each subject first, so the current list is known
+// right after connecting, followed by every new message. Without a stream
+// the subject is subscribed to with core NATS and only lists published
+// while connected are received.
+type NATSIPRange struct {
+	// Server URL, e.g. nats://nats:4222 or tls://nats:4222.
+	Server string `json:"server"`
+	// Subject to subscribe to. May contain wildcards.
+	Subject string `json:"subject"`
+	// JetStream stream that captures the subject.
+	Stream string `json:"stream,omitempty"`
+	// Credentials. Support placeholders such as {env.NATS_PASSWORD}.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+
+	streamSource
+}
+
+// CaddyModule returns the Caddy module information.
+func (NATSIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.nats",
+		New: func() caddy.Module { return new(NATSIPRange) },
+	}
+}
+
+func (s *NATSIPRange) Provision(ctx caddy.Context) error {
+	if s.Server == "" || s.Subject == "" {
+		return fmt.Errorf("server and subject are required")
+	}
+	u, err := url.Parse(s.Server)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return fmt.Errorf("unsupported server scheme %q", u.Scheme)
+	}
+	if err := checkNATSSubject(s.Subject); err != nil {
+		return err
+	}
+	if s.Stream != "" {
+		if err := checkNATSStream(s.Stream); err != nil {
+			return err
+		}
+	}
+	repl := caddy.NewReplacer()
+	s.Username = repl.ReplaceAll(s.Username, "")
+	s.Password = repl.ReplaceAll(s.Password, "")
+	s.Token = repl.ReplaceAll(s.Token, "")
+
+	s.run(ctx, s.session)
+	return nil
+}
+
+func (s *NATSIPRange) session(ctx context.Context) error {
+	var opts []nats.Option
+	if s.Username != "" || s.Password != "" {
+		opts = append(opts, nats.UserInfo(s.Username, s.Password))
+	}
+	if s.Token != "" {
+		opts = append(opts, nats.Token(s.Token))
+	}
+	nc, closed, err := connectNATS(s.Server, s.log, opts...)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	if s.Stream == "" {
+		sub, err := nc.Subscribe(s.Subject, func(msg *nats.Msg) {
+			s.update(msg.Subject, msg.Data)
+		})
+		if err != nil {
+			return err
+		}
+		defer sub.Unsubscribe()
+	} else {
+		// ephemeral consumer starting at the last message of each subject
+		js, err := jetstream.New(nc)
+		if err != nil {
+			return err
+		}
+		consumer, err := js.OrderedConsumer(ctx, s.Stream, jetstream.OrderedConsumerConfig{
+			FilterSubjects: []string{s.Subject},
+			DeliverPolicy:  jetstream.DeliverLastPerSubjectPolicy,
+		})
+		if err != nil {
+			return fmt.Errorf("creating consumer on stream %s: %w", s.Stream, err)
+		}
+		consume, err := consumer.Consume(func(msg jetstream.Msg) {
+			// JetStream deliveries keep the subject the list was published on
+			s.update(msg.Subject(), msg.Data())
+		}, jetstream.ConsumeErrHandler(func(_ jetstream.ConsumeContext, err error) {
+			s.log.Warn("JetStream consumer error", zap.String("stream", s.Stream), zap.Error(err))
+		}))
+		if err != nil {
+			return fmt.Errorf("consuming stream %s: %w", s.Stream, err)
+		}
+		defer consume.Stop()
+		s.log.Info("subscribed to JetStream subject", zap.String("stream", s.Stream), zap.String("subject", s.Subject))
+	}
+	return waitNATS(ctx, nc, closed)
+}
+
+// connectNATS connects to the NATS server at server, returning the
+// connection and a channel closed once it is lost. The connection doesn't
+// reconnect by itself: the session that uses it is restarted instead.
+func connectNATS(server string, log *zap.Logger, opts ...nats.Option) (*nats.Conn, <-chan struct{}, error) {
+	closed := make(chan struct{})
+	opts = append([]nats.Option{
+		nats.Name("caddy-ip-list"),
+		nats.NoReconnect(),
+		nats.ClosedHandler(func(*nats.Conn) { close(closed) }),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			log.Warn("NATS error", zap.Error(err))
+		}),
+	}, opts...)
+	nc, err := nats.Connect(server, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nc, closed, nil
+}
+
+// waitNATS waits until ctx is done or the connection is lost.
+func waitNATS(ctx context.Context, nc *nats.Conn, closed <-chan struct{}) error {
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-closed:
+		if err := nc.LastError(); err != nil {
+			return err
+		}
+		return fmt.Errorf("connection closed")
+	}
+}
+
+// checkNATSSubject returns an error if subject isn't a valid NATS subject:
+// dot-separated tokens without whitespace or control characters.
+func checkNATSSubject(subject string) error {
+	for _, token := range strings.Split(subject, ".") {
+		if token == "" || strings.ContainsFunc(token, spaceOrControl) {
+			return fmt.Errorf("invalid NATS subject %q", subject)
+		}
+	}
+	return nil
+}
+
+// checkNATSStream returns an error if stream isn't a valid JetStream
+// stream name, which is a single subject token without wildcards.
+func checkNATSStream(stream string) error {
+	if strings.ContainsAny(stream, ".*>") || checkNATSSubject(stream) != nil {
+		return fmt.Errorf("invalid JetStream stream name %q", stream)
+	}
+	return nil
+}
+
+func spaceOrControl(r rune) bool {
+	return unicode.IsSpace(r) || unicode.IsControl(r)
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	nats {
+//	   server url
+//	   subject subject
+//	   stream name
+//	   username name
+//	   password secret
+//	   token token
+//	}
+func (m *NATSIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	// No same-line options are supported
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "server":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Server = d.Val()
+		case "subject":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Subject = d.Val()
+		case "stream":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Stream = d.Val()
+		case "username":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Username = d.Val()
+		case "password":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Password = d.Val()
+		case "token":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Token = d.Val()
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*NATSIPRange)(nil)
+	_ caddy.Provisioner       = (*NATSIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*NATSIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*NATSIPRange)(nil)
+)
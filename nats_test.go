@@ -0,0 +1,243 @@
+package caddy_ip_list
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// fakeNATS is a NATS server that serves one client connection at a time.
+// The messages the client publishes are passed to publish, which may reply
+// to them with send.
+type fakeNATS struct {
+	t       *testing.T
+	ln      net.Listener
+	publish func(subject, reply string, payload []byte)
+	connect chan string
+
+	mu   sync.Mutex
+	conn net.Conn
+	subs map[string]string
+}
+
+func newFakeNATS(t *testing.T, publish func(subject, reply string, payload []byte)) *fakeNATS {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	n := &fakeNATS{t: t, ln: ln, publish: publish, connect: make(chan string, 1)}
+	go n.serve()
+	return n
+}
+
+func (n *fakeNATS) serve() {
+	for {
+		conn, err := n.ln.Accept()
+		if err != nil {
+			return
+		}
+		n.mu.Lock()
+		n.conn, n.subs = conn, make(map[string]string)
+		n.mu.Unlock()
+		n.handle(conn)
+		conn.Close()
+	}
+}
+
+func (n *fakeNATS) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	n.write("INFO {\"server_id\":\"test\",\"headers\":true,\"max_payload\":1048576}\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "CONNECT":
+			select {
+			case n.connect <- line:
+			default:
+			}
+		case "PING":
+			n.write("PONG\r\n")
+		case "SUB":
+			n.mu.Lock()
+			n.subs[args[1]] = args[len(args)-1]
+			n.mu.Unlock()
+		case "PUB", "HPUB":
+			var size, hdrLen int
+			fmt.Sscan(args[len(args)-1], &size)
+			if args[0] == "HPUB" {
+				fmt.Sscan(args[len(args)-2], &hdrLen)
+			}
+			body := make([]byte, size+2)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return
+			}
+			var reply string
+			if len(args) == 4 && args[0] == "PUB" || len(args) == 5 {
+				reply = args[2]
+			}
+			n.publish(args[1], reply, body[hdrLen:size])
+		}
+	}
+}
+
+func (n *fakeNATS) write(s string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	fmt.Fprint(n.conn, s)
+}
+
+// send delivers a message published on subject to the subscription that
+// matches target.
+func (n *fakeNATS) send(target, subject, reply string, payload []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for pattern, sid := range n.subs {
+		if natsSubjectMatch(pattern, target) {
+			fmt.Fprintf(n.conn, "MSG %s %s %s %d\r\n%s\r\n", subject, sid, reply, len(payload), payload)
+			return
+		}
+	}
+	n.t.Errorf("no subscription for %s", target)
+}
+
+// waitSubscribed waits until the client subscribes to subject.
+func (n *fakeNATS) waitSubscribed(subject string) {
+	n.t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		n.mu.Lock()
+		_, ok := n.subs[subject]
+		n.mu.Unlock()
+		if ok {
+			return
+		}
+	}
+	n.t.Fatalf("no subscription to %s", subject)
+}
+
+func natsSubjectMatch(pattern, subject string) bool {
+	p, s := strings.Split(pattern, "."), strings.Split(subject, ".")
+	for i, token := range p {
+		switch {
+		case token == ">":
+			return len(s) > i
+		case i >= len(s) || token != "*" && token != s[i]:
+			return false
+		}
+	}
+	return len(p) == len(s)
+}
+
+func TestNATSJetStream(t *testing.T) {
+	pulls := make(chan string, 1)
+	var consumer string
+	var n *fakeNATS
+	n = newFakeNATS(t, func(subject, reply string, payload []byte) {
+		switch {
+		case strings.HasPrefix(subject, "$JS.API.CONSUMER.CREATE.BLOCKLISTS."):
+			var request struct {
+				Config map[string]any `json:"config"`
+			}
+			_ = json.Unmarshal(payload, &request)
+			filter, _ := request.Config["filter_subject"].(string)
+			if filter != "blocklists.>" || request.Config["deliver_policy"] != "last_per_subject" {
+				t.Errorf("unexpected consumer request %s %s", subject, payload)
+			}
+			consumer, _ = request.Config["name"].(string)
+			response, _ := json.Marshal(map[string]any{
+				"type":        "io.nats.jetstream.api.v1.consumer_create_response",
+				"stream_name": "BLOCKLISTS",
+				"name":        consumer,
+				"config":      request.Config,
+			})
+			n.send(reply, reply, "", response)
+		case strings.HasPrefix(subject, "$JS.API.CONSUMER.MSG.NEXT.BLOCKLISTS."):
+			select {
+			case pulls <- reply:
+			default:
+			}
+		}
+	})
+
+	d := caddyfile.NewTestDispenser(`nats {
+		server nats://` + n.ln.Addr().String() + `
+		subject blocklists.>
+		stream BLOCKLISTS
+		token secret
+	}`)
+	r := NATSIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	if connect := <-n.connect; !strings.Contains(connect, `"auth_token":"secret"`) {
+		t.Errorf("expected token in %s", connect)
+	}
+	inbox := <-pulls
+
+	waitFor := func(expected []string) {
+		t.Helper()
+		var got []string
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			got = prefixStrings(r.GetIPRanges(nil))
+			if slices.Equal(got, expected) {
+				return
+			}
+		}
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	seq := 0
+	publish := func(subject, payload string) {
+		seq++
+		ack := fmt.Sprintf("$JS.ACK.BLOCKLISTS.%s.1.%d.%d.%d.0", consumer, seq, seq, time.Now().UnixNano())
+		n.send(inbox, subject, ack, []byte(payload))
+	}
+
+	publish("blocklists.scanners", "192.0.2.0/24\n198.51.100.1\n")
+	waitFor([]string{"192.0.2.0/24", "198.51.100.1/32"})
+
+	publish("blocklists.abuse", "203.0.113.0/24\n")
+	waitFor([]string{"203.0.113.0/24", "192.0.2.0/24", "198.51.100.1/32"})
+
+	publish("blocklists.scanners", "")
+	waitFor([]string{"203.0.113.0/24"})
+}
+
+func TestNATSSubjects(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	for _, s := range []NATSIPRange{
+		{Server: "nats://nats:4222", Subject: "lists a"},
+		{Server: "nats://nats:4222", Subject: "lists\r\nPUB x 0"},
+		{Server: "nats://nats:4222", Subject: "lists..a"},
+		{Server: "nats://nats:4222", Subject: "lists.>", Stream: "LISTS\r\nPUB"},
+		{Server: "nats://nats:4222", Subject: "lists.>", Stream: "LISTS.A"},
+	} {
+		if err := s.Provision(ctx); err == nil {
+			t.Errorf("expected subject %q and stream %q to be rejected", s.Subject, s.Stream)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(NetBoxIPRange{})
+}
+
+// NetBoxIPRange provides the prefixes recorded in NetBox IPAM, selected by
+// tag, role and status.
+type NetBoxIPRange struct {
+	// Base URL of NetBox, e.g. https://netbox.example.com.
+	URL string `json:"url"`
+	// API token. Supports placeholders such as {env.NETBOX_TOKEN}.
+	APIToken string `json:"api_token"`
+	// Only include prefixes that have all of these tags (slugs).
+	Tags []string `json:"tags,omitempty"`
+	// Only include prefixes with one of these roles (slugs).
+	Roles []string `json:"roles,omitempty"`
+	// Only include prefixes with one of these statuses. Default is active.
+	Status []string `json:"status,omitempty"`
+	// refresh Interval
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// request Timeout
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	pollingSource
+}
+
+// CaddyModule returns the Caddy module information.
+func (NetBoxIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.netbox",
+		New: func() caddy.Module { return new(NetBoxIPRange) },
+	}
+}
+
+func (s *NetBoxIPRange) Provision(ctx caddy.Context) error {
+	if s.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	s.URL = strings.TrimSuffix(s.URL, "/")
+	s.APIToken = caddy.NewReplacer().ReplaceAll(s.APIToken, "")
+	if s.APIToken == "" {
+		return fmt.Errorf("api_token is required")
+	}
+	if len(s.Status) == 0 {
+		s.Status = []string{"active"}
+	}
+	return s.start(ctx, time.Duration(s.Interval), s.fetch)
+}
+
+func (s *NetBoxIPRange) fetch(ctx context.Context) ([]netip.Prefix, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.Timeout))
+		defer cancel()
+	}
+
+	q := url.Values{"limit": {"1000"}, "ordering": {"prefix"}, "brief": {"true"}}
+	q["tag"] = s.Tags
+	q["role"] = s.Roles
+	q["status"] = s.Status
+	next := s.URL + "/api/ipam/prefixes/?" + q.Encode()
+
+	var prefixes []netip.Prefix
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Token "+s.APIToken)
+		req.Header.Set("Accept", "application/json")
+		var page struct {
+			Next    string `json:"next"`
+			Results []struct {
+				Prefix string `json:"prefix"`
+			} `json:"results"`
+		}
+		if err := getJSON(req, &page); err != nil {
+			return nil, err
+		}
+		for _, result := range page.Results {
+			prefix, err := netip.ParsePrefix(result.Prefix)
+			if err != nil {
+				return nil, fmt.Errorf("invalid prefix %q: %v", result.Prefix, err)
+			}
+			prefixes = append(prefixes, prefix)
+		}
+		next = page.Next
+	}
+	return prefixes, nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	netbox <url> {
+//	   api_token token
+//	   tags <slug...>
+//	   roles <slug...>
+//	   status <status...>
+//	   interval val
+//	   timeout val
+//	}
+func (m *NetBoxIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	m.URL = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "api_token":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.APIToken = d.Val()
+		case "tags":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			m.Tags = append(m.Tags, args...)
+		case "roles":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			m.Roles = append(m.Roles, args...)
+		case "status":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			m.Status = append(m.Status, args...)
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Interval = caddy.Duration(val)
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Timeout = caddy.Duration(val)
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*NetBoxIPRange)(nil)
+	_ caddy.Provisioner       = (*NetBoxIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*NetBoxIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*NetBoxIPRange)(nil)
+)
@@ -0,0 +1,39 @@
+package caddy_ip_list
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestNetBox(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/ipam/prefixes/" || r.Header.Get("Authorization") != "Token nb-token" {
+			t.Errorf("unexpected request %s with %q", r.URL.Path, r.Header.Get("Authorization"))
+			http.NotFound(w, r)
+			return
+		}
+		q := r.URL.Query()
+		if !slices.Equal(q["tag"], []string{"edge", "trusted"}) || !slices.Equal(q["role"], []string{"proxies"}) || !slices.Equal(q["status"], []string{"active"}) {
+			t.Errorf("unexpected filters %v", q)
+		}
+		if q.Get("offset") == "" {
+			w.Write([]byte(`{"count":3,"next":"` + server.URL + `/api/ipam/prefixes/?` + q.Encode() + `&offset=2","results":[{"prefix":"10.0.0.0/24"},{"prefix":"10.0.1.0/24"}]}`))
+		} else {
+			w.Write([]byte(`{"count":3,"next":null,"results":[{"prefix":"2001:db8::/48"}]}`))
+		}
+	}))
+	defer server.Close()
+
+	got := provisionSource(t, &NetBoxIPRange{}, `netbox `+server.URL+`/ {
+		api_token nb-token
+		tags edge trusted
+		roles proxies
+	}`)
+	expected := []string{"10.0.0.0/24", "10.0.1.0/24", "2001:db8::/48"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,90 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// S3 URLs (s3://bucket/key) are fetched through a GetObject URL presigned
+// with the default AWS credential chain of the SDK: environment, shared
+// config, web identity (IRSA), ECS task role or EC2 instance role. The
+// "region" and "endpoint" query parameters select the bucket's region and
+// a compatible service such as MinIO.
+//
+// Objects in Google Cloud Storage or Azure Blob Storage are listed through
+// signed or SAS HTTPS URLs like any other URL.
+
+// awsConfig loads the default AWS configuration once, so the credentials
+// it resolves are cached across fetches.
+var awsConfig = sync.OnceValues(func() (aws.Config, error) {
+	return config.LoadDefaultConfig(context.Background())
+})
+
+// awsRegion returns the region of cfg, or us-east-1 if it has none.
+func awsRegion(cfg aws.Config) string {
+	if cfg.Region != "" {
+		return cfg.Region
+	}
+	return "us-east-1"
+}
+
+// newRequest builds the GET request for a list URL, presigning the
+// request of s3:// URLs.
+func newRequest(ctx context.Context, rawURL string) (*http.Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "s3" {
+		return newS3Request(ctx, u)
+	}
+	return http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+}
+
+func newS3Request(ctx context.Context, u *url.URL) (*http.Request, error) {
+	bucket := u.Host
+	key := strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("s3 URL must be of the form s3://bucket/key: %s", u)
+	}
+	cfg, err := awsConfig()
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS config: %w", err)
+	}
+	q := u.Query()
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.Region = awsRegion(cfg)
+		if region := q.Get("region"); region != "" {
+			o.Region = region
+		}
+		if endpoint := q.Get("endpoint"); endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+	presigned, err := s3.NewPresignClient(client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("presigning %s: %w", u, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, presigned.Method, presigned.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range presigned.SignedHeader {
+		if !strings.EqualFold(name, "Host") {
+			req.Header[name] = values
+		}
+	}
+	return req, nil
+}
@@ -0,0 +1,68 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestS3Addressing(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	for rawURL, expected := range map[string]string{
+		"s3://lists/edge/blocklist.txt?region=eu-west-1":             "https://lists.s3.eu-west-1.amazonaws.com/edge/blocklist.txt",
+		"s3://lists.example.com/edge/blocklist.txt?region=eu-west-1": "https://s3.eu-west-1.amazonaws.com/lists.example.com/edge/blocklist.txt",
+	} {
+		req, err := newRequest(context.Background(), rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := req.URL.Scheme + "://" + req.URL.Host + req.URL.Path; got != expected {
+			t.Errorf("expected %s to be fetched from %s, got %s", rawURL, expected, got)
+		}
+	}
+}
+
+func provisionList(t *testing.T, input string) *URLIPRange {
+	t.Helper()
+	d := caddyfile.NewTestDispenser(input)
+	r := &URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	return r
+}
+
+func TestS3Source(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/lists/edge/blocklist.txt" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if credential := r.URL.Query().Get("X-Amz-Credential"); !strings.HasPrefix(credential, "AKIDEXAMPLE/") {
+			t.Errorf("request not presigned: %q", r.URL.RawQuery)
+		}
+		w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	defer server.Close()
+
+	r := provisionList(t, `list {
+		url s3://lists/edge/blocklist.txt?region=eu-west-1&endpoint=`+server.URL+`
+		cache_file `+filepath.Join(t.TempDir(), "cache.json")+`
+	}`)
+	if ranges := r.GetIPRanges(nil); len(ranges) != 1 || ranges[0].String() != "192.0.2.0/24" {
+		t.Errorf("unexpected ranges: %v", ranges)
+	}
+}
@@ -0,0 +1,252 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(PHPIPAMIPRange{})
+}
+
+// PHPIPAMIPRange provides the subnets of phpIPAM sections through its REST
+// API. The API app authenticates either with a static app code token or
+// with a user's credentials, in which case a session token is requested
+// for each refresh.
+type PHPIPAMIPRange struct {
+	// Base URL of phpIPAM, e.g. https://ipam.example.com.
+	URL string `json:"url"`
+	// API app ID.
+	AppID string `json:"app_id"`
+	// App code for apps using token security.
+	Token string `json:"token,omitempty"`
+	// User credentials for apps using user authentication.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Sections to include subnets of, by name or ID.
+	Sections []string `json:"sections"`
+	// refresh Interval
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// request Timeout
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	pollingSource
+}
+
+// CaddyModule returns the Caddy module information.
+func (PHPIPAMIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.phpipam",
+		New: func() caddy.Module { return new(PHPIPAMIPRange) },
+	}
+}
+
+func (s *PHPIPAMIPRange) Provision(ctx caddy.Context) error {
+	if s.URL == "" || s.AppID == "" {
+		return fmt.Errorf("url and app_id are required")
+	}
+	if len(s.Sections) == 0 {
+		return fmt.Errorf("at least one section is required")
+	}
+	repl := caddy.NewReplacer()
+	s.Token = repl.ReplaceAll(s.Token, "")
+	s.Username = repl.ReplaceAll(s.Username, "")
+	s.Password = repl.ReplaceAll(s.Password, "")
+	if (s.Token == "") == (s.Username == "") {
+		return fmt.Errorf("either token or username is required")
+	}
+	s.URL = strings.TrimSuffix(s.URL, "/") + "/api/" + url.PathEscape(s.AppID)
+	return s.start(ctx, time.Duration(s.Interval), s.fetch)
+}
+
+func (s *PHPIPAMIPRange) fetch(ctx context.Context) ([]netip.Prefix, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.Timeout))
+		defer cancel()
+	}
+
+	token := s.Token
+	if token == "" {
+		var session struct {
+			Token string `json:"token"`
+		}
+		if err := s.call(ctx, http.MethodPost, "/user/", "", &session); err != nil {
+			return nil, err
+		}
+		token = session.Token
+	}
+
+	var prefixes []netip.Prefix
+	for _, name := range s.Sections {
+		var section struct {
+			ID phpipamValue `json:"id"`
+		}
+		if err := s.call(ctx, http.MethodGet, "/sections/"+url.PathEscape(name)+"/", token, &section); err != nil {
+			return nil, fmt.Errorf("section %s: %w", name, err)
+		}
+		var subnets []struct {
+			Subnet   string       `json:"subnet"`
+			Mask     phpipamValue `json:"mask"`
+			IsFolder phpipamValue `json:"isFolder"`
+		}
+		if err := s.call(ctx, http.MethodGet, "/sections/"+url.PathEscape(string(section.ID))+"/subnets/", token, &subnets); err != nil {
+			return nil, fmt.Errorf("section %s: %w", name, err)
+		}
+		for _, subnet := range subnets {
+			if subnet.IsFolder == "1" || subnet.Subnet == "" {
+				continue
+			}
+			prefix, err := netip.ParsePrefix(subnet.Subnet + "/" + string(subnet.Mask))
+			if err != nil {
+				return nil, fmt.Errorf("section %s: invalid subnet: %v", name, err)
+			}
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes, nil
+}
+
+// call performs an API request and decodes the data of the response
+// envelope into v. Without a token the user credentials are sent.
+func (s *PHPIPAMIPRange) call(ctx context.Context, method, path, token string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, s.URL+path, nil)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		req.SetBasicAuth(s.Username, s.Password)
+	} else {
+		req.Header.Set("token", token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var envelope struct {
+		Success bool            `json:"success"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("%s %s returned HTTP %d: %w", method, path, resp.StatusCode, err)
+	}
+	if !envelope.Success {
+		if resp.StatusCode == http.StatusOK {
+			// empty results, e.g. "No subnets found"
+			return nil
+		}
+		return fmt.Errorf("phpIPAM API error (HTTP %d): %s", resp.StatusCode, envelope.Message)
+	}
+	return json.Unmarshal(envelope.Data, v)
+}
+
+// phpipamValue is a value that phpIPAM versions return either as a string
+// or as a number.
+type phpipamValue string
+
+func (v *phpipamValue) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*v = phpipamValue(s)
+		return nil
+	}
+	if string(b) == "null" {
+		*v = ""
+		return nil
+	}
+	*v = phpipamValue(b)
+	return nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	phpipam <url> <app_id> {
+//	   token token
+//	   username name
+//	   password secret
+//	   sections <name|id...>
+//	   interval val
+//	   timeout val
+//	}
+func (m *PHPIPAMIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	if !d.Args(&m.URL, &m.AppID) {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "token":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Token = d.Val()
+		case "username":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Username = d.Val()
+		case "password":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Password = d.Val()
+		case "sections":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			m.Sections = append(m.Sections, args...)
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Interval = caddy.Duration(val)
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Timeout = caddy.Duration(val)
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*PHPIPAMIPRange)(nil)
+	_ caddy.Provisioner       = (*PHPIPAMIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*PHPIPAMIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*PHPIPAMIPRange)(nil)
+)
@@ -0,0 +1,54 @@
+package caddy_ip_list
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestPHPIPAM(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/caddy/user/" {
+			if user, pass, _ := r.BasicAuth(); r.Method != http.MethodPost || user != "caddy" || pass != "hunter2" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"code":401,"success":false,"message":"Invalid username or password"}`))
+				return
+			}
+			w.Write([]byte(`{"code":200,"success":true,"data":{"token":"session-token","expires":"2030-01-01 00:00:00"}}`))
+			return
+		}
+		if r.Header.Get("token") != "session-token" {
+			t.Errorf("unexpected token %q for %s", r.Header.Get("token"), r.URL.Path)
+		}
+		switch r.URL.Path {
+		case "/api/caddy/sections/Edge/":
+			w.Write([]byte(`{"code":200,"success":true,"data":{"id":"3","name":"Edge"}}`))
+		case "/api/caddy/sections/3/subnets/":
+			w.Write([]byte(`{"code":200,"success":true,"data":[
+				{"id":"7","subnet":"10.20.0.0","mask":"16","isFolder":"0"},
+				{"id":"8","subnet":null,"mask":"","isFolder":"1"},
+				{"id":"9","subnet":"2001:db8::","mask":48,"isFolder":0}
+			]}`))
+		case "/api/caddy/sections/4/":
+			w.Write([]byte(`{"code":200,"success":true,"data":{"id":4,"name":"Empty"}}`))
+		case "/api/caddy/sections/4/subnets/":
+			w.Write([]byte(`{"code":200,"success":false,"message":"No subnets found"}`))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code":404,"success":false,"message":"Not found"}`))
+		}
+	}))
+	defer server.Close()
+
+	got := provisionSource(t, &PHPIPAMIPRange{}, `phpipam `+server.URL+` caddy {
+		username caddy
+		password hunter2
+		sections Edge 4
+	}`)
+	expected := []string{"10.20.0.0/16", "2001:db8::/48"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
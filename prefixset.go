@@ -0,0 +1,228 @@
+package caddy_ip_list
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+)
+
+// subtractPrefixes returns the parts of base that are not covered by any
+// prefix in exclude. Base prefixes that contain an excluded prefix are
+// split around it, so excluding 10.0.0.0/24 from 10.0.0.0/22 leaves
+// 10.0.1.0/24 and 10.0.2.0/23.
+func subtractPrefixes(base, exclude []netip.Prefix) []netip.Prefix {
+	var result []netip.Prefix
+	for _, b := range base {
+		remaining := []netip.Prefix{b.Masked()}
+		for _, e := range exclude {
+			e = e.Masked()
+			var next []netip.Prefix
+			for _, p := range remaining {
+				switch {
+				case !p.Overlaps(e):
+					next = append(next, p)
+				case e.Bits() <= p.Bits():
+					// p is entirely excluded
+				default:
+					next = append(next, splitAround(p, e)...)
+				}
+			}
+			remaining = next
+		}
+		result = append(result, remaining...)
+	}
+	return result
+}
+
+// intersectPrefixes returns the address space covered by both a and b.
+// Where two prefixes overlap, one contains the other and the more
+// specific of the two is the intersection.
+func intersectPrefixes(a, b []netip.Prefix) []netip.Prefix {
+	var result []netip.Prefix
+	for _, x := range a {
+		x = x.Masked()
+		for _, y := range b {
+			y = y.Masked()
+			if !x.Overlaps(y) {
+				continue
+			}
+			if x.Bits() >= y.Bits() {
+				result = append(result, x)
+			} else {
+				result = append(result, y)
+			}
+		}
+	}
+	return result
+}
+
+// aggregatePrefixes returns the fewest prefixes covering the same address
+// space as prefixes: prefixes contained in others are dropped and
+// adjacent prefixes are merged into their common supernet. The result is
+// sorted, IPv4 first.
+func aggregatePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	sorted := make([]netip.Prefix, 0, len(prefixes))
+	for _, p := range prefixes {
+		sorted = append(sorted, p.Masked())
+	}
+	slices.SortFunc(sorted, comparePrefixes)
+
+	var result []netip.Prefix
+	for _, p := range sorted {
+		// the result is sorted and disjoint, so only the last prefix can
+		// overlap p, and then it contains p
+		if n := len(result); n > 0 && result[n-1].Overlaps(p) {
+			continue
+		}
+		result = append(result, p)
+		for n := len(result); n >= 2; n = len(result) {
+			a, b := result[n-2], result[n-1]
+			if a.Bits() != b.Bits() || a.Bits() == 0 {
+				break
+			}
+			parent := netip.PrefixFrom(a.Addr(), a.Bits()-1).Masked()
+			if parent.Addr() != a.Addr() || flipBit(a.Addr(), a.Bits()-1) != b.Addr() {
+				break
+			}
+			result = append(result[:n-2], parent)
+		}
+	}
+	return result
+}
+
+// dedupePrefixes drops duplicate prefixes and prefixes contained in
+// others, keeping the order of the remaining prefixes.
+func dedupePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	sorted := make([]netip.Prefix, 0, len(prefixes))
+	for _, p := range prefixes {
+		sorted = append(sorted, p.Masked())
+	}
+	slices.SortFunc(sorted, comparePrefixes)
+
+	keep := make(map[netip.Prefix]bool, len(sorted))
+	var last netip.Prefix
+	for _, p := range sorted {
+		// as in aggregatePrefixes, only the last kept prefix can contain p
+		if last.IsValid() && last.Overlaps(p) {
+			continue
+		}
+		keep[p] = true
+		last = p
+	}
+	result := make([]netip.Prefix, 0, len(keep))
+	for _, p := range prefixes {
+		if keep[p.Masked()] {
+			delete(keep, p.Masked())
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// canonicalPrefixes returns prefixes masked to their network address,
+// sorted and without duplicates, so that the same set always results in
+// the same slice.
+func canonicalPrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	result := make([]netip.Prefix, 0, len(prefixes))
+	for _, p := range prefixes {
+		result = append(result, p.Masked())
+	}
+	slices.SortFunc(result, comparePrefixes)
+	return slices.Compact(result)
+}
+
+// diffPrefixes returns the prefixes of next that are not in previous, and
+// those of previous that are not in next. Both must be canonical.
+func diffPrefixes(previous, next []netip.Prefix) (added, removed []netip.Prefix) {
+	i, j := 0, 0
+	for i < len(previous) && j < len(next) {
+		switch c := comparePrefixes(previous[i], next[j]); {
+		case c < 0:
+			removed = append(removed, previous[i])
+			i++
+		case c > 0:
+			added = append(added, next[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return append(added, next[j:]...), append(removed, previous[i:]...)
+}
+
+// embedIPv4 returns the IPv4 prefix p embedded in the last 32 bits of the
+// IPv6 /96 prefix into, as in NAT64 (RFC 6052) and IPv4-mapped addresses.
+func embedIPv4(p, into netip.Prefix) netip.Prefix {
+	b := into.Addr().As16()
+	v4 := p.Addr().As4()
+	copy(b[12:], v4[:])
+	return netip.PrefixFrom(netip.AddrFrom16(b), 96+p.Bits())
+}
+
+// comparePrefixes orders prefixes by address, and prefixes with the same
+// address from shortest to longest.
+func comparePrefixes(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return a.Bits() - b.Bits()
+}
+
+// splitAround returns the prefixes covering p except for e, which must be
+// a strict sub-prefix of p.
+func splitAround(p, e netip.Prefix) []netip.Prefix {
+	var parts []netip.Prefix
+	for bits := p.Bits(); bits < e.Bits(); bits++ {
+		// the half of the current prefix that does not contain e
+		half := netip.PrefixFrom(e.Addr(), bits+1).Masked()
+		parts = append(parts, netip.PrefixFrom(flipBit(half.Addr(), bits), bits+1))
+	}
+	return parts
+}
+
+// flipBit inverts bit i (counted from the most significant bit) of addr.
+func flipBit(addr netip.Addr, i int) netip.Addr {
+	if addr.Is4() {
+		b := addr.As4()
+		b[i/8] ^= 0x80 >> (i % 8)
+		return netip.AddrFrom4(b)
+	}
+	b := addr.As16()
+	b[i/8] ^= 0x80 >> (i % 8)
+	return netip.AddrFrom16(b)
+}
+
+// rangeMemo caches the result of a set operation over the ranges of child
+// sources. Sources replace their slice when their ranges change, so the
+// result is only recomputed when a child returns a different slice.
+type rangeMemo struct {
+	mu     sync.Mutex
+	inputs [][]netip.Prefix
+	result []netip.Prefix
+}
+
+func (m *rangeMemo) get(inputs [][]netip.Prefix, compute func() []netip.Prefix) []netip.Prefix {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.inputs != nil && sameSlices(m.inputs, inputs) {
+		return m.result
+	}
+	m.inputs, m.result = inputs, compute()
+	return m.result
+}
+
+func sameSlices(a, b [][]netip.Prefix) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+		if len(a[i]) > 0 && &a[i][0] != &b[i][0] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,136 @@
+package caddy_ip_list
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func parsePrefixes(t *testing.T, cidrs ...string) []netip.Prefix {
+	t.Helper()
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, c := range cidrs {
+		prefixes = append(prefixes, netip.MustParsePrefix(c))
+	}
+	return prefixes
+}
+
+func sortedPrefixStrings(prefixes []netip.Prefix) []string {
+	s := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		s = append(s, p.String())
+	}
+	slices.Sort(s)
+	return s
+}
+
+func TestSubtractPrefixes(t *testing.T) {
+	for i, tc := range []struct {
+		base, exclude, expected []string
+	}{
+		{
+			base:     []string{"10.0.0.0/22"},
+			exclude:  []string{"10.0.0.0/24"},
+			expected: []string{"10.0.1.0/24", "10.0.2.0/23"},
+		},
+		{
+			base:     []string{"10.0.0.0/24", "192.0.2.0/24"},
+			exclude:  []string{"10.0.0.0/8"},
+			expected: []string{"192.0.2.0/24"},
+		},
+		{
+			base:     []string{"192.0.2.0/24"},
+			exclude:  []string{"192.0.2.128/26", "192.0.2.7"},
+			expected: []string{"192.0.2.0/30", "192.0.2.16/28", "192.0.2.192/26", "192.0.2.32/27", "192.0.2.4/31", "192.0.2.6/32", "192.0.2.64/26", "192.0.2.8/29"},
+		},
+		{
+			base:     []string{"2001:db8::/32", "192.0.2.0/24"},
+			exclude:  []string{"2001:db8:8000::/33"},
+			expected: []string{"192.0.2.0/24", "2001:db8::/33"},
+		},
+	} {
+		var exclude []netip.Prefix
+		for _, e := range tc.exclude {
+			if p, err := netip.ParsePrefix(e); err == nil {
+				exclude = append(exclude, p)
+			} else {
+				addr := netip.MustParseAddr(e)
+				exclude = append(exclude, netip.PrefixFrom(addr, addr.BitLen()))
+			}
+		}
+		got := sortedPrefixStrings(subtractPrefixes(parsePrefixes(t, tc.base...), exclude))
+		if !slices.Equal(got, tc.expected) {
+			t.Errorf("case %d: expected %v, got %v", i, tc.expected, got)
+		}
+	}
+}
+
+func TestIntersectPrefixes(t *testing.T) {
+	a := parsePrefixes(t, "104.16.0.0/13", "172.64.0.0/13", "2606:4700::/32")
+	b := parsePrefixes(t, "104.16.0.0/12", "104.24.0.0/14", "2606:4700:10::/48")
+	expected := []string{"104.16.0.0/13", "2606:4700:10::/48"}
+	if got := sortedPrefixStrings(intersectPrefixes(a, b)); !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestAggregatePrefixes(t *testing.T) {
+	for i, tc := range []struct {
+		prefixes, expected []string
+	}{
+		{
+			prefixes: []string{"192.0.2.0/25", "192.0.2.128/25"},
+			expected: []string{"192.0.2.0/24"},
+		},
+		{
+			// adjacent but not siblings
+			prefixes: []string{"10.0.1.0/24", "10.0.2.0/24"},
+			expected: []string{"10.0.1.0/24", "10.0.2.0/24"},
+		},
+		{
+			prefixes: []string{"10.0.3.0/24", "10.0.0.0/24", "10.0.2.0/24", "10.0.1.0/24", "10.0.1.7/32", "10.0.0.0/24"},
+			expected: []string{"10.0.0.0/22"},
+		},
+		{
+			prefixes: []string{"10.0.0.0/8", "10.1.0.0/16", "2001:db8::/33", "2001:db8:8000::/33", "192.0.2.1/32"},
+			expected: []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::/32"},
+		},
+		{
+			prefixes: []string{"0.0.0.0/1", "128.0.0.0/1"},
+			expected: []string{"0.0.0.0/0"},
+		},
+	} {
+		got := prefixStrings(aggregatePrefixes(parsePrefixes(t, tc.prefixes...)))
+		if !slices.Equal(got, tc.expected) {
+			t.Errorf("case %d: expected %v, got %v", i, tc.expected, got)
+		}
+	}
+}
+
+func TestDedupePrefixes(t *testing.T) {
+	prefixes := parsePrefixes(t, "198.51.100.0/24", "192.0.2.1/32", "10.0.0.0/8", "192.0.2.0/24", "10.1.0.0/16", "198.51.100.0/24", "2001:db8::1/128", "2001:db8::/32")
+	got := prefixStrings(dedupePrefixes(prefixes))
+	if expected := []string{"198.51.100.0/24", "10.0.0.0/8", "192.0.2.0/24", "2001:db8::/32"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestCanonicalPrefixes(t *testing.T) {
+	prefixes := parsePrefixes(t, "2001:DB8::1/32", "192.0.2.7/24", "10.0.0.0/8", "192.0.2.0/24", "10.0.0.0/16")
+	got := prefixStrings(canonicalPrefixes(prefixes))
+	if expected := []string{"10.0.0.0/8", "10.0.0.0/16", "192.0.2.0/24", "2001:db8::/32"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestDiffPrefixes(t *testing.T) {
+	previous := canonicalPrefixes(parsePrefixes(t, "10.0.0.0/8", "192.0.2.0/24", "198.51.100.0/24", "2001:db8::/32"))
+	next := canonicalPrefixes(parsePrefixes(t, "10.0.0.0/16", "192.0.2.0/24", "203.0.113.0/24", "2001:db8::/32", "2001:db8:1::/48"))
+	added, removed := diffPrefixes(previous, next)
+	if expected := []string{"10.0.0.0/16", "203.0.113.0/24", "2001:db8:1::/48"}; !slices.Equal(prefixStrings(added), expected) {
+		t.Errorf("expected added %v, got %v", expected, added)
+	}
+	if expected := []string{"10.0.0.0/8", "198.51.100.0/24"}; !slices.Equal(prefixStrings(removed), expected) {
+		t.Errorf("expected removed %v, got %v", expected, removed)
+	}
+}
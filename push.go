@@ -0,0 +1,111 @@
+package caddy_ip_list
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(PushIPRange{})
+}
+
+// pushSources holds the lists pushed through the admin API by source name,
+// along with how many provisioned sources use each name. Lists outlive the
+// sources so a config reload does not drop what was pushed.
+var (
+	pushSources   = make(map[string]*pushSource)
+	pushSourcesMu sync.RWMutex
+)
+
+type pushSource struct {
+	refs   int
+	ranges []netip.Prefix
+}
+
+// PushIPRange provides IP ranges pushed to the admin API, so CI pipelines
+// can update them instead of Caddy polling:
+//
+//	curl -X POST --data-binary @ranges.txt localhost:2019/ip-list/sources/<name>
+//
+// The body holds one IP or CIDR per line and replaces the current list.
+// A GET on the same endpoint returns the current list.
+type PushIPRange struct {
+	// Name of the source, used in the admin endpoint path.
+	Name string `json:"name"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (PushIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.push",
+		New: func() caddy.Module { return new(PushIPRange) },
+	}
+}
+
+func (s *PushIPRange) Provision(ctx caddy.Context) error {
+	if s.Name == "" {
+		return fmt.Errorf("source name is required")
+	}
+
+	pushSourcesMu.Lock()
+	defer pushSourcesMu.Unlock()
+	src, ok := pushSources[s.Name]
+	if !ok {
+		src = new(pushSource)
+		pushSources[s.Name] = src
+	}
+	src.refs++
+	return nil
+}
+
+// Cleanup releases the source name. The pushed list is kept, so it is still
+// available if a later config uses the same name.
+func (s *PushIPRange) Cleanup() error {
+	pushSourcesMu.Lock()
+	defer pushSourcesMu.Unlock()
+	if src, ok := pushSources[s.Name]; ok {
+		src.refs--
+	}
+	return nil
+}
+
+func (s *PushIPRange) GetIPRanges(_ *http.Request) []netip.Prefix {
+	pushSourcesMu.RLock()
+	defer pushSourcesMu.RUnlock()
+	if src, ok := pushSources[s.Name]; ok {
+		return src.ranges
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	push <name>
+func (m *PushIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	m.Name = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*PushIPRange)(nil)
+	_ caddy.Provisioner       = (*PushIPRange)(nil)
+	_ caddy.CleanerUpper      = (*PushIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*PushIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*PushIPRange)(nil)
+)
@@ -0,0 +1,67 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestPush(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`push ci-deploy`)
+	r := PushIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+
+	api := adminIPList{}
+	req := httptest.NewRequest(http.MethodPost, "/ip-list/sources/ci-deploy", strings.NewReader("192.0.2.0/24\n# runners\n198.51.100.7\n"))
+	rec := httptest.NewRecorder()
+	if err := api.handleSources(rec, req); err != nil {
+		t.Fatalf("push error: %v", err)
+	}
+	if body := strings.TrimSpace(rec.Body.String()); body != `{"count":2}` {
+		t.Errorf("unexpected response: %s", body)
+	}
+
+	expected := []string{"192.0.2.0/24", "198.51.100.7/32"}
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/ip-list/sources/ci-deploy", strings.NewReader("not-an-ip\n"))
+	if err := api.handleSources(httptest.NewRecorder(), req); err == nil {
+		t.Errorf("expected error for invalid list")
+	}
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, expected) {
+		t.Errorf("invalid push changed ranges to %v", got)
+	}
+
+	// the list survives a reload of the source
+	if err := r.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := PushIPRange{Name: "ci-deploy"}
+	if err := reloaded.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	defer reloaded.Cleanup()
+	if got := prefixStrings(reloaded.GetIPRanges(nil)); !slices.Equal(got, expected) {
+		t.Errorf("expected %v after reload, got %v", expected, got)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/ip-list/sources/unknown", strings.NewReader("192.0.2.1\n"))
+	if err := api.handleSources(httptest.NewRecorder(), req); err == nil {
+		t.Errorf("expected error for unknown source")
+	}
+}
@@ -0,0 +1,130 @@
+package caddy_ip_list
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RPKIValidation configures the RPKI validation of fetched prefixes.
+type RPKIValidation struct {
+	// Base URL of a validator with Routinator's HTTP API, e.g.
+	// http://localhost:8323.
+	Validator string `json:"validator"`
+	// ASNs that may originate the prefixes.
+	ASNs []uint32 `json:"asns"`
+}
+
+// rpkiValidity is the response of the validity endpoint of Routinator
+// and compatible RPKI validators.
+type rpkiValidity struct {
+	ValidatedRoute struct {
+		Validity struct {
+			State string `json:"state"`
+		} `json:"validity"`
+	} `json:"validated_route"`
+}
+
+// rpkiResult is a cached validation of a prefix.
+type rpkiResult struct {
+	valid   bool
+	checked time.Time
+}
+
+// rpkiResultTTL is how long a validation is reused. ROAs rarely change, so
+// it spans many refreshes, and unchanged lists don't query the validator
+// again.
+const rpkiResultTTL = 24 * time.Hour
+
+// rpkiLookups bounds the concurrent queries to the validator.
+const rpkiLookups = 8
+
+// validateRPKI drops the prefixes of url that no ROA validates for any of
+// the expected ASNs.
+func (s *URLIPRange) validateRPKI(url string, prefixes []netip.Prefix) ([]netip.Prefix, error) {
+	if s.rpkiResults == nil {
+		s.rpkiResults = make(map[string]map[netip.Prefix]rpkiResult)
+	}
+	now := time.Now()
+	// only the prefixes still listed are kept
+	previous := s.rpkiResults[url]
+	results := make(map[netip.Prefix]rpkiResult, len(prefixes))
+	var unchecked []netip.Prefix
+	for _, prefix := range prefixes {
+		if result, ok := previous[prefix]; ok && now.Sub(result.checked) < rpkiResultTTL {
+			results[prefix] = result
+		} else if _, ok := results[prefix]; !ok {
+			results[prefix] = rpkiResult{}
+			unchecked = append(unchecked, prefix)
+		}
+	}
+
+	valid := make([]bool, len(unchecked))
+	errs := make([]error, len(unchecked))
+	sem := make(chan struct{}, rpkiLookups)
+	var wg sync.WaitGroup
+	for i, prefix := range unchecked {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			valid[i], errs[i] = s.rpkiValid(prefix)
+		}()
+	}
+	wg.Wait()
+	for i, prefix := range unchecked {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("validating %s: %w", prefix, errs[i])
+		}
+		results[prefix] = rpkiResult{valid: valid[i], checked: now}
+	}
+	s.rpkiResults[url] = results
+
+	kept := make([]netip.Prefix, 0, len(prefixes))
+	var invalid []string
+	for _, prefix := range prefixes {
+		if !results[prefix].valid {
+			invalid = append(invalid, prefix.String())
+			continue
+		}
+		kept = append(kept, prefix)
+	}
+	if len(invalid) > 0 && s.log != nil {
+		s.log.Warn("dropped prefixes without a valid ROA from IP list",
+			zap.String("url", url),
+			zap.Strings("prefixes", invalid))
+	}
+	return kept, nil
+}
+
+// rpkiValid reports whether prefix is RPKI valid for one of the expected
+// ASNs.
+func (s *URLIPRange) rpkiValid(prefix netip.Prefix) (bool, error) {
+	for _, asn := range s.RPKI.ASNs {
+		ctx, cancel := s.getContext()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+			fmt.Sprintf("%s/api/v1/validity/AS%d/%s", strings.TrimSuffix(s.RPKI.Validator, "/"), asn, prefix), nil)
+		if err != nil {
+			cancel()
+			return false, err
+		}
+		var validity rpkiValidity
+		err = getJSON(req, &validity)
+		cancel()
+		if err != nil {
+			return false, err
+		}
+		if validity.ValidatedRoute.Validity.State == "valid" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
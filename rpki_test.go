@@ -0,0 +1,137 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestRPKI(t *testing.T) {
+	var mu sync.Mutex
+	var queried []string
+	validator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queried = append(queried, r.URL.Path)
+		mu.Unlock()
+		state := "not-found"
+		switch r.URL.Path {
+		case "/api/v1/validity/AS13335/104.16.0.0/13":
+			state = "valid"
+		case "/api/v1/validity/AS13335/198.51.100.0/24":
+			state = "invalid"
+		case "/api/v1/validity/AS64496/198.51.100.0/24":
+			state = "valid"
+		}
+		fmt.Fprintf(w, `{"validated_route":{"validity":{"state":%q}}}`, state)
+	}))
+	defer validator.Close()
+
+	body := "104.16.0.0/13\n192.0.2.0/24\n198.51.100.0/24\n"
+	got, err := provisionFiltered(t, body, "rpki "+validator.URL+"/ AS13335")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"104.16.0.0/13"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	got, err = provisionFiltered(t, body, "rpki "+validator.URL+" 13335 64496")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"104.16.0.0/13", "198.51.100.0/24"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// bogons are stripped before they are validated
+	mu.Lock()
+	queried = nil
+	mu.Unlock()
+	if _, err := provisionFiltered(t, body, "rpki "+validator.URL+" AS13335\nstrip_bogons"); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if slices.ContainsFunc(queried, func(path string) bool { return strings.HasSuffix(path, "/192.0.2.0/24") }) {
+		t.Errorf("expected the bogon not to be validated, got queries %v", queried)
+	}
+	mu.Unlock()
+
+	validator.Close()
+	if _, err := provisionFiltered(t, body, "rpki "+validator.URL+" AS13335"); err == nil {
+		t.Error("expected the list to be rejected without a validator")
+	}
+}
+
+func TestRPKICache(t *testing.T) {
+	var queries, inFlight, maxInFlight atomic.Int32
+	validator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for m := maxInFlight.Load(); n > m && !maxInFlight.CompareAndSwap(m, n); m = maxInFlight.Load() {
+		}
+		time.Sleep(time.Millisecond)
+		fmt.Fprint(w, `{"validated_route":{"validity":{"state":"valid"}}}`)
+	}))
+	defer validator.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	r := URLIPRange{RPKI: &RPKIValidation{Validator: validator.URL, ASNs: []uint32{13335}}, ctx: ctx}
+	var prefixes []netip.Prefix
+	for i := range 50 {
+		prefixes = append(prefixes, netip.PrefixFrom(netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}), 32))
+	}
+	validate := func(url string, prefixes []netip.Prefix) {
+		t.Helper()
+		kept, err := r.validateRPKI(url, prefixes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(kept) != len(prefixes) {
+			t.Errorf("expected %d valid prefixes, got %d", len(prefixes), len(kept))
+		}
+	}
+
+	validate("a", prefixes)
+	validate("b", prefixes[:10])
+	if got := queries.Load(); got != 60 {
+		t.Errorf("expected each prefix of each URL to be validated, got %d queries", got)
+	}
+	if got := maxInFlight.Load(); got < 2 || got > rpkiLookups {
+		t.Errorf("expected up to %d concurrent queries, got %d", rpkiLookups, got)
+	}
+	// results are reused across refreshes, and only for the listed prefixes
+	validate("a", prefixes[:25])
+	validate("b", prefixes[:10])
+	if got := queries.Load(); got != 60 {
+		t.Errorf("expected cached results, got %d queries", got)
+	}
+	if got := len(r.rpkiResults["a"]); got != 25 {
+		t.Errorf("expected the results of unlisted prefixes to be dropped, got %d", got)
+	}
+	validate("a", prefixes)
+	if got := queries.Load(); got != 85 {
+		t.Errorf("expected the dropped prefixes to be validated again, got %d queries", got)
+	}
+
+	// expired results are validated again
+	for prefix, result := range r.rpkiResults["b"] {
+		result.checked = result.checked.Add(-rpkiResultTTL)
+		r.rpkiResults["b"][prefix] = result
+	}
+	validate("b", prefixes[:10])
+	if got := queries.Load(); got != 95 {
+		t.Errorf("expected expired results to be validated again, got %d queries", got)
+	}
+}
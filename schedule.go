@@ -0,0 +1,443 @@
+package caddy_ip_list
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// retryDelay is the delay before the first retry of a URL that failed to
+// be fetched on startup. It doubles with every further failure up to the
+// interval of the URL.
+var retryDelay = 5 * time.Second
+
+// setupSchedule applies the default interval and parses the interval
+// jitter.
+func (s *URLIPRange) setupSchedule() error {
+	s.cron = nil
+	if s.Schedule != "" {
+		if s.Interval != 0 {
+			return fmt.Errorf("interval and schedule are mutually exclusive")
+		}
+		cron, err := parseCron(s.Schedule)
+		if err != nil {
+			return err
+		}
+		s.cron = cron
+	}
+	if s.Interval == 0 {
+		s.Interval = caddy.Duration(time.Hour)
+	}
+	if s.Interval < 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+	shortest := time.Duration(s.Interval)
+	if s.cron != nil {
+		// the jitter is only bounded by the intervals of URLs
+		shortest = time.Duration(math.MaxInt64)
+	}
+	for url, interval := range s.URLIntervals {
+		if !slices.Contains(s.URLs, url) {
+			return fmt.Errorf("interval of %s, which is not a list URL", url)
+		}
+		if interval <= 0 {
+			return fmt.Errorf("interval of %s must be positive", url)
+		}
+		shortest = min(shortest, time.Duration(interval))
+	}
+	if s.MaxBackoff < 0 {
+		return fmt.Errorf("max_backoff must not be negative")
+	}
+	if s.RefreshDeadline < 0 {
+		return fmt.Errorf("refresh_deadline must not be negative")
+	}
+	if s.Stagger && s.Schedule != "" {
+		return fmt.Errorf("stagger can't be combined with schedule")
+	}
+	switch s.Refresh {
+	case "", "interval":
+	case "on_demand":
+		if s.Schedule != "" || s.RefreshWindow != "" {
+			return fmt.Errorf("refresh on_demand can't be combined with schedule or refresh_window")
+		}
+		if s.OnDemandMaxAge < 0 {
+			return fmt.Errorf("max_age must not be negative")
+		}
+		if s.OnDemandMaxAge == 0 {
+			s.OnDemandMaxAge = s.Interval
+		}
+	default:
+		return fmt.Errorf("unknown refresh %q: must be interval or on_demand", s.Refresh)
+	}
+	s.window = nil
+	if s.RefreshWindow != "" {
+		window, err := parseRefreshWindow(s.RefreshWindow)
+		if err != nil {
+			return err
+		}
+		s.window = window
+	}
+	s.due = make(map[string]time.Time)
+	s.failures = make(map[string]int)
+	s.retrying = make(map[string]bool)
+	s.warned = make(map[string]time.Time)
+	s.jitter, s.jitterPercent = 0, 0
+	if s.IntervalJitter == "" {
+		return nil
+	}
+	if value, ok := strings.CutSuffix(s.IntervalJitter, "%"); ok {
+		percent, err := strconv.ParseFloat(value, 64)
+		if err != nil || percent < 0 || percent >= 100 {
+			return fmt.Errorf("invalid interval_jitter %q: must be a percentage below 100%%", s.IntervalJitter)
+		}
+		s.jitterPercent = percent
+		return nil
+	}
+	jitter, err := caddy.ParseDuration(s.IntervalJitter)
+	if err != nil {
+		return fmt.Errorf("invalid interval_jitter %q: %v", s.IntervalJitter, err)
+	}
+	if jitter < 0 || jitter >= shortest {
+		return fmt.Errorf("interval_jitter %s must be shorter than interval %s", jitter, shortest)
+	}
+	s.jitter = jitter
+	return nil
+}
+
+// intervalOf returns the refresh interval of url at now, which is the
+// time until the next run of the schedule if url follows it.
+func (s *URLIPRange) intervalOf(url string, now time.Time) time.Duration {
+	if interval, ok := s.URLIntervals[url]; ok {
+		return time.Duration(interval)
+	}
+	if s.cron != nil {
+		return s.cron.next(now).Sub(now)
+	}
+	return time.Duration(s.Interval)
+}
+
+// nextInterval returns the time until the next refresh after interval:
+// the interval, moved randomly by up to the jitter in either direction.
+func (s *URLIPRange) nextInterval(interval time.Duration) time.Duration {
+	jitter := s.jitter
+	if s.jitterPercent > 0 {
+		jitter = time.Duration(float64(interval) * s.jitterPercent / 100)
+	}
+	if jitter > 0 {
+		interval += time.Duration(rand.Int64N(2*int64(jitter)+1)) - jitter
+	}
+	return interval
+}
+
+// isDue reports whether url is to be refreshed at now. URLs that were
+// never fetched are always due.
+func (s *URLIPRange) isDue(url string, now time.Time) bool {
+	due, ok := s.due[url]
+	return !ok || !now.Before(due)
+}
+
+// scheduleNext schedules the next refresh of url, fetched at now. With
+// stagger, the first refresh of the URLs after they were fetched together
+// is spread evenly across the interval.
+func (s *URLIPRange) scheduleNext(url string, now time.Time) {
+	interval := s.intervalOf(url, now)
+	next := now.Add(s.nextInterval(interval))
+	if _, scheduled := s.due[url]; !scheduled && s.Stagger {
+		urls := slices.Concat(s.URLs, s.excludeURLs)
+		next = next.Add(interval * time.Duration(slices.Index(urls, url)) / time.Duration(len(urls)))
+	}
+	s.setDue(url, next)
+}
+
+// backOff reschedules url after a failed fetch at now, doubling its
+// interval with every consecutive failure up to max_backoff. URLs that
+// are retried after a failed startup start from the retry delay instead.
+// A successful fetch resets its backoff.
+func (s *URLIPRange) backOff(url string, now time.Time, err error) {
+	defer s.storeBackoff(url, now, err)
+	if err == nil || (s.MaxBackoff == 0 && !s.retrying[url]) {
+		delete(s.failures, url)
+		delete(s.retrying, url)
+		return
+	}
+	s.failures[url]++
+	interval := s.intervalOf(url, now)
+	limit := max(time.Duration(s.MaxBackoff), interval)
+	if s.retrying[url] {
+		interval = min(retryDelay, interval)
+	}
+	for i := 1; i < s.failures[url] && interval < limit; i++ {
+		interval *= 2
+	}
+	s.setDue(url, now.Add(s.nextInterval(min(interval, limit))))
+}
+
+// backoffStates holds the schedule of the URLs that are failing by their
+// source key, so a list that replaces them on a config reload keeps backing
+// off instead of fetching them again right away.
+var (
+	backoffStates   = make(map[string]backoffState)
+	backoffStatesMu sync.Mutex
+)
+
+type backoffState struct {
+	due      time.Time
+	failures int
+	retrying bool
+	// the last good list of the URL
+	list urlList
+}
+
+// sourceKey identifies url together with the options that determine how
+// it is fetched, filtered and scheduled.
+func (s *URLIPRange) sourceKey(url string) string {
+	interval, ok := s.URLIntervals[url]
+	if !ok {
+		interval = s.Interval
+	}
+	source, _ := json.Marshal(struct {
+		URL        string
+		Interval   caddy.Duration
+		Schedule   string
+		MaxBackoff caddy.Duration
+		Timeout    caddy.Duration
+		Retries    *int
+		HeadCheck  bool
+		Filter     string
+	}{url, interval, s.Schedule, s.MaxBackoff, s.Timeout, s.Retries, s.HeadCheck, s.filterKey()})
+	sum := sha256.Sum256(source)
+	return hex.EncodeToString(sum[:])
+}
+
+// storeBackoff records the schedule of url after a fetch at now that
+// failed with err, or forgets it after a successful fetch.
+func (s *URLIPRange) storeBackoff(url string, now time.Time, err error) {
+	key := s.sourceKey(url)
+	backoffStatesMu.Lock()
+	defer backoffStatesMu.Unlock()
+	for key, state := range backoffStates {
+		if state.due.Before(now) {
+			delete(backoffStates, key)
+		}
+	}
+	list, ok := s.lists[url]
+	if slices.Contains(s.excludeURLs, url) {
+		list, ok = s.excluded[url]
+	}
+	if err == nil || !ok {
+		// without a last good list, the URL is fetched on startup
+		delete(backoffStates, key)
+		return
+	}
+	backoffStates[key] = backoffState{
+		due:      s.due[url],
+		failures: s.failures[url],
+		retrying: s.retrying[url],
+		list:     list,
+	}
+}
+
+// restoreBackoff makes the URLs that a replaced list was backing off from
+// keep their schedule and last good list, so they are not fetched on
+// startup.
+func (s *URLIPRange) restoreBackoff() {
+	now := time.Now()
+	backoffStatesMu.Lock()
+	defer backoffStatesMu.Unlock()
+	for _, url := range slices.Concat(s.URLs, s.excludeURLs) {
+		state, ok := backoffStates[s.sourceKey(url)]
+		if !ok || !state.due.After(now) {
+			continue
+		}
+		s.due[url] = state.due
+		if state.failures > 0 {
+			s.failures[url] = state.failures
+		}
+		if state.retrying {
+			s.retrying[url] = true
+		}
+		if slices.Contains(s.excludeURLs, url) {
+			s.excluded[url] = state.list
+			continue
+		}
+		s.lists[url] = state.list
+		s.updateStatus(url, func(status *urlStatus) { status.Entries = len(state.list.prefixes) })
+		if s.log != nil {
+			s.log.Info("keeping backoff of failing IP list from previous config",
+				zap.String("url", url),
+				zap.Time("next_fetch", state.due))
+		}
+	}
+}
+
+// retrySoon makes url, which is served from the cache or not at all after
+// a failed fetch on startup, be retried after the retry delay rather than
+// a full interval, until a fetch succeeds.
+func (s *URLIPRange) retrySoon(url string) {
+	s.retrying[url] = true
+	if _, ok := s.due[url]; ok {
+		s.setDue(url, time.Now().Add(retryDelay))
+	}
+}
+
+// setDue schedules the refresh of url at due, or at the next start of the
+// refresh window if due is outside of it.
+func (s *URLIPRange) setDue(url string, due time.Time) {
+	if s.window != nil {
+		due = s.window.next(due)
+	}
+	s.due[url] = due
+}
+
+// untilDue returns the time until the next URL is due, which is right
+// away for URLs that were never fetched. Lists refreshed on demand are
+// never due.
+func (s *URLIPRange) untilDue() time.Duration {
+	if s.Refresh == "on_demand" {
+		return math.MaxInt64
+	}
+	var next time.Time
+	for _, urls := range [][]string{s.URLs, s.excludeURLs} {
+		for _, url := range urls {
+			due, ok := s.due[url]
+			if !ok {
+				return 0
+			}
+			if next.IsZero() || due.Before(next) {
+				next = due
+			}
+		}
+	}
+	if next.IsZero() {
+		return s.nextInterval(s.intervalOf("", time.Now()))
+	}
+	return max(time.Until(next), 0)
+}
+
+// setPaused suspends or restarts the refreshes of the list. While paused,
+// the ranges only change when entries expire.
+func (s *URLIPRange) setPaused(paused bool) {
+	if s.paused.Swap(paused) && !paused {
+		select {
+		case s.resumed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// degradedLogInterval is how often the failures of a degraded URL are
+// logged as warnings. The failures in between are logged at debug level.
+var degradedLogInterval = time.Hour
+
+// warnDegraded reports whether a failure of the degraded URL at now should
+// be logged as a warning: the first one, and then one per
+// degradedLogInterval.
+func (s *URLIPRange) warnDegraded(url string, now time.Time) bool {
+	if last, ok := s.warned[url]; ok && now.Sub(last) < degradedLogInterval {
+		return false
+	}
+	s.warned[url] = now
+	return true
+}
+
+type refreshRequest struct {
+	url  string
+	done chan refreshResult
+}
+
+type refreshResult struct {
+	changed int
+	err     error
+}
+
+// forceRefresh fetches url, or every URL if url is empty, right away. The
+// fetch is done by the refresh loop, which owns the lists.
+func (s *URLIPRange) forceRefresh(url string) (changed int, err error) {
+	if url != "" && !slices.Contains(s.URLs, url) && !slices.Contains(s.excludeURLs, url) {
+		return 0, fmt.Errorf("list has no URL %s", url)
+	}
+	done := make(chan refreshResult, 1)
+	select {
+	case s.refreshes <- refreshRequest{url: url, done: done}:
+		result := <-done
+		return result.changed, result.err
+	case <-s.shutdown:
+		return 0, fmt.Errorf("list is stopped")
+	case <-s.ctx.Done():
+		return 0, fmt.Errorf("list is stopped")
+	}
+}
+
+// refreshNow fetches url, and any other URLs that are due, or every URL
+// if url is empty.
+func (s *URLIPRange) refreshNow(url string) (changed int, err error) {
+	if url == "" {
+		return s.refresh()
+	}
+	// due right away, but still scheduled as far as stagger is concerned
+	s.due[url] = time.Time{}
+	return s.refreshDue()
+}
+
+// refreshWindow is the time of day, in UTC, during which URLs may be
+// refreshed, as offsets from midnight. It wraps around midnight if end is
+// before start.
+type refreshWindow struct {
+	start, end time.Duration
+}
+
+// parseRefreshWindow parses a window such as "01:00-05:00".
+func parseRefreshWindow(window string) (*refreshWindow, error) {
+	startText, endText, ok := strings.Cut(window, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid refresh_window %q: expected <start>-<end>", window)
+	}
+	var w refreshWindow
+	for _, bound := range []struct {
+		text   string
+		offset *time.Duration
+	}{{startText, &w.start}, {endText, &w.end}} {
+		t, err := time.Parse("15:04", bound.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid refresh_window %q: %v", window, err)
+		}
+		*bound.offset = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("invalid refresh_window %q: empty window", window)
+	}
+	return &w, nil
+}
+
+// next returns t if it is inside the window, or else the next start of
+// the window.
+func (w *refreshWindow) next(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	offset := t.Sub(day)
+	if w.start < w.end {
+		switch {
+		case offset < w.start:
+			return day.Add(w.start)
+		case offset < w.end:
+			return t
+		default:
+			return day.AddDate(0, 0, 1).Add(w.start)
+		}
+	}
+	if offset >= w.start || offset < w.end {
+		return t
+	}
+	return day.Add(w.start)
+}
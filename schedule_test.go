@@ -0,0 +1,488 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestIntervalJitter(t *testing.T) {
+	for _, test := range []struct {
+		jitter   string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"10%", 6 * time.Minute},
+		{"5m", 5 * time.Minute},
+	} {
+		r := URLIPRange{IntervalJitter: test.jitter}
+		if err := r.setupSchedule(); err != nil {
+			t.Fatalf("%q: %v", test.jitter, err)
+		}
+		for range 100 {
+			if next := r.nextInterval(time.Hour); next < time.Hour-test.expected || next > time.Hour+test.expected {
+				t.Fatalf("%q: interval %s out of bounds", test.jitter, next)
+			}
+		}
+	}
+
+	for _, jitter := range []string{"100%", "-5%", "1h", "soon"} {
+		r := URLIPRange{Interval: caddy.Duration(time.Hour), IntervalJitter: jitter}
+		if err := r.setupSchedule(); err == nil {
+			t.Errorf("expected interval_jitter %q to be rejected", jitter)
+		}
+	}
+}
+
+func TestURLInterval(t *testing.T) {
+	var weekly, minutely atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/weekly" {
+			weekly.Add(1)
+			w.Write([]byte("192.0.2.0/24\n"))
+		} else {
+			minutely.Add(1)
+			w.Write([]byte("198.51.100.0/24\n"))
+		}
+	}))
+	defer server.Close()
+
+	d := caddyfile.NewTestDispenser(`list {
+		interval 10ms
+		url ` + server.URL + `/weekly {
+			interval 1h
+		}
+		url ` + server.URL + `/minutely
+		cache off
+	}`)
+	r := &URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	defer r.Cleanup()
+	time.Sleep(100 * time.Millisecond)
+	if weekly.Load() != 1 {
+		t.Errorf("expected the weekly list to be fetched once, got %d", weekly.Load())
+	}
+	if minutely.Load() < 3 {
+		t.Errorf("expected the other list to be refreshed, got %d fetches", minutely.Load())
+	}
+
+	// an interval jitter must fit the shortest interval
+	r = &URLIPRange{
+		URLs:           []string{server.URL},
+		URLIntervals:   map[string]caddy.Duration{server.URL: caddy.Duration(time.Minute)},
+		IntervalJitter: "5m",
+	}
+	if err := r.setupSchedule(); err == nil {
+		t.Error("expected interval_jitter longer than a URL's interval to be rejected")
+	}
+}
+
+func TestForceRefresh(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	r, update := provisionUpdatable(t, ctx)
+
+	update()
+	rec := httptest.NewRecorder()
+	if err := (adminIPList{}).handleRefresh(rec, httptest.NewRequest(http.MethodPost, "/ip-list/refresh/"+r.listID()+"?url="+r.URLs[0], nil)); err != nil {
+		t.Fatal(err)
+	}
+	var refreshes []listRefresh
+	if err := json.Unmarshal(rec.Body.Bytes(), &refreshes); err != nil {
+		t.Fatal(err)
+	}
+	if len(refreshes) != 1 || refreshes[0].Changed != 1 || refreshes[0].Error != "" {
+		t.Errorf("unexpected refresh result %s", rec.Body)
+	}
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, []string{"198.51.100.0/24"}) {
+		t.Errorf("expected refreshed ranges, got %v", got)
+	}
+
+	for _, target := range []string{"/ip-list/refresh/unknown", "/ip-list/refresh?url=https://example.com/unknown"} {
+		if err := (adminIPList{}).handleRefresh(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, target, nil)); err == nil {
+			t.Errorf("%s: expected not found", target)
+		}
+	}
+}
+
+func TestPause(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	r, update := provisionUpdatable(t, ctx)
+
+	pause := func(action string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		if err := (adminIPList{}).handlePause(rec, httptest.NewRequest(http.MethodPost, "/ip-list/"+action+"/"+r.listID(), nil)); err != nil {
+			t.Fatal(err)
+		}
+		var pauses []listPause
+		if err := json.Unmarshal(rec.Body.Bytes(), &pauses); err != nil {
+			t.Fatal(err)
+		}
+		if len(pauses) != 1 || pauses[0].Paused != (action == "pause") {
+			t.Errorf("unexpected %s result %s", action, rec.Body)
+		}
+	}
+
+	update()
+	pause("pause")
+	if _, err := r.forceRefresh(""); err == nil {
+		t.Error("expected a refresh of a paused list to fail")
+	}
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, []string{"192.0.2.0/24"}) {
+		t.Errorf("expected the paused list to keep its ranges, got %v", got)
+	}
+
+	pause("resume")
+	if _, err := r.forceRefresh(""); err != nil {
+		t.Fatal(err)
+	}
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, []string{"198.51.100.0/24"}) {
+		t.Errorf("expected refreshed ranges, got %v", got)
+	}
+
+	if err := (adminIPList{}).handlePause(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/ip-list/pause/unknown", nil)); err == nil {
+		t.Error("expected not found")
+	}
+}
+
+func TestBackoffAcrossReload(t *testing.T) {
+	var fetches atomic.Int32
+	var down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	defer server.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	provision := func(r *URLIPRange) error {
+		r.URLs, r.Retries, r.CacheDisabled = []string{server.URL}, new(int), true
+		if err := r.Provision(ctx); err != nil {
+			return err
+		}
+		t.Cleanup(func() { r.Cleanup() })
+		return nil
+	}
+	r := &URLIPRange{}
+	if err := provision(r); err != nil {
+		t.Fatal(err)
+	}
+	down.Store(true)
+	if _, err := r.forceRefresh(""); err != nil {
+		t.Fatal(err)
+	}
+
+	// another config with the same source keeps backing off
+	reloaded := &URLIPRange{CIDRs: []string{"203.0.113.0/24"}}
+	if err := provision(reloaded); err != nil {
+		t.Fatal(err)
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("expected the failing URL not to be fetched on reload, got %d fetches", got)
+	}
+	if got := prefixStrings(reloaded.GetIPRanges(nil)); !slices.Equal(got, []string{"192.0.2.0/24", "203.0.113.0/24"}) {
+		t.Errorf("expected the last good ranges, got %v", got)
+	}
+
+	// a changed source is fetched
+	if err := provision(&URLIPRange{Timeout: caddy.Duration(time.Minute)}); err == nil {
+		t.Error("expected the failing URL to be fetched with a changed source")
+	}
+	if got := fetches.Load(); got != 3 {
+		t.Errorf("expected the changed source to be fetched, got %d fetches", got)
+	}
+	// as are changed filters, which the last good ranges did not go through
+	if err := provision(&URLIPRange{AllowWithin: []string{"198.51.100.0/24"}}); err == nil {
+		t.Error("expected the failing URL to be fetched with changed filters")
+	}
+	if got := fetches.Load(); got != 4 {
+		t.Errorf("expected the changed filters to be fetched, got %d fetches", got)
+	}
+}
+
+func TestMaxBackoff(t *testing.T) {
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	d := caddyfile.NewTestDispenser(`list {
+		url ` + server.URL + `
+		interval 10ms
+		max_backoff 80ms
+		on_startup_failure start_empty
+		cache off
+	}`)
+	r := &URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	defer r.Cleanup()
+	time.Sleep(300 * time.Millisecond)
+	// without backoff, the URL would be fetched about 30 times
+	if n := fetches.Load(); n < 3 || n > 12 {
+		t.Errorf("expected the failing URL to back off, got %d fetches", n)
+	}
+
+	if err := (&URLIPRange{MaxBackoff: -1}).setupSchedule(); err == nil {
+		t.Error("expected a negative max_backoff to be rejected")
+	}
+}
+
+func TestRetryAfterStartupFailure(t *testing.T) {
+	defer func(delay time.Duration) { retryDelay = delay }(retryDelay)
+	retryDelay = 10 * time.Millisecond
+
+	var down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	defer server.Close()
+
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	r := &URLIPRange{URLs: []string{server.URL}, CacheFile: cacheFile}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.setup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	r.lists[server.URL] = urlList{prefixes: []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")}, updated: time.Now()}
+	if err := r.saveToCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	down.Store(true)
+	d := caddyfile.NewTestDispenser(`list {
+		url ` + server.URL + `
+		interval 1h
+		retries 0
+		cache_file ` + cacheFile + `
+	}`)
+	r = &URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	defer r.Cleanup()
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, []string{"198.51.100.0/24"}) {
+		t.Fatalf("expected the cached ranges, got %v", got)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	down.Store(false)
+	waitForRanges(t, r, []string{"192.0.2.0/24"})
+}
+
+func TestRefreshWindow(t *testing.T) {
+	day := time.Date(2024, time.January, 10, 0, 0, 0, 0, time.UTC)
+	at := func(hour, minute int) time.Time {
+		return day.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)
+	}
+	for _, test := range []struct {
+		window   string
+		t        time.Time
+		expected time.Time
+	}{
+		{"01:00-05:00", at(0, 30), at(1, 0)},
+		{"01:00-05:00", at(3, 0), at(3, 0)},
+		{"01:00-05:00", at(5, 0), at(25, 0)},
+		{"22:00-02:00", at(23, 0), at(23, 0)},
+		{"22:00-02:00", at(1, 0), at(1, 0)},
+		{"22:00-02:00", at(12, 0), at(22, 0)},
+	} {
+		w, err := parseRefreshWindow(test.window)
+		if err != nil {
+			t.Fatalf("%q: %v", test.window, err)
+		}
+		if next := w.next(test.t); !next.Equal(test.expected) {
+			t.Errorf("%q at %s: expected %s, got %s", test.window, test.t, test.expected, next)
+		}
+	}
+
+	d := caddyfile.NewTestDispenser(`list {
+		url https://example.com/list.txt
+		interval 1h
+		refresh_window 01:00-05:00
+	}`)
+	r := &URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if err := r.setupSchedule(); err != nil {
+		t.Fatal(err)
+	}
+	r.scheduleNext(r.URLs[0], at(4, 30))
+	if due := r.due[r.URLs[0]]; !due.Equal(at(25, 0)) {
+		t.Errorf("expected the refresh to wait for the next window, got %s", due)
+	}
+
+	for _, window := range []string{"01:00", "1am-5am", "01:00-01:00", "25:00-05:00"} {
+		if _, err := parseRefreshWindow(window); err == nil {
+			t.Errorf("expected refresh_window %q to be rejected", window)
+		}
+	}
+}
+
+func TestRefreshDeadline(t *testing.T) {
+	var fast atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			return
+		}
+		fast.Add(1)
+		w.Write([]byte("198.51.100.0/24\n"))
+	}))
+	defer server.Close()
+
+	slowURL, fastURL := server.URL+"/slow", server.URL+"/fast"
+	r := &URLIPRange{
+		URLs:            []string{slowURL, fastURL},
+		RefreshDeadline: caddy.Duration(50 * time.Millisecond),
+		CacheDisabled:   true,
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.setup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	previous := urlList{prefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, updated: time.Now()}
+	r.lists[slowURL], r.lists[fastURL] = previous, previous
+
+	start := time.Now()
+	changed, err := r.refresh()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the refresh to end at the deadline, took %s", elapsed)
+	}
+	if changed != 0 || err != nil || fast.Load() != 0 {
+		t.Errorf("expected both URLs to keep their ranges, got %d changed, %d fetches: %v", changed, fast.Load(), err)
+	}
+	if !r.isDue(fastURL, time.Now()) {
+		t.Error("expected the URL that was not fetched to stay due")
+	}
+
+	// without previous ranges, the URLs that were not fetched fail
+	delete(r.lists, fastURL)
+	if _, err := r.refresh(); err == nil {
+		t.Error("expected an error for the URL without ranges")
+	}
+}
+
+func TestRefreshOnDemand(t *testing.T) {
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	defer server.Close()
+
+	d := caddyfile.NewTestDispenser(`list {
+		url ` + server.URL + `
+		interval 10ms
+		refresh on_demand max_age 50ms
+		cache off
+	}`)
+	r := &URLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	defer r.Cleanup()
+
+	r.GetIPRanges(nil)
+	time.Sleep(100 * time.Millisecond)
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("expected no background refresh of an idle list, got %d fetches", n)
+	}
+	r.GetIPRanges(nil)
+	for deadline := time.Now().Add(5 * time.Second); fetches.Load() < 2 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+	}
+	for range 10 {
+		r.GetIPRanges(nil)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("expected a single refresh of the stale list, got %d fetches", n)
+	}
+
+	for _, options := range []string{"refresh sometimes", "refresh on_demand max_age", "refresh on_demand\nschedule @daily"} {
+		r := &URLIPRange{}
+		d := caddyfile.NewTestDispenser("list {\nurl " + server.URL + "\n" + options + "\n}")
+		err := r.UnmarshalCaddyfile(d)
+		if err == nil {
+			err = r.setupSchedule()
+		}
+		if err == nil {
+			t.Errorf("expected %q to be rejected", options)
+		}
+	}
+}
+
+func TestStagger(t *testing.T) {
+	r := &URLIPRange{
+		URLs:     []string{"https://example.com/1", "https://example.com/2", "https://example.com/3", "https://example.com/4"},
+		Interval: caddy.Duration(time.Hour),
+		Stagger:  true,
+	}
+	if err := r.setupSchedule(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i, url := range r.URLs {
+		r.scheduleNext(url, now)
+		if expected := now.Add(time.Hour + time.Duration(i)*15*time.Minute); !r.due[url].Equal(expected) {
+			t.Errorf("%s: expected to be due at %s, got %s", url, expected, r.due[url])
+		}
+	}
+	// later refreshes keep the spacing
+	r.scheduleNext(r.URLs[1], now.Add(75*time.Minute))
+	if expected := now.Add(135 * time.Minute); !r.due[r.URLs[1]].Equal(expected) {
+		t.Errorf("expected to be due at %s, got %s", expected, r.due[r.URLs[1]])
+	}
+
+	r = &URLIPRange{URLs: r.URLs, Schedule: "@daily", Stagger: true}
+	if err := r.setupSchedule(); err == nil {
+		t.Error("expected stagger with a schedule to be rejected")
+	}
+}
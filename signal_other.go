@@ -0,0 +1,6 @@
+//go:build !unix
+
+package caddy_ip_list
+
+// watchSignals does nothing, as there is no SIGUSR1 on this platform.
+func watchSignals() {}
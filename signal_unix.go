@@ -0,0 +1,31 @@
+//go:build unix
+
+package caddy_ip_list
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+var watchSignalsOnce sync.Once
+
+// watchSignals makes every list fetch its URLs right away whenever the
+// process receives SIGUSR1. Caddy has no action for SIGUSR1 and only logs
+// that it is not implemented, so both handle the signal.
+func watchSignals() {
+	watchSignalsOnce.Do(func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGUSR1)
+		go func() {
+			log := caddy.Log().Named("ip_list")
+			for range signals {
+				log.Info("refreshing IP lists on SIGUSR1")
+				refreshAll(log)
+			}
+		}()
+	})
+}
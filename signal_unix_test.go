@@ -0,0 +1,23 @@
+//go:build unix
+
+package caddy_ip_list
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestRefreshOnSignal(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	r, update := provisionUpdatable(t, ctx)
+
+	update()
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	waitForRanges(t, r, []string{"198.51.100.0/24"})
+}
@@ -0,0 +1,174 @@
+package caddy_ip_list
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(SocketIPRange{})
+}
+
+// pushedRanges keeps the last list pushed to each socket, so a config
+// reload does not drop what the agent sent.
+var (
+	pushedRanges   = make(map[string][]netip.Prefix)
+	pushedRangesMu sync.RWMutex
+)
+
+// SocketIPRange provides IP ranges pushed by a local agent over a Unix
+// socket. Every connection sends a complete list (one IP or CIDR per line,
+// '#' comments allowed) and closes its write side; the list replaces the
+// current ranges immediately and the server answers "OK <count>" or
+// "ERR <reason>".
+//
+// Example fail2ban action:
+//
+//	printf '%s\n' 192.0.2.1 198.51.100.0/24 | nc -UN /run/caddy/banned.sock
+type SocketIPRange struct {
+	// Path of the Unix socket. Permissions can be set with Caddy's
+	// usual suffix, e.g. /run/caddy/banned.sock|0660.
+	Path string `json:"path"`
+	// Maximum time to wait for a client to send its list. Default is 10s.
+	ReadTimeout caddy.Duration `json:"read_timeout,omitempty"`
+
+	key      string
+	listener net.Listener
+	log      *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (SocketIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.socket",
+		New: func() caddy.Module { return new(SocketIPRange) },
+	}
+}
+
+func (s *SocketIPRange) Provision(ctx caddy.Context) error {
+	if s.Path == "" {
+		return fmt.Errorf("socket path is required")
+	}
+	if s.ReadTimeout == 0 {
+		s.ReadTimeout = caddy.Duration(10 * time.Second)
+	}
+	s.log = ctx.Logger()
+
+	addr, err := caddy.ParseNetworkAddress("unix/" + s.Path)
+	if err != nil {
+		return err
+	}
+	s.key, _, _ = strings.Cut(addr.Host, "|")
+	ln, err := addr.Listen(ctx, 0, net.ListenConfig{})
+	if err != nil {
+		return err
+	}
+	s.listener = ln.(net.Listener)
+	go s.serve()
+	return nil
+}
+
+func (s *SocketIPRange) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.log.Error("accepting connection", zap.Error(err))
+			}
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *SocketIPRange) handle(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Duration(s.ReadTimeout)))
+
+	prefixes, err := parseList(conn)
+	if err != nil {
+		s.log.Warn("rejected pushed IP ranges", zap.Error(err))
+		fmt.Fprintf(conn, "ERR %v\n", err)
+		return
+	}
+
+	pushedRangesMu.Lock()
+	pushedRanges[s.key] = prefixes
+	pushedRangesMu.Unlock()
+
+	s.log.Info("received pushed IP ranges", zap.Int("count", len(prefixes)))
+	fmt.Fprintf(conn, "OK %d\n", len(prefixes))
+}
+
+func (s *SocketIPRange) GetIPRanges(_ *http.Request) []netip.Prefix {
+	pushedRangesMu.RLock()
+	defer pushedRangesMu.RUnlock()
+	return pushedRanges[s.key]
+}
+
+// Cleanup closes the listener.
+func (s *SocketIPRange) Cleanup() error {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	socket <path> {
+//	   read_timeout val
+//	}
+func (m *SocketIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	m.Path = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "read_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.ReadTimeout = caddy.Duration(val)
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*SocketIPRange)(nil)
+	_ caddy.Provisioner       = (*SocketIPRange)(nil)
+	_ caddy.CleanerUpper      = (*SocketIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*SocketIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*SocketIPRange)(nil)
+)
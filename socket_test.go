@@ -0,0 +1,67 @@
+package caddy_ip_list
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func pushList(t *testing.T, path, list string) string {
+	t.Helper()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(list)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn.(*net.UnixConn).CloseWrite()
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	return reply
+}
+
+func TestSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "banned.sock")
+
+	d := caddyfile.NewTestDispenser(`socket ` + path + `|0600 {
+		read_timeout 2s
+	}`)
+	r := SocketIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	defer r.Cleanup()
+
+	if ranges := r.GetIPRanges(nil); len(ranges) != 0 {
+		t.Errorf("expected no ranges before a push, got %v", ranges)
+	}
+
+	if reply := pushList(t, path, "# banned\n192.0.2.1\n198.51.100.0/24\n"); reply != "OK 2\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if ranges := r.GetIPRanges(nil); len(ranges) != 2 || ranges[1].String() != "198.51.100.0/24" {
+		t.Errorf("unexpected ranges: %v", ranges)
+	}
+
+	// an invalid list is rejected and keeps the previous ranges
+	if reply := pushList(t, path, "not-an-ip\n"); reply[:4] != "ERR " {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if ranges := r.GetIPRanges(nil); len(ranges) != 2 {
+		t.Errorf("ranges should be unchanged, got %v", ranges)
+	}
+}
@@ -0,0 +1,156 @@
+package caddy_ip_list
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// pollingSource is embedded by sources that rebuild their ranges by
+// periodically calling a fetch function.
+type pollingSource struct {
+	ranges []netip.Prefix
+	lock   *sync.RWMutex
+}
+
+// start performs the initial fetch and keeps refreshing the ranges every
+// interval until ctx is done. Failed refreshes keep the previous ranges.
+func (p *pollingSource) start(ctx caddy.Context, interval time.Duration, fetch func(context.Context) ([]netip.Prefix, error)) error {
+	p.lock = new(sync.RWMutex)
+	prefixes, err := fetch(ctx)
+	if err != nil {
+		return err
+	}
+	p.ranges = prefixes
+
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	log := ctx.Logger()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				prefixes, err := fetch(ctx)
+				if err != nil {
+					log.Warn("failed to refresh IP ranges; keeping previous ranges", zap.Error(err))
+					continue
+				}
+				p.setRanges(prefixes)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (p *pollingSource) setRanges(prefixes []netip.Prefix) {
+	p.lock.Lock()
+	p.ranges = prefixes
+	p.lock.Unlock()
+}
+
+func (p *pollingSource) GetIPRanges(_ *http.Request) []netip.Prefix {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.ranges
+}
+
+// getJSON performs req and decodes a JSON response body into v.
+func getJSON(req *http.Request, v any) error {
+	return getJSONWith(http.DefaultClient, req, v)
+}
+
+// getJSONWith is like getJSON but performs req with client.
+func getJSONWith(client *http.Client, req *http.Request, v any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s returned HTTP %d", req.Method, req.URL.Redacted(), resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// streamSource is embedded by sources that receive complete lists as
+// messages on topics or subjects. The latest list of each key is kept and
+// the published ranges are their combination; an empty list removes a key.
+type streamSource struct {
+	lists  map[string][]netip.Prefix
+	ranges []netip.Prefix
+	lock   *sync.RWMutex
+	log    *zap.Logger
+}
+
+// run keeps a session with the server until ctx is done, reconnecting with
+// exponential backoff. Backoff resets after a session that lasted a minute.
+func (s *streamSource) run(ctx caddy.Context, session func(context.Context) error) {
+	s.lists = make(map[string][]netip.Prefix)
+	s.lock = new(sync.RWMutex)
+	s.log = ctx.Logger()
+
+	go func() {
+		backoff := time.Second
+		for {
+			start := time.Now()
+			err := session(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if time.Since(start) > time.Minute {
+				backoff = time.Second
+			}
+			s.log.Warn("session ended; reconnecting", zap.Error(err), zap.Duration("backoff", backoff))
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(backoff*2, time.Minute)
+		}
+	}()
+}
+
+// update replaces the list of key with the one in payload.
+func (s *streamSource) update(key string, payload []byte) {
+	prefixes, err := parseList(bytes.NewReader(payload))
+	if err != nil {
+		s.log.Warn("ignoring invalid list", zap.String("key", key), zap.Error(err))
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(prefixes) == 0 {
+		delete(s.lists, key)
+	} else {
+		s.lists[key] = prefixes
+	}
+	var ranges []netip.Prefix
+	for _, k := range slices.Sorted(maps.Keys(s.lists)) {
+		ranges = append(ranges, s.lists[k]...)
+	}
+	s.ranges = ranges
+	s.log.Info("updated IP ranges", zap.String("key", key), zap.Int("count", len(prefixes)))
+}
+
+func (s *streamSource) GetIPRanges(_ *http.Request) []netip.Prefix {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.ranges
+}
@@ -0,0 +1,170 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(SQLIPRange{})
+}
+
+// SQLIPRange provides IP ranges returned by a SQL query. The query must
+// return a single column of IPs or CIDRs; NULLs and empty values are
+// skipped. The database driver has to be compiled into Caddy, for example
+// github.com/jackc/pgx/v5/stdlib ("pgx"), github.com/go-sql-driver/mysql
+// ("mysql") or modernc.org/sqlite ("sqlite").
+type SQLIPRange struct {
+	// Name of the database/sql driver.
+	Driver string `json:"driver"`
+	// Data source name passed to the driver. Supports placeholders such
+	// as {env.DB_PASSWORD}.
+	DSN string `json:"dsn"`
+	// Query returning one CIDR per row.
+	Query string `json:"query"`
+	// refresh Interval
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// Timeout for a single query.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	db *sql.DB
+	pollingSource
+}
+
+// CaddyModule returns the Caddy module information.
+func (SQLIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.sql",
+		New: func() caddy.Module { return new(SQLIPRange) },
+	}
+}
+
+func (s *SQLIPRange) Provision(ctx caddy.Context) error {
+	if s.Driver == "" || s.DSN == "" || s.Query == "" {
+		return fmt.Errorf("driver, dsn and query are required")
+	}
+	dsn := caddy.NewReplacer().ReplaceAll(s.DSN, "")
+	db, err := sql.Open(s.Driver, dsn)
+	if err != nil {
+		return err
+	}
+	s.db = db
+	return s.start(ctx, time.Duration(s.Interval), s.fetch)
+}
+
+func (s *SQLIPRange) fetch(ctx context.Context) ([]netip.Prefix, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.Timeout))
+		defer cancel()
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.Query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var prefixes []netip.Prefix
+	for rows.Next() {
+		var val sql.NullString
+		if err := rows.Scan(&val); err != nil {
+			return nil, err
+		}
+		cidr := strings.TrimSpace(val.String)
+		if cidr == "" {
+			continue
+		}
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, rows.Err()
+}
+
+// Cleanup closes the database handle.
+func (s *SQLIPRange) Cleanup() error {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	sql {
+//	   driver name
+//	   dsn string
+//	   query string
+//	   interval val
+//	   timeout val
+//	}
+func (m *SQLIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	// No same-line options are supported
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "driver":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Driver = d.Val()
+		case "dsn":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.DSN = d.Val()
+		case "query":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Query = d.Val()
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Interval = caddy.Duration(val)
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Timeout = caddy.Duration(val)
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*SQLIPRange)(nil)
+	_ caddy.Provisioner       = (*SQLIPRange)(nil)
+	_ caddy.CleanerUpper      = (*SQLIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*SQLIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*SQLIPRange)(nil)
+)
@@ -0,0 +1,92 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// fakeDriver answers every query with the rows registered for the DSN.
+type fakeDriver map[string][]driver.Value
+
+func (f fakeDriver) Open(dsn string) (driver.Conn, error) {
+	rows, ok := f[dsn]
+	if !ok {
+		return nil, errors.New("unknown dsn")
+	}
+	return fakeConn(rows), nil
+}
+
+type fakeConn []driver.Value
+
+func (c fakeConn) Prepare(string) (driver.Stmt, error) { return c, nil }
+func (c fakeConn) Close() error                        { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+func (c fakeConn) NumInput() int                       { return 0 }
+func (c fakeConn) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+func (c fakeConn) Query([]driver.Value) (driver.Rows, error) {
+	return &fakeRows{values: c}, nil
+}
+
+type fakeRows struct{ values []driver.Value }
+
+func (r *fakeRows) Columns() []string { return []string{"cidr"} }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0], r.values = r.values[0], r.values[1:]
+	return nil
+}
+
+func init() {
+	sql.Register("iplistfake", fakeDriver{
+		"allowlist": {"192.0.2.0/24", nil, " 2001:db8::/48 ", "", "198.51.100.9"},
+	})
+}
+
+func TestSQLProvision(t *testing.T) {
+	input := `
+	sql {
+		driver iplistfake
+		dsn allowlist
+		query "SELECT cidr FROM allowlist WHERE enabled"
+		interval 5m
+	}`
+
+	d := caddyfile.NewTestDispenser(input)
+	r := SQLIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if r.Query != "SELECT cidr FROM allowlist WHERE enabled" {
+		t.Errorf("unexpected query: %q", r.Query)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+	defer r.Cleanup()
+
+	ranges := r.GetIPRanges(nil)
+	expected := []string{"192.0.2.0/24", "2001:db8::/48", "198.51.100.9/32"}
+	if len(ranges) != len(expected) {
+		t.Fatalf("expected %d ranges, got %v", len(expected), ranges)
+	}
+	for i, p := range ranges {
+		if p.String() != expected[i] {
+			t.Errorf("range %d: expected %s, got %s", i, expected[i], p)
+		}
+	}
+}
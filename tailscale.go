@@ -0,0 +1,175 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(TailscaleIPRange{})
+}
+
+// TailscaleIPRange provides the addresses of the nodes in the local
+// tailnet, as reported by the Tailscale daemon's LocalAPI, and optionally
+// the subnet routes they advertise.
+type TailscaleIPRange struct {
+	// Path of the tailscaled socket. Default is
+	// /var/run/tailscale/tailscaled.sock.
+	Socket string `json:"socket,omitempty"`
+	// Also include the subnet routes served by peers.
+	Routes bool `json:"routes,omitempty"`
+	// refresh Interval. Default is 1m.
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// request Timeout
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	client *http.Client
+	pollingSource
+}
+
+// CaddyModule returns the Caddy module information.
+func (TailscaleIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.tailscale",
+		New: func() caddy.Module { return new(TailscaleIPRange) },
+	}
+}
+
+func (s *TailscaleIPRange) Provision(ctx caddy.Context) error {
+	if s.Socket == "" {
+		s.Socket = "/var/run/tailscale/tailscaled.sock"
+	}
+	if s.Interval == 0 {
+		s.Interval = caddy.Duration(time.Minute)
+	}
+	s.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", s.Socket)
+			},
+		},
+	}
+	return s.start(ctx, time.Duration(s.Interval), s.fetch)
+}
+
+type tailscalePeerStatus struct {
+	TailscaleIPs  []netip.Addr   `json:"TailscaleIPs"`
+	PrimaryRoutes []netip.Prefix `json:"PrimaryRoutes"`
+}
+
+func (s *TailscaleIPRange) fetch(ctx context.Context) ([]netip.Prefix, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.Timeout))
+		defer cancel()
+	}
+
+	// the host is not used for dialing, but tailscaled checks it
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://local-tailscaled.sock/localapi/v0/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	var status struct {
+		Self *tailscalePeerStatus           `json:"Self"`
+		Peer map[string]tailscalePeerStatus `json:"Peer"`
+	}
+	if err := getJSONWith(s.client, req, &status); err != nil {
+		return nil, err
+	}
+
+	// sort peers for a stable order between refreshes
+	keys := make([]string, 0, len(status.Peer))
+	for k := range status.Peer {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	nodes := make([]tailscalePeerStatus, 0, len(keys)+1)
+	if status.Self != nil {
+		nodes = append(nodes, *status.Self)
+	}
+	for _, k := range keys {
+		nodes = append(nodes, status.Peer[k])
+	}
+
+	var prefixes []netip.Prefix
+	for _, node := range nodes {
+		for _, addr := range node.TailscaleIPs {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+		if s.Routes {
+			prefixes = append(prefixes, node.PrimaryRoutes...)
+		}
+	}
+	return prefixes, nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	tailscale {
+//	   socket path
+//	   routes
+//	   interval val
+//	   timeout val
+//	}
+func (m *TailscaleIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	// No same-line options are supported
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "socket":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Socket = d.Val()
+		case "routes":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Routes = true
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Interval = caddy.Duration(val)
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Timeout = caddy.Duration(val)
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*TailscaleIPRange)(nil)
+	_ caddy.Provisioner       = (*TailscaleIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*TailscaleIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*TailscaleIPRange)(nil)
+)
@@ -0,0 +1,56 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestTailscale(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "tailscaled.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/localapi/v0/status" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		w.Write([]byte(`{
+			"Self": {"TailscaleIPs": ["100.64.0.1", "fd7a:115c:a1e0::1"]},
+			"Peer": {
+				"nodekey:bb": {"TailscaleIPs": ["100.64.0.3"]},
+				"nodekey:aa": {"TailscaleIPs": ["100.64.0.2"], "PrimaryRoutes": ["10.1.0.0/16"]}
+			}
+		}`))
+	}))
+	server.Listener = ln
+	server.Start()
+	defer server.Close()
+
+	d := caddyfile.NewTestDispenser(`tailscale {
+		socket ` + socket + `
+		routes
+	}`)
+	r := TailscaleIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+
+	expected := []string{"100.64.0.1/32", "fd7a:115c:a1e0::1/128", "100.64.0.2/32", "10.1.0.0/16", "100.64.0.3/32"}
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,412 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(ThreatFeedIPRange{})
+	caddy.RegisterModule(GreyNoiseFeed{})
+	caddy.RegisterModule(ShodanFeed{})
+}
+
+// ThreatFeed is implemented by modules in the ip_list.threat_feeds
+// namespace, which adapt the API of a threat intelligence feed.
+type ThreatFeed interface {
+	// FetchPage returns the indicators (IPs or CIDRs) of the page at
+	// cursor, which is empty for the first page, and the cursor of the
+	// next page or an empty string if this was the last one.
+	FetchPage(ctx context.Context, cursor string) (indicators []string, next string, err error)
+}
+
+// ThreatFeedIPRange provides the IP indicators of a threat intelligence
+// feed, such as GreyNoise or Shodan, fetching every page of results.
+type ThreatFeedIPRange struct {
+	// The feed provider.
+	ProviderRaw json.RawMessage `json:"provider,omitempty" caddy:"namespace=ip_list.threat_feeds inline_key=provider"`
+	// Maximum number of pages fetched per refresh, as a guard against
+	// runaway pagination and API credit usage. Default is 10.
+	MaxPages int `json:"max_pages,omitempty"`
+	// refresh Interval
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// request Timeout, covering all pages of a refresh
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	provider ThreatFeed
+	pollingSource
+}
+
+// CaddyModule returns the Caddy module information.
+func (ThreatFeedIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.threat_feed",
+		New: func() caddy.Module { return new(ThreatFeedIPRange) },
+	}
+}
+
+func (s *ThreatFeedIPRange) Provision(ctx caddy.Context) error {
+	if s.ProviderRaw == nil {
+		return fmt.Errorf("a provider is required")
+	}
+	mod, err := ctx.LoadModule(s, "ProviderRaw")
+	if err != nil {
+		return fmt.Errorf("loading threat feed provider: %v", err)
+	}
+	s.provider = mod.(ThreatFeed)
+	if s.MaxPages == 0 {
+		s.MaxPages = 10
+	}
+	return s.start(ctx, time.Duration(s.Interval), s.fetch)
+}
+
+func (s *ThreatFeedIPRange) fetch(ctx context.Context) ([]netip.Prefix, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.Timeout))
+		defer cancel()
+	}
+
+	var prefixes []netip.Prefix
+	var cursor string
+	for page := 1; ; page++ {
+		indicators, next, err := s.provider.FetchPage(ctx, cursor)
+		if err != nil {
+			return nil, fmt.Errorf("page %d: %w", page, err)
+		}
+		for _, indicator := range indicators {
+			prefix, err := caddyhttp.CIDRExpressionToPrefix(indicator)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix)
+		}
+		if next == "" || page >= s.MaxPages {
+			return prefixes, nil
+		}
+		cursor = next
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	threat_feed {
+//	   provider <name> {
+//	      ...
+//	   }
+//	   max_pages count
+//	   interval val
+//	   timeout val
+//	}
+func (m *ThreatFeedIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	// No same-line options are supported
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "provider":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "ip_list.threat_feeds."+name)
+			if err != nil {
+				return err
+			}
+			m.ProviderRaw = caddyconfig.JSONModuleObject(unm, "provider", name, nil)
+		case "max_pages":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := strconv.Atoi(d.Val())
+			if err != nil || val < 1 {
+				return d.Errf("invalid max_pages: %s", d.Val())
+			}
+			m.MaxPages = val
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Interval = caddy.Duration(val)
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Timeout = caddy.Duration(val)
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// GreyNoiseFeed provides the IPs matching a GreyNoise GNQL query.
+type GreyNoiseFeed struct {
+	// API key. Supports placeholders such as {env.GREYNOISE_API_KEY}.
+	APIKey string `json:"api_key"`
+	// GNQL query. Default is "classification:malicious last_seen:1d".
+	Query string `json:"query,omitempty"`
+	// Results per page. Default is 10000.
+	PageSize int `json:"page_size,omitempty"`
+	// Optional override of the API base URL.
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (GreyNoiseFeed) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "ip_list.threat_feeds.greynoise",
+		New: func() caddy.Module { return new(GreyNoiseFeed) },
+	}
+}
+
+func (f *GreyNoiseFeed) Provision(ctx caddy.Context) error {
+	f.APIKey = caddy.NewReplacer().ReplaceAll(f.APIKey, "")
+	if f.APIKey == "" {
+		return fmt.Errorf("api_key is required")
+	}
+	if f.Query == "" {
+		f.Query = "classification:malicious last_seen:1d"
+	}
+	if f.PageSize == 0 {
+		f.PageSize = 10000
+	}
+	if f.Endpoint == "" {
+		f.Endpoint = "https://api.greynoise.io"
+	}
+	f.Endpoint = strings.TrimSuffix(f.Endpoint, "/")
+	return nil
+}
+
+func (f *GreyNoiseFeed) FetchPage(ctx context.Context, cursor string) ([]string, string, error) {
+	q := url.Values{"query": {f.Query}, "size": {strconv.Itoa(f.PageSize)}}
+	if cursor != "" {
+		q.Set("scroll", cursor)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.Endpoint+"/v2/experimental/gnql?"+q.Encode(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("key", f.APIKey)
+	req.Header.Set("Accept", "application/json")
+
+	var out struct {
+		Complete bool `json:"complete"`
+		Data     []struct {
+			IP string `json:"ip"`
+		} `json:"data"`
+		Scroll string `json:"scroll"`
+	}
+	if err := getJSON(req, &out); err != nil {
+		return nil, "", err
+	}
+	indicators := make([]string, 0, len(out.Data))
+	for _, d := range out.Data {
+		indicators = append(indicators, d.IP)
+	}
+	if out.Complete {
+		return indicators, "", nil
+	}
+	return indicators, out.Scroll, nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	greynoise {
+//	   api_key key
+//	   query gnql
+//	   page_size count
+//	   endpoint url
+//	}
+func (f *GreyNoiseFeed) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	// No same-line options are supported
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "api_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			f.APIKey = d.Val()
+		case "query":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			f.Query = d.Val()
+		case "page_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := strconv.Atoi(d.Val())
+			if err != nil || val < 1 {
+				return d.Errf("invalid page_size: %s", d.Val())
+			}
+			f.PageSize = val
+		case "endpoint":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			f.Endpoint = d.Val()
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// ShodanFeed provides the IPs of the hosts matching a Shodan search
+// query. Every page of 100 results uses a query credit.
+type ShodanFeed struct {
+	// API key. Supports placeholders such as {env.SHODAN_API_KEY}.
+	APIKey string `json:"api_key"`
+	// Search query, e.g. "product:Cobalt Strike Beacon".
+	Query string `json:"query"`
+	// Optional override of the API base URL.
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (ShodanFeed) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "ip_list.threat_feeds.shodan",
+		New: func() caddy.Module { return new(ShodanFeed) },
+	}
+}
+
+func (f *ShodanFeed) Provision(ctx caddy.Context) error {
+	f.APIKey = caddy.NewReplacer().ReplaceAll(f.APIKey, "")
+	if f.APIKey == "" || f.Query == "" {
+		return fmt.Errorf("api_key and query are required")
+	}
+	if f.Endpoint == "" {
+		f.Endpoint = "https://api.shodan.io"
+	}
+	f.Endpoint = strings.TrimSuffix(f.Endpoint, "/")
+	return nil
+}
+
+func (f *ShodanFeed) FetchPage(ctx context.Context, cursor string) ([]string, string, error) {
+	page := 1
+	if cursor != "" {
+		page, _ = strconv.Atoi(cursor)
+	}
+	q := url.Values{
+		"key":    {f.APIKey},
+		"query":  {f.Query},
+		"page":   {strconv.Itoa(page)},
+		"minify": {"true"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.Endpoint+"/shodan/host/search?"+q.Encode(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var out struct {
+		Matches []struct {
+			IP string `json:"ip_str"`
+		} `json:"matches"`
+		Total int `json:"total"`
+	}
+	if err := getJSON(req, &out); err != nil {
+		// the key is part of the URL, keep it out of the logs
+		return nil, "", errors.New(strings.ReplaceAll(err.Error(), f.APIKey, "REDACTED"))
+	}
+	indicators := make([]string, 0, len(out.Matches))
+	for _, m := range out.Matches {
+		indicators = append(indicators, m.IP)
+	}
+	if len(out.Matches) == 0 || page*100 >= out.Total {
+		return indicators, "", nil
+	}
+	return indicators, strconv.Itoa(page + 1), nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	shodan {
+//	   api_key key
+//	   query search
+//	   endpoint url
+//	}
+func (f *ShodanFeed) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	// No same-line options are supported
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "api_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			f.APIKey = d.Val()
+		case "query":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			f.Query = d.Val()
+		case "endpoint":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			f.Endpoint = d.Val()
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*ThreatFeedIPRange)(nil)
+	_ caddy.Provisioner       = (*ThreatFeedIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*ThreatFeedIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*ThreatFeedIPRange)(nil)
+
+	_ caddy.Module          = (*GreyNoiseFeed)(nil)
+	_ caddy.Provisioner     = (*GreyNoiseFeed)(nil)
+	_ caddyfile.Unmarshaler = (*GreyNoiseFeed)(nil)
+	_ ThreatFeed            = (*GreyNoiseFeed)(nil)
+
+	_ caddy.Module          = (*ShodanFeed)(nil)
+	_ caddy.Provisioner     = (*ShodanFeed)(nil)
+	_ caddyfile.Unmarshaler = (*ShodanFeed)(nil)
+	_ ThreatFeed            = (*ShodanFeed)(nil)
+)
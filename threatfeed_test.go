@@ -0,0 +1,69 @@
+package caddy_ip_list
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestThreatFeedGreyNoise(t *testing.T) {
+	t.Setenv("GREYNOISE_API_KEY", "gn-key")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/experimental/gnql" || r.Header.Get("key") != "gn-key" {
+			t.Errorf("unexpected request %s with key %q", r.URL.Path, r.Header.Get("key"))
+		}
+		if r.URL.Query().Get("query") != "classification:malicious tags:Mirai" {
+			t.Errorf("unexpected query %q", r.URL.Query().Get("query"))
+		}
+		switch r.URL.Query().Get("scroll") {
+		case "":
+			w.Write([]byte(`{"complete":false,"count":3,"data":[{"ip":"192.0.2.1"},{"ip":"192.0.2.2"}],"scroll":"next-page"}`))
+		case "next-page":
+			w.Write([]byte(`{"complete":true,"count":3,"data":[{"ip":"192.0.2.3"}],"scroll":"ignored"}`))
+		default:
+			t.Errorf("unexpected scroll %q", r.URL.Query().Get("scroll"))
+		}
+	}))
+	defer server.Close()
+
+	got := provisionSource(t, &ThreatFeedIPRange{}, `threat_feed {
+		provider greynoise {
+			api_key {env.GREYNOISE_API_KEY}
+			query "classification:malicious tags:Mirai"
+			endpoint `+server.URL+`
+		}
+	}`)
+	expected := []string{"192.0.2.1/32", "192.0.2.2/32", "192.0.2.3/32"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestThreatFeedShodan(t *testing.T) {
+	var pages []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("key") != "shodan-key" {
+			t.Errorf("unexpected key %q", r.URL.Query().Get("key"))
+		}
+		pages = append(pages, r.URL.Query().Get("page"))
+		w.Write([]byte(`{"matches":[{"ip_str":"198.51.100.` + r.URL.Query().Get("page") + `"}],"total":1000}`))
+	}))
+	defer server.Close()
+
+	got := provisionSource(t, &ThreatFeedIPRange{}, `threat_feed {
+		provider shodan {
+			api_key shodan-key
+			query "product:\"Cobalt Strike Beacon\""
+			endpoint `+server.URL+`
+		}
+		max_pages 3
+	}`)
+	expected := []string{"198.51.100.1/32", "198.51.100.2/32", "198.51.100.3/32"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if !slices.Equal(pages, []string{"1", "2", "3"}) {
+		t.Errorf("expected max_pages to stop after 3 pages, fetched %v", pages)
+	}
+}
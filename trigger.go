@@ -0,0 +1,155 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// RefreshTrigger subscribes to a Redis or NATS channel, and makes the list
+// fetch its URLs whenever a message is published on it. The messages are
+// only a signal: their contents are ignored.
+type RefreshTrigger struct {
+	// Server URL: redis://, rediss:// (TLS), nats:// or tls:// (NATS over
+	// TLS). Credentials go in the URL, e.g. redis://:secret@redis:6379,
+	// and support placeholders such as {env.REDIS_PASSWORD}.
+	Server string `json:"server"`
+	// Redis channel or NATS subject to subscribe to.
+	Channel string `json:"channel"`
+
+	server       *url.URL
+	log          *zap.Logger
+	pingInterval time.Duration
+}
+
+func (t *RefreshTrigger) setup() error {
+	if t.Server == "" || t.Channel == "" {
+		return fmt.Errorf("refresh_on requires a server and a channel")
+	}
+	u, err := url.Parse(caddy.NewReplacer().ReplaceAll(t.Server, ""))
+	if err != nil {
+		return fmt.Errorf("invalid refresh_on server: %v", err)
+	}
+	switch u.Scheme {
+	case "redis", "rediss":
+		if strings.ContainsFunc(t.Channel, spaceOrControl) {
+			return fmt.Errorf("invalid refresh_on channel %q", t.Channel)
+		}
+	case "nats", "tls":
+		if err := checkNATSSubject(t.Channel); err != nil {
+			return fmt.Errorf("invalid refresh_on channel: %v", err)
+		}
+	default:
+		return fmt.Errorf("unsupported refresh_on server scheme %q", u.Scheme)
+	}
+	t.server = u
+	t.pingInterval = redisPingInterval
+	return nil
+}
+
+// watchTrigger refreshes the list on every message published on the
+// refresh_on channel until the list is stopped, reconnecting as needed.
+func (s *URLIPRange) watchTrigger() {
+	log := s.log
+	if log == nil {
+		log = zap.NewNop()
+	}
+	log = log.With(zap.String("channel", s.RefreshOn.Channel))
+	s.RefreshOn.log = log
+	onMessage := func() {
+		log.Info("refreshing IP list on message")
+		if _, err := s.forceRefresh(""); err != nil && s.ctx.Err() == nil {
+			log.Warn("failed to refresh IP list", zap.Error(err))
+		}
+	}
+	session := s.RefreshOn.natsSession
+	if strings.HasPrefix(s.RefreshOn.server.Scheme, "redis") {
+		session = s.RefreshOn.redisSession
+	}
+
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := session(s.ctx, onMessage)
+		if s.ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		log.Warn("refresh_on subscription ended; reconnecting", zap.Error(err), zap.Duration("backoff", backoff))
+		select {
+		case <-time.After(backoff):
+		case <-s.ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+func (t *RefreshTrigger) natsSession(ctx context.Context, onMessage func()) error {
+	nc, closed, err := connectNATS(t.server.String(), t.log)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	sub, err := nc.Subscribe(t.Channel, func(*nats.Msg) { onMessage() })
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+	return waitNATS(ctx, nc, closed)
+}
+
+// redisPingInterval is how often a Redis subscription pings the server. A
+// subscription that receives nothing for twice as long is reconnected.
+const redisPingInterval = 30 * time.Second
+
+func (t *RefreshTrigger) redisSession(ctx context.Context, onMessage func()) error {
+	opts, err := redis.ParseURL(t.server.String())
+	if err != nil {
+		return err
+	}
+	client := redis.NewClient(opts)
+	defer client.Close()
+	sub := client.Subscribe(ctx, t.Channel)
+	defer sub.Close()
+	stop := context.AfterFunc(ctx, func() { sub.Close() })
+	defer stop()
+
+	// ping so a connection that died without being closed is noticed by
+	// the receive timeout. The server replies to PING while subscribed.
+	pingDone := make(chan struct{})
+	defer close(pingDone)
+	go func() {
+		ticker := time.NewTicker(t.pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if sub.Ping(ctx) != nil {
+					return
+				}
+			case <-pingDone:
+				return
+			}
+		}
+	}()
+
+	for {
+		msg, err := sub.ReceiveTimeout(ctx, t.pingInterval*2)
+		if err != nil {
+			return err
+		}
+		if _, ok := msg.(*redis.Message); ok {
+			onMessage()
+		}
+	}
+}
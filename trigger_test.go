@@ -0,0 +1,137 @@
+package caddy_ip_list
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestRefreshOnRedis(t *testing.T) {
+	m := miniredis.RunT(t)
+	m.RequireAuth("secret")
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	r, update := provisionUpdatable(t, ctx, "refresh_on redis://:secret@"+m.Addr()+" lists")
+	for deadline := time.Now().Add(5 * time.Second); m.PubSubNumSub("lists")["lists"] == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no subscription to lists")
+		}
+	}
+	update()
+	m.Publish("lists", "updated")
+	waitForRanges(t, r, []string{"198.51.100.0/24"})
+}
+
+// TestRefreshOnRedisKeepAlive tests that a Redis subscription ends once
+// the server stops replying to pings.
+func TestRefreshOnRedisKeepAlive(t *testing.T) {
+	// the proxy stops forwarding the replies of the server once the
+	// client pings, as if the connection had died
+	m := miniredis.RunT(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	pings := make(chan struct{}, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		server, err := net.Dial("tcp", m.Addr())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer server.Close()
+		var dead atomic.Bool
+		go func() {
+			b := make([]byte, 4096)
+			for {
+				n, err := server.Read(b)
+				if err != nil {
+					return
+				}
+				if !dead.Load() {
+					conn.Write(b[:n])
+				}
+			}
+		}()
+		b := make([]byte, 4096)
+		for {
+			n, err := conn.Read(b)
+			if err != nil {
+				return
+			}
+			if bytes.Contains(bytes.ToLower(b[:n]), []byte("ping")) {
+				dead.Store(true)
+				select {
+				case pings <- struct{}{}:
+				default:
+				}
+			}
+			server.Write(b[:n])
+		}
+	}()
+
+	trigger := &RefreshTrigger{Server: "redis://" + ln.Addr().String(), Channel: "lists"}
+	if err := trigger.setup(); err != nil {
+		t.Fatal(err)
+	}
+	trigger.pingInterval = 20 * time.Millisecond
+	done := make(chan error, 1)
+	go func() { done <- trigger.redisSession(context.Background(), func() {}) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected the subscription to end with an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription did not end")
+	}
+	select {
+	case <-pings:
+	case <-time.After(time.Second):
+		t.Error("expected the subscription to ping the server")
+	}
+}
+
+func TestRefreshOnNATS(t *testing.T) {
+	n := newFakeNATS(t, func(string, string, []byte) {})
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	r, update := provisionUpdatable(t, ctx, "refresh_on nats://caddy:secret@"+n.ln.Addr().String()+" lists")
+	if connect := <-n.connect; !strings.Contains(connect, `"pass":"secret"`) || !strings.Contains(connect, `"user":"caddy"`) {
+		t.Errorf("expected credentials in %s", connect)
+	}
+	n.waitSubscribed("lists")
+	update()
+	n.send("lists", "lists", "", []byte("updated"))
+	waitForRanges(t, r, []string{"198.51.100.0/24"})
+}
+
+func TestRefreshOnSetup(t *testing.T) {
+	for _, trigger := range []RefreshTrigger{
+		{Channel: "lists"},
+		{Server: "http://redis:6379", Channel: "lists"},
+		{Server: "redis://redis:6379", Channel: "lists\r\nFLUSHALL"},
+		{Server: "redis://redis:6379", Channel: "ip lists"},
+		{Server: "nats://nats:4222", Channel: "lists\r\nPUB x 0"},
+		{Server: "nats://nats:4222", Channel: "lists..a"},
+	} {
+		if err := trigger.setup(); err == nil {
+			t.Errorf("expected refresh_on %q %q to be rejected", trigger.Server, trigger.Channel)
+		}
+	}
+}
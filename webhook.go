@@ -0,0 +1,160 @@
+package caddy_ip_list
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(RefreshWebhook{})
+	httpcaddyfile.RegisterHandlerDirective("ip_list_refresh", parseRefreshWebhook)
+	httpcaddyfile.RegisterDirectiveOrder("ip_list_refresh", httpcaddyfile.Before, "respond")
+}
+
+// maxWebhookBody is the largest webhook payload that is verified.
+const maxWebhookBody = 1 << 20
+
+// RefreshWebhook is an HTTP handler that makes the lists fetch their URLs
+// right away, so upstream providers or CI can nudge a refresh without
+// access to the admin API:
+//
+//	handle /internal/ip-list/refresh {
+//	    ip_list_refresh {
+//	        secret {env.IP_LIST_WEBHOOK_SECRET}
+//	    }
+//	}
+//
+// Requests must be POSTs signed with the secret: the signature header holds
+// the hex HMAC-SHA256 of the body, optionally prefixed with "sha256=" as
+// GitHub does. The list and url query parameters scope the refresh to the
+// list with that ID or to that URL, as with the admin API.
+type RefreshWebhook struct {
+	// Secret the payloads are signed with. Placeholders like
+	// {env.SECRET} are replaced.
+	Secret string `json:"secret"`
+	// Header holding the signature. Default is X-Hub-Signature-256.
+	SignatureHeader string `json:"signature_header,omitempty"`
+
+	log *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (RefreshWebhook) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.ip_list_refresh",
+		New: func() caddy.Module { return new(RefreshWebhook) },
+	}
+}
+
+func (h *RefreshWebhook) Provision(ctx caddy.Context) error {
+	h.log = ctx.Logger()
+	h.Secret = caddy.NewReplacer().ReplaceAll(h.Secret, "")
+	if h.Secret == "" {
+		return fmt.Errorf("secret is required")
+	}
+	if h.SignatureHeader == "" {
+		h.SignatureHeader = "X-Hub-Signature-256"
+	}
+	return nil
+}
+
+func (h *RefreshWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody+1))
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	if len(body) > maxWebhookBody {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge, fmt.Errorf("payload too large"))
+	}
+	if !h.verify(body, r.Header.Get(h.SignatureHeader)) {
+		h.log.Warn("rejected IP list refresh webhook with invalid signature", zap.String("remote_addr", r.RemoteAddr))
+		return caddyhttp.Error(http.StatusUnauthorized, fmt.Errorf("invalid signature"))
+	}
+	query := r.URL.Query()
+	refreshes, ok := refreshLists(query.Get("list"), query.Get("url"))
+	if !ok {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("not found"))
+	}
+	h.log.Info("refreshed IP lists from webhook", zap.Int("count", len(refreshes)))
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(refreshes)
+}
+
+// verify reports whether signature is the HMAC of body.
+func (h *RefreshWebhook) verify(body []byte, signature string) bool {
+	sum, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(h.Secret))
+	mac.Write(body)
+	return hmac.Equal(sum, mac.Sum(nil))
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	ip_list_refresh [<secret>] {
+//	   secret <secret>
+//	   signature_header <header>
+//	}
+func (h *RefreshWebhook) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip directive name.
+	if d.NextArg() {
+		h.Secret = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "secret":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			h.Secret = d.Val()
+		case "signature_header":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			h.SignatureHeader = d.Val()
+		default:
+			return d.Errf("unknown ip_list_refresh option %q", d.Val())
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+func parseRefreshWebhook(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var m RefreshWebhook
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	return &m, err
+}
+
+// Interface guards
+var (
+	_ caddy.Module                = (*RefreshWebhook)(nil)
+	_ caddy.Provisioner           = (*RefreshWebhook)(nil)
+	_ caddyhttp.MiddlewareHandler = (*RefreshWebhook)(nil)
+	_ caddyfile.Unmarshaler       = (*RefreshWebhook)(nil)
+)
@@ -0,0 +1,76 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestRefreshWebhook(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	r, update := provisionUpdatable(t, ctx)
+
+	h := &RefreshWebhook{}
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`ip_list_refresh {
+		secret s3cret
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	sign := func(body string) string {
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write([]byte(body))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	serve := func(method, target, body, signature string) (int, error) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("X-Hub-Signature-256", signature)
+		rec := httptest.NewRecorder()
+		if err := h.ServeHTTP(rec, req, nil); err != nil {
+			return err.(caddyhttp.HandlerError).StatusCode, err
+		}
+		return rec.Code, nil
+	}
+
+	update()
+	for _, test := range []struct {
+		method, target, signature string
+		status                    int
+	}{
+		{http.MethodGet, "/", sign(`{}`), http.StatusMethodNotAllowed},
+		{http.MethodPost, "/", "", http.StatusUnauthorized},
+		{http.MethodPost, "/", sign(`{"forged":true}`), http.StatusUnauthorized},
+		{http.MethodPost, "/?list=unknown", sign(`{}`), http.StatusNotFound},
+	} {
+		if status, _ := serve(test.method, test.target, `{}`, test.signature); status != test.status {
+			t.Errorf("%s %s: expected status %d, got %d", test.method, test.target, test.status, status)
+		}
+	}
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, []string{"192.0.2.0/24"}) {
+		t.Errorf("expected rejected webhooks not to refresh, got %v", got)
+	}
+
+	if status, err := serve(http.MethodPost, "/?list="+r.listID(), `{}`, sign(`{}`)); status != http.StatusOK {
+		t.Fatalf("expected the signed webhook to succeed, got %d: %v", status, err)
+	}
+	if got := prefixStrings(r.GetIPRanges(nil)); !slices.Equal(got, []string{"198.51.100.0/24"}) {
+		t.Errorf("expected refreshed ranges, got %v", got)
+	}
+
+	if err := (&RefreshWebhook{}).Provision(ctx); err == nil {
+		t.Error("expected a missing secret to be rejected")
+	}
+}
@@ -0,0 +1,129 @@
+package caddy_ip_list
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(WireGuardIPRange{})
+}
+
+// WireGuardIPRange provides the allowed IPs of the peers of a WireGuard
+// interface, read with `wg show <interface> allowed-ips`. The wg tool must
+// be installed and Caddy needs the CAP_NET_ADMIN capability to use it.
+type WireGuardIPRange struct {
+	// Name of the WireGuard interface, e.g. wg0.
+	Interface string `json:"interface"`
+	// refresh Interval. Default is 1m.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	pollingSource
+}
+
+// CaddyModule returns the Caddy module information.
+func (WireGuardIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.wireguard",
+		New: func() caddy.Module { return new(WireGuardIPRange) },
+	}
+}
+
+func (s *WireGuardIPRange) Provision(ctx caddy.Context) error {
+	if s.Interface == "" {
+		return fmt.Errorf("interface is required")
+	}
+	if s.Interval == 0 {
+		s.Interval = caddy.Duration(time.Minute)
+	}
+	return s.start(ctx, time.Duration(s.Interval), s.fetch)
+}
+
+func (s *WireGuardIPRange) fetch(ctx context.Context) ([]netip.Prefix, error) {
+	cmd := exec.CommandContext(ctx, "wg", "show", s.Interface, "allowed-ips")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("wg show: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return parseWGAllowedIPs(bytes.NewReader(out))
+}
+
+// parseWGAllowedIPs parses the output of `wg show <interface> allowed-ips`:
+// a public key followed by the peer's allowed IPs (or "(none)") per line.
+func parseWGAllowedIPs(r io.Reader) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if field == "(none)" {
+				continue
+			}
+			prefix, err := caddyhttp.CIDRExpressionToPrefix(field)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes, scanner.Err()
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	wireguard <interface> {
+//	   interval val
+//	}
+func (m *WireGuardIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	m.Interface = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Interval = caddy.Duration(val)
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*WireGuardIPRange)(nil)
+	_ caddy.Provisioner       = (*WireGuardIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*WireGuardIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*WireGuardIPRange)(nil)
+)
@@ -0,0 +1,21 @@
+package caddy_ip_list
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseWGAllowedIPs(t *testing.T) {
+	out := "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=\t10.0.0.2/32 fd00::2/128\n" +
+		"TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=\t(none)\n" +
+		"gN65BkIKy1eCE9pP1wdc8ROUtkHLF2PfAqYdyYBz6EA=\t10.0.1.0/24\n"
+	prefixes, err := parseWGAllowedIPs(strings.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"10.0.0.2/32", "fd00::2/128", "10.0.1.0/24"}
+	if got := prefixStrings(prefixes); !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,218 @@
+package caddy_ip_list
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(ZeroTierIPRange{})
+}
+
+// ZeroTierIPRange provides the managed IPs of the authorized members of a
+// ZeroTier network, from ZeroTier Central or from a self-hosted network
+// controller. Members that are deauthorized or deleted drop out on the
+// next refresh.
+type ZeroTierIPRange struct {
+	// Network ID.
+	Network string `json:"network"`
+	// API token for ZeroTier Central, or the controller's authtoken.secret.
+	// Supports placeholders such as {env.ZT_TOKEN} or
+	// {file./var/lib/zerotier-one/authtoken.secret}.
+	APIToken string `json:"api_token"`
+	// Base URL of a self-hosted controller's service API, e.g.
+	// http://localhost:9993. When unset ZeroTier Central is queried.
+	Controller string `json:"controller,omitempty"`
+	// Optional override of the ZeroTier Central API base URL.
+	Endpoint string `json:"endpoint,omitempty"`
+	// refresh Interval. Default is 1m.
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// request Timeout
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	pollingSource
+}
+
+// CaddyModule returns the Caddy module information.
+func (ZeroTierIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.zerotier",
+		New: func() caddy.Module { return new(ZeroTierIPRange) },
+	}
+}
+
+func (s *ZeroTierIPRange) Provision(ctx caddy.Context) error {
+	if s.Network == "" {
+		return fmt.Errorf("network is required")
+	}
+	s.APIToken = strings.TrimSpace(caddy.NewReplacer().ReplaceAll(s.APIToken, ""))
+	if s.APIToken == "" {
+		return fmt.Errorf("api_token is required")
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = "https://api.zerotier.com/api/v1"
+	}
+	s.Endpoint = strings.TrimSuffix(s.Endpoint, "/")
+	s.Controller = strings.TrimSuffix(s.Controller, "/")
+	if s.Interval == 0 {
+		s.Interval = caddy.Duration(time.Minute)
+	}
+	return s.start(ctx, time.Duration(s.Interval), s.fetch)
+}
+
+type zeroTierMember struct {
+	Authorized    bool     `json:"authorized"`
+	IPAssignments []string `json:"ipAssignments"`
+}
+
+type zeroTierCentralMember struct {
+	NodeID string         `json:"nodeId"`
+	Config zeroTierMember `json:"config"`
+}
+
+func (s *ZeroTierIPRange) fetch(ctx context.Context) ([]netip.Prefix, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.Timeout))
+		defer cancel()
+	}
+
+	var members []zeroTierMember
+	if s.Controller == "" {
+		var out []zeroTierCentralMember
+		if err := s.get(ctx, s.Endpoint+"/network/"+url.PathEscape(s.Network)+"/member", &out); err != nil {
+			return nil, err
+		}
+		slices.SortFunc(out, func(a, b zeroTierCentralMember) int {
+			return strings.Compare(a.NodeID, b.NodeID)
+		})
+		for _, m := range out {
+			members = append(members, m.Config)
+		}
+	} else {
+		// the controller lists member IDs with their revision and each
+		// member has to be fetched separately
+		base := s.Controller + "/controller/network/" + url.PathEscape(s.Network) + "/member"
+		var ids map[string]any
+		if err := s.get(ctx, base, &ids); err != nil {
+			return nil, err
+		}
+		for _, id := range slices.Sorted(maps.Keys(ids)) {
+			var m zeroTierMember
+			if err := s.get(ctx, base+"/"+url.PathEscape(id), &m); err != nil {
+				return nil, err
+			}
+			members = append(members, m)
+		}
+	}
+
+	var prefixes []netip.Prefix
+	for _, m := range members {
+		if !m.Authorized {
+			continue
+		}
+		for _, ip := range m.IPAssignments {
+			addr, err := netip.ParseAddr(ip)
+			if err != nil {
+				return nil, fmt.Errorf("invalid member IP %q: %v", ip, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return prefixes, nil
+}
+
+func (s *ZeroTierIPRange) get(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if s.Controller == "" {
+		req.Header.Set("Authorization", "token "+s.APIToken)
+	} else {
+		req.Header.Set("X-ZT1-Auth", s.APIToken)
+	}
+	return getJSON(req, v)
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	zerotier <network> {
+//	   api_token token
+//	   controller url
+//	   endpoint url
+//	   interval val
+//	   timeout val
+//	}
+func (m *ZeroTierIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name.
+
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	m.Network = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "api_token":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.APIToken = d.Val()
+		case "controller":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Controller = d.Val()
+		case "endpoint":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Endpoint = d.Val()
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Interval = caddy.Duration(val)
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			m.Timeout = caddy.Duration(val)
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*ZeroTierIPRange)(nil)
+	_ caddy.Provisioner       = (*ZeroTierIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*ZeroTierIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*ZeroTierIPRange)(nil)
+)
@@ -0,0 +1,62 @@
+package caddy_ip_list
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestZeroTierCentral(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/network/8056c2e21c000001/member" || r.Header.Get("Authorization") != "token zt-token" {
+			t.Errorf("unexpected request %s with %q", r.URL.Path, r.Header.Get("Authorization"))
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`[
+			{"nodeId":"b","config":{"authorized":true,"ipAssignments":["10.147.17.2","fd80:56c2:e21c::2"]}},
+			{"nodeId":"a","config":{"authorized":true,"ipAssignments":["10.147.17.1"]}},
+			{"nodeId":"c","config":{"authorized":false,"ipAssignments":["10.147.17.3"]}}
+		]`))
+	}))
+	defer server.Close()
+
+	got := provisionSource(t, &ZeroTierIPRange{}, `zerotier 8056c2e21c000001 {
+		api_token zt-token
+		endpoint `+server.URL+`
+	}`)
+	expected := []string{"10.147.17.1/32", "10.147.17.2/32", "fd80:56c2:e21c::2/128"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestZeroTierController(t *testing.T) {
+	t.Setenv("ZT_AUTHTOKEN", "secret\n")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-ZT1-Auth") != "secret" {
+			t.Errorf("unexpected auth token %q", r.Header.Get("X-ZT1-Auth"))
+		}
+		switch r.URL.Path {
+		case "/controller/network/8056c2e21c000001/member":
+			w.Write([]byte(`{"aaaaaaaaaa":3,"bbbbbbbbbb":1}`))
+		case "/controller/network/8056c2e21c000001/member/aaaaaaaaaa":
+			w.Write([]byte(`{"id":"aaaaaaaaaa","authorized":true,"ipAssignments":["10.147.17.1"]}`))
+		case "/controller/network/8056c2e21c000001/member/bbbbbbbbbb":
+			w.Write([]byte(`{"id":"bbbbbbbbbb","authorized":false,"ipAssignments":["10.147.17.2"]}`))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	got := provisionSource(t, &ZeroTierIPRange{}, `zerotier 8056c2e21c000001 {
+		api_token {env.ZT_AUTHTOKEN}
+		controller `+server.URL+`
+	}`)
+	if expected := []string{"10.147.17.1/32"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}